@@ -1,13 +1,31 @@
 #!/bin/sh
 
+# Login links are emailed over SMTP if SMTP_ADDR is set, otherwise email
+# login is disabled.
+if [ -n "$SMTP_ADDR" ]; then
+    MAILER=${MAILER:-smtp}
+fi
+
 # Use 'exec' to make './api' PID 1, replacing 'sh'
 # and correctly forwarding signals.
-exec ./api \
+exec ./api serve \
     --addr=:80 \
+    --trusted-proxies=$TRUSTED_PROXIES \
+    --client-ip-header=${CLIENT_IP_HEADER:-X-Forwarded-For} \
+    --metrics-addr=$METRICS_ADDR \
     --apple-team-id=$APPLE_TEAM_ID \
     --mapkit-key-id=$MAPKIT_KEY_ID \
     --mapkit-secret-b64=$MAPKIT_SECRET_B64 \
-    --psql-conn=$PSQL_CONN \
-    --recaptcha-secret=$RECAPTCHA_SECRET \
+    --db-conn=$PSQL_CONN \
+    --captcha-secret=$RECAPTCHA_SECRET \
     --license-salt=$LICENSE_SALT \
-    --cloudinary-secret=$CLOUDINARY_SECRET
+    --cloudinary-api-key=$CLOUDINARY_API_KEY \
+    --cloudinary-secret=$CLOUDINARY_SECRET \
+    --mailer=${MAILER:-none} \
+    --smtp-addr=$SMTP_ADDR \
+    --smtp-username=$SMTP_USERNAME \
+    --smtp-password=$SMTP_PASSWORD \
+    --oidc-issuer=$OIDC_ISSUER \
+    --oidc-client-id=$OIDC_CLIENT_ID \
+    --oidc-client-secret=$OIDC_CLIENT_SECRET \
+    --oidc-roles=$OIDC_ROLES
@@ -0,0 +1,375 @@
+// Package apiv1 defines the request and response bodies of version 1 of the
+// manualsmap.com API, which is served under /api/v1. The types are shared by
+// the API handlers and the client package, and are documented in the OpenAPI
+// document in the openapi package.
+package apiv1
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// MapkitToken is the response body of GET /mapkit/token.
+type MapkitToken struct {
+	Token string `json:"token"`
+}
+
+// SignatureRequest is the request body of POST /images/signature.
+type SignatureRequest struct {
+	// Parameters are the Cloudinary upload parameters to sign.
+	Parameters map[string]string `json:"parameters"`
+	Recaptcha  string            `json:"recaptcha"`
+}
+
+// SignatureResponse is the response body of POST /images/signature.
+type SignatureResponse struct {
+	Signature string `json:"signature"`
+}
+
+// MapBlocksQuery holds the query parameters of GET /mapblocks, which select
+// the map blocks in a bounding box.
+type MapBlocksQuery struct {
+	MinLatitude  decimal.Decimal `schema:"min_latitude,required"`
+	MinLongitude decimal.Decimal `schema:"min_longitude,required"`
+	MaxLatitude  decimal.Decimal `schema:"max_latitude,required"`
+	MaxLongitude decimal.Decimal `schema:"max_longitude,required"`
+}
+
+// Values returns the query as URL query parameters.
+func (query MapBlocksQuery) Values() url.Values {
+	return url.Values{
+		"min_latitude":  {query.MinLatitude.String()},
+		"min_longitude": {query.MinLongitude.String()},
+		"max_latitude":  {query.MaxLatitude.String()},
+		"max_longitude": {query.MaxLongitude.String()},
+	}
+}
+
+// NearbyMapBlocksQuery holds the query parameters of GET /mapblocks/nearby,
+// which select the map blocks within Radius meters of a location.
+type NearbyMapBlocksQuery struct {
+	Latitude  decimal.Decimal `schema:"latitude,required"`
+	Longitude decimal.Decimal `schema:"longitude,required"`
+	Radius    float64         `schema:"radius,required"`
+}
+
+// Values returns the query as URL query parameters.
+func (query NearbyMapBlocksQuery) Values() url.Values {
+	return url.Values{
+		"latitude":  {query.Latitude.String()},
+		"longitude": {query.Longitude.String()},
+		"radius":    {strconv.FormatFloat(query.Radius, 'f', -1, 64)},
+	}
+}
+
+// MapBlock is a block of the map that contains at least one car. Latitude and
+// Longitude are the block's southwest corner.
+type MapBlock struct {
+	ID        int             `json:"id"`
+	Latitude  decimal.Decimal `json:"latitude"`
+	Longitude decimal.Decimal `json:"longitude"`
+}
+
+// MapBlocks is the response body of GET /mapblocks and GET /mapblocks/nearby.
+type MapBlocks struct {
+	MapBlocks []MapBlock `json:"mapBlocks"`
+}
+
+// Car is a car listed in a map block. ImageURL and ThumbnailURL are empty
+// unless the car has an approved image.
+type Car struct {
+	ID           int    `json:"id"`
+	MapBlockID   int    `json:"mapBlockId"`
+	Year         int    `json:"year"`
+	Make         string `json:"make"`
+	Model        string `json:"model"`
+	Trim         string `json:"trim"`
+	Color        string `json:"color"`
+	ImageURL     string `json:"imageUrl"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+}
+
+// Cars is the response body of GET /mapblocks/{id}/cars.
+type Cars struct {
+	Cars []Car `json:"cars"`
+}
+
+// CarSubmission is the request body of POST /cars. The JSON schema it's
+// validated against is served at GET /cars/schema.
+type CarSubmission struct {
+	Year      int             `json:"year"`
+	Make      string          `json:"make"`
+	Model     string          `json:"model"`
+	Trim      string          `json:"trim"`
+	Color     string          `json:"color"`
+	Latitude  decimal.Decimal `json:"latitude"`
+	Longitude decimal.Decimal `json:"longitude"`
+	Recaptcha string          `json:"recaptcha"`
+	// CloudinaryPublicID is the public ID of an image of the car uploaded to
+	// Cloudinary with a signature from POST /images/signature.
+	CloudinaryPublicID string `json:"cloudinaryPublicId"`
+}
+
+// MarshalJSON encodes the car with its coordinates as JSON numbers, which the
+// request schema requires, regardless of decimal.MarshalJSONWithoutQuotes.
+func (car CarSubmission) MarshalJSON() ([]byte, error) {
+	// plain has the same fields but no MarshalJSON method. The coordinates
+	// below take precedence over its fields with the same JSON names.
+	type plain CarSubmission
+	return json.Marshal(struct {
+		plain
+		Latitude  json.Number `json:"latitude"`
+		Longitude json.Number `json:"longitude"`
+	}{
+		plain:     plain(car),
+		Latitude:  json.Number(car.Latitude.String()),
+		Longitude: json.Number(car.Longitude.String()),
+	})
+}
+
+// CarSubmitted is the response body of POST /cars.
+type CarSubmitted struct {
+	ID         int `json:"id"`
+	MapBlockID int `json:"mapBlockId"`
+	// EditToken authorizes editing and deleting the car with PATCH and
+	// DELETE /cars/{id}. It's only returned once and can't be recovered.
+	EditToken string `json:"editToken"`
+}
+
+// EditTokenHeader is the request header that holds the edit token returned
+// when a car was submitted.
+const EditTokenHeader = "X-Edit-Token"
+
+// CarUpdate is the request body of PATCH /cars/{id}. Only the fields that are
+// set are changed. Latitude and Longitude must be set together and move the
+// car to the map block containing them. Setting CloudinaryPublicID to an
+// empty string removes the car's image.
+type CarUpdate struct {
+	Year               *int             `json:"year,omitempty"`
+	Make               *string          `json:"make,omitempty"`
+	Model              *string          `json:"model,omitempty"`
+	Trim               *string          `json:"trim,omitempty"`
+	Color              *string          `json:"color,omitempty"`
+	Latitude           *decimal.Decimal `json:"latitude,omitempty"`
+	Longitude          *decimal.Decimal `json:"longitude,omitempty"`
+	CloudinaryPublicID *string          `json:"cloudinaryPublicId,omitempty"`
+}
+
+// MarshalJSON encodes the update with its coordinates as JSON numbers, like
+// CarSubmission.MarshalJSON.
+func (update CarUpdate) MarshalJSON() ([]byte, error) {
+	type plain CarUpdate
+	return json.Marshal(struct {
+		plain
+		Latitude  *json.Number `json:"latitude,omitempty"`
+		Longitude *json.Number `json:"longitude,omitempty"`
+	}{
+		plain:     plain(update),
+		Latitude:  number(update.Latitude),
+		Longitude: number(update.Longitude),
+	})
+}
+
+// number returns the decimal as a JSON number, or nil if the decimal is nil.
+func number(d *decimal.Decimal) *json.Number {
+	if d == nil {
+		return nil
+	}
+	n := json.Number(d.String())
+	return &n
+}
+
+// CarUpdated is the response body of PATCH /cars/{id}.
+type CarUpdated struct {
+	ID         int `json:"id"`
+	MapBlockID int `json:"mapBlockId"`
+}
+
+// LoginRequest is the request body of POST /login, which emails a login link
+// to the address.
+type LoginRequest struct {
+	Email     string `json:"email"`
+	Recaptcha string `json:"recaptcha"`
+}
+
+// LoginVerification is the request body of POST /login/verify. Token is the
+// "login" query parameter of the emailed login link.
+type LoginVerification struct {
+	Token string `json:"token"`
+}
+
+// SessionCookie is the name of the cookie that holds the session token set by
+// POST /login/verify and GET /login/oidc/callback.
+const SessionCookie = "session"
+
+// User is a logged in user. It's the response body of POST /login/verify.
+type User struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	// Role is one of "user", "moderator" or "admin". Only users that log in
+	// with OIDC can have roles other than "user".
+	Role string `json:"role"`
+}
+
+// Me is the response body of GET /me, the logged in user and the cars they
+// submitted while logged in, newest first.
+type Me struct {
+	User
+	Cars []Car `json:"cars"`
+}
+
+// MergeCarsRequest is the request body of POST /admin/cars/merge, which
+// deletes duplicate submissions of the car to keep. If the car to keep has no
+// image, it gets the image of the duplicate with the lowest ID that has one.
+type MergeCarsRequest struct {
+	KeepID       int   `json:"keepId"`
+	DuplicateIDs []int `json:"duplicateIds"`
+}
+
+// MoveCarsRequest is the request body of POST /admin/cars/move, which moves
+// the cars to the map block.
+type MoveCarsRequest struct {
+	CarIDs     []int `json:"carIds"`
+	MapBlockID int   `json:"mapBlockId"`
+}
+
+// CarName is a car's make and model. An empty Model matches every model of
+// the make.
+type CarName struct {
+	Make  string `json:"make"`
+	Model string `json:"model,omitempty"`
+}
+
+// RenameCarsRequest is the request body of POST /admin/cars/rename, which
+// renames every car named From to To. Names are matched case-insensitively.
+// From.Model and To.Model must both be set, or both be empty to only rename
+// the make.
+type RenameCarsRequest struct {
+	From CarName `json:"from"`
+	To   CarName `json:"to"`
+}
+
+// CarsRenamed is the response body of POST /admin/cars/rename.
+type CarsRenamed struct {
+	Count int `json:"count"`
+}
+
+// CarVersion is a previous version of a car, stored when the car was edited,
+// deleted or changed by a moderator.
+type CarVersion struct {
+	// Action is "update" or "delete".
+	Action     string `json:"action"`
+	MapBlockID int    `json:"mapBlockId"`
+	Year       int    `json:"year"`
+	Make       string `json:"make"`
+	Model      string `json:"model"`
+	Trim       string `json:"trim"`
+	Color      string `json:"color"`
+	// ImagePublicID is the Cloudinary public ID of the car's image at the
+	// time, or empty if it had none.
+	ImagePublicID string `json:"imagePublicId,omitempty"`
+	// Created is when the version was replaced.
+	Created time.Time `json:"created"`
+}
+
+// CarHistory is the response body of GET /admin/cars/{id}/history, the
+// previous versions of the car, oldest first.
+type CarHistory struct {
+	Versions []CarVersion `json:"versions"`
+}
+
+// MapBlocksDeleted is the response body of POST
+// /admin/mapblocks/delete-empty, the IDs of the deleted map blocks.
+type MapBlocksDeleted struct {
+	MapBlockIDs []int `json:"mapBlockIds"`
+}
+
+// BanRequest is the request body of POST /admin/bans. Exactly one of IP and
+// UserID must be set.
+type BanRequest struct {
+	IP     string `json:"ip,omitempty"`
+	UserID int    `json:"userId,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Ban bans a client IP address or a user. It's the response body of POST
+// /admin/bans.
+type Ban struct {
+	ID      int       `json:"id"`
+	IP      string    `json:"ip,omitempty"`
+	UserID  int       `json:"userId,omitempty"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// Bans is the response body of GET /admin/bans, newest first.
+type Bans struct {
+	Bans []Ban `json:"bans"`
+}
+
+// AdminActionsQuery holds the query parameters of GET /admin/actions. Before
+// is the ID of the last action on the previous page, or 0 for the first page.
+type AdminActionsQuery struct {
+	Before int `schema:"before"`
+	Limit  int `schema:"limit"`
+}
+
+// Values returns the query as URL query parameters.
+func (query AdminActionsQuery) Values() url.Values {
+	values := url.Values{}
+	if query.Before != 0 {
+		values.Set("before", strconv.Itoa(query.Before))
+	}
+	if query.Limit != 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	return values
+}
+
+// AdminAction is an entry in the audit log of admin and moderator actions.
+type AdminAction struct {
+	ID int `json:"id"`
+	// UserID is the ID of the user that made the change, or 0 if their
+	// account was deleted.
+	UserID    int    `json:"userId,omitempty"`
+	UserEmail string `json:"userEmail"`
+	// Action is one of "merge_cars", "move_cars", "rename_cars",
+	// "delete_empty_map_blocks", "ban" or "unban".
+	Action string `json:"action"`
+	// Details describe the action, and depend on it.
+	Details map[string]interface{} `json:"details"`
+	Created time.Time              `json:"created"`
+}
+
+// AdminActions is the response body of GET /admin/actions, newest first.
+type AdminActions struct {
+	Actions []AdminAction `json:"actions"`
+}
+
+// Problem is an RFC 7807 "problem details" error response body.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Code is a stable, machine-readable error code, like
+	// "validation_failed".
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes a single invalid field in a request.
+type FieldError struct {
+	// Pointer is a JSON pointer (RFC 6901) to the invalid field in the request
+	// body, or to the invalid query parameter, like "/latitude".
+	Pointer string `json:"pointer"`
+	// Keyword is the JSON schema keyword that failed validation, like
+	// "required" or "maximum".
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,183 @@
+package apiv1
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/openapi"
+)
+
+func TestOpenAPI(t *testing.T) {
+	assert.NoError(t, openapi.CheckBodies(
+		openapi.Body{OperationID: "getMapkitToken", Status: "200", Value: MapkitToken{}},
+		openapi.Body{OperationID: "postImagesSignature", Value: SignatureRequest{}},
+		openapi.Body{OperationID: "postImagesSignature", Status: "200", Value: SignatureResponse{}},
+		openapi.Body{OperationID: "getMapBlocks", Status: "200", Value: MapBlocks{}},
+		openapi.Body{OperationID: "getMapBlockCars", Status: "200", Value: Cars{}},
+		openapi.Body{OperationID: "postCars", Value: CarSubmission{}},
+		openapi.Body{OperationID: "postCars", Status: "200", Value: CarSubmitted{}},
+		openapi.Body{OperationID: "patchCar", Value: CarUpdate{}},
+		openapi.Body{OperationID: "patchCar", Status: "200", Value: CarUpdated{}},
+		openapi.Body{OperationID: "postLogin", Value: LoginRequest{}},
+		openapi.Body{OperationID: "postLoginVerify", Value: LoginVerification{}},
+		openapi.Body{OperationID: "postLoginVerify", Status: "200", Value: User{}},
+		openapi.Body{OperationID: "getMe", Status: "200", Value: Me{}},
+		openapi.Body{OperationID: "postAdminCarsMerge", Value: MergeCarsRequest{}},
+		openapi.Body{OperationID: "postAdminCarsMove", Value: MoveCarsRequest{}},
+		openapi.Body{OperationID: "postAdminCarsRename", Value: RenameCarsRequest{}},
+		openapi.Body{OperationID: "postAdminCarsRename", Status: "200", Value: CarsRenamed{}},
+		openapi.Body{OperationID: "getAdminCarHistory", Status: "200", Value: CarHistory{}},
+		openapi.Body{OperationID: "postAdminMapBlocksDeleteEmpty", Status: "200", Value: MapBlocksDeleted{}},
+		openapi.Body{OperationID: "getAdminBans", Status: "200", Value: Bans{}},
+		openapi.Body{OperationID: "postAdminBans", Value: BanRequest{}},
+		openapi.Body{OperationID: "postAdminBans", Status: "201", Value: Ban{}},
+		openapi.Body{OperationID: "getAdminActions", Status: "200", Value: AdminActions{}},
+		openapi.Body{OperationID: "postCars", Status: "400", Value: Problem{}},
+	), "Expected the documented schemas to match")
+
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal("Error loading OpenAPI document:", err)
+	}
+	assert.NoError(
+		t,
+		doc.CheckParameters("getMapBlocks", "query", MapBlocksQuery{}),
+		"Expected the documented query parameters to match")
+	assert.NoError(
+		t,
+		doc.CheckParameters("getNearbyMapBlocks", "query", NearbyMapBlocksQuery{}),
+		"Expected the documented query parameters to match")
+	assert.NoError(
+		t,
+		doc.CheckParameters("getAdminActions", "query", AdminActionsQuery{}),
+		"Expected the documented query parameters to match")
+}
+
+func TestMapBlocksQueryValues(t *testing.T) {
+	query := MapBlocksQuery{
+		MinLatitude:  decimal.RequireFromString("37.7"),
+		MinLongitude: decimal.RequireFromString("-122.5"),
+		MaxLatitude:  decimal.RequireFromString("37.8"),
+		MaxLongitude: decimal.RequireFromString("-122.3"),
+	}
+	assert.Equal(
+		t,
+		url.Values{
+			"min_latitude":  {"37.7"},
+			"min_longitude": {"-122.5"},
+			"max_latitude":  {"37.8"},
+			"max_longitude": {"-122.3"},
+		},
+		query.Values(),
+		"Expected query parameters to match")
+}
+
+func TestNearbyMapBlocksQueryValues(t *testing.T) {
+	query := NearbyMapBlocksQuery{
+		Latitude:  decimal.RequireFromString("37.76"),
+		Longitude: decimal.RequireFromString("-122.39"),
+		Radius:    2500.5,
+	}
+	assert.Equal(
+		t,
+		url.Values{
+			"latitude":  {"37.76"},
+			"longitude": {"-122.39"},
+			"radius":    {"2500.5"},
+		},
+		query.Values(),
+		"Expected query parameters to match")
+}
+
+func TestAdminActionsQueryValues(t *testing.T) {
+	tests := []struct {
+		description string
+		query       AdminActionsQuery
+		expected    url.Values
+	}{
+		{
+			description: "Empty queries should have no parameters",
+			expected:    url.Values{},
+		},
+		{
+			description: "Set parameters should be included",
+			query:       AdminActionsQuery{Before: 10, Limit: 20},
+			expected:    url.Values{"before": {"10"}, "limit": {"20"}},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, test.query.Values(), "Expected query parameters to match")
+		})
+	}
+}
+
+func TestCarSubmissionMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(CarSubmission{
+		Year:      1994,
+		Make:      "Mazda",
+		Model:     "Miata",
+		Color:     "red",
+		Latitude:  decimal.RequireFromString("37.7749"),
+		Longitude: decimal.RequireFromString("-122.4194"),
+		Recaptcha: "captcha",
+	})
+	assert.NoError(t, err, "Expected no error")
+	assert.JSONEq(
+		t,
+		`{
+			"year": 1994,
+			"make": "Mazda",
+			"model": "Miata",
+			"trim": "",
+			"color": "red",
+			"latitude": 37.7749,
+			"longitude": -122.4194,
+			"recaptcha": "captcha",
+			"cloudinaryPublicId": ""
+		}`,
+		string(b),
+		"Expected the coordinates to be encoded as numbers")
+}
+
+func TestCarUpdateMarshalJSON(t *testing.T) {
+	year := 1995
+	color := ""
+	latitude := decimal.RequireFromString("37.7749")
+	longitude := decimal.RequireFromString("-122.4194")
+	tests := []struct {
+		description string
+		update      CarUpdate
+		expected    string
+	}{
+		{
+			description: "Fields that aren't set should be omitted",
+			update:      CarUpdate{Year: &year, Color: &color},
+			expected:    `{"year": 1995, "color": ""}`,
+		},
+		{
+			description: "Coordinates should be encoded as numbers",
+			update:      CarUpdate{Latitude: &latitude, Longitude: &longitude},
+			expected:    `{"latitude": 37.7749, "longitude": -122.4194}`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			b, err := json.Marshal(test.update)
+			assert.NoError(t, err, "Expected no error")
+			assert.JSONEq(t, test.expected, string(b), "Expected JSON to match")
+		})
+	}
+}
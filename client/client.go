@@ -0,0 +1,488 @@
+// Package client is a Go client for version 1 of the manualsmap.com API. It
+// uses the request and response types in the apiv1 package, which are shared
+// with the API handlers.
+//
+//	c := client.New("https://manualsmap.com").
+//		WithCaptcha(client.StaticCaptcha(token))
+//	blocks, err := c.MapBlocks(ctx, apiv1.MapBlocksQuery{...})
+//
+// Logging in stores the session cookie in the HTTP client's cookie jar, so
+// later requests are sent as the logged in user.
+//
+// Requests that fail because the server is overloaded or rate limited are
+// retried with exponential backoff. Requests that are safe to repeat are
+// also retried after network errors and HTTP 5xx responses.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+)
+
+// CaptchaProvider provides captcha responses (e.g. reCAPTCHA tokens) for
+// requests that require one. Captcha responses can only be verified once, so
+// a new one is requested for every attempt.
+type CaptchaProvider interface {
+	CaptchaResponse(ctx context.Context) (string, error)
+}
+
+// CaptchaFunc is a function that implements CaptchaProvider.
+type CaptchaFunc func(ctx context.Context) (string, error)
+
+func (fn CaptchaFunc) CaptchaResponse(ctx context.Context) (string, error) {
+	return fn(ctx)
+}
+
+// StaticCaptcha is a CaptchaProvider that always returns the same captcha
+// response, like a reCAPTCHA test key response.
+type StaticCaptcha string
+
+func (captcha StaticCaptcha) CaptchaResponse(context.Context) (string, error) {
+	return string(captcha), nil
+}
+
+// maxRetryAfter is the longest Retry-After delay that the client waits for.
+// Longer delays, like for exhausted hourly rate limits, are returned as errors
+// instead.
+const maxRetryAfter = time.Minute
+
+// Client calls the manualsmap.com API.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	captcha    CaptchaProvider
+	maxRetries int
+	backoff    time.Duration
+}
+
+// New creates a Client for the API served at baseURL, e.g.
+// "https://manualsmap.com". By default, requests are retried up to 3 times,
+// starting with a 500ms backoff.
+func New(baseURL string) Client {
+	// cookiejar.New never returns an error without options.
+	jar, _ := cookiejar.New(nil)
+	return Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v1",
+		httpClient: &http.Client{Timeout: 30 * time.Second, Jar: jar},
+		maxRetries: 3,
+		backoff:    500 * time.Millisecond,
+	}
+}
+
+// WithHTTPClient returns a copy of the Client that sends requests with the
+// given HTTP client. The HTTP client needs a cookie jar to stay logged in.
+func (c Client) WithHTTPClient(httpClient *http.Client) Client {
+	c.httpClient = httpClient
+	return c
+}
+
+// WithCaptcha returns a copy of the Client that gets captcha responses from
+// the provider for requests that require one.
+func (c Client) WithCaptcha(captcha CaptchaProvider) Client {
+	c.captcha = captcha
+	return c
+}
+
+// WithRetries returns a copy of the Client that retries failed requests up to
+// maxRetries times, waiting backoff before the first retry and doubling the
+// wait after every retry. Set maxRetries to 0 to disable retries.
+func (c Client) WithRetries(maxRetries int, backoff time.Duration) Client {
+	c.maxRetries = maxRetries
+	c.backoff = backoff
+	return c
+}
+
+// Error is an error response from the API.
+type Error struct {
+	StatusCode int
+	// Problem is the error response body. Problem.Code is empty if the
+	// response wasn't a problem details object, e.g. if it came from a proxy.
+	Problem    apiv1.Problem
+	retryAfter time.Duration
+}
+
+func (err *Error) Error() string {
+	if err.Problem.Code == "" {
+		return "manualsmap API error: HTTP " + strconv.Itoa(err.StatusCode)
+	}
+	return fmt.Sprintf(
+		"manualsmap API error: HTTP %d %s: %s",
+		err.StatusCode,
+		err.Problem.Code,
+		err.Problem.Detail)
+}
+
+// MapkitToken returns a short-lived Apple MapKit JS token.
+func (c Client) MapkitToken(ctx context.Context) (string, error) {
+	var res apiv1.MapkitToken
+	err := c.do(ctx, http.MethodGet, "/mapkit/token", nil, nil, nil, true, &res)
+	return res.Token, err
+}
+
+// UploadSignature signs Cloudinary upload parameters. It requires a captcha
+// response.
+func (c Client) UploadSignature(ctx context.Context, parameters map[string]string) (string, error) {
+	body := func(ctx context.Context) (interface{}, error) {
+		captcha, err := c.captchaResponse(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return apiv1.SignatureRequest{Parameters: parameters, Recaptcha: captcha}, nil
+	}
+	var res apiv1.SignatureResponse
+	// Signing has no side effects, so it's always safe to retry.
+	err := c.do(ctx, http.MethodPost, "/images/signature", nil, nil, body, true, &res)
+	return res.Signature, err
+}
+
+// MapBlocks returns the map blocks with cars in the bounding box.
+func (c Client) MapBlocks(ctx context.Context, query apiv1.MapBlocksQuery) ([]apiv1.MapBlock, error) {
+	var res apiv1.MapBlocks
+	err := c.do(ctx, http.MethodGet, "/mapblocks", query.Values(), nil, nil, true, &res)
+	return res.MapBlocks, err
+}
+
+// NearbyMapBlocks returns the map blocks with cars within the query's radius,
+// nearest first.
+func (c Client) NearbyMapBlocks(ctx context.Context, query apiv1.NearbyMapBlocksQuery) ([]apiv1.MapBlock, error) {
+	var res apiv1.MapBlocks
+	err := c.do(ctx, http.MethodGet, "/mapblocks/nearby", query.Values(), nil, nil, true, &res)
+	return res.MapBlocks, err
+}
+
+// Cars returns the cars in the map block.
+func (c Client) Cars(ctx context.Context, mapBlockID int) ([]apiv1.Car, error) {
+	var res apiv1.Cars
+	path := "/mapblocks/" + strconv.Itoa(mapBlockID) + "/cars"
+	err := c.do(ctx, http.MethodGet, path, nil, nil, nil, true, &res)
+	return res.Cars, err
+}
+
+// SubmitCar submits a car and returns its ID, the ID of the map block it was
+// added to, and the edit token needed to update or delete it. If
+// car.Recaptcha is empty, a captcha response is requested from the
+// CaptchaProvider. Submissions aren't idempotent, so they're only retried if
+// the server rejected them without adding the car. Captcha responses can only
+// be used once, so if car.Recaptcha is set, it's only used for the first
+// attempt, and the submission is only retried if a CaptchaProvider is set.
+func (c Client) SubmitCar(ctx context.Context, car apiv1.CarSubmission) (apiv1.CarSubmitted, error) {
+	if car.Recaptcha != "" && c.captcha == nil {
+		c.maxRetries = 0
+	}
+	recaptcha := car.Recaptcha
+	body := func(ctx context.Context) (interface{}, error) {
+		submission := car
+		submission.Recaptcha = recaptcha
+		recaptcha = ""
+		if submission.Recaptcha != "" {
+			return submission, nil
+		}
+		captcha, err := c.captchaResponse(ctx)
+		if err != nil {
+			return nil, err
+		}
+		submission.Recaptcha = captcha
+		return submission, nil
+	}
+	var res apiv1.CarSubmitted
+	err := c.do(ctx, http.MethodPost, "/cars", nil, nil, body, false, &res)
+	return res, err
+}
+
+// UpdateCar changes the fields of a car that are set in the update and
+// returns the ID of the map block the car is in afterwards. The edit token is
+// the one returned by SubmitCar.
+func (c Client) UpdateCar(
+	ctx context.Context,
+	id int,
+	editToken string,
+	update apiv1.CarUpdate,
+) (apiv1.CarUpdated, error) {
+	body := func(context.Context) (interface{}, error) {
+		return update, nil
+	}
+	var res apiv1.CarUpdated
+	// Applying the same update twice has the same result, so it's safe to
+	// retry.
+	err := c.do(ctx, http.MethodPatch, carPath(id), nil, editTokenHeader(editToken), body, true, &res)
+	return res, err
+}
+
+// DeleteCar removes a car from the map. The edit token is the one returned by
+// SubmitCar.
+func (c Client) DeleteCar(ctx context.Context, id int, editToken string) error {
+	// Deleting a car twice fails with HTTP 404, which would hide that the
+	// first attempt succeeded, so it's only retried if it wasn't processed.
+	return c.do(ctx, http.MethodDelete, carPath(id), nil, editTokenHeader(editToken), nil, false, nil)
+}
+
+// RequestLogin emails a login link to the address. It requires a captcha
+// response. The token in the link's "login" query parameter is passed to
+// VerifyLogin. Every attempt sends an email, so it's only retried if the
+// server rejected it without sending one.
+func (c Client) RequestLogin(ctx context.Context, email string) error {
+	body := func(ctx context.Context) (interface{}, error) {
+		captcha, err := c.captchaResponse(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return apiv1.LoginRequest{Email: email, Recaptcha: captcha}, nil
+	}
+	return c.do(ctx, http.MethodPost, "/login", nil, nil, body, false, nil)
+}
+
+// VerifyLogin logs in with the token from a login link and returns the
+// logged in user. The session cookie is stored in the HTTP client's cookie
+// jar. Login tokens can only be used once, so it's only retried if the server
+// rejected it without using the token.
+func (c Client) VerifyLogin(ctx context.Context, token string) (apiv1.User, error) {
+	body := func(context.Context) (interface{}, error) {
+		return apiv1.LoginVerification{Token: token}, nil
+	}
+	var res apiv1.User
+	err := c.do(ctx, http.MethodPost, "/login/verify", nil, nil, body, false, &res)
+	return res, err
+}
+
+// Logout ends the session.
+func (c Client) Logout(ctx context.Context) error {
+	// Logging out twice has the same result, so it's safe to retry.
+	return c.do(ctx, http.MethodPost, "/logout", nil, nil, nil, true, nil)
+}
+
+// Me returns the logged in user and the cars they submitted while logged in.
+// It fails with HTTP 401 if the client isn't logged in.
+func (c Client) Me(ctx context.Context) (apiv1.Me, error) {
+	var res apiv1.Me
+	err := c.do(ctx, http.MethodGet, "/me", nil, nil, nil, true, &res)
+	return res, err
+}
+
+// MergeCars deletes duplicate submissions of the car to keep. If the car to
+// keep has no image, it gets the image of the duplicate with the lowest ID
+// that has one. It requires the moderator role. Merging twice fails with HTTP
+// 404, so it's only retried if the server didn't process it.
+func (c Client) MergeCars(ctx context.Context, keepID int, duplicateIDs []int) error {
+	body := func(context.Context) (interface{}, error) {
+		return apiv1.MergeCarsRequest{KeepID: keepID, DuplicateIDs: duplicateIDs}, nil
+	}
+	return c.do(ctx, http.MethodPost, "/admin/cars/merge", nil, nil, body, false, nil)
+}
+
+// MoveCars moves the cars to the map block. It requires the moderator role.
+func (c Client) MoveCars(ctx context.Context, carIDs []int, mapBlockID int) error {
+	body := func(context.Context) (interface{}, error) {
+		return apiv1.MoveCarsRequest{CarIDs: carIDs, MapBlockID: mapBlockID}, nil
+	}
+	// Moving cars twice has the same result, so it's safe to retry.
+	return c.do(ctx, http.MethodPost, "/admin/cars/move", nil, nil, body, true, nil)
+}
+
+// RenameCars renames every car named from to the new name and returns the
+// number of renamed cars. Names are matched case-insensitively. Leave both
+// models empty to only rename the make. It requires the moderator role.
+func (c Client) RenameCars(ctx context.Context, from, to apiv1.CarName) (int, error) {
+	body := func(context.Context) (interface{}, error) {
+		return apiv1.RenameCarsRequest{From: from, To: to}, nil
+	}
+	var res apiv1.CarsRenamed
+	// Renaming twice has the same result, so it's safe to retry, but the
+	// count of a retried request may miss the cars renamed by the first
+	// attempt.
+	err := c.do(ctx, http.MethodPost, "/admin/cars/rename", nil, nil, body, true, &res)
+	return res.Count, err
+}
+
+// CarHistory returns the previous versions of the car, oldest first. It
+// requires the moderator role.
+func (c Client) CarHistory(ctx context.Context, id int) ([]apiv1.CarVersion, error) {
+	var res apiv1.CarHistory
+	err := c.do(ctx, http.MethodGet, "/admin"+carPath(id)+"/history", nil, nil, nil, true, &res)
+	return res.Versions, err
+}
+
+// DeleteEmptyMapBlocks deletes every map block without cars and returns their
+// IDs. It requires the moderator role.
+func (c Client) DeleteEmptyMapBlocks(ctx context.Context) ([]int, error) {
+	var res apiv1.MapBlocksDeleted
+	err := c.do(ctx, http.MethodPost, "/admin/mapblocks/delete-empty", nil, nil, nil, true, &res)
+	return res.MapBlockIDs, err
+}
+
+// Bans returns the banned client IP addresses and users, newest first. It
+// requires the admin role.
+func (c Client) Bans(ctx context.Context) ([]apiv1.Ban, error) {
+	var res apiv1.Bans
+	err := c.do(ctx, http.MethodGet, "/admin/bans", nil, nil, nil, true, &res)
+	return res.Bans, err
+}
+
+// Ban bans a client IP address or a user and returns the ban. It requires the
+// admin role. Banning twice fails with HTTP 409, so it's only retried if the
+// server didn't process it.
+func (c Client) Ban(ctx context.Context, ban apiv1.BanRequest) (apiv1.Ban, error) {
+	body := func(context.Context) (interface{}, error) {
+		return ban, nil
+	}
+	var res apiv1.Ban
+	err := c.do(ctx, http.MethodPost, "/admin/bans", nil, nil, body, false, &res)
+	return res, err
+}
+
+// Unban lifts the ban with the ID. It requires the admin role.
+func (c Client) Unban(ctx context.Context, id int) error {
+	// Lifting a ban twice fails with HTTP 404, so it's only retried if it
+	// wasn't processed.
+	return c.do(ctx, http.MethodDelete, "/admin/bans/"+strconv.Itoa(id), nil, nil, nil, false, nil)
+}
+
+// AdminActions returns a page of the audit log of admin and moderator
+// actions, newest first. It requires the admin role.
+func (c Client) AdminActions(ctx context.Context, query apiv1.AdminActionsQuery) ([]apiv1.AdminAction, error) {
+	var res apiv1.AdminActions
+	err := c.do(ctx, http.MethodGet, "/admin/actions", query.Values(), nil, nil, true, &res)
+	return res.Actions, err
+}
+
+func carPath(id int) string {
+	return "/cars/" + strconv.Itoa(id)
+}
+
+func editTokenHeader(editToken string) http.Header {
+	return http.Header{apiv1.EditTokenHeader: {editToken}}
+}
+
+func (c Client) captchaResponse(ctx context.Context) (string, error) {
+	if c.captcha == nil {
+		return "", errors.New("request requires a captcha response, but no CaptchaProvider is set")
+	}
+	captcha, err := c.captcha.CaptchaResponse(ctx)
+	return captcha, errors.WithMessage(err, "error getting captcha response")
+}
+
+// do sends a request and decodes the JSON response into v, retrying failed
+// attempts. The request body is created by body for every attempt, or is
+// empty if body is nil. If idempotent is false, requests are only retried if
+// the server didn't process them. If v is nil, the response body is ignored.
+func (c Client) do(
+	ctx context.Context,
+	method,
+	path string,
+	query url.Values,
+	header http.Header,
+	body func(ctx context.Context) (interface{}, error),
+	idempotent bool,
+	v interface{},
+) error {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(ctx, method, path, query, header, body, idempotent, v)
+		if err == nil || !retry || attempt >= c.maxRetries {
+			return err
+		}
+
+		delay := wait
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.retryAfter > delay {
+			delay = apiErr.retryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// attempt sends a request once and returns whether it may be retried if it
+// failed.
+func (c Client) attempt(
+	ctx context.Context,
+	method,
+	path string,
+	query url.Values,
+	header http.Header,
+	body func(ctx context.Context) (interface{}, error),
+	idempotent bool,
+	v interface{},
+) (bool, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := body(ctx)
+		if err != nil {
+			return false, err
+		}
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return false, errors.WithMessage(err, "error encoding request body")
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return false, errors.WithMessage(err, "error creating request")
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		// The request may have been processed if the connection failed
+		// after it was sent.
+		return idempotent && ctx.Err() == nil, errors.WithMessagef(err, "error sending %s %s", method, path)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		if v == nil {
+			return false, nil
+		}
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			return false, errors.WithMessage(err, "error decoding response body")
+		}
+		return false, nil
+	}
+
+	apiErr := &Error{StatusCode: res.StatusCode}
+	// Error bodies that aren't problem details, e.g. from a proxy, are
+	// ignored.
+	json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&apiErr.Problem)
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		apiErr.retryAfter = time.Duration(seconds) * time.Second
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// The request was rejected without being processed.
+		return apiErr.retryAfter <= maxRetryAfter, apiErr
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent, apiErr
+	}
+	return false, apiErr
+}
@@ -0,0 +1,410 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+)
+
+// response is a canned response from the fake API server.
+type response struct {
+	status     int
+	retryAfter string
+	body       interface{}
+}
+
+// fakeServer responds to each request with the next canned response and
+// records the request bodies.
+type fakeServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []response
+	requests  []*http.Request
+	bodies    []map[string]interface{}
+}
+
+func newFakeServer(t *testing.T, responses ...response) *fakeServer {
+	fake := &fakeServer{responses: responses}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fake.requests = append(fake.requests, r)
+		fake.bodies = append(fake.bodies, body)
+		if len(fake.responses) == 0 {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		res := fake.responses[0]
+		fake.responses = fake.responses[1:]
+		if res.retryAfter != "" {
+			w.Header().Set("Retry-After", res.retryAfter)
+		}
+		w.WriteHeader(res.status)
+		json.NewEncoder(w).Encode(res.body)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakeServer) attempts() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.requests)
+}
+
+func problem(status int, code string) apiv1.Problem {
+	return apiv1.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: code,
+	}
+}
+
+// countingCaptcha returns a new captcha response for every call.
+func countingCaptcha() CaptchaProvider {
+	var mu sync.Mutex
+	n := 0
+	return CaptchaFunc(func(context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return "captcha-" + strconv.Itoa(n), nil
+	})
+}
+
+var testCar = apiv1.CarSubmission{
+	Year:      1994,
+	Make:      "Mazda",
+	Model:     "Miata",
+	Color:     "red",
+	Latitude:  decimal.RequireFromString("37.7749"),
+	Longitude: decimal.RequireFromString("-122.4194"),
+}
+
+func TestClient(t *testing.T) {
+	tests := []struct {
+		description      string
+		responses        []response
+		call             func(ctx context.Context, c Client) error
+		expectedAttempts int
+		expectedCode     string
+	}{
+		{
+			description: "Successful requests should not be retried",
+			responses: []response{
+				{status: http.StatusOK, body: apiv1.MapkitToken{Token: "token"}},
+			},
+			call: func(ctx context.Context, c Client) error {
+				token, err := c.MapkitToken(ctx)
+				assert.Equal(t, "token", token, "Expected the token to match")
+				return err
+			},
+			expectedAttempts: 1,
+		},
+		{
+			description: "Idempotent requests should be retried after HTTP 5xx",
+			responses: []response{
+				{status: http.StatusBadGateway},
+				{status: http.StatusInternalServerError, body: problem(500, "cars_failed")},
+				{status: http.StatusOK, body: apiv1.Cars{Cars: []apiv1.Car{{Make: "Mazda"}}}},
+			},
+			call: func(ctx context.Context, c Client) error {
+				cars, err := c.Cars(ctx, 1)
+				assert.Equal(t, []apiv1.Car{{Make: "Mazda"}}, cars, "Expected cars to match")
+				return err
+			},
+			expectedAttempts: 3,
+		},
+		{
+			description: "Retries should stop after the maximum number of retries",
+			responses: []response{
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusServiceUnavailable, body: problem(503, "unavailable")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				_, err := c.Cars(ctx, 1)
+				return err
+			},
+			expectedAttempts: 4,
+			expectedCode:     "unavailable",
+		},
+		{
+			description: "Car submissions should not be retried after HTTP 500",
+			responses: []response{
+				{status: http.StatusInternalServerError, body: problem(500, "car_insert_failed")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				_, err := c.SubmitCar(ctx, testCar)
+				return err
+			},
+			expectedAttempts: 1,
+			expectedCode:     "car_insert_failed",
+		},
+		{
+			description: "Rate limited car submissions should be retried",
+			responses: []response{
+				{status: http.StatusTooManyRequests, retryAfter: "0", body: problem(429, "rate_limited")},
+				{status: http.StatusOK, body: apiv1.CarSubmitted{ID: 3, MapBlockID: 7, EditToken: "token"}},
+			},
+			call: func(ctx context.Context, c Client) error {
+				submitted, err := c.SubmitCar(ctx, testCar)
+				assert.Equal(
+					t,
+					apiv1.CarSubmitted{ID: 3, MapBlockID: 7, EditToken: "token"},
+					submitted,
+					"Expected the response to match")
+				return err
+			},
+			expectedAttempts: 2,
+		},
+		{
+			description: "Long Retry-After delays should not be waited for",
+			responses: []response{
+				{status: http.StatusTooManyRequests, retryAfter: "3600", body: problem(429, "rate_limited")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				_, err := c.SubmitCar(ctx, testCar)
+				return err
+			},
+			expectedAttempts: 1,
+			expectedCode:     "rate_limited",
+		},
+		{
+			description: "Car updates should be retried after HTTP 5xx",
+			responses: []response{
+				{status: http.StatusBadGateway},
+				{status: http.StatusOK, body: apiv1.CarUpdated{ID: 3, MapBlockID: 8}},
+			},
+			call: func(ctx context.Context, c Client) error {
+				updated, err := c.UpdateCar(ctx, 3, "token", apiv1.CarUpdate{})
+				assert.Equal(t, apiv1.CarUpdated{ID: 3, MapBlockID: 8}, updated, "Expected the response to match")
+				return err
+			},
+			expectedAttempts: 2,
+		},
+		{
+			description: "Car deletions should not be retried after HTTP 500",
+			responses: []response{
+				{status: http.StatusInternalServerError, body: problem(500, "car_delete_failed")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				return c.DeleteCar(ctx, 3, "token")
+			},
+			expectedAttempts: 1,
+			expectedCode:     "car_delete_failed",
+		},
+		{
+			description: "Login requests should not be retried after HTTP 500",
+			responses: []response{
+				{status: http.StatusInternalServerError, body: problem(500, "login_email_failed")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				return c.RequestLogin(ctx, "driver@example.com")
+			},
+			expectedAttempts: 1,
+			expectedCode:     "login_email_failed",
+		},
+		{
+			description: "Login verifications should not be retried after HTTP 500",
+			responses: []response{
+				{status: http.StatusInternalServerError, body: problem(500, "login_failed")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				_, err := c.VerifyLogin(ctx, "token")
+				return err
+			},
+			expectedAttempts: 1,
+			expectedCode:     "login_failed",
+		},
+		{
+			description: "Logouts should be retried after HTTP 5xx",
+			responses: []response{
+				{status: http.StatusBadGateway},
+				{status: http.StatusNoContent},
+			},
+			call: func(ctx context.Context, c Client) error {
+				return c.Logout(ctx)
+			},
+			expectedAttempts: 2,
+		},
+		{
+			description: "Client errors should not be retried",
+			responses: []response{
+				{status: http.StatusBadRequest, body: problem(400, "validation_failed")},
+			},
+			call: func(ctx context.Context, c Client) error {
+				_, err := c.MapBlocks(ctx, apiv1.MapBlocksQuery{})
+				return err
+			},
+			expectedAttempts: 1,
+			expectedCode:     "validation_failed",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			fake := newFakeServer(t, test.responses...)
+			c := New(fake.URL).
+				WithCaptcha(countingCaptcha()).
+				WithRetries(3, time.Millisecond)
+
+			err := test.call(context.Background(), c)
+			assert.Equal(t, test.expectedAttempts, fake.attempts(), "Expected the number of attempts to match")
+			if test.expectedCode == "" {
+				assert.NoError(t, err, "Expected no error")
+				return
+			}
+			var apiErr *Error
+			if assert.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err) {
+				assert.Equal(t, test.expectedCode, apiErr.Problem.Code, "Expected error codes to match")
+			}
+		})
+	}
+}
+
+func TestClientSubmitCarCaptcha(t *testing.T) {
+	rateLimited := response{status: http.StatusTooManyRequests, retryAfter: "0", body: problem(429, "rate_limited")}
+	submitted := response{status: http.StatusOK, body: apiv1.CarSubmitted{ID: 3, MapBlockID: 7, EditToken: "token"}}
+	car := testCar
+	car.Recaptcha = "caller-captcha"
+
+	t.Run("Retries should use a new captcha response", func(t *testing.T) {
+		fake := newFakeServer(t, rateLimited, submitted)
+		c := New(fake.URL).
+			WithCaptcha(countingCaptcha()).
+			WithRetries(3, time.Millisecond)
+
+		_, err := c.SubmitCar(context.Background(), car)
+		assert.NoError(t, err, "Expected no error")
+		if assert.Len(t, fake.bodies, 2, "Expected two attempts") {
+			assert.Equal(t, "caller-captcha", fake.bodies[0]["recaptcha"], "Expected the caller's captcha response first")
+			assert.Equal(t, "captcha-1", fake.bodies[1]["recaptcha"], "Expected a new captcha response for the retry")
+		}
+	})
+
+	t.Run("Submissions should not be retried without a CaptchaProvider", func(t *testing.T) {
+		fake := newFakeServer(t, rateLimited)
+		c := New(fake.URL).WithRetries(3, time.Millisecond)
+
+		_, err := c.SubmitCar(context.Background(), car)
+		var apiErr *Error
+		if assert.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err) {
+			assert.Equal(t, "rate_limited", apiErr.Problem.Code, "Expected error codes to match")
+		}
+		assert.Equal(t, 1, fake.attempts(), "Expected the number of attempts to match")
+	})
+}
+
+func TestClientRequests(t *testing.T) {
+	fake := newFakeServer(
+		t,
+		response{status: http.StatusTooManyRequests, retryAfter: "0"},
+		response{status: http.StatusOK, body: apiv1.SignatureResponse{Signature: "signature"}},
+		response{status: http.StatusOK, body: apiv1.MapBlocks{}})
+	c := New(fake.URL+"/").
+		WithCaptcha(countingCaptcha()).
+		WithRetries(1, time.Millisecond)
+
+	signature, err := c.UploadSignature(context.Background(), map[string]string{"public_id": "miata"})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "signature", signature, "Expected the signature to match")
+	_, err = c.MapBlocks(context.Background(), apiv1.MapBlocksQuery{
+		MinLatitude:  decimal.RequireFromString("37.7"),
+		MinLongitude: decimal.RequireFromString("-122.5"),
+		MaxLatitude:  decimal.RequireFromString("37.8"),
+		MaxLongitude: decimal.RequireFromString("-122.3"),
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	if !assert.Len(t, fake.requests, 3, "Expected three requests") {
+		return
+	}
+	assert.Equal(t, "/api/v1/images/signature", fake.requests[0].URL.Path, "Expected paths to match")
+	assert.Equal(
+		t,
+		map[string]interface{}{"public_id": "miata"},
+		fake.bodies[0]["parameters"],
+		"Expected upload parameters to match")
+	// Captcha responses can only be verified once, so every attempt must
+	// use a new one.
+	assert.Equal(t, "captcha-1", fake.bodies[0]["recaptcha"], "Expected the first captcha response")
+	assert.Equal(t, "captcha-2", fake.bodies[1]["recaptcha"], "Expected a new captcha response for the retry")
+	assert.Equal(t, "/api/v1/mapblocks", fake.requests[2].URL.Path, "Expected paths to match")
+	assert.Equal(t, "37.7", fake.requests[2].URL.Query().Get("min_latitude"), "Expected query parameters to match")
+}
+
+func TestClientCarEdits(t *testing.T) {
+	fake := newFakeServer(
+		t,
+		response{status: http.StatusOK, body: apiv1.CarUpdated{ID: 3, MapBlockID: 7}},
+		response{status: http.StatusNoContent})
+	c := New(fake.URL)
+
+	year := 1995
+	latitude := decimal.RequireFromString("37.7749")
+	longitude := decimal.RequireFromString("-122.4194")
+	_, err := c.UpdateCar(context.Background(), 3, "token", apiv1.CarUpdate{
+		Year:      &year,
+		Latitude:  &latitude,
+		Longitude: &longitude,
+	})
+	assert.NoError(t, err, "Expected no error")
+	assert.NoError(t, c.DeleteCar(context.Background(), 3, "token"), "Expected no error")
+
+	if !assert.Len(t, fake.requests, 2, "Expected two requests") {
+		return
+	}
+	assert.Equal(t, http.MethodPatch, fake.requests[0].Method, "Expected methods to match")
+	assert.Equal(t, "/api/v1/cars/3", fake.requests[0].URL.Path, "Expected paths to match")
+	assert.Equal(t, "token", fake.requests[0].Header.Get(apiv1.EditTokenHeader), "Expected edit tokens to match")
+	assert.Equal(
+		t,
+		map[string]interface{}{"year": 1995.0, "latitude": 37.7749, "longitude": -122.4194},
+		fake.bodies[0],
+		"Expected only the updated fields to be sent")
+	assert.Equal(t, http.MethodDelete, fake.requests[1].Method, "Expected methods to match")
+	assert.Equal(t, "/api/v1/cars/3", fake.requests[1].URL.Path, "Expected paths to match")
+	assert.Equal(t, "token", fake.requests[1].Header.Get(apiv1.EditTokenHeader), "Expected edit tokens to match")
+}
+
+func TestClientRequiresCaptcha(t *testing.T) {
+	fake := newFakeServer(t)
+	_, err := New(fake.URL).SubmitCar(context.Background(), testCar)
+	assert.Error(t, err, "Expected an error without a CaptchaProvider")
+	assert.Equal(t, 0, fake.attempts(), "Expected no requests")
+}
+
+func TestClientCanceled(t *testing.T) {
+	fake := newFakeServer(
+		t,
+		response{status: http.StatusServiceUnavailable, body: problem(503, "unavailable")})
+	c := New(fake.URL).WithRetries(3, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.MapkitToken(ctx)
+	var apiErr *Error
+	assert.True(t, errors.As(err, &apiErr), "Expected the last API error, got %v", err)
+	assert.Equal(t, 1, fake.attempts(), "Expected no retries after the context is done")
+}
@@ -0,0 +1,179 @@
+// Package clientip resolves the IP address of the client that sent an HTTP
+// request, including when the API is running behind reverse proxies.
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Headers that trusted proxies can use to pass on the client IP address.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// Resolver resolves client IP addresses. The proxy header is only honored if
+// the request was sent by a trusted proxy, otherwise clients could spoof their
+// IP address by setting the header themselves. Only the one header the trusted
+// proxies are configured to set is read, because proxies pass on any other
+// proxy headers sent by the client unchanged.
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewResolver creates a Resolver that trusts the given proxy header when set
+// by proxies in the given CIDR ranges. Single IP addresses are also accepted.
+// The header must be one of HeaderXForwardedFor, HeaderForwarded or
+// HeaderXRealIP, and defaults to HeaderXForwardedFor if empty.
+func NewResolver(trustedProxies []string, header string) (Resolver, error) {
+	switch http.CanonicalHeaderKey(header) {
+	case "":
+		header = HeaderXForwardedFor
+	case http.CanonicalHeaderKey(HeaderXForwardedFor):
+		header = HeaderXForwardedFor
+	case http.CanonicalHeaderKey(HeaderForwarded):
+		header = HeaderForwarded
+	case http.CanonicalHeaderKey(HeaderXRealIP):
+		header = HeaderXRealIP
+	default:
+		return Resolver{}, errors.Errorf("unsupported client IP header %q", header)
+	}
+
+	trusted := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return Resolver{}, errors.Errorf("invalid trusted proxy IP %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return Resolver{}, errors.WithMessagef(err, "invalid trusted proxy CIDR %q", proxy)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return Resolver{trusted: trusted, header: header}, nil
+}
+
+func (res Resolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range res.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the IP address of the client that sent the request.
+func (res Resolver) Resolve(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid remote address")
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return "", errors.Errorf("invalid remote IP %q", host)
+	}
+	if !res.isTrusted(remote) {
+		return remote.String(), nil
+	}
+
+	var chain []net.IP
+	switch res.header {
+	case HeaderForwarded:
+		chain = forwardedFor(r.Header)
+	case HeaderXRealIP:
+		if value := r.Header.Get(HeaderXRealIP); value != "" {
+			chain = []net.IP{net.ParseIP(strings.TrimSpace(value))}
+		}
+	default:
+		chain = xForwardedFor(r.Header)
+	}
+
+	// Each proxy appends the address it received the request from, so walk
+	// the chain from the closest proxy outward and return the first address
+	// that isn't a trusted proxy. Everything left of that address was sent by
+	// the client and can't be trusted.
+	hop := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			// A trusted proxy passed on an address we can't parse, so the
+			// proxy that sent it is the closest known client address.
+			return hop.String(), nil
+		}
+		if !res.isTrusted(chain[i]) {
+			return chain[i].String(), nil
+		}
+		hop = chain[i]
+	}
+	// Every address is a trusted proxy, so use the original client address.
+	return hop.String(), nil
+}
+
+// xForwardedFor parses the X-Forwarded-For headers. Invalid addresses are
+// returned as nil.
+func xForwardedFor(header http.Header) []net.IP {
+	var chain []net.IP
+	for _, value := range header.Values(HeaderXForwardedFor) {
+		for _, addr := range strings.Split(value, ",") {
+			chain = append(chain, net.ParseIP(strings.TrimSpace(addr)))
+		}
+	}
+	return chain
+}
+
+// forwardedFor parses the "for" parameters of the RFC 7239 Forwarded headers.
+// Invalid or obfuscated addresses, and elements without a "for" parameter,
+// are returned as nil.
+func forwardedFor(header http.Header) []net.IP {
+	var chain []net.IP
+	for _, value := range header.Values(HeaderForwarded) {
+		for _, element := range strings.Split(value, ",") {
+			var ip net.IP
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) >= 4 && strings.EqualFold(pair[:4], "for=") {
+					ip = parseForwardedNode(pair[4:])
+					break
+				}
+			}
+			chain = append(chain, ip)
+		}
+	}
+	return chain
+}
+
+// parseForwardedNode parses a Forwarded node like 192.0.2.60,
+// "192.0.2.60:4711" or "[2001:db8:cafe::17]:4711".
+func parseForwardedNode(node string) net.IP {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+		return net.ParseIP(node[1:end])
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(node)
+}
@@ -0,0 +1,175 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		description string
+		remoteAddr  string
+		proxyHeader string
+		header      http.Header
+		expected    string
+	}{
+		{
+			description: "Should use the remote address without proxy headers",
+			remoteAddr:  "203.0.113.5:1234",
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should ignore spoofed X-Forwarded-For from untrusted clients",
+			remoteAddr:  "203.0.113.5:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should ignore spoofed X-Real-IP from untrusted clients",
+			remoteAddr:  "203.0.113.5:1234",
+			header:      http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should ignore spoofed Forwarded from untrusted clients",
+			remoteAddr:  "203.0.113.5:1234",
+			header:      http.Header{"Forwarded": {"for=198.51.100.1"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should use X-Forwarded-For from a trusted proxy",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"203.0.113.5"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should skip spoofed addresses prepended by the client",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.5"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should skip multiple trusted proxies",
+			remoteAddr:  "10.0.0.2:1234",
+			header: http.Header{"X-Forwarded-For": {
+				"198.51.100.1, 203.0.113.5",
+				"10.0.0.3",
+			}},
+			expected: "203.0.113.5",
+		},
+		{
+			description: "Should use X-Real-IP from a trusted proxy",
+			remoteAddr:  "127.0.0.1:1234",
+			proxyHeader: HeaderXRealIP,
+			header:      http.Header{"X-Real-Ip": {"203.0.113.5"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should use Forwarded from a trusted proxy",
+			remoteAddr:  "10.0.0.2:1234",
+			proxyHeader: HeaderForwarded,
+			header: http.Header{"Forwarded": {
+				`for="[2001:db8::1]:4711";proto=https, for=203.0.113.5:80`,
+			}},
+			expected: "203.0.113.5",
+		},
+		{
+			description: "Should ignore Forwarded sent by the client when the proxy sets X-Forwarded-For",
+			remoteAddr:  "10.0.0.2:1234",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.1"},
+				"X-Forwarded-For": {"203.0.113.5"},
+			},
+			expected: "203.0.113.5",
+		},
+		{
+			description: "Should ignore X-Forwarded-For sent by the client when the proxy sets Forwarded",
+			remoteAddr:  "10.0.0.2:1234",
+			proxyHeader: HeaderForwarded,
+			header: http.Header{
+				"Forwarded":       {"for=203.0.113.5"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			expected: "203.0.113.5",
+		},
+		{
+			description: "Should read the whole X-Forwarded-For list past invalid addresses",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"1.2.3.4, junk, 203.0.113.5"}},
+			expected:    "203.0.113.5",
+		},
+		{
+			description: "Should use the trusted proxy for invalid addresses it appended",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"203.0.113.5, unknown"}},
+			expected:    "10.0.0.2",
+		},
+		{
+			description: "Should use the closest trusted proxy for invalid addresses",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.1, junk, 10.0.0.3"}},
+			expected:    "10.0.0.3",
+		},
+		{
+			description: "Should use the trusted proxy for obfuscated Forwarded addresses",
+			remoteAddr:  "10.0.0.2:1234",
+			proxyHeader: HeaderForwarded,
+			header:      http.Header{"Forwarded": {"for=198.51.100.1, for=_hidden"}},
+			expected:    "10.0.0.2",
+		},
+		{
+			description: "Should not fall back to X-Real-IP when X-Forwarded-For is invalid",
+			remoteAddr:  "10.0.0.2:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"junk"},
+				"X-Real-Ip":       {"198.51.100.1"},
+			},
+			expected: "10.0.0.2",
+		},
+		{
+			description: "Should not fall back to X-Real-IP when X-Forwarded-For is missing",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			expected:    "10.0.0.2",
+		},
+		{
+			description: "Should use the original client when every address is a trusted proxy",
+			remoteAddr:  "10.0.0.2:1234",
+			header:      http.Header{"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"}},
+			expected:    "10.0.0.4",
+		},
+		{
+			description: "Should use the trusted proxy if headers are missing",
+			remoteAddr:  "10.0.0.2:1234",
+			expected:    "10.0.0.2",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := NewResolver([]string{"10.0.0.0/8", "127.0.0.1"}, test.proxyHeader)
+			require.NoError(t, err, "Expected no error creating resolver")
+			r := &http.Request{RemoteAddr: test.remoteAddr, Header: test.header}
+			actual, err := res.Resolve(r)
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, test.expected, actual, "Expected client IPs to match")
+		})
+	}
+}
+
+func TestNewResolverInvalid(t *testing.T) {
+	_, err := NewResolver([]string{"10.0.0.0/33"}, "")
+	assert.Error(t, err, "Expected an error for an invalid CIDR")
+
+	_, err = NewResolver([]string{"localhost"}, "")
+	assert.Error(t, err, "Expected an error for an invalid IP")
+
+	_, err = NewResolver([]string{"10.0.0.0/8"}, "X-Client-IP")
+	assert.Error(t, err, "Expected an error for an unsupported header")
+}
@@ -1,27 +1,66 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/health"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/jobs"
+	"github.com/matthewdale/manualsmap.com/logging"
+	"github.com/matthewdale/manualsmap.com/migrations"
 	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
 	"github.com/shopspring/decimal"
 
 	"github.com/alecthomas/kong"
-	"github.com/dpapathanasiou/go-recaptcha"
-	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
-
-	"github.com/matthewdale/manualsmap.com/handlers/images"
-	"github.com/matthewdale/manualsmap.com/handlers/mapblocks"
-	"github.com/matthewdale/manualsmap.com/handlers/mapkit"
+	"github.com/pkg/errors"
 )
 
-var opts struct {
+var cli struct {
+	// Logging configuration.
+	LogFormat string     `kong:"name='log-format',default='text',help='log format, one of: text, json'"`
+	LogLevel  slog.Level `kong:"name='log-level',default='INFO',help='minimum log level, one of: DEBUG, INFO, WARN, ERROR'"`
+
+	// Tracing configuration.
+	TraceExporter string `kong:"name='trace-exporter',default='none',help='trace exporter, one of: otlp, stdout, none (otlp is configured with OTEL_EXPORTER_OTLP_* environment variables)'"`
+
+	// Postgres connection.
+	DBConn       string               `kong:"name='db-conn',xor='db-conn',help='database connection string, a Postgres connection string or sqlite:///path/to/manualsmap.db (required)'"`
+	PSQLConn     string               `kong:"name='psql-conn',xor='db-conn',hidden,help='deprecated alias of --db-conn'"`
+	QueryTimeout time.Duration        `kong:"name='query-timeout',default='5s',help='maximum duration of each database query, 0 for no limit'"`
+	Spatial      services.SpatialMode `kong:"name='spatial',default='numeric',help='how map blocks are queried by location, one of: numeric, postgis (requires the PostGIS extension)'"`
+
+	// Cloudinary API configuration.
+	CloudinaryAPIKey string `kong:"name='cloudinary-api-key',help='Cloudinary API key, required by serve and gc-images'"`
+	CloudinarySecret string `kong:"name='cloudinary-secret',help='Cloudinary API secret, required by serve and gc-images'"`
+
+	Serve    serveCmd    `kong:"cmd,help='Run the API server.'"`
+	GCImages gcImagesCmd `kong:"cmd,name='gc-images',help='Delete uploaded images that were never attached to a car.'"`
+	Migrate  migrateCmd  `kong:"cmd,help='Manage the database schema.'"`
+}
+
+type serveCmd struct {
 	// Server configuration.
-	Addr string `kong:"name='addr',default=':8080',help='the address to listen on'"`
+	Addr            string        `kong:"name='addr',default=':8080',help='the address to listen on'"`
+	TrustedProxies  []string      `kong:"name='trusted-proxies',sep=',',help='comma-separated CIDRs of reverse proxies whose client IP headers are trusted'"`
+	ClientIPHeader  string        `kong:"name='client-ip-header',default='X-Forwarded-For',enum='X-Forwarded-For,Forwarded,X-Real-IP',help='the header the trusted proxies set to the client IP, one of: X-Forwarded-For, Forwarded, X-Real-IP'"`
+	ReadTimeout     time.Duration `kong:"name='read-timeout',default='10s',help='maximum duration for reading an entire request, including the body'"`
+	WriteTimeout    time.Duration `kong:"name='write-timeout',default='30s',help='maximum duration before timing out writing a response'"`
+	IdleTimeout     time.Duration `kong:"name='idle-timeout',default='120s',help='maximum duration to keep idle keep-alive connections open'"`
+	MaxHeaderBytes  int           `kong:"name='max-header-bytes',default='65536',help='maximum size of request headers in bytes'"`
+	MetricsAddr     string        `kong:"name='metrics-addr',help='the address to serve Prometheus metrics at /metrics on, separately from the API, like 127.0.0.1:9090 (empty to disable)'"`
+	ShutdownTimeout time.Duration `kong:"name='shutdown-timeout',default='8s',help='maximum duration to wait for in-flight requests to finish when shutting down, which must be shorter than the container stop timeout'"`
 
 	// Mapkit JS configuration.
 	AppleTeamID     string `kong:"required,name='apple-team-id',help='Apple developer team ID'"`
@@ -29,80 +68,382 @@ var opts struct {
 	MapkitSecretB64 string `kong:"required,name='mapkit-secret-b64',help='base64-encoded Apple Mapkit P8/PEM secret'"`
 	MapkitOrigin    string `kong:"name='mapkit-origin',help='Apple Mapkit JWT origin domain'"`
 
-	// reCAPTCHA API configuration.
-	RecaptchaSecret string `kong:"required,name='recaptcha-secret',help='reCAPTCHA API secret'"`
+	// Captcha API configuration.
+	CaptchaProvider   string  `kong:"name='captcha-provider',default='recaptcha',help='captcha provider, one of: recaptcha, hcaptcha, turnstile, none'"`
+	CaptchaSecret     string  `kong:"name='captcha-secret',xor='captcha-secret',help='captcha provider API secret'"`
+	RecaptchaSecret   string  `kong:"name='recaptcha-secret',xor='captcha-secret',hidden,help='deprecated alias of --captcha-secret'"`
+	RecaptchaMinScore float64 `kong:"name='recaptcha-min-score',help='minimum reCAPTCHA v3 score, 0 for reCAPTCHA v2'"`
+	RecaptchaAction   string  `kong:"name='recaptcha-action',help='expected reCAPTCHA v3 action, empty to skip the check'"`
 
-	// Cloudinary API configuration.
-	CloudinarySecret string `kong:"required,name='cloudinary-secret',help='Cloudinary API secret'"`
+	// Rate limit configuration.
+	RateLimitStore       string             `kong:"name='rate-limit-store',default='memory',help='rate limit store, one of: memory, database'"`
+	CarsIPRateLimit      services.RateLimit `kong:"name='cars-ip-rate-limit',default='10/1h',help='maximum car submissions per client IP, like 10/1h (empty to disable)'"`
+	CarsBlockRateLimit   services.RateLimit `kong:"name='cars-block-rate-limit',default='30/1h',help='maximum car submissions per map block, like 30/1h (empty to disable)'"`
+	CarEditsIPRateLimit  services.RateLimit `kong:"name='car-edits-ip-rate-limit',default='30/1h',help='maximum car edits and deletions per client IP, like 30/1h (empty to disable)'"`
+	SignatureIPRateLimit services.RateLimit `kong:"name='signature-ip-rate-limit',default='20/1h',help='maximum image upload signatures per client IP, like 20/1h (empty to disable)'"`
+	LoginIPRateLimit     services.RateLimit `kong:"name='login-ip-rate-limit',default='10/1h',help='maximum login emails per client IP, like 10/1h (empty to disable)'"`
+	LoginEmailRateLimit  services.RateLimit `kong:"name='login-email-rate-limit',default='5/1h',help='maximum login emails per email address, like 5/1h (empty to disable)'"`
 
-	// Postgres connection.
-	PSQLConn string `kong:"required,name='psql-conn',help='Postgres SQL connection string'"`
+	// Account configuration.
+	BaseURL         string        `kong:"name='base-url',default='https://manualsmap.com',help='URL of the site, used in emailed login links'"`
+	LoginTTL        time.Duration `kong:"name='login-ttl',default='15m',help='how long emailed login links are valid'"`
+	SessionTTL      time.Duration `kong:"name='session-ttl',default='720h',help='how long users stay logged in'"`
+	InsecureCookies bool          `kong:"name='insecure-cookies',help='send session cookies over plain HTTP, for local development only'"`
+
+	// OpenID Connect login configuration.
+	OIDCIssuer       string             `kong:"name='oidc-issuer',help='OpenID Connect issuer URL, like https://accounts.google.com (empty to disable OIDC login)'"`
+	OIDCClientID     string             `kong:"name='oidc-client-id',help='OpenID Connect client ID'"`
+	OIDCClientSecret string             `kong:"name='oidc-client-secret',help='OpenID Connect client secret'"`
+	OIDCRoles        services.RoleRules `kong:"name='oidc-roles',sep=',',help='comma-separated roles granted to OIDC logins, like email:alice@example.com=admin,sub:248289761001=moderator'"`
+
+	// Email configuration.
+	Mailer       string `kong:"name='mailer',default='none',help='how login emails are sent, one of: none (disables email login), smtp, log (logs emails instead of sending them, for local development)'"`
+	SMTPAddr     string `kong:"name='smtp-addr',help='SMTP server address, like smtp.example.com:587'"`
+	SMTPUsername string `kong:"name='smtp-username',help='SMTP username, empty to send without authenticating'"`
+	SMTPPassword string `kong:"name='smtp-password',help='SMTP password'"`
+	MailFrom     string `kong:"name='mail-from',default='Manuals Map <noreply@manualsmap.com>',help='from address of login emails'"`
 
 	LicenseSalt string `kong:"required,name='license-salt',help='salt for hashed license plate information'"`
+
+	AutoMigrate bool `kong:"name='auto-migrate',help='apply pending database migrations, and set up the PostGIS columns with --spatial=postgis, before starting the server'"`
+}
+
+// checkTimeout is how long the startup and readiness checks can take before
+// they fail.
+const checkTimeout = 5 * time.Second
+
+// rateLimitMaxAge is how long unused rate limit buckets are kept. It must be
+// at least as long as the longest configured rate limit period.
+const rateLimitMaxAge = 24 * time.Hour
+
+func (cmd serveCmd) rateLimitStore(db *sql.DB, driver database.Driver) (services.RateLimitStore, error) {
+	switch cmd.RateLimitStore {
+	case "memory":
+		return services.NewMemoryRateLimitStore(rateLimitMaxAge), nil
+	// "postgres" is accepted for configurations from before SQLite support.
+	case "database", "postgres":
+		return services.NewSQLRateLimitStore(db, driver, rateLimitMaxAge), nil
+	}
+	return nil, errors.Errorf("unknown rate limit store %q", cmd.RateLimitStore)
+}
+
+func (cmd serveCmd) captchaVerifier(logger *slog.Logger) (services.CaptchaVerifier, error) {
+	if cmd.CaptchaProvider != "none" && cmd.CaptchaSecret == "" {
+		return nil, errors.Errorf("--captcha-secret is required for captcha provider %q", cmd.CaptchaProvider)
+	}
+	switch cmd.CaptchaProvider {
+	case "recaptcha":
+		return services.NewRecaptcha(
+			cmd.CaptchaSecret,
+			cmd.RecaptchaMinScore,
+			cmd.RecaptchaAction,
+			logger), nil
+	case "hcaptcha":
+		return services.NewHCaptcha(cmd.CaptchaSecret, logger), nil
+	case "turnstile":
+		return services.NewTurnstile(cmd.CaptchaSecret, logger), nil
+	case "none":
+		logger.Warn("captcha validation is disabled, all submissions will be accepted")
+		return services.FixedVerifier(true), nil
+	}
+	return nil, errors.Errorf("unknown captcha provider %q", cmd.CaptchaProvider)
+}
+
+// mailer returns the Mailer for login emails, or nil if email login is
+// disabled.
+func (cmd serveCmd) mailer(logger *slog.Logger) (services.Mailer, error) {
+	switch cmd.Mailer {
+	case "none":
+		logger.Info("email login is disabled, set --mailer to enable it")
+		return nil, nil
+	case "smtp":
+		if cmd.SMTPAddr == "" {
+			return nil, errors.New("--smtp-addr is required for mailer \"smtp\"")
+		}
+		return services.NewSMTPMailer(cmd.SMTPAddr, cmd.SMTPUsername, cmd.SMTPPassword, cmd.MailFrom)
+	case "log":
+		logger.Warn("emails are logged instead of sent, login links are written to the log")
+		return services.NewLogMailer(logger), nil
+	}
+	return nil, errors.Errorf("unknown mailer %q", cmd.Mailer)
+}
+
+// oidc returns the OIDC login client, or nil if OIDC login is disabled. The
+// provider redirects back to the API's callback route on the site.
+func (cmd serveCmd) oidc() (*services.OIDC, error) {
+	if cmd.OIDCIssuer == "" {
+		if len(cmd.OIDCRoles) > 0 {
+			return nil, errors.New("--oidc-roles requires --oidc-issuer")
+		}
+		return nil, nil
+	}
+	oidc, err := services.NewOIDC(
+		cmd.OIDCIssuer,
+		cmd.OIDCClientID,
+		cmd.OIDCClientSecret,
+		strings.TrimSuffix(cmd.BaseURL, "/")+apiPrefix+"/login/oidc/callback")
+	if err != nil {
+		return nil, err
+	}
+	return &oidc, nil
+}
+
+func (cmd serveCmd) Run(logger *slog.Logger) error {
+	metrics := instrumenting.NewPrometheus()
+
+	verifier, err := cmd.captchaVerifier(logger)
+	if err != nil {
+		return err
+	}
+	verifier = instrumenting.CaptchaVerifier(metrics, verifier)
+
+	mapkitSecret, err := base64.StdEncoding.DecodeString(cmd.MapkitSecretB64)
+	if err != nil {
+		return errors.WithMessage(err, "error decoding Mapkit secret")
+	}
+
+	appleMapkit, err := services.NewAppleMapkit(
+		cmd.AppleTeamID,
+		cmd.MapkitKeyID,
+		mapkitSecret,
+		cmd.MapkitOrigin)
+	if err != nil {
+		return errors.WithMessage(err, "error parsing private key PEM file")
+	}
+
+	db, driver, err := database.Open(cli.DBConn)
+	if err != nil {
+		return err
+	}
+	// Close the DB pool only after the HTTP server has finished handling all
+	// in-flight requests.
+	defer db.Close()
+
+	migrator, err := migrations.New(db, driver, logger)
+	if err != nil {
+		return err
+	}
+	if cmd.AutoMigrate {
+		if _, err := migrator.Up(context.Background()); err != nil {
+			return errors.WithMessage(err, "error applying migrations")
+		}
+		if cli.Spatial == services.SpatialPostGIS {
+			if err := migrator.SetupPostGIS(context.Background()); err != nil {
+				return err
+			}
+		}
+	}
+
+	resolver, err := clientip.NewResolver(cmd.TrustedProxies, cmd.ClientIPHeader)
+	if err != nil {
+		return err
+	}
+
+	limits, err := cmd.rateLimitStore(db, driver)
+	if err != nil {
+		return err
+	}
+
+	persistence := services.NewPersistence(
+		db,
+		driver,
+		[]byte(cmd.LicenseSalt),
+		cli.Spatial,
+		cli.QueryTimeout,
+		metrics.QueryDuration)
+	cloudinary := services.NewCloudinary(cli.CloudinaryAPIKey, cli.CloudinarySecret)
+
+	mailer, err := cmd.mailer(logger)
+	if err != nil {
+		return err
+	}
+	accounts, err := services.NewAccounts(persistence, mailer, cmd.BaseURL, cmd.LoginTTL, cmd.SessionTTL)
+	if err != nil {
+		return err
+	}
+	accounts = accounts.WithRoleRules(cmd.OIDCRoles)
+	oidc, err := cmd.oidc()
+	if err != nil {
+		return err
+	}
+	if cmd.InsecureCookies {
+		logger.Warn("session cookies are sent over plain HTTP")
+	}
+
+	// sql.Open doesn't connect to the database, so check all dependencies
+	// before serving any requests to fail fast if they're misconfigured.
+	checks := health.Checks{
+		"database":   persistence.Ping,
+		"schema":     migrator.CheckVersion,
+		"spatial":    persistence.CheckSpatial,
+		"cloudinary": cloudinary.CheckConfig,
+	}
+	if oidc != nil {
+		checks["oidc"] = oidc.CheckConfig
+	}
+	checkCtx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	err = checks.Run(checkCtx)
+	cancel()
+	if err != nil {
+		return errors.WithMessage(err, "startup check failed")
+	}
+
+	handler := newRouter(routerConfig{
+		mapkit:               appleMapkit,
+		persistence:          persistence,
+		cloudinary:           cloudinary,
+		verifier:             verifier,
+		limits:               limits,
+		resolver:             resolver,
+		accounts:             accounts,
+		oidc:                 oidc,
+		carsIPRateLimit:      cmd.CarsIPRateLimit,
+		carsBlockRateLimit:   cmd.CarsBlockRateLimit,
+		carEditsIPRateLimit:  cmd.CarEditsIPRateLimit,
+		signatureIPRateLimit: cmd.SignatureIPRateLimit,
+		loginIPRateLimit:     cmd.LoginIPRateLimit,
+		loginEmailRateLimit:  cmd.LoginEmailRateLimit,
+		secureCookies:        !cmd.InsecureCookies,
+		checks:               checks,
+		checkTimeout:         checkTimeout,
+		publicDir:            "public",
+		metrics:              metrics,
+		logger:               logger,
+	})
+
+	logger.Info("starting HTTP server", "addr", cmd.Addr, "version", health.BuildVersion())
+	servers := []*http.Server{cmd.server(cmd.Addr, handler, logger)}
+	// Metrics are served on a separate listener so that they aren't exposed
+	// to the internet with the API.
+	if cmd.MetricsAddr != "" {
+		logger.Info("starting metrics server", "addr", cmd.MetricsAddr)
+		servers = append(servers, cmd.server(cmd.MetricsAddr, newMetricsRouter(), logger))
+	}
+	return serveUntilSignal(servers, cmd.ShutdownTimeout, logger)
+}
+
+func (cmd serveCmd) server(addr string, handler http.Handler, logger *slog.Logger) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    cmd.ReadTimeout,
+		WriteTimeout:   cmd.WriteTimeout,
+		IdleTimeout:    cmd.IdleTimeout,
+		MaxHeaderBytes: cmd.MaxHeaderBytes,
+		ErrorLog:       slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// serveUntilSignal runs the servers until the process receives SIGTERM or
+// SIGINT, then stops accepting new connections and waits up to
+// shutdownTimeout for in-flight requests to finish. Dokku sends SIGTERM to the
+// old container during a deploy, so this prevents dropping submissions. If
+// any server fails, the others are shut down too.
+func serveUntilSignal(
+	servers []*http.Server,
+	shutdownTimeout time.Duration,
+	logger *slog.Logger,
+) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		server := server // Capture range variable.
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	var serveErr error
+	select {
+	case err := <-errs:
+		serveErr = errors.WithMessage(err, "error starting HTTP server")
+	case <-ctx.Done():
+	}
+	// Restore the default signal behavior so that a second signal kills the
+	// process immediately.
+	stop()
+
+	logger.Info("shutting down HTTP server", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil && serveErr == nil {
+			serveErr = errors.WithMessage(err, "error shutting down HTTP server")
+		}
+	}
+	if serveErr != nil {
+		return serveErr
+	}
+	logger.Info("HTTP server stopped")
+	return nil
+}
+
+type gcImagesCmd struct {
+	GracePeriod time.Duration `kong:"name='grace-period',default='24h',help='only delete images uploaded longer ago than this'"`
+	DryRun      bool          `kong:"name='dry-run',help='report the images that would be deleted without deleting them'"`
+}
+
+func (cmd gcImagesCmd) Run(logger *slog.Logger) error {
+	db, driver, err := database.Open(cli.DBConn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The license salt isn't used to collect images.
+	persistence := services.NewPersistence(db, driver, nil, cli.Spatial, cli.QueryTimeout, nil)
+	cloudinary := services.NewCloudinary(cli.CloudinaryAPIKey, cli.CloudinarySecret)
+	if err := cloudinary.CheckConfig(context.Background()); err != nil {
+		return err
+	}
+
+	collector := jobs.NewImageCollector(persistence, cloudinary, cmd.GracePeriod, logger)
+	images, err := collector.Collect(context.Background(), cmd.DryRun)
+	if err != nil {
+		return err
+	}
+	logger.Info(
+		"collected orphaned images",
+		"count", len(images),
+		"dry_run", cmd.DryRun)
+	return nil
 }
 
 func main() {
 	// Marshal decimal types as numbers, not strings.
 	decimal.MarshalJSONWithoutQuotes = true
-	kong.Parse(&opts, kong.UsageOnError())
-	recaptcha.Init(opts.RecaptchaSecret)
+	ctx := kong.Parse(&cli, kong.UsageOnError())
+	// --psql-conn was renamed to --db-conn when SQLite support was added.
+	if cli.DBConn == "" {
+		cli.DBConn = cli.PSQLConn
+	}
+	if cli.DBConn == "" {
+		ctx.Fatalf("missing flags: --db-conn=STRING")
+	}
+	// --recaptcha-secret was renamed to --captcha-secret when other captcha
+	// providers were added.
+	if cli.Serve.CaptchaSecret == "" {
+		cli.Serve.CaptchaSecret = cli.Serve.RecaptchaSecret
+	}
+	if cli.LogFormat != "text" && cli.LogFormat != "json" {
+		ctx.Fatalf("unknown log format %q", cli.LogFormat)
+	}
+	logger := logging.New(os.Stdout, cli.LogFormat, cli.LogLevel)
+	slog.SetDefault(logger)
 
-	mapkitSecret, err := base64.StdEncoding.DecodeString(opts.MapkitSecretB64)
+	provider, err := tracing.NewProvider(context.Background(), cli.TraceExporter, os.Stdout)
 	if err != nil {
-		log.Fatal("Error decoding Mapkit secret", err)
+		ctx.Fatalf("error configuring tracing: %v", err)
 	}
 
-	appleMapkit, err := services.NewAppleMapkit(
-		opts.AppleTeamID,
-		opts.MapkitKeyID,
-		mapkitSecret,
-		opts.MapkitOrigin)
-	if err != nil {
-		log.Fatal("Error parsing private key PEM file", err)
-	}
-
-	db, err := sql.Open("postgres", opts.PSQLConn)
-	if err != nil {
-		log.Fatal("Error connecting to Postgres DB", err)
-	}
-
-	persistence := services.NewPersistence(db, []byte(opts.LicenseSalt))
-	cloudinary := services.NewCloudinary(opts.CloudinarySecret)
-
-	router := mux.NewRouter()
-	router.
-		Methods("GET").
-		Path("/mapkit/token").
-		Handler(mapkit.GetTokenHandler(appleMapkit))
-	router.
-		Methods("POST").
-		Path("/images/signature").
-		Handler(images.PostSignatureHandler(cloudinary))
-	router.
-		Methods("POST").
-		Path("/images/notification").
-		Handler(images.PostNotificationHandler(persistence, cloudinary))
-	router.
-		Methods("GET").
-		Path("/mapblocks").
-		Handler(mapblocks.GetHandler(persistence))
-	router.
-		Methods("GET").
-		Path("/mapblocks/{id}/cars").
-		Handler(mapblocks.GetCarsHandler(persistence, cloudinary))
-	router.
-		Methods("GET").
-		Path("/cars/schema").
-		Handler(mapblocks.GetCarsSchemaHandler())
-	router.
-		Methods("POST").
-		Path("/cars").
-		Handler(mapblocks.PostCarsHandler(persistence))
-	router.
-		PathPrefix("/").
-		Handler(http.FileServer(http.Dir("public")))
-
-	if err := http.ListenAndServe(opts.Addr, router); err != nil {
-		log.Print("Error starting HTTP server:", err)
+	err = ctx.Run(logger)
+	// Flush any buffered spans before exiting.
+	if err := provider.Shutdown(context.Background()); err != nil {
+		logger.Error("error shutting down tracing", "error", err)
+	}
+	if err != nil {
+		logger.Error("command failed", "command", ctx.Command(), "error", err)
+		os.Exit(1)
 	}
 }
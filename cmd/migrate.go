@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/migrations"
+)
+
+type migrateCmd struct {
+	Up      migrateUpCmd      `kong:"cmd,help='Apply all pending migrations.'"`
+	Down    migrateDownCmd    `kong:"cmd,help='Revert the most recently applied migrations.'"`
+	Status  migrateStatusCmd  `kong:"cmd,help='List all migrations and whether they have been applied.'"`
+	PostGIS migratePostGISCmd `kong:"cmd,name='postgis',help='Add the geometry columns used by --spatial=postgis. Requires the PostGIS extension and can be re-run at any time.'"`
+}
+
+// openMigrator connects to the database and creates a Migrator for the
+// embedded migrations. The caller must close the returned DB.
+func openMigrator(logger *slog.Logger) (migrations.Migrator, *sql.DB, error) {
+	db, driver, err := database.Open(cli.DBConn)
+	if err != nil {
+		return migrations.Migrator{}, nil, err
+	}
+	migrator, err := migrations.New(db, driver, logger)
+	if err != nil {
+		db.Close()
+		return migrations.Migrator{}, nil, err
+	}
+	return migrator, db, nil
+}
+
+type migrateUpCmd struct{}
+
+func (cmd migrateUpCmd) Run(logger *slog.Logger) error {
+	migrator, db, err := openMigrator(logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		return err
+	}
+	logger.Info(
+		"database schema is up to date",
+		"applied", len(applied),
+		"version", migrator.Latest())
+	return nil
+}
+
+type migrateDownCmd struct {
+	Steps int `kong:"name='steps',default='1',help='number of migrations to revert'"`
+}
+
+func (cmd migrateDownCmd) Run(logger *slog.Logger) error {
+	migrator, db, err := openMigrator(logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reverted, err := migrator.Down(context.Background(), cmd.Steps)
+	if err != nil {
+		return err
+	}
+	logger.Info("reverted migrations", "reverted", len(reverted))
+	return nil
+}
+
+type migrateStatusCmd struct{}
+
+func (cmd migrateStatusCmd) Run(logger *slog.Logger) error {
+	migrator, db, err := openMigrator(logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	statuses, err := migrator.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, status := range statuses {
+		applied := "pending"
+		if status.Applied {
+			applied = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	return w.Flush()
+}
+
+type migratePostGISCmd struct{}
+
+func (cmd migratePostGISCmd) Run(logger *slog.Logger) error {
+	migrator, db, err := openMigrator(logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrator.SetupPostGIS(context.Background())
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/health"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/openapi"
+	"github.com/matthewdale/manualsmap.com/requestid"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
+
+	"github.com/matthewdale/manualsmap.com/handlers/accounts"
+	"github.com/matthewdale/manualsmap.com/handlers/admin"
+	"github.com/matthewdale/manualsmap.com/handlers/images"
+	"github.com/matthewdale/manualsmap.com/handlers/mapblocks"
+	"github.com/matthewdale/manualsmap.com/handlers/mapkit"
+)
+
+// routerConfig holds the services and settings used by the API routes.
+type routerConfig struct {
+	mapkit      services.AppleMapkit
+	persistence services.Persistence
+	cloudinary  services.Cloudinary
+	verifier    services.CaptchaVerifier
+	limits      services.RateLimitStore
+	resolver    clientip.Resolver
+	accounts    services.Accounts
+	// oidc is nil if OIDC login is disabled.
+	oidc *services.OIDC
+
+	carsIPRateLimit      services.RateLimit
+	carsBlockRateLimit   services.RateLimit
+	carEditsIPRateLimit  services.RateLimit
+	signatureIPRateLimit services.RateLimit
+	loginIPRateLimit     services.RateLimit
+	loginEmailRateLimit  services.RateLimit
+
+	// secureCookies restricts session cookies to HTTPS. It's only disabled
+	// for local development over HTTP.
+	secureCookies bool
+
+	// checks are run by the readiness endpoint, each for up to checkTimeout.
+	checks       health.Checks
+	checkTimeout time.Duration
+
+	// publicDir is the directory of static files served for all other paths.
+	publicDir string
+
+	metrics instrumenting.Metrics
+	logger  *slog.Logger
+}
+
+// apiPrefix is the path prefix of the current API version. The JSON API
+// routes that existed before the API was versioned are also served without
+// the prefix for clients written before then.
+const apiPrefix = "/api/v1"
+
+// newRouter returns the handler for all API routes and static files, with
+// tracing and request IDs applied to every request.
+func newRouter(config routerConfig) http.Handler {
+	return tracing.Handler(requestid.Middleware(newRoutes(config)))
+}
+
+// newMetricsRouter returns the handler for Prometheus metrics, which is served
+// on a separate listener from the API.
+func newMetricsRouter() http.Handler {
+	router := mux.NewRouter()
+	router.
+		Methods("GET").
+		Path("/metrics").
+		Handler(promhttp.Handler())
+	return router
+}
+
+// newRoutes registers all routes. The operational endpoints (health checks and
+// version) aren't part of the versioned API and are only served at the root.
+func newRoutes(config routerConfig) *mux.Router {
+	router := mux.NewRouter()
+	router.
+		Methods("GET").
+		Path("/healthz").
+		Handler(health.HealthzHandler())
+	router.
+		Methods("GET").
+		Path("/readyz").
+		Handler(health.ReadyzHandler(config.checks, config.checkTimeout, config.logger))
+	router.
+		Methods("GET").
+		Path("/version").
+		Handler(health.VersionHandler())
+
+	api := router.PathPrefix(apiPrefix).Subrouter()
+	api.
+		Methods("GET").
+		Path("/openapi.json").
+		Handler(openapi.Handler())
+	addAPIRoutes(api, config)
+	addLegacyAPIRoutes(router, config)
+
+	router.
+		PathPrefix("/").
+		Handler(http.FileServer(http.Dir(config.publicDir)))
+	return router
+}
+
+// addAPIRoutes registers the JSON API routes on the router.
+func addAPIRoutes(router *mux.Router, config routerConfig) {
+	addLegacyAPIRoutes(router, config)
+	router.
+		Methods("GET").
+		Path("/mapblocks/nearby").
+		Handler(mapblocks.GetNearbyHandler(config.persistence, config.metrics, config.logger))
+	router.
+		Methods("PATCH").
+		Path("/cars/{id}").
+		Handler(mapblocks.PatchCarHandler(
+			config.persistence,
+			config.limits,
+			config.carEditsIPRateLimit,
+			config.resolver,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("DELETE").
+		Path("/cars/{id}").
+		Handler(mapblocks.DeleteCarHandler(
+			config.persistence,
+			config.limits,
+			config.carEditsIPRateLimit,
+			config.resolver,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/login").
+		Handler(accounts.PostLoginHandler(
+			config.accounts,
+			config.persistence,
+			config.verifier,
+			config.limits,
+			config.loginIPRateLimit,
+			config.loginEmailRateLimit,
+			config.resolver,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/login/verify").
+		Handler(accounts.PostLoginVerifyHandler(
+			config.accounts,
+			config.secureCookies,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/login/oidc").
+		Handler(accounts.GetLoginOIDCHandler(
+			config.oidc,
+			config.secureCookies,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/login/oidc/callback").
+		Handler(accounts.GetLoginOIDCCallbackHandler(
+			config.accounts,
+			config.oidc,
+			config.secureCookies,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/logout").
+		Handler(accounts.PostLogoutHandler(
+			config.accounts,
+			config.secureCookies,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/me").
+		Handler(accounts.GetMeHandler(
+			config.accounts,
+			config.persistence,
+			config.cloudinary,
+			config.metrics,
+			config.logger))
+	addAdminRoutes(router, config)
+}
+
+// addLegacyAPIRoutes registers the JSON API routes that existed before the
+// API was versioned, which are also served without the version prefix.
+func addLegacyAPIRoutes(router *mux.Router, config routerConfig) {
+	router.
+		Methods("GET").
+		Path("/mapkit/token").
+		Handler(mapkit.GetTokenHandler(config.mapkit, config.metrics, config.logger))
+	router.
+		Methods("POST").
+		Path("/images/signature").
+		Handler(images.PostSignatureHandler(
+			config.cloudinary,
+			config.persistence,
+			config.verifier,
+			config.limits,
+			config.signatureIPRateLimit,
+			config.resolver,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/images/notification").
+		Handler(images.PostNotificationHandler(
+			config.persistence,
+			config.cloudinary,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/mapblocks").
+		Handler(mapblocks.GetHandler(config.persistence, config.metrics, config.logger))
+	router.
+		Methods("GET").
+		Path("/mapblocks/{id}/cars").
+		Handler(mapblocks.GetCarsHandler(
+			config.persistence,
+			config.cloudinary,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/cars/schema").
+		Handler(mapblocks.GetCarsSchemaHandler(config.metrics, config.logger))
+	router.
+		Methods("POST").
+		Path("/cars").
+		Handler(mapblocks.PostCarsHandler(
+			config.persistence,
+			config.accounts,
+			config.verifier,
+			config.limits,
+			config.carsIPRateLimit,
+			config.carsBlockRateLimit,
+			config.resolver,
+			config.metrics,
+			config.logger))
+}
+
+// addAdminRoutes registers the admin API routes on the router, which require
+// the moderator or admin role.
+func addAdminRoutes(router *mux.Router, config routerConfig) {
+	router.
+		Methods("POST").
+		Path("/admin/cars/merge").
+		Handler(admin.PostMergeCarsHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/admin/cars/move").
+		Handler(admin.PostMoveCarsHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/admin/cars/rename").
+		Handler(admin.PostRenameCarsHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/admin/cars/{id}/history").
+		Handler(admin.GetCarHistoryHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/admin/mapblocks/delete-empty").
+		Handler(admin.PostDeleteEmptyMapBlocksHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/admin/bans").
+		Handler(admin.GetBansHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("POST").
+		Path("/admin/bans").
+		Handler(admin.PostBanHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("DELETE").
+		Path("/admin/bans/{id}").
+		Handler(admin.DeleteBanHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+	router.
+		Methods("GET").
+		Path("/admin/actions").
+		Handler(admin.GetActionsHandler(
+			config.accounts,
+			config.persistence,
+			config.metrics,
+			config.logger))
+}
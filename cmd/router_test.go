@@ -0,0 +1,1005 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/client"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+	"github.com/matthewdale/manualsmap.com/health"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/jobs"
+	"github.com/matthewdale/manualsmap.com/oidctest"
+	"github.com/matthewdale/manualsmap.com/openapi"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+// The tests in this file drive the full API over HTTP against each supported
+// database, see the dbtest package for how to enable Postgres. reCAPTCHA and
+// the Cloudinary Admin API are replaced by fake servers.
+
+func TestMain(m *testing.M) {
+	dbtest.Main(m)
+}
+
+const (
+	testCloudinaryAPIKey = "1234"
+	testCloudinarySecret = "cloudinary-secret"
+	testCaptchaSecret    = "captcha-secret"
+	// validCaptcha is the only captcha response accepted by the fake
+	// reCAPTCHA server.
+	validCaptcha = "valid-captcha"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newFakeRecaptcha starts a fake reCAPTCHA siteverify server that accepts
+// validCaptcha if it's sent with testCaptchaSecret.
+func newFakeRecaptcha(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		success := r.PostForm.Get("secret") == testCaptchaSecret &&
+			r.PostForm.Get("response") == validCaptcha
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": success})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeCloudinary is a fake Cloudinary Admin API server that records the
+// public IDs of deleted images.
+type fakeCloudinary struct {
+	*httptest.Server
+	mu      sync.Mutex
+	deleted []string
+}
+
+func newFakeCloudinary(t *testing.T) *fakeCloudinary {
+	fake := &fakeCloudinary{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret, ok := r.BasicAuth()
+		if !ok || key != testCloudinaryAPIKey || secret != testCloudinarySecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodDelete || r.URL.Path != "/resources/image/authenticated" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		deleted := make(map[string]string)
+		fake.mu.Lock()
+		for _, publicID := range r.URL.Query()["public_ids[]"] {
+			fake.deleted = append(fake.deleted, publicID)
+			deleted[publicID] = "deleted"
+		}
+		fake.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakeCloudinary) Deleted() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string(nil), fake.deleted...)
+}
+
+// testMapkitKey returns a PEM encoded private key for signing MapKit tokens.
+func testMapkitKey(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "Expected no error generating MapKit key")
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err, "Expected no error encoding MapKit key")
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// recordingMailer is a Mailer that records the emails sent to each address.
+type recordingMailer struct {
+	mu     sync.Mutex
+	bodies map[string][]string
+}
+
+func (mailer *recordingMailer) Send(_ context.Context, to, _, body string) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	if mailer.bodies == nil {
+		mailer.bodies = make(map[string][]string)
+	}
+	mailer.bodies[to] = append(mailer.bodies[to], body)
+	return nil
+}
+
+// loginToken returns the login token from the last login link emailed to the
+// address.
+func (mailer *recordingMailer) loginToken(t *testing.T, to string) string {
+	t.Helper()
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	bodies := mailer.bodies[to]
+	require.NotEmpty(t, bodies, "Expected an email to %s", to)
+	for _, line := range strings.Split(bodies[len(bodies)-1], "\n") {
+		if link, err := url.Parse(line); err == nil && link.Query().Get("login") != "" {
+			return link.Query().Get("login")
+		}
+	}
+	t.Fatalf("Expected a login link in the email to %s", to)
+	return ""
+}
+
+// testAPI is an API server backed by a test database and fake external
+// services.
+type testAPI struct {
+	*httptest.Server
+	persistence services.Persistence
+	cloudinary  services.Cloudinary
+	fakeCloud   *fakeCloudinary
+	mailer      *recordingMailer
+	idp         *oidctest.Provider
+}
+
+func newTestAPI(t *testing.T, db *sql.DB, driver database.Driver) testAPI {
+	fakeCloud := newFakeCloudinary(t)
+	cloudinary := services.NewCloudinary(testCloudinaryAPIKey, testCloudinarySecret).
+		WithAdminURL(fakeCloud.URL)
+	verifier := services.NewRecaptcha(testCaptchaSecret, 0, "", discardLogger).
+		WithVerifyURL(newFakeRecaptcha(t).URL)
+	appleMapkit, err := services.NewAppleMapkit("team", "key", testMapkitKey(t), "")
+	require.NoError(t, err, "Expected no error creating MapKit service")
+	persistence := services.NewPersistence(
+		db,
+		driver,
+		[]byte("salt"),
+		services.SpatialNumeric,
+		5*time.Second,
+		nil)
+	mailer := &recordingMailer{}
+	accounts, err := services.NewAccounts(persistence, mailer, "https://manualsmap.test", time.Minute, time.Hour)
+	require.NoError(t, err, "Expected no error creating Accounts service")
+	accounts = accounts.WithRoleRules(services.RoleRules{
+		{Claim: "email", Value: "admin@example.com", Role: services.RoleAdmin},
+		{Claim: "sub", Value: "moderator", Role: services.RoleModerator},
+	})
+
+	// The OIDC provider redirects back to the API, so the API's URL must be
+	// known before creating the router.
+	server := httptest.NewUnstartedServer(nil)
+	idp := oidctest.NewProvider(t)
+	oidc, err := services.NewOIDC(
+		idp.Issuer,
+		oidctest.ClientID,
+		oidctest.ClientSecret,
+		"http://"+server.Listener.Addr().String()+apiPrefix+"/login/oidc/callback")
+	require.NoError(t, err, "Expected no error creating OIDC service")
+
+	server.Config.Handler = newRouter(routerConfig{
+		mapkit:               appleMapkit,
+		persistence:          persistence,
+		cloudinary:           cloudinary,
+		verifier:             verifier,
+		limits:               services.NewMemoryRateLimitStore(time.Hour),
+		resolver:             clientip.Resolver{},
+		accounts:             accounts,
+		oidc:                 &oidc,
+		carsIPRateLimit:      services.RateLimit{Limit: 100, Per: time.Hour},
+		carsBlockRateLimit:   services.RateLimit{Limit: 100, Per: time.Hour},
+		carEditsIPRateLimit:  services.RateLimit{Limit: 100, Per: time.Hour},
+		signatureIPRateLimit: services.RateLimit{Limit: 100, Per: time.Hour},
+		loginIPRateLimit:     services.RateLimit{Limit: 100, Per: time.Hour},
+		loginEmailRateLimit:  services.RateLimit{Limit: 100, Per: time.Hour},
+		// The test server uses plain HTTP, so secure cookies would never be
+		// sent back.
+		secureCookies: false,
+		checks: health.Checks{
+			"database":   persistence.Ping,
+			"cloudinary": cloudinary.CheckConfig,
+		},
+		checkTimeout: time.Second,
+		publicDir:    t.TempDir(),
+		metrics:      instrumenting.NewDiscard(),
+		logger:       discardLogger,
+	})
+	server.Start()
+	t.Cleanup(server.Close)
+	return testAPI{
+		Server:      server,
+		persistence: persistence,
+		cloudinary:  cloudinary,
+		fakeCloud:   fakeCloud,
+		mailer:      mailer,
+		idp:         idp,
+	}
+}
+
+// do sends a request to the API and returns the response status and body.
+func (api testAPI) do(t *testing.T, method, path string, header http.Header, body string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	require.NoError(t, err, "Expected no error creating request")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := api.Client().Do(req)
+	require.NoError(t, err, "Expected no error sending request")
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	require.NoError(t, err, "Expected no error reading response")
+	return res.StatusCode, resBody
+}
+
+// notify sends a Cloudinary notification signed with the test secret. It uses
+// the unversioned path because that's the notification URL configured in
+// Cloudinary.
+func (api testAPI) notify(t *testing.T, body string) (int, []byte) {
+	t.Helper()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return api.do(t, http.MethodPost, "/images/notification", http.Header{
+		"X-Cld-Timestamp": {timestamp},
+		"X-Cld-Signature": {api.cloudinary.NotificationSignature(body, timestamp)},
+	}, body)
+}
+
+// oidcLogin logs in with the OIDC provider like a browser, following
+// redirects, and returns a client with the session cookie that solves
+// captchas.
+func (api testAPI) oidcLogin(t *testing.T, subject, email string) client.Client {
+	t.Helper()
+	api.idp.SetUser(subject, email)
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err, "Expected no error creating a cookie jar")
+	browser := &http.Client{Jar: jar}
+	res, err := browser.Get(api.URL + apiPrefix + "/login/oidc")
+	require.NoError(t, err, "Expected no error logging in")
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "Expected HTTP 200")
+	assert.Equal(t, "/", res.Request.URL.Path, "Expected a redirect to the site")
+	return client.New(api.URL).
+		WithHTTPClient(browser).
+		WithCaptcha(client.StaticCaptcha(validCaptcha))
+}
+
+type carsResponse struct {
+	Cars []struct {
+		Year     int    `json:"year"`
+		Make     string `json:"make"`
+		Model    string `json:"model"`
+		Color    string `json:"color"`
+		ImageURL string `json:"imageUrl"`
+	} `json:"cars"`
+}
+
+func TestAPIEndToEnd(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		api := newTestAPI(t, db, driver)
+
+		status, _ := api.do(t, http.MethodGet, "/healthz", nil, "")
+		assert.Equal(t, http.StatusOK, status, "Expected the server to be healthy")
+		status, _ = api.do(t, http.MethodGet, "/readyz", nil, "")
+		assert.Equal(t, http.StatusOK, status, "Expected the server to be ready")
+
+		status, body := api.do(t, http.MethodGet, apiPrefix+"/mapkit/token", nil, "")
+		assert.Equal(t, http.StatusOK, status, "Expected a MapKit token")
+		var token struct {
+			Token string `json:"token"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &token), "Expected a JSON body")
+		assert.NotEmpty(t, token.Token, "Expected a MapKit token")
+
+		// The client signs its upload parameters before uploading the image
+		// to Cloudinary.
+		status, body = api.do(t, http.MethodPost, apiPrefix+"/images/signature", nil, `{
+			"parameters": {"public_id": "miata", "timestamp": "1315060510", "upload_preset": "manualsmap_com"},
+			"recaptcha": "`+validCaptcha+`"
+		}`)
+		require.Equal(t, http.StatusOK, status, "Expected the upload to be signed: %s", body)
+		var signature struct {
+			Signature string `json:"signature"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &signature), "Expected a JSON body")
+		assert.Equal(
+			t,
+			api.cloudinary.UploadSignature(map[string]string{
+				"public_id":     "miata",
+				"timestamp":     "1315060510",
+				"upload_preset": "manualsmap_com",
+			}),
+			signature.Signature,
+			"Expected the upload signature to match")
+
+		// Cloudinary notifies the API of the uploaded images. The second
+		// image is never attached to a car.
+		for _, publicID := range []string{"miata", "orphan"} {
+			status, body = api.notify(t, `{"notification_type": "upload", "public_id": "`+publicID+`", "format": "jpg"}`)
+			assert.Equal(t, http.StatusOK, status, "Expected the upload notification to succeed: %s", body)
+		}
+
+		status, body = api.do(t, http.MethodPost, apiPrefix+"/cars", nil, `{
+			"year": 1994,
+			"make": "Mazda",
+			"model": "Miata",
+			"color": "Red",
+			"latitude": 37.7749,
+			"longitude": -122.4194,
+			"recaptcha": "`+validCaptcha+`",
+			"cloudinaryPublicId": "miata"
+		}`)
+		require.Equal(t, http.StatusOK, status, "Expected the car to be submitted: %s", body)
+		var submitted struct {
+			MapBlockID int `json:"mapBlockId"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &submitted), "Expected a JSON body")
+
+		status, body = api.do(
+			t,
+			http.MethodGet,
+			apiPrefix+"/mapblocks?min_latitude=37.7&min_longitude=-122.5&max_latitude=37.8&max_longitude=-122.3",
+			nil,
+			"")
+		assert.Equal(t, http.StatusOK, status, "Expected map blocks: %s", body)
+		var blocks struct {
+			MapBlocks []struct {
+				ID int `json:"id"`
+			} `json:"mapBlocks"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &blocks), "Expected a JSON body")
+		require.Len(t, blocks.MapBlocks, 1, "Expected one map block")
+		assert.Equal(t, submitted.MapBlockID, blocks.MapBlocks[0].ID, "Expected the map block IDs to match")
+
+		carsPath := apiPrefix + "/mapblocks/" + strconv.Itoa(submitted.MapBlockID) + "/cars"
+		status, body = api.do(t, http.MethodGet, carsPath, nil, "")
+		assert.Equal(t, http.StatusOK, status, "Expected cars: %s", body)
+		var cars carsResponse
+		assert.NoError(t, json.Unmarshal(body, &cars), "Expected a JSON body")
+		require.Len(t, cars.Cars, 1, "Expected one car")
+		assert.Equal(t, "red", cars.Cars[0].Color, "Expected the car color to be normalized")
+		assert.Empty(t, cars.Cars[0].ImageURL, "Expected no image before moderation")
+
+		status, body = api.notify(t, `{"notification_type": "moderation", "public_id": "miata", "moderation_status": "approved"}`)
+		assert.Equal(t, http.StatusOK, status, "Expected the moderation notification to succeed: %s", body)
+
+		status, body = api.do(t, http.MethodGet, carsPath, nil, "")
+		assert.Equal(t, http.StatusOK, status, "Expected cars: %s", body)
+		cars = carsResponse{}
+		assert.NoError(t, json.Unmarshal(body, &cars), "Expected a JSON body")
+		require.Len(t, cars.Cars, 1, "Expected one car")
+		assert.Equal(
+			t,
+			api.cloudinary.URL(services.CloudinaryImage{PublicID: "miata", Format: "jpg"}, "").String(),
+			cars.Cars[0].ImageURL,
+			"Expected the approved image URL")
+
+		// The image that was never attached to a car is collected.
+		collector := jobs.NewImageCollector(api.persistence, api.cloudinary, 0, discardLogger)
+		collected, err := collector.Collect(context.Background(), false)
+		assert.NoError(t, err, "Expected no error collecting images")
+		assert.Equal(
+			t,
+			[]services.CloudinaryImage{{PublicID: "orphan", Format: "jpg"}},
+			collected,
+			"Expected only the orphaned image to be collected")
+		assert.Equal(t, []string{"orphan"}, api.fakeCloud.Deleted(), "Expected the orphaned image to be deleted")
+	})
+}
+
+func TestAPIRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		description    string
+		method         string
+		path           string
+		header         http.Header
+		body           string
+		expectedStatus int
+	}{
+		{
+			description:    "Upload signatures with an invalid captcha should be rejected",
+			method:         http.MethodPost,
+			path:           "/images/signature",
+			body:           `{"parameters": {"public_id": "miata"}, "recaptcha": "invalid"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description: "Cars with an invalid captcha should be rejected",
+			method:      http.MethodPost,
+			path:        "/cars",
+			body: `{
+				"year": 1994,
+				"make": "Mazda",
+				"model": "Miata",
+				"color": "red",
+				"latitude": 37.7749,
+				"longitude": -122.4194,
+				"recaptcha": "invalid"
+			}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Cars that don't match the schema should be rejected",
+			method:         http.MethodPost,
+			path:           "/cars",
+			body:           `{"year": 1800, "recaptcha": "` + validCaptcha + `"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description: "Notifications with an invalid signature should be rejected",
+			method:      http.MethodPost,
+			path:        "/images/notification",
+			header: http.Header{
+				"X-Cld-Timestamp": {"1315060510"},
+				"X-Cld-Signature": {"invalid"},
+			},
+			body:           `{"notification_type": "upload", "public_id": "miata", "format": "jpg"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			description:    "Cars in a map block with an invalid ID should be rejected",
+			method:         http.MethodGet,
+			path:           "/mapblocks/abc/cars",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "Map blocks without a bounding box should be rejected",
+			method:         http.MethodGet,
+			path:           "/mapblocks",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "Login emails with an invalid captcha should be rejected",
+			method:         http.MethodPost,
+			path:           apiPrefix + "/login",
+			body:           `{"email": "driver@example.com", "recaptcha": "invalid"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Logins with an unknown token should be rejected",
+			method:         http.MethodPost,
+			path:           apiPrefix + "/login/verify",
+			body:           `{"token": "unknown"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			description:    "The logged in user without a session should be rejected",
+			method:         http.MethodGet,
+			path:           apiPrefix + "/me",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			description:    "The logged in user with an unknown session should be rejected",
+			method:         http.MethodGet,
+			path:           apiPrefix + "/me",
+			header:         http.Header{"Cookie": {"session=unknown"}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	api := newTestAPI(t, dbtest.Open(t, database.SQLite), database.SQLite)
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			status, body := api.do(t, test.method, test.path, test.header, test.body)
+			assert.Equal(t, test.expectedStatus, status, "Expected HTTP status to match: %s", body)
+		})
+	}
+}
+
+// TestRoutesDocumented checks that every registered route is documented in
+// the OpenAPI document and that every documented operation is registered.
+func TestRoutesDocumented(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err, "Expected no error loading the OpenAPI document")
+	documented := make(map[string]bool)
+	for _, endpoint := range doc.Endpoints() {
+		documented[endpoint.Method+" "+endpoint.Path] = true
+	}
+
+	router := newRoutes(routerConfig{
+		metrics: instrumenting.NewDiscard(),
+		logger:  discardLogger,
+	})
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Routes without methods are path prefixes, like the static
+			// file server.
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			// The unversioned routes are aliases of the versioned routes.
+			assert.True(
+				t,
+				documented[method+" "+path] || documented[method+" "+apiPrefix+path],
+				"Expected route %s %s to be documented",
+				method,
+				path)
+		}
+		return nil
+	})
+	require.NoError(t, err, "Expected no error walking routes")
+
+	for _, endpoint := range doc.Endpoints() {
+		req := httptest.NewRequest(endpoint.Method, strings.ReplaceAll(endpoint.Path, "{id}", "1"), nil)
+		var match mux.RouteMatch
+		matched := router.Match(req, &match)
+		if assert.True(t, matched, "Expected %s %s to be registered", endpoint.Method, endpoint.Path) {
+			path, err := match.Route.GetPathTemplate()
+			assert.NoError(t, err, "Expected no error getting the path template")
+			assert.Equal(
+				t,
+				endpoint.Path,
+				path,
+				"Expected %s %s to be registered",
+				endpoint.Method,
+				endpoint.Path)
+		}
+	}
+}
+
+func TestAPIVersioning(t *testing.T) {
+	api := newTestAPI(t, dbtest.Open(t, database.SQLite), database.SQLite)
+
+	status, body := api.do(t, http.MethodGet, apiPrefix+"/openapi.json", nil, "")
+	assert.Equal(t, http.StatusOK, status, "Expected the OpenAPI document")
+	assert.JSONEq(t, string(openapi.Spec()), string(body), "Expected the OpenAPI document to match")
+
+	// The unversioned paths are aliases of the versioned paths.
+	status, versioned := api.do(t, http.MethodGet, apiPrefix+"/cars/schema", nil, "")
+	assert.Equal(t, http.StatusOK, status, "Expected the versioned schema")
+	status, unversioned := api.do(t, http.MethodGet, "/cars/schema", nil, "")
+	assert.Equal(t, http.StatusOK, status, "Expected the unversioned schema")
+	assert.JSONEq(t, string(versioned), string(unversioned), "Expected the schemas to match")
+
+	// Endpoints added after the API was versioned are only served under the
+	// prefix.
+	status, _ = api.do(t, http.MethodGet, apiPrefix+"/me", nil, "")
+	assert.Equal(t, http.StatusUnauthorized, status, "Expected the versioned endpoint")
+	for _, path := range []string{"/me", "/mapblocks/nearby?latitude=0&longitude=0", "/admin/bans"} {
+		status, _ = api.do(t, http.MethodGet, path, nil, "")
+		assert.Equal(t, http.StatusNotFound, status, "Expected no unversioned %s", path)
+	}
+
+	// The operational endpoints aren't versioned.
+	status, _ = api.do(t, http.MethodGet, apiPrefix+"/healthz", nil, "")
+	assert.Equal(t, http.StatusNotFound, status, "Expected no versioned health check")
+}
+
+func TestMetricsRouter(t *testing.T) {
+	api := newTestAPI(t, dbtest.Open(t, database.SQLite), database.SQLite)
+	status, _ := api.do(t, http.MethodGet, "/metrics", nil, "")
+	assert.Equal(t, http.StatusNotFound, status, "Expected no metrics on the API listener")
+
+	recorder := httptest.NewRecorder()
+	newMetricsRouter().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "Expected metrics on the metrics listener")
+}
+
+// TestClient checks that the client package works against the real API.
+func TestClient(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		api := newTestAPI(t, db, driver)
+		c := client.New(api.URL).
+			WithHTTPClient(api.Client()).
+			WithCaptcha(client.StaticCaptcha(validCaptcha))
+		ctx := context.Background()
+
+		token, err := c.MapkitToken(ctx)
+		assert.NoError(t, err, "Expected no error getting a MapKit token")
+		assert.NotEmpty(t, token, "Expected a MapKit token")
+
+		signature, err := c.UploadSignature(ctx, map[string]string{"public_id": "miata"})
+		assert.NoError(t, err, "Expected no error signing the upload")
+		assert.Equal(
+			t,
+			api.cloudinary.UploadSignature(map[string]string{"public_id": "miata"}),
+			signature,
+			"Expected the upload signature to match")
+
+		submitted, err := c.SubmitCar(ctx, apiv1.CarSubmission{
+			Year:      1994,
+			Make:      "Mazda",
+			Model:     "Miata",
+			Color:     "Red",
+			Latitude:  decimal.RequireFromString("37.7749"),
+			Longitude: decimal.RequireFromString("-122.4194"),
+		})
+		require.NoError(t, err, "Expected no error submitting the car")
+		assert.NotEmpty(t, submitted.EditToken, "Expected an edit token")
+		mapBlockID := submitted.MapBlockID
+
+		blocks, err := c.MapBlocks(ctx, apiv1.MapBlocksQuery{
+			MinLatitude:  decimal.RequireFromString("37.7"),
+			MinLongitude: decimal.RequireFromString("-122.5"),
+			MaxLatitude:  decimal.RequireFromString("37.8"),
+			MaxLongitude: decimal.RequireFromString("-122.3"),
+		})
+		assert.NoError(t, err, "Expected no error getting map blocks")
+		require.Len(t, blocks, 1, "Expected one map block")
+		assert.Equal(t, mapBlockID, blocks[0].ID, "Expected the map block IDs to match")
+
+		blocks, err = c.NearbyMapBlocks(ctx, apiv1.NearbyMapBlocksQuery{
+			Latitude:  decimal.RequireFromString("37.76"),
+			Longitude: decimal.RequireFromString("-122.39"),
+			Radius:    5000,
+		})
+		assert.NoError(t, err, "Expected no error getting nearby map blocks")
+		require.Len(t, blocks, 1, "Expected one nearby map block")
+		assert.Equal(t, mapBlockID, blocks[0].ID, "Expected the map block IDs to match")
+
+		cars, err := c.Cars(ctx, mapBlockID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Equal(
+			t,
+			[]apiv1.Car{{ID: submitted.ID, MapBlockID: mapBlockID, Year: 1994, Make: "Mazda", Model: "Miata", Color: "red"}},
+			cars,
+			"Expected cars to match")
+
+		_, err = c.SubmitCar(ctx, apiv1.CarSubmission{Year: 1800})
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "validation_failed", apiErr.Problem.Code, "Expected error codes to match")
+
+		// Move the car to Portland and change its color.
+		color := "Blue"
+		latitude := decimal.RequireFromString("45.5152")
+		longitude := decimal.RequireFromString("-122.6784")
+		update := apiv1.CarUpdate{Color: &color, Latitude: &latitude, Longitude: &longitude}
+		_, err = c.UpdateCar(ctx, submitted.ID, "wrong", update)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "invalid_edit_token", apiErr.Problem.Code, "Expected error codes to match")
+		updated, err := c.UpdateCar(ctx, submitted.ID, submitted.EditToken, update)
+		require.NoError(t, err, "Expected no error updating the car")
+		assert.NotEqual(t, mapBlockID, updated.MapBlockID, "Expected the car to move to another map block")
+
+		cars, err = c.Cars(ctx, updated.MapBlockID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Equal(
+			t,
+			[]apiv1.Car{{
+				ID:         submitted.ID,
+				MapBlockID: updated.MapBlockID,
+				Year:       1994,
+				Make:       "Mazda",
+				Model:      "Miata",
+				Color:      "blue",
+			}},
+			cars,
+			"Expected the updated car")
+
+		require.NoError(t, c.DeleteCar(ctx, submitted.ID, submitted.EditToken), "Expected no error deleting the car")
+		cars, err = c.Cars(ctx, updated.MapBlockID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Empty(t, cars, "Expected deleted cars to be hidden")
+		err = c.DeleteCar(ctx, submitted.ID, submitted.EditToken)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "car_not_found", apiErr.Problem.Code, "Expected error codes to match")
+	})
+}
+
+// TestClientLogin checks logging in with an emailed login link and that cars
+// submitted while logged in are listed for the user.
+func TestClientLogin(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		api := newTestAPI(t, db, driver)
+		newClient := func() client.Client {
+			jar, err := cookiejar.New(nil)
+			require.NoError(t, err, "Expected no error creating a cookie jar")
+			return client.New(api.URL).
+				WithHTTPClient(&http.Client{Jar: jar}).
+				WithCaptcha(client.StaticCaptcha(validCaptcha))
+		}
+		c := newClient()
+		ctx := context.Background()
+		var apiErr *client.Error
+
+		_, err := c.Me(ctx)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "login_required", apiErr.Problem.Code, "Expected error codes to match")
+
+		err = c.RequestLogin(ctx, "Driver <driver@example.com>")
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "validation_failed", apiErr.Problem.Code, "Expected error codes to match")
+
+		require.NoError(t, c.RequestLogin(ctx, "Driver@Example.com"), "Expected no error requesting a login link")
+		token := api.mailer.loginToken(t, "driver@example.com")
+		user, err := c.VerifyLogin(ctx, token)
+		require.NoError(t, err, "Expected no error logging in")
+		assert.Equal(t, "driver@example.com", user.Email, "Expected the email address to be normalized")
+
+		_, err = c.VerifyLogin(ctx, token)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "invalid_login_token", apiErr.Problem.Code, "Expected login tokens to be single-use")
+
+		car := apiv1.CarSubmission{
+			Year:      1994,
+			Make:      "Mazda",
+			Model:     "Miata",
+			Color:     "red",
+			Latitude:  decimal.RequireFromString("37.7749"),
+			Longitude: decimal.RequireFromString("-122.4194"),
+		}
+		submitted, err := c.SubmitCar(ctx, car)
+		require.NoError(t, err, "Expected no error submitting a car while logged in")
+		// Cars submitted without a session aren't linked to the user.
+		_, err = newClient().SubmitCar(ctx, car)
+		require.NoError(t, err, "Expected no error submitting an anonymous car")
+
+		me, err := c.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		assert.Equal(
+			t,
+			apiv1.Me{
+				User: user,
+				Cars: []apiv1.Car{{
+					ID:         submitted.ID,
+					MapBlockID: submitted.MapBlockID,
+					Year:       1994,
+					Make:       "Mazda",
+					Model:      "Miata",
+					Color:      "red",
+				}},
+			},
+			me,
+			"Expected only the car submitted while logged in")
+
+		// Logging in again with the same address logs in as the same user.
+		other := newClient()
+		require.NoError(t, other.RequestLogin(ctx, "driver@example.com"), "Expected no error requesting a login link")
+		otherUser, err := other.VerifyLogin(ctx, api.mailer.loginToken(t, "driver@example.com"))
+		require.NoError(t, err, "Expected no error logging in again")
+		assert.Equal(t, user, otherUser, "Expected the same user")
+
+		require.NoError(t, c.Logout(ctx), "Expected no error logging out")
+		_, err = c.Me(ctx)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "login_required", apiErr.Problem.Code, "Expected to be logged out")
+		_, err = other.Me(ctx)
+		assert.NoError(t, err, "Expected other sessions to stay logged in")
+	})
+}
+
+func TestClientOIDCLogin(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		api := newTestAPI(t, db, driver)
+		ctx := context.Background()
+		var apiErr *client.Error
+
+		admin := api.oidcLogin(t, "alice", "Admin@Example.com")
+		me, err := admin.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		assert.Equal(t, "admin@example.com", me.Email, "Expected the email address to be normalized")
+		assert.Equal(t, "admin", me.Role, "Expected roles granted by email address")
+
+		moderator := api.oidcLogin(t, "moderator", "moderator@example.com")
+		me, err = moderator.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		assert.Equal(t, "moderator", me.Role, "Expected roles granted by subject")
+
+		user := api.oidcLogin(t, "bob", "bob@example.com")
+		me, err = user.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		assert.Equal(t, "user", me.Role, "Expected users without rules to be users")
+
+		// Logging in with an emailed link uses the same account, but never
+		// grants roles.
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err, "Expected no error creating a cookie jar")
+		emailClient := client.New(api.URL).
+			WithHTTPClient(&http.Client{Jar: jar}).
+			WithCaptcha(client.StaticCaptcha(validCaptcha))
+		require.NoError(t, emailClient.RequestLogin(ctx, "admin@example.com"), "Expected no error requesting a login link")
+		emailUser, err := emailClient.VerifyLogin(ctx, api.mailer.loginToken(t, "admin@example.com"))
+		require.NoError(t, err, "Expected no error logging in")
+		adminMe, err := admin.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		assert.Equal(t, adminMe.ID, emailUser.ID, "Expected the same user")
+		assert.Equal(t, "user", emailUser.Role, "Expected no role for emailed link logins")
+
+		// Callbacks without the state cookie are rejected, e.g. when an
+		// attacker tricks a user into opening a callback URL.
+		status, body := api.do(t, http.MethodGet, apiPrefix+"/login/oidc/callback?code=code&state=state", nil, "")
+		assert.Equal(t, http.StatusBadRequest, status, "Expected HTTP 400")
+		var p apiv1.Problem
+		require.NoError(t, json.Unmarshal(body, &p), "Expected a JSON body")
+		assert.Equal(t, "invalid_oidc_state", p.Code, "Expected error codes to match")
+
+		// Logins with unverified email addresses are rejected, including when
+		// the provider doesn't say whether the address is verified.
+		for _, claims := range []jwt.MapClaims{
+			{"sub": "mallory", "email": "admin@example.com", "email_verified": false},
+			{"sub": "mallory", "email": "admin@example.com"},
+		} {
+			api.idp.SetClaims(claims)
+			jar, err = cookiejar.New(nil)
+			require.NoError(t, err, "Expected no error creating a cookie jar")
+			res, err := (&http.Client{Jar: jar}).Get(api.URL + apiPrefix + "/login/oidc")
+			require.NoError(t, err, "Expected no error logging in")
+			res.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "Expected HTTP 401")
+			_, err = client.New(api.URL).WithHTTPClient(&http.Client{Jar: jar}).Me(ctx)
+			require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+			assert.Equal(t, "login_required", apiErr.Problem.Code, "Expected not to be logged in")
+		}
+	})
+}
+
+// TestClientAdmin checks the admin API, which requires roles granted by OIDC
+// logins.
+func TestClientAdmin(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		api := newTestAPI(t, db, driver)
+		ctx := context.Background()
+		var apiErr *client.Error
+		admin := api.oidcLogin(t, "alice", "admin@example.com")
+		moderator := api.oidcLogin(t, "moderator", "moderator@example.com")
+		user := api.oidcLogin(t, "bob", "bob@example.com")
+
+		submit := func(c client.Client, make, model, latitude, longitude string) apiv1.CarSubmitted {
+			t.Helper()
+			submitted, err := c.SubmitCar(ctx, apiv1.CarSubmission{
+				Year:      1994,
+				Make:      make,
+				Model:     model,
+				Color:     "red",
+				Latitude:  decimal.RequireFromString(latitude),
+				Longitude: decimal.RequireFromString(longitude),
+			})
+			require.NoError(t, err, "Expected no error submitting the car")
+			return submitted
+		}
+		keep := submit(user, "Mazda", "Miata", "37.7749", "-122.4194")
+		duplicate := submit(user, "mazda", "miata", "37.7749", "-122.4194")
+		other := submit(user, "MAZDA", "MX-5", "45.5152", "-122.6784")
+
+		err := user.MergeCars(ctx, keep.ID, []int{duplicate.ID})
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "forbidden", apiErr.Problem.Code, "Expected users to be forbidden")
+
+		require.NoError(t, moderator.MergeCars(ctx, keep.ID, []int{duplicate.ID}), "Expected no error merging cars")
+		err = moderator.MergeCars(ctx, keep.ID, []int{duplicate.ID})
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "car_not_found", apiErr.Problem.Code, "Expected merged cars to be deleted")
+
+		require.NoError(t, moderator.MoveCars(ctx, []int{other.ID}, keep.MapBlockID), "Expected no error moving cars")
+		count, err := moderator.RenameCars(ctx, apiv1.CarName{Make: "mazda"}, apiv1.CarName{Make: "Mazda"})
+		require.NoError(t, err, "Expected no error renaming cars")
+		assert.Equal(t, 1, count, "Expected only cars with other names to be renamed")
+		cars, err := user.Cars(ctx, keep.MapBlockID)
+		require.NoError(t, err, "Expected no error getting cars")
+		var names []string
+		for _, car := range cars {
+			names = append(names, car.Make+" "+car.Model)
+		}
+		assert.ElementsMatch(t, []string{"Mazda Miata", "Mazda MX-5"}, names, "Expected the merged, moved and renamed cars")
+
+		_, err = user.CarHistory(ctx, other.ID)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "forbidden", apiErr.Problem.Code, "Expected users to be forbidden")
+		history, err := moderator.CarHistory(ctx, other.ID)
+		require.NoError(t, err, "Expected no error getting the car history")
+		require.NotEmpty(t, history, "Expected the versions before the move and rename")
+		assert.Equal(t, other.MapBlockID, history[0].MapBlockID, "Expected the map block before the move")
+		assert.Equal(t, "MAZDA", history[0].Make, "Expected the make before the rename")
+		history, err = moderator.CarHistory(ctx, duplicate.ID)
+		require.NoError(t, err, "Expected no error getting the car history")
+		require.Len(t, history, 1, "Expected the version before the merge")
+		assert.Equal(t, "delete", history[0].Action, "Expected merged cars to be deleted")
+
+		deleted, err := moderator.DeleteEmptyMapBlocks(ctx)
+		require.NoError(t, err, "Expected no error deleting empty map blocks")
+		assert.Equal(t, []int{other.MapBlockID}, deleted, "Expected the map block the car moved out of to be deleted")
+
+		_, err = moderator.Bans(ctx)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "forbidden", apiErr.Problem.Code, "Expected moderators to be forbidden")
+
+		// Banned users are logged out and can't log in again.
+		me, err := user.Me(ctx)
+		require.NoError(t, err, "Expected no error getting the logged in user")
+		userBan, err := admin.Ban(ctx, apiv1.BanRequest{UserID: me.ID, Reason: "spam"})
+		require.NoError(t, err, "Expected no error banning the user")
+		_, err = user.Me(ctx)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "login_required", apiErr.Problem.Code, "Expected banned users to be logged out")
+		api.idp.SetUser("bob", "bob@example.com")
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err, "Expected no error creating a cookie jar")
+		res, err := (&http.Client{Jar: jar}).Get(api.URL + apiPrefix + "/login/oidc")
+		require.NoError(t, err, "Expected no error logging in")
+		res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode, "Expected banned users to not be able to log in")
+		_, err = admin.Ban(ctx, apiv1.BanRequest{UserID: me.ID, Reason: "spam"})
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "already_banned", apiErr.Problem.Code, "Expected duplicate bans to be rejected")
+
+		// Banned IP addresses can't submit, edit or delete cars.
+		ipBan, err := admin.Ban(ctx, apiv1.BanRequest{IP: "127.0.0.1", Reason: "spam"})
+		require.NoError(t, err, "Expected no error banning the IP address")
+		_, err = moderator.SubmitCar(ctx, apiv1.CarSubmission{
+			Year:      1994,
+			Make:      "Mazda",
+			Model:     "Miata",
+			Color:     "red",
+			Latitude:  decimal.RequireFromString("37.7749"),
+			Longitude: decimal.RequireFromString("-122.4194"),
+		})
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "banned", apiErr.Problem.Code, "Expected banned IP addresses to be rejected")
+		status, body := api.do(t, http.MethodPost, apiPrefix+"/cars", nil, `{
+			"year": 1994,
+			"make": "Mazda",
+			"model": "Miata",
+			"color": "red",
+			"latitude": 37.7749,
+			"longitude": -122.4194,
+			"recaptcha": "invalid"
+		}`)
+		var problem apiv1.Problem
+		require.NoError(t, json.Unmarshal(body, &problem), "Expected a JSON body")
+		assert.Equal(t, http.StatusForbidden, status, "Expected HTTP 403")
+		assert.Equal(t, "banned", problem.Code, "Expected bans to be checked before the captcha")
+		year := 1995
+		_, err = user.UpdateCar(ctx, keep.ID, keep.EditToken, apiv1.CarUpdate{Year: &year})
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "banned", apiErr.Problem.Code, "Expected banned IP addresses to not edit cars")
+		err = user.DeleteCar(ctx, keep.ID, keep.EditToken)
+		require.True(t, errors.As(err, &apiErr), "Expected an API error, got %v", err)
+		assert.Equal(t, "banned", apiErr.Problem.Code, "Expected banned IP addresses to not delete cars")
+		require.NoError(t, admin.Unban(ctx, ipBan.ID), "Expected no error lifting the ban")
+		submit(moderator, "Mazda", "Miata", "37.7749", "-122.4194")
+
+		bans, err := admin.Bans(ctx)
+		require.NoError(t, err, "Expected no error getting bans")
+		assert.Equal(t, []apiv1.Ban{userBan}, bans, "Expected only the user ban")
+
+		actions, err := admin.AdminActions(ctx, apiv1.AdminActionsQuery{})
+		require.NoError(t, err, "Expected no error getting admin actions")
+		names = nil
+		for _, action := range actions {
+			names = append(names, action.Action)
+		}
+		assert.Equal(
+			t,
+			[]string{"unban", "ban", "ban", "delete_empty_map_blocks", "rename_cars", "move_cars", "merge_cars"},
+			names,
+			"Expected every admin action, newest first")
+		assert.Equal(t, "moderator@example.com", actions[len(actions)-1].UserEmail, "Expected the moderator")
+
+		page, err := admin.AdminActions(ctx, apiv1.AdminActionsQuery{Before: actions[1].ID, Limit: 2})
+		require.NoError(t, err, "Expected no error getting admin actions")
+		assert.Equal(t, actions[2:4], page, "Expected the next page")
+	})
+}
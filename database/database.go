@@ -0,0 +1,90 @@
+// Package database opens the SQL database selected by a connection string and
+// smooths over the differences between the supported drivers.
+package database
+
+import (
+	"database/sql"
+	"net/url"
+	"regexp"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// Driver identifies the kind of database behind a *sql.DB.
+type Driver string
+
+const (
+	// Postgres is the default driver, used for connection strings with a
+	// postgres:// or postgresql:// scheme and for key=value connection strings.
+	Postgres Driver = "postgres"
+	// SQLite is used for connection strings with a sqlite:// scheme, e.g.
+	// sqlite:///var/lib/manualsmap/manualsmap.db. It is intended for
+	// single-instance deployments and local development.
+	SQLite Driver = "sqlite"
+)
+
+// sqliteParams are appended to every SQLite connection string. Foreign keys
+// are off by default in SQLite, and immediate transactions take the write lock
+// up front so concurrent transactions wait for the busy timeout instead of
+// failing when they try to write.
+var sqliteParams = url.Values{
+	"_foreign_keys": {"1"},
+	"_busy_timeout": {"5000"},
+	"_journal_mode": {"WAL"},
+	"_txlock":       {"immediate"},
+}
+
+// Open opens the database described by conn. Like sql.Open, it doesn't
+// connect to the database.
+func Open(conn string) (*sql.DB, Driver, error) {
+	scheme, rest, ok := strings.Cut(conn, "://")
+	if !ok {
+		// lib/pq also accepts "host=localhost dbname=manualsmap" style
+		// connection strings, which have no scheme.
+		scheme = string(Postgres)
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		db, err := sql.Open("postgres", conn)
+		return db, Postgres, errors.WithMessage(err, "error opening Postgres DB")
+	case "sqlite":
+		path, query, _ := strings.Cut(rest, "?")
+		if path == "" {
+			return nil, "", errors.New("SQLite connection string must include a file path")
+		}
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, "", errors.WithMessage(err, "invalid SQLite connection string parameters")
+		}
+		for key, values := range sqliteParams {
+			if _, ok := params[key]; !ok {
+				params[key] = values
+			}
+		}
+		db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+		if err != nil {
+			return nil, "", errors.WithMessage(err, "error opening SQLite DB")
+		}
+		if path == ":memory:" {
+			// Every connection to :memory: opens a new, empty database.
+			db.SetMaxOpenConns(1)
+		}
+		return db, SQLite, nil
+	}
+	return nil, "", errors.Errorf("unsupported database connection string scheme %q", scheme)
+}
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// Rebind rewrites the Postgres style $1 placeholders in query for the driver.
+// SQLite numbers "$" placeholders in the order they first appear, so they are
+// rewritten to "?1" placeholders, which SQLite numbers explicitly.
+func (d Driver) Rebind(query string) string {
+	if d != SQLite {
+		return query
+	}
+	return placeholder.ReplaceAllString(query, "?$1")
+}
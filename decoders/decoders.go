@@ -0,0 +1,145 @@
+// Package decoders provides helpers for decoding HTTP requests that map client
+// mistakes to HTTP 4xx JSONErrors, reserving HTTP 5xx for server faults.
+package decoders
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/schema"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+)
+
+// ReadBody reads the entire HTTP request body, returning an HTTP 413 error if
+// the body is larger than maxBytes.
+func ReadBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	defer r.Body.Close()
+
+	// Read one byte more than the limit to detect oversized bodies.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, encoders.NewJSONError(
+			errors.WithMessage(err, "error reading body"),
+			http.StatusBadRequest,
+			"read_body_failed",
+			"failed to read HTTP body")
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, encoders.NewJSONError(
+			nil,
+			http.StatusRequestEntityTooLarge,
+			"body_too_large",
+			"request body is too large")
+	}
+	return body, nil
+}
+
+// DecodeJSONBody reads the HTTP request body and unmarshals it into v,
+// returning HTTP 4xx errors for oversized, malformed or invalid bodies. If
+// strict is true, fields that are not present in v are rejected.
+func DecodeJSONBody(r *http.Request, maxBytes int64, strict bool, v interface{}) error {
+	body, err := ReadBody(r, maxBytes)
+	if err != nil {
+		return err
+	}
+	return UnmarshalJSON(body, strict, v)
+}
+
+// UnmarshalJSON unmarshals the JSON body into v, returning HTTP 400 errors for
+// malformed or invalid bodies. If strict is true, fields that are not present
+// in v are rejected.
+func UnmarshalJSON(body []byte, strict bool, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return encoders.NewValidationError(
+			"request body does not match schema",
+			[]encoders.FieldError{{
+				Pointer: encoders.JSONPointer(strings.Split(typeErr.Field, ".")...),
+				Keyword: "type",
+				Message: "Invalid type. Expected: " + typeErr.Type.String() + ", given: " + typeErr.Value,
+			}})
+	}
+	// The JSON decoder doesn't export an error type for unknown fields, so
+	// match the error message instead.
+	const unknownFieldPrefix = `json: unknown field "`
+	if msg := err.Error(); strings.HasPrefix(msg, unknownFieldPrefix) {
+		field := strings.TrimSuffix(strings.TrimPrefix(msg, unknownFieldPrefix), `"`)
+		return encoders.NewValidationError(
+			"request body does not match schema",
+			[]encoders.FieldError{{
+				Pointer: encoders.JSONPointer(field),
+				Keyword: "additionalProperties",
+				Message: "Additional property " + field + " is not allowed",
+			}})
+	}
+	return encoders.NewJSONError(
+		errors.WithMessage(err, "error unmarshalling JSON body"),
+		http.StatusBadRequest,
+		"invalid_json",
+		"request body is not valid JSON")
+}
+
+var queryDecoder = schema.NewDecoder()
+
+// DecodeQuery decodes the URL query parameters into v using the "schema"
+// struct tags, returning an HTTP 400 error listing every missing, invalid or
+// unknown parameter.
+func DecodeQuery(query url.Values, v interface{}) error {
+	err := queryDecoder.Decode(v, query)
+	if err == nil {
+		return nil
+	}
+	multiErr, ok := err.(schema.MultiError)
+	if !ok {
+		return encoders.NewJSONError(
+			errors.WithMessage(err, "error decoding query parameters"),
+			http.StatusBadRequest,
+			"invalid_query",
+			"invalid query parameters")
+	}
+
+	fieldErrors := make([]encoders.FieldError, 0, len(multiErr))
+	for key, err := range multiErr {
+		fieldErr := encoders.FieldError{Pointer: encoders.JSONPointer(key)}
+		switch e := err.(type) {
+		case schema.EmptyFieldError:
+			fieldErr.Keyword = "required"
+			fieldErr.Message = key + " is required"
+		case schema.ConversionError:
+			fieldErr.Keyword = "type"
+			fieldErr.Message = "Invalid value for " + key
+			if e.Err != nil {
+				fieldErr.Message += ": " + e.Err.Error()
+			}
+		case schema.UnknownKeyError:
+			fieldErr.Keyword = "additionalProperties"
+			fieldErr.Message = "Unknown query parameter " + key
+		default:
+			fieldErr.Keyword = "invalid"
+			fieldErr.Message = err.Error()
+		}
+		fieldErrors = append(fieldErrors, fieldErr)
+	}
+	// Sort the errors so responses are deterministic.
+	sort.Slice(fieldErrors, func(i, j int) bool {
+		return fieldErrors[i].Pointer < fieldErrors[j].Pointer
+	})
+	return encoders.NewValidationError("invalid query parameters", fieldErrors)
+}
@@ -4,8 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/requestid"
 )
 
 // EmptyResponseEncoder returns a response with code HTTP 200 and no body.
@@ -14,6 +20,12 @@ func EmptyResponseEncoder(_ context.Context, writer http.ResponseWriter, _ inter
 	return nil
 }
 
+// NoContentResponseEncoder returns a response with code HTTP 204 and no body.
+func NoContentResponseEncoder(_ context.Context, writer http.ResponseWriter, _ interface{}) error {
+	writer.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 // JSONResponseEncoder returns a response with a JSON-serialized response body.
 // If the response implements httptransport.StatusCoder, the provided HTTP
 // status code is used, otherwise code HTTP 200 is used.
@@ -27,29 +39,197 @@ func JSONResponseEncoder(_ context.Context, writer http.ResponseWriter, response
 	return json.NewEncoder(writer).Encode(response)
 }
 
+// JSONErrorEncoder returns an error response with an RFC 7807 "problem
+// details" JSON body. The internal cause of the error is never returned to the
+// client, only the request ID that it's logged with. If the error doesn't
+// wrap a JSONError, code HTTP 500 is used.
+func JSONErrorEncoder(ctx context.Context, err error, writer http.ResponseWriter) {
+	var jsonErr JSONError
+	var e *JSONError
+	if errors.As(err, &e) {
+		jsonErr = *e
+	} else {
+		jsonErr = JSONError{
+			cause:      err,
+			statusCode: http.StatusInternalServerError,
+			code:       "internal_error",
+			message:    "internal server error",
+		}
+	}
+	jsonErr.requestID = requestid.FromContext(ctx)
+
+	for key, values := range jsonErr.Headers() {
+		for _, value := range values {
+			writer.Header().Add(key, value)
+		}
+	}
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.WriteHeader(jsonErr.StatusCode())
+	json.NewEncoder(writer).Encode(jsonErr)
+}
+
+// FieldError describes a single invalid field in a request.
+type FieldError = apiv1.FieldError
+
+// JSONError is an error that is returned to clients as a JSON response. It
+// separates the stable error code and public message, which are returned to
+// the client, from the internal cause, which is only logged.
 type JSONError struct {
-	error
-	statusCode int
+	cause       error
+	statusCode  int
+	code        string
+	message     string
+	headers     http.Header
+	fieldErrors []FieldError
+	requestID   string
+}
+
+// NewJSONError returns a JSONError with the given HTTP status code, stable
+// error code and public message. The cause may contain internal details like
+// database errors and is never returned to the client. If the cause is nil,
+// the public message is used as the cause.
+func NewJSONError(cause error, statusCode int, code, message string) error {
+	return NewJSONErrorWithHeaders(cause, statusCode, code, message, nil)
+}
+
+// NewJSONErrorWithHeaders returns a JSONError that also sets the given
+// headers on the HTTP response.
+func NewJSONErrorWithHeaders(
+	cause error,
+	statusCode int,
+	code,
+	message string,
+	headers http.Header,
+) error {
+	if cause == nil {
+		cause = errors.New(message)
+	}
+	return &JSONError{
+		cause:      cause,
+		statusCode: statusCode,
+		code:       code,
+		message:    message,
+		headers:    headers,
+	}
 }
 
-func NewJSONError(err error, statusCode int) error {
-	if err == nil {
-		return nil
+// NewValidationError returns an HTTP 400 JSONError that lists every invalid
+// field in the request.
+func NewValidationError(message string, fieldErrors []FieldError) error {
+	return &JSONError{
+		cause:       errors.New(message),
+		statusCode:  http.StatusBadRequest,
+		code:        "validation_failed",
+		message:     message,
+		fieldErrors: fieldErrors,
 	}
-	return &JSONError{err, statusCode}
+}
+
+func (err JSONError) Error() string {
+	return err.code + ": " + err.cause.Error()
+}
+
+func (err JSONError) Unwrap() error {
+	return err.cause
 }
 
 func (err JSONError) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Err string `json:"err"`
-	}{
-		Err: err.Error(),
+	statusCode := err.StatusCode()
+	return json.Marshal(apiv1.Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Code:      err.code,
+		Detail:    err.message,
+		RequestID: err.requestID,
+		Errors:    err.fieldErrors,
 	})
 }
 
+func (err JSONError) Headers() http.Header {
+	return err.headers
+}
+
 func (err JSONError) StatusCode() int {
 	if err.statusCode < 100 || err.statusCode >= 600 {
 		return http.StatusInternalServerError
 	}
 	return err.statusCode
 }
+
+func (err JSONError) Code() string {
+	return err.code
+}
+
+func (err JSONError) FieldErrors() []FieldError {
+	return err.fieldErrors
+}
+
+// schemaKeywords maps gojsonschema error types to the JSON schema keyword
+// that failed validation.
+var schemaKeywords = map[string]string{
+	"invalid_type":                    "type",
+	"number_gte":                      "minimum",
+	"number_gt":                       "exclusiveMinimum",
+	"number_lte":                      "maximum",
+	"number_lt":                       "exclusiveMaximum",
+	"string_gte":                      "minLength",
+	"string_lte":                      "maxLength",
+	"array_min_items":                 "minItems",
+	"array_max_items":                 "maxItems",
+	"array_min_properties":            "minProperties",
+	"array_max_properties":            "maxProperties",
+	"additional_property_not_allowed": "additionalProperties",
+	"multiple_of":                     "multipleOf",
+	"unique":                          "uniqueItems",
+	"number_one_of":                   "oneOf",
+	"number_any_of":                   "anyOf",
+	"number_all_of":                   "allOf",
+	"number_not":                      "not",
+}
+
+// SchemaFieldErrors converts JSON schema validation errors to FieldErrors.
+func SchemaFieldErrors(errs []gojsonschema.ResultError) []FieldError {
+	fieldErrors := make([]FieldError, 0, len(errs))
+	for _, err := range errs {
+		// Join the context with a delimiter that can't appear in JSON keys so
+		// keys containing "." or "/" are preserved.
+		var tokens []string
+		for _, token := range strings.Split(err.Context().String("\x00"), "\x00") {
+			if token != gojsonschema.STRING_CONTEXT_ROOT {
+				tokens = append(tokens, token)
+			}
+		}
+		// Required and additional property errors are reported on the parent
+		// object, so add the property to the pointer.
+		switch err.Type() {
+		case "required", "additional_property_not_allowed":
+			if property, ok := err.Details()["property"].(string); ok {
+				tokens = append(tokens, property)
+			}
+		}
+		keyword, ok := schemaKeywords[err.Type()]
+		if !ok {
+			keyword = err.Type()
+		}
+		fieldErrors = append(fieldErrors, FieldError{
+			Pointer: JSONPointer(tokens...),
+			Keyword: keyword,
+			Message: err.Description(),
+		})
+	}
+	return fieldErrors
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// JSONPointer returns an RFC 6901 JSON pointer to the field identified by the
+// given reference tokens.
+func JSONPointer(tokens ...string) string {
+	var buf strings.Builder
+	for _, token := range tokens {
+		buf.WriteByte('/')
+		buf.WriteString(pointerEscaper.Replace(token))
+	}
+	return buf.String()
+}
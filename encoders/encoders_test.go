@@ -0,0 +1,155 @@
+package encoders
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/matthewdale/manualsmap.com/requestid"
+)
+
+func TestSchemaFieldErrors(t *testing.T) {
+	schema := gojsonschema.NewGoLoader(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"year": map[string]interface{}{
+				"type":    "number",
+				"maximum": 2100,
+			},
+			"make": map[string]interface{}{
+				"type":      "string",
+				"minLength": 2,
+			},
+			"a/b": map[string]interface{}{
+				"type": "string",
+			},
+		},
+		"required": []string{"model"},
+	})
+	document := gojsonschema.NewGoLoader(map[string]interface{}{
+		"year": 3000,
+		"make": "x",
+		"a/b":  1,
+	})
+	result, err := gojsonschema.Validate(schema, document)
+	assert.NoError(t, err, "Expected no error validating document")
+
+	actual := SchemaFieldErrors(result.Errors())
+	pointers := make(map[string]string)
+	for _, fieldErr := range actual {
+		pointers[fieldErr.Pointer] = fieldErr.Keyword
+		assert.NotEmpty(t, fieldErr.Message, "Expected a message for %s", fieldErr.Pointer)
+	}
+	assert.Equal(
+		t,
+		map[string]string{
+			"/year":  "maximum",
+			"/make":  "minLength",
+			"/a~1b":  "type",
+			"/model": "required",
+		},
+		pointers,
+		"Expected every violation to be reported")
+}
+
+func TestJSONErrorEncoder(t *testing.T) {
+	tests := []struct {
+		description    string
+		err            error
+		expectedStatus int
+		expectedBody   map[string]interface{}
+	}{
+		{
+			description:    "Should encode validation errors as problem details",
+			err:            NewValidationError("invalid body", []FieldError{{Pointer: "/year", Keyword: "maximum", Message: "too big"}}),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody: map[string]interface{}{
+				"type":      "about:blank",
+				"title":     "Bad Request",
+				"status":    float64(400),
+				"code":      "validation_failed",
+				"detail":    "invalid body",
+				"requestId": "abcd",
+				"errors": []interface{}{
+					map[string]interface{}{
+						"pointer": "/year",
+						"keyword": "maximum",
+						"message": "too big",
+					},
+				},
+			},
+		},
+		{
+			description: "Should not return the internal cause",
+			err: NewJSONError(
+				errors.New(`pq: relation "cars" does not exist`),
+				http.StatusInternalServerError,
+				"cars_failed",
+				"error getting cars"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody: map[string]interface{}{
+				"type":      "about:blank",
+				"title":     "Internal Server Error",
+				"status":    float64(500),
+				"code":      "cars_failed",
+				"detail":    "error getting cars",
+				"requestId": "abcd",
+			},
+		},
+		{
+			description: "Should encode wrapped JSON errors",
+			err: errors.WithMessage(
+				NewJSONError(nil, http.StatusNotFound, "car_not_found", "car not found"),
+				"error updating car"),
+			expectedStatus: http.StatusNotFound,
+			expectedBody: map[string]interface{}{
+				"type":      "about:blank",
+				"title":     "Not Found",
+				"status":    float64(404),
+				"code":      "car_not_found",
+				"detail":    "car not found",
+				"requestId": "abcd",
+			},
+		},
+		{
+			description:    "Non-JSON errors should be encoded as HTTP 500",
+			err:            errors.New("unexpected"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody: map[string]interface{}{
+				"type":      "about:blank",
+				"title":     "Internal Server Error",
+				"status":    float64(500),
+				"code":      "internal_error",
+				"detail":    "internal server error",
+				"requestId": "abcd",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			ctx := requestid.NewContext(context.Background(), "abcd")
+			JSONErrorEncoder(ctx, test.err, recorder)
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+			assert.Equal(
+				t,
+				"application/problem+json",
+				recorder.Header().Get("Content-Type"),
+				"Expected problem details content type")
+
+			var body map[string]interface{}
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body), "Expected a JSON body")
+			assert.Equal(t, test.expectedBody, body, "Expected bodies to match")
+		})
+	}
+}
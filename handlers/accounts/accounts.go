@@ -0,0 +1,347 @@
+package accounts
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/decoders"
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
+	"github.com/matthewdale/manualsmap.com/middlewares"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// maxBodyBytes is the maximum number of bytes that are read from the HTTP
+// POST body into memory. The login request bodies are tiny.
+const maxBodyBytes = 64 * 1024
+
+type postLoginRequest struct {
+	apiv1.LoginRequest
+	remoteIP string
+}
+
+func (req postLoginRequest) CaptchaResponse() string {
+	return req.Recaptcha
+}
+
+func (req postLoginRequest) RemoteIP() string {
+	return req.remoteIP
+}
+
+func (req postLoginRequest) EmailKey() string {
+	return services.EmailKey(req.Email)
+}
+
+func postLoginEndpoint(accounts services.Accounts, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		err := accounts.SendLoginLink(ctx, request.(postLoginRequest).Email)
+		if err == services.ErrInvalidEmail {
+			return nil, encoders.NewValidationError(
+				"invalid email address",
+				[]encoders.FieldError{{
+					Pointer: encoders.JSONPointer("email"),
+					Keyword: "format",
+					Message: "must be an email address like user@example.com",
+				}})
+		}
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error sending login link"),
+				http.StatusInternalServerError,
+				"login_email_failed",
+				"error sending login email")
+		}
+		metrics.Logins.With("step", "link_sent").Add(1)
+		return nil, nil
+	}
+}
+
+func postLoginDecoder(resolver clientip.Resolver) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		var req postLoginRequest
+		if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+			return nil, err
+		}
+		ip, err := resolver.Resolve(r)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "failed to get remote IP"),
+				http.StatusInternalServerError,
+				"remote_ip_failed",
+				"failed to get remote IP")
+		}
+		req.remoteIP = ip
+		return req, nil
+	}
+}
+
+// emailLoginEnabled rejects requests with HTTP 404 if email login is disabled
+// because no mailer is configured. It runs before the other middlewares, so
+// requests don't use up captcha verifications or rate limits.
+func emailLoginEnabled(accounts services.Accounts) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if !accounts.EmailLoginEnabled() {
+				return nil, encoders.NewJSONError(
+					nil,
+					http.StatusNotFound,
+					"email_login_disabled",
+					"email login isn't configured")
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// PostLoginHandler emails a login link to the requested address. Requests are
+// rate limited by IP and require a captcha so the API can't be used to send
+// spam. They're also rate limited by address so that no one can flood an inbox
+// from many IPs. The address limit is checked after the captcha, so requests
+// without a valid captcha don't use it up. Banned client IP addresses can't
+// request login links. It returns HTTP 404 if email login is disabled.
+func PostLoginHandler(
+	accounts services.Accounts,
+	bans middlewares.BanChecker,
+	verifier services.CaptchaVerifier,
+	limits services.RateLimitStore,
+	ipLimit services.RateLimit,
+	emailLimit services.RateLimit,
+	resolver clientip.Resolver,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("post_login"),
+			instrumenting.Endpoint(metrics, "post_login"),
+			emailLoginEnabled(accounts),
+			middlewares.BanEnforcer(bans),
+			middlewares.IPRateLimiter(limits, "login", ipLimit),
+			middlewares.CaptchaValidator(verifier),
+			middlewares.EmailRateLimiter(limits, "login", emailLimit),
+		)(postLoginEndpoint(accounts, metrics)),
+		postLoginDecoder(resolver),
+		encoders.NoContentResponseEncoder,
+		options...,
+	)
+}
+
+func bannedError(err error) error {
+	return encoders.NewJSONError(err, http.StatusForbidden, "banned", "you are banned")
+}
+
+func newUserResponse(user services.User) apiv1.User {
+	return apiv1.User{ID: user.ID, Email: user.Email, Role: string(user.Role)}
+}
+
+// loginResponse is the logged in user and their new session, which is
+// returned in the session cookie.
+type loginResponse struct {
+	user    apiv1.User
+	session services.Session
+}
+
+func postLoginVerifyEndpoint(accounts services.Accounts, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		user, session, err := accounts.Login(ctx, request.(apiv1.LoginVerification).Token)
+		if err == services.ErrInvalidLoginToken {
+			return nil, encoders.NewJSONError(
+				err,
+				http.StatusBadRequest,
+				"invalid_login_token",
+				"login link is invalid, expired or was already used")
+		}
+		if err == services.ErrBanned {
+			return nil, bannedError(err)
+		}
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error logging in"),
+				http.StatusInternalServerError,
+				"login_failed",
+				"error logging in")
+		}
+		metrics.Logins.With("step", "login").Add(1)
+		return loginResponse{
+			user:    newUserResponse(user),
+			session: session,
+		}, nil
+	}
+}
+
+func postLoginVerifyDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.LoginVerification
+	if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Token) == "" {
+		return nil, encoders.NewValidationError(
+			"missing login token",
+			[]encoders.FieldError{{
+				Pointer: encoders.JSONPointer("token"),
+				Keyword: "required",
+				Message: "token is required",
+			}})
+	}
+	return req, nil
+}
+
+// loginResponseEncoder sets the session cookie and returns the logged in user.
+func loginResponseEncoder(secureCookies bool) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, writer http.ResponseWriter, response interface{}) error {
+		res := response.(loginResponse)
+		http.SetCookie(writer, sessions.NewCookie(res.session, secureCookies))
+		return encoders.JSONResponseEncoder(ctx, writer, res.user)
+	}
+}
+
+// PostLoginVerifyHandler exchanges the login token from a login link for a
+// session, which is returned in the session cookie. Session cookies are only
+// sent over HTTPS if secureCookies is true. It returns HTTP 404 if email login
+// is disabled.
+func PostLoginVerifyHandler(
+	accounts services.Accounts,
+	secureCookies bool,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("post_login_verify"),
+			instrumenting.Endpoint(metrics, "post_login_verify"),
+			emailLoginEnabled(accounts),
+		)(postLoginVerifyEndpoint(accounts, metrics)),
+		postLoginVerifyDecoder,
+		loginResponseEncoder(secureCookies),
+		options...,
+	)
+}
+
+func postLogoutEndpoint(accounts services.Accounts, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		token := sessions.TokenFromContext(ctx)
+		if token == "" {
+			return nil, nil
+		}
+		if err := accounts.Logout(ctx, token); err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error logging out"),
+				http.StatusInternalServerError,
+				"logout_failed",
+				"error logging out")
+		}
+		metrics.Logins.With("step", "logout").Add(1)
+		return nil, nil
+	}
+}
+
+// logoutResponseEncoder deletes the session cookie.
+func logoutResponseEncoder(secureCookies bool) httptransport.EncodeResponseFunc {
+	return func(ctx context.Context, writer http.ResponseWriter, response interface{}) error {
+		http.SetCookie(writer, sessions.ExpiredCookie(secureCookies))
+		return encoders.NoContentResponseEncoder(ctx, writer, response)
+	}
+}
+
+// PostLogoutHandler ends the session in the session cookie, if any, and
+// deletes the cookie.
+func PostLogoutHandler(
+	accounts services.Accounts,
+	secureCookies bool,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerBefore(sessions.ContextFromCookie),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("post_logout"),
+			instrumenting.Endpoint(metrics, "post_logout"),
+		)(postLogoutEndpoint(accounts, metrics)),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+		logoutResponseEncoder(secureCookies),
+		options...,
+	)
+}
+
+func getMeEndpoint(persistence services.Persistence, cloudinary services.Cloudinary) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		// The Authenticator middleware rejects requests without a user.
+		user, _ := sessions.UserFromContext(ctx)
+		cars, err := persistence.GetUserCars(ctx, user.ID)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error getting user cars"),
+				http.StatusInternalServerError,
+				"cars_failed",
+				"error getting cars")
+		}
+
+		carResponses := make([]apiv1.Car, 0, len(cars))
+		for _, car := range cars {
+			carResponses = append(carResponses, apiv1.Car{
+				ID:           car.ID,
+				MapBlockID:   car.MapBlockID,
+				Year:         car.Year,
+				Make:         car.Make,
+				Model:        car.Model,
+				Trim:         car.Trim,
+				Color:        car.Color,
+				ImageURL:     cloudinary.URL(car.Image, "").String(),
+				ThumbnailURL: cloudinary.URL(car.Image, "c_limit,w_300").String(),
+			})
+		}
+		return apiv1.Me{
+			User: newUserResponse(user),
+			Cars: carResponses,
+		}, nil
+	}
+}
+
+// GetMeHandler returns the logged in user and the cars they submitted. It
+// requires a session cookie.
+func GetMeHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	cloudinary services.Cloudinary,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerBefore(sessions.ContextFromCookie),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("get_me"),
+			instrumenting.Endpoint(metrics, "get_me"),
+			middlewares.Authenticator(accounts, true),
+		)(getMeEndpoint(persistence, cloudinary)),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+		encoders.JSONResponseEncoder,
+		options...,
+	)
+}
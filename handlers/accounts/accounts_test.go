@@ -0,0 +1,261 @@
+package accounts
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestPostLoginVerifyHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description  string
+		body         string
+		expectedCode string
+	}{
+		{
+			description:  "Malformed JSON should return HTTP 400",
+			body:         `{"token": `,
+			expectedCode: "invalid_json",
+		},
+		{
+			description:  "Missing tokens should return HTTP 400",
+			body:         `{"token": " "}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Unknown fields should return HTTP 400",
+			body:         `{"token": "token", "email": "driver@example.com"}`,
+			expectedCode: "validation_failed",
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Accounts service.
+	handler := PostLoginVerifyHandler(services.Accounts{}, true, instrumenting.NewDiscard(), discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/login/verify", strings.NewReader(test.body)))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+			assert.Empty(t, recorder.Result().Cookies(), "Expected no session cookie")
+
+			var p apiv1.Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+			assert.Equal(t, test.expectedCode, p.Code, "Expected error codes to match")
+		})
+	}
+}
+
+func TestPostLogoutHandlerWithoutSession(t *testing.T) {
+	// Logging out without a session doesn't reach the database.
+	handler := PostLogoutHandler(services.Accounts{}, true, instrumenting.NewDiscard(), discardLogger)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/logout", nil))
+	assert.Equal(t, http.StatusNoContent, recorder.Code, "Expected HTTP 204")
+
+	cookies := recorder.Result().Cookies()
+	require.Len(t, cookies, 1, "Expected the session cookie to be deleted")
+	assert.Equal(t, sessions.CookieName, cookies[0].Name, "Expected cookie names to match")
+	assert.Empty(t, cookies[0].Value, "Expected an empty session cookie")
+	assert.True(t, cookies[0].MaxAge < 0, "Expected the cookie to expire immediately")
+	assert.True(t, cookies[0].Secure, "Expected a secure cookie")
+	assert.True(t, cookies[0].HttpOnly, "Expected an HttpOnly cookie")
+}
+
+func TestGetMeHandlerWithoutSession(t *testing.T) {
+	handler := GetMeHandler(
+		services.Accounts{},
+		services.Persistence{},
+		services.Cloudinary{},
+		instrumenting.NewDiscard(),
+		discardLogger)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/me", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code, "Expected HTTP 401")
+
+	var p apiv1.Problem
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+	assert.Equal(t, "login_required", p.Code, "Expected error codes to match")
+}
+
+func TestEmailLoginHandlersDisabled(t *testing.T) {
+	tests := []struct {
+		description string
+		handler     http.Handler
+		path        string
+		body        string
+	}{
+		{
+			description: "Requesting login links should return HTTP 404 if email login is disabled",
+			handler: PostLoginHandler(
+				services.Accounts{},
+				services.Persistence{},
+				services.FixedVerifier(false),
+				nil,
+				services.RateLimit{},
+				services.RateLimit{},
+				clientip.Resolver{},
+				instrumenting.NewDiscard(),
+				discardLogger),
+			path: "/login",
+			body: `{"email": "driver@example.com", "recaptcha": "token"}`,
+		},
+		{
+			description: "Verifying login links should return HTTP 404 if email login is disabled",
+			handler:     PostLoginVerifyHandler(services.Accounts{}, true, instrumenting.NewDiscard(), discardLogger),
+			path:        "/login/verify",
+			body:        `{"token": "token"}`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			test.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body)))
+			assert.Equal(t, http.StatusNotFound, recorder.Code, "Expected HTTP 404")
+
+			var p apiv1.Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+			assert.Equal(t, "email_login_disabled", p.Code, "Expected error codes to match")
+		})
+	}
+}
+
+func TestOIDCHandlersDisabled(t *testing.T) {
+	tests := []struct {
+		description string
+		handler     http.Handler
+		path        string
+	}{
+		{
+			description: "Starting OIDC logins should return HTTP 404 if OIDC is disabled",
+			handler:     GetLoginOIDCHandler(nil, true, instrumenting.NewDiscard(), discardLogger),
+			path:        "/login/oidc",
+		},
+		{
+			description: "OIDC callbacks should return HTTP 404 if OIDC is disabled",
+			handler: GetLoginOIDCCallbackHandler(
+				services.Accounts{},
+				nil,
+				true,
+				instrumenting.NewDiscard(),
+				discardLogger),
+			path: "/login/oidc/callback?code=code&state=state",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "state"})
+			recorder := httptest.NewRecorder()
+			test.handler.ServeHTTP(recorder, r)
+			assert.Equal(t, http.StatusNotFound, recorder.Code, "Expected HTTP 404")
+
+			var p apiv1.Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+			assert.Equal(t, "oidc_disabled", p.Code, "Expected error codes to match")
+		})
+	}
+}
+
+func TestGetLoginOIDCCallbackHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description    string
+		query          string
+		cookie         string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			description:    "Missing state cookies should return HTTP 400",
+			query:          "code=code&state=state",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_oidc_state",
+		},
+		{
+			description:    "Mismatched states should return HTTP 400",
+			query:          "code=code&state=other",
+			cookie:         "state",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_oidc_state",
+		},
+		{
+			description:    "Missing states should return HTTP 400",
+			query:          "code=code",
+			cookie:         "state",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_oidc_state",
+		},
+		{
+			description:    "Missing codes should return HTTP 400",
+			query:          "state=state",
+			cookie:         "state",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_oidc_state",
+		},
+		{
+			description:    "Provider errors should return HTTP 401",
+			query:          "error=access_denied&state=state",
+			cookie:         "state",
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "oidc_login_failed",
+		},
+	}
+
+	// Requests that fail decoding never reach the provider, so use an empty
+	// OIDC service.
+	handler := GetLoginOIDCCallbackHandler(
+		services.Accounts{},
+		&services.OIDC{},
+		true,
+		instrumenting.NewDiscard(),
+		discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?"+test.query, nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: test.cookie})
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+			assert.Empty(t, recorder.Result().Cookies(), "Expected no session cookie")
+
+			var p apiv1.Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+			assert.Equal(t, test.expectedCode, p.Code, "Expected error codes to match")
+		})
+	}
+}
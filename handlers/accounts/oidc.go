@@ -0,0 +1,236 @@
+package accounts
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// oidcStateCookie is the name of the cookie that ties an OIDC login to the
+// browser that started it. It holds a random token that's sent to the provider
+// as the state, and whose hash is sent as the nonce.
+const oidcStateCookie = "oidc_state"
+
+// oidcStateTTL is how long users have to log in with the OIDC provider.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcLoginRedirect is the path users are redirected to after logging in with
+// OIDC.
+const oidcLoginRedirect = "/"
+
+func newOIDCStateCookie(value string, maxAge int, secure bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		// The provider redirects back with a top-level GET navigation, which
+		// includes Lax cookies.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func oidcDisabledError() error {
+	return encoders.NewJSONError(
+		nil,
+		http.StatusNotFound,
+		"oidc_disabled",
+		"OIDC login isn't configured")
+}
+
+// oidcRedirect redirects to the URL, optionally setting cookies first.
+type oidcRedirect struct {
+	url     string
+	cookies []*http.Cookie
+}
+
+func oidcRedirectEncoder(_ context.Context, writer http.ResponseWriter, response interface{}) error {
+	res := response.(oidcRedirect)
+	for _, cookie := range res.cookies {
+		http.SetCookie(writer, cookie)
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Location", res.url)
+	writer.WriteHeader(http.StatusFound)
+	return nil
+}
+
+func getLoginOIDCEndpoint(oidc *services.OIDC, secureCookies bool) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		if oidc == nil {
+			return nil, oidcDisabledError()
+		}
+		state, nonce, err := services.NewToken()
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error creating OIDC state"),
+				http.StatusInternalServerError,
+				"login_failed",
+				"error logging in")
+		}
+		authURL, err := oidc.AuthURL(ctx, state, nonce)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error getting OIDC authorization URL"),
+				http.StatusInternalServerError,
+				"oidc_unavailable",
+				"OIDC provider is unavailable")
+		}
+		return oidcRedirect{
+			url:     authURL,
+			cookies: []*http.Cookie{newOIDCStateCookie(state, int(oidcStateTTL.Seconds()), secureCookies)},
+		}, nil
+	}
+}
+
+// GetLoginOIDCHandler starts logging in with the OIDC provider by redirecting
+// to it. oidc is nil if OIDC login isn't configured, in which case the handler
+// returns HTTP 404.
+func GetLoginOIDCHandler(
+	oidc *services.OIDC,
+	secureCookies bool,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("get_login_oidc"),
+			instrumenting.Endpoint(metrics, "get_login_oidc"),
+		)(getLoginOIDCEndpoint(oidc, secureCookies)),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+		oidcRedirectEncoder,
+		options...,
+	)
+}
+
+type oidcCallbackRequest struct {
+	code  string
+	state string
+}
+
+func getLoginOIDCCallbackEndpoint(
+	accounts services.Accounts,
+	oidc *services.OIDC,
+	secureCookies bool,
+	metrics instrumenting.Metrics,
+) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if oidc == nil {
+			return nil, oidcDisabledError()
+		}
+		req := request.(oidcCallbackRequest)
+		identity, err := oidc.Exchange(ctx, req.code, services.HashToken(req.state))
+		if errors.Cause(err) == services.ErrInvalidIDToken {
+			return nil, encoders.NewJSONError(
+				err,
+				http.StatusUnauthorized,
+				"invalid_id_token",
+				"OIDC provider returned an invalid identity")
+		}
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error exchanging OIDC authorization code"),
+				http.StatusInternalServerError,
+				"oidc_unavailable",
+				"OIDC provider is unavailable")
+		}
+		_, session, err := accounts.LoginOIDC(ctx, identity)
+		if err == services.ErrBanned {
+			return nil, bannedError(err)
+		}
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error logging in"),
+				http.StatusInternalServerError,
+				"login_failed",
+				"error logging in")
+		}
+		metrics.Logins.With("step", "oidc_login").Add(1)
+		return oidcRedirect{
+			url: oidcLoginRedirect,
+			cookies: []*http.Cookie{
+				sessions.NewCookie(session, secureCookies),
+				newOIDCStateCookie("", -1, secureCookies),
+			},
+		}, nil
+	}
+}
+
+// getLoginOIDCCallbackDecoder checks that the provider redirected back with
+// the state from the state cookie, which means the login was started by the
+// same browser.
+func getLoginOIDCCallbackDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		return nil, encoders.NewJSONError(
+			errors.Errorf("OIDC provider returned error %q", query.Get("error")),
+			http.StatusUnauthorized,
+			"oidc_login_failed",
+			"login with the OIDC provider failed")
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	state := query.Get("state")
+	if err != nil ||
+		state == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, encoders.NewJSONError(
+			nil,
+			http.StatusBadRequest,
+			"invalid_oidc_state",
+			"login expired or was started in another browser")
+	}
+	if query.Get("code") == "" {
+		return nil, encoders.NewJSONError(
+			nil,
+			http.StatusBadRequest,
+			"invalid_oidc_state",
+			"OIDC provider didn't return an authorization code")
+	}
+	return oidcCallbackRequest{code: query.Get("code"), state: state}, nil
+}
+
+// GetLoginOIDCCallbackHandler finishes logging in with the OIDC provider,
+// which redirects back to it with an authorization code. The code is exchanged
+// for the user's identity, and a new session is returned in the session cookie
+// before redirecting to the site. oidc is nil if OIDC login isn't configured,
+// in which case the handler returns HTTP 404.
+func GetLoginOIDCCallbackHandler(
+	accounts services.Accounts,
+	oidc *services.OIDC,
+	secureCookies bool,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("get_login_oidc_callback"),
+			instrumenting.Endpoint(metrics, "get_login_oidc_callback"),
+		)(getLoginOIDCCallbackEndpoint(accounts, oidc, secureCookies, metrics)),
+		getLoginOIDCCallbackDecoder,
+		oidcRedirectEncoder,
+		options...,
+	)
+}
@@ -0,0 +1,438 @@
+// Package admin provides the handlers of the admin API, which moderators and
+// admins use to fix bad data. Every change is recorded in the audit log.
+package admin
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/decoders"
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
+	"github.com/matthewdale/manualsmap.com/middlewares"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// maxBodyBytes is the maximum number of bytes that are read from the HTTP
+// POST body into memory.
+const maxBodyBytes = 64 * 1024
+
+// maxIDs is the most cars that can be merged or moved at once.
+const maxIDs = 100
+
+// Makes and models must have between minNameLength and maxNameLength
+// characters, like makes in car submissions.
+const (
+	minNameLength = 2
+	maxNameLength = 100
+)
+
+// newServer returns a handler for the admin endpoint that requires a logged in
+// user with the role.
+func newServer(
+	route string,
+	role services.Role,
+	accounts middlewares.SessionUserGetter,
+	e endpoint.Endpoint,
+	dec httptransport.DecodeRequestFunc,
+	enc httptransport.EncodeResponseFunc,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerBefore(sessions.ContextFromCookie),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint(route),
+			instrumenting.Endpoint(metrics, route),
+			middlewares.Authenticator(accounts, true),
+			middlewares.RoleChecker(role),
+		)(e),
+		dec,
+		enc,
+		options...,
+	)
+}
+
+// adminFromContext returns the logged in user. The Authenticator middleware
+// rejects requests without a user.
+func adminFromContext(ctx context.Context) services.User {
+	user, _ := sessions.UserFromContext(ctx)
+	return user
+}
+
+// adminError converts errors from admin actions to JSON errors.
+func adminError(err error, code, message string) error {
+	switch errors.Cause(err) {
+	case services.ErrCarNotFound:
+		return encoders.NewJSONError(err, http.StatusNotFound, "car_not_found", "car not found")
+	case services.ErrMapBlockNotFound:
+		return encoders.NewJSONError(err, http.StatusNotFound, "map_block_not_found", "map block not found")
+	case services.ErrUserNotFound:
+		return encoders.NewJSONError(err, http.StatusNotFound, "user_not_found", "user not found")
+	case services.ErrBanNotFound:
+		return encoders.NewJSONError(err, http.StatusNotFound, "ban_not_found", "ban not found")
+	case services.ErrAlreadyBanned:
+		return encoders.NewJSONError(err, http.StatusConflict, "already_banned", "already banned")
+	}
+	return encoders.NewJSONError(err, http.StatusInternalServerError, code, message)
+}
+
+// validationError returns an HTTP 400 error for the field errors, or nil if
+// there are none.
+func validationError(fieldErrors []encoders.FieldError) error {
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+	return encoders.NewValidationError("request body does not match schema", fieldErrors)
+}
+
+// checkIDs returns field errors if ids is empty, too long or contains IDs
+// that aren't positive.
+func checkIDs(ids []int, name string) []encoders.FieldError {
+	if len(ids) == 0 {
+		return []encoders.FieldError{{
+			Pointer: encoders.JSONPointer(name),
+			Keyword: "minItems",
+			Message: name + " must not be empty",
+		}}
+	}
+	if len(ids) > maxIDs {
+		return []encoders.FieldError{{
+			Pointer: encoders.JSONPointer(name),
+			Keyword: "maxItems",
+			Message: name + " must have at most " + strconv.Itoa(maxIDs) + " items",
+		}}
+	}
+	var fieldErrors []encoders.FieldError
+	for i, id := range ids {
+		if id < 1 {
+			fieldErrors = append(fieldErrors, encoders.FieldError{
+				Pointer: encoders.JSONPointer(name, strconv.Itoa(i)),
+				Keyword: "minimum",
+				Message: "must be a car ID",
+			})
+		}
+	}
+	return fieldErrors
+}
+
+// checkID returns a field error if the ID isn't positive.
+func checkID(id int, name string) []encoders.FieldError {
+	if id >= 1 {
+		return nil
+	}
+	return []encoders.FieldError{{
+		Pointer: encoders.JSONPointer(name),
+		Keyword: "minimum",
+		Message: name + " is required",
+	}}
+}
+
+func postMergeCarsEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiv1.MergeCarsRequest)
+		err := persistence.MergeCars(ctx, adminFromContext(ctx), req.KeepID, req.DuplicateIDs)
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error merging cars"),
+				"merge_failed",
+				"error merging cars")
+		}
+		metrics.AdminActions.With("action", services.ActionMergeCars).Add(1)
+		return nil, nil
+	}
+}
+
+func postMergeCarsDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.MergeCarsRequest
+	if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+		return nil, err
+	}
+	fieldErrors := checkID(req.KeepID, "keepId")
+	fieldErrors = append(fieldErrors, checkIDs(req.DuplicateIDs, "duplicateIds")...)
+	for i, id := range req.DuplicateIDs {
+		if id == req.KeepID {
+			fieldErrors = append(fieldErrors, encoders.FieldError{
+				Pointer: encoders.JSONPointer("duplicateIds", strconv.Itoa(i)),
+				Keyword: "not",
+				Message: "must not be the car to keep",
+			})
+		}
+	}
+	if err := validationError(fieldErrors); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// PostMergeCarsHandler merges duplicate submissions of a car. It requires the
+// moderator role.
+func PostMergeCarsHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"post_admin_cars_merge",
+		services.RoleModerator,
+		accounts,
+		postMergeCarsEndpoint(persistence, metrics),
+		postMergeCarsDecoder,
+		encoders.NoContentResponseEncoder,
+		metrics,
+		logger)
+}
+
+func postMoveCarsEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiv1.MoveCarsRequest)
+		err := persistence.MoveCars(ctx, adminFromContext(ctx), req.CarIDs, req.MapBlockID)
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error moving cars"),
+				"move_failed",
+				"error moving cars")
+		}
+		metrics.AdminActions.With("action", services.ActionMoveCars).Add(1)
+		return nil, nil
+	}
+}
+
+func postMoveCarsDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.MoveCarsRequest
+	if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+		return nil, err
+	}
+	fieldErrors := checkIDs(req.CarIDs, "carIds")
+	fieldErrors = append(fieldErrors, checkID(req.MapBlockID, "mapBlockId")...)
+	if err := validationError(fieldErrors); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// PostMoveCarsHandler moves cars to another map block. It requires the
+// moderator role.
+func PostMoveCarsHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"post_admin_cars_move",
+		services.RoleModerator,
+		accounts,
+		postMoveCarsEndpoint(persistence, metrics),
+		postMoveCarsDecoder,
+		encoders.NoContentResponseEncoder,
+		metrics,
+		logger)
+}
+
+func postRenameCarsEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiv1.RenameCarsRequest)
+		count, err := persistence.RenameCars(
+			ctx,
+			adminFromContext(ctx),
+			services.CarName{Make: req.From.Make, Model: req.From.Model},
+			services.CarName{Make: req.To.Make, Model: req.To.Model})
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error renaming cars"),
+				"rename_failed",
+				"error renaming cars")
+		}
+		metrics.AdminActions.With("action", services.ActionRenameCars).Add(1)
+		return apiv1.CarsRenamed{Count: count}, nil
+	}
+}
+
+// checkName returns field errors if the make is missing, or if the make or
+// model are too short or too long. Models can be empty.
+func checkName(name apiv1.CarName, field string) []encoders.FieldError {
+	if name.Make == "" {
+		return []encoders.FieldError{{
+			Pointer: encoders.JSONPointer(field, "make"),
+			Keyword: "required",
+			Message: "make is required",
+		}}
+	}
+	var fieldErrors []encoders.FieldError
+	for _, f := range []struct{ key, value string }{{"make", name.Make}, {"model", name.Model}} {
+		length := utf8.RuneCountInString(f.value)
+		switch {
+		case f.value == "":
+		case length < minNameLength:
+			fieldErrors = append(fieldErrors, encoders.FieldError{
+				Pointer: encoders.JSONPointer(field, f.key),
+				Keyword: "minLength",
+				Message: f.key + " must have at least " + strconv.Itoa(minNameLength) + " characters",
+			})
+		case length > maxNameLength:
+			fieldErrors = append(fieldErrors, encoders.FieldError{
+				Pointer: encoders.JSONPointer(field, f.key),
+				Keyword: "maxLength",
+				Message: f.key + " must be at most " + strconv.Itoa(maxNameLength) + " characters",
+			})
+		}
+	}
+	return fieldErrors
+}
+
+func postRenameCarsDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.RenameCarsRequest
+	if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+		return nil, err
+	}
+	// Names are stored as submitted, so only surrounding whitespace is
+	// removed.
+	for _, name := range []*apiv1.CarName{&req.From, &req.To} {
+		name.Make = strings.TrimSpace(name.Make)
+		name.Model = strings.TrimSpace(name.Model)
+	}
+	fieldErrors := checkName(req.From, "from")
+	fieldErrors = append(fieldErrors, checkName(req.To, "to")...)
+	if (req.From.Model == "") != (req.To.Model == "") {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("to", "model"),
+			Keyword: "required",
+			Message: "the old and new model must both be set or both be empty",
+		})
+	}
+	if err := validationError(fieldErrors); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// PostRenameCarsHandler renames the make or model of every matching car. It
+// requires the moderator role.
+func PostRenameCarsHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"post_admin_cars_rename",
+		services.RoleModerator,
+		accounts,
+		postRenameCarsEndpoint(persistence, metrics),
+		postRenameCarsDecoder,
+		encoders.JSONResponseEncoder,
+		metrics,
+		logger)
+}
+
+func getCarHistoryEndpoint(persistence services.Persistence) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		history, err := persistence.GetCarHistory(ctx, request.(int))
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error getting car history"),
+				"car_history_failed",
+				"error getting car history")
+		}
+		versions := make([]apiv1.CarVersion, 0, len(history))
+		for _, version := range history {
+			versions = append(versions, apiv1.CarVersion{
+				Action:        version.Action,
+				MapBlockID:    version.MapBlockID,
+				Year:          version.Year,
+				Make:          version.Make,
+				Model:         version.Model,
+				Trim:          version.Trim,
+				Color:         version.Color,
+				ImagePublicID: version.ImagePublicID,
+				Created:       version.Created,
+			})
+		}
+		return apiv1.CarHistory{Versions: versions}, nil
+	}
+}
+
+func getCarHistoryDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, encoders.NewJSONError(
+			errors.WithMessage(err, "invalid {id} format, must be integer"),
+			http.StatusBadRequest,
+			"invalid_car_id",
+			"invalid {id} format, must be integer")
+	}
+	return id, nil
+}
+
+// GetCarHistoryHandler returns the previous versions of a car, oldest first,
+// so moderators can review edits and deletions. It requires the moderator
+// role.
+func GetCarHistoryHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"get_admin_car_history",
+		services.RoleModerator,
+		accounts,
+		getCarHistoryEndpoint(persistence),
+		getCarHistoryDecoder,
+		encoders.JSONResponseEncoder,
+		metrics,
+		logger)
+}
+
+func postDeleteEmptyMapBlocksEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		ids, err := persistence.DeleteEmptyMapBlocks(ctx, adminFromContext(ctx))
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error deleting empty map blocks"),
+				"map_block_delete_failed",
+				"error deleting map blocks")
+		}
+		metrics.AdminActions.With("action", services.ActionDeleteEmptyMapBlocks).Add(1)
+		return apiv1.MapBlocksDeleted{MapBlockIDs: ids}, nil
+	}
+}
+
+// PostDeleteEmptyMapBlocksHandler deletes every map block without cars. It
+// requires the moderator role.
+func PostDeleteEmptyMapBlocksHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"post_admin_mapblocks_delete_empty",
+		services.RoleModerator,
+		accounts,
+		postDeleteEmptyMapBlocksEndpoint(persistence, metrics),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+		encoders.JSONResponseEncoder,
+		metrics,
+		logger)
+}
@@ -0,0 +1,304 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// fakeSessions is a SessionUserGetter whose session tokens are the role of
+// the logged in user.
+type fakeSessions struct{}
+
+func (fakeSessions) SessionUser(_ context.Context, sessionToken string) (*services.User, error) {
+	if sessionToken == "" {
+		return nil, nil
+	}
+	return &services.User{ID: 1, Email: "admin@example.com", Role: services.Role(sessionToken)}, nil
+}
+
+// newTestRouter returns a router with all admin handlers. Requests that fail
+// decoding or authorization never reach the database, so it uses an empty
+// Persistence service.
+func newTestRouter() *mux.Router {
+	accounts := fakeSessions{}
+	persistence := services.Persistence{}
+	metrics := instrumenting.NewDiscard()
+	router := mux.NewRouter()
+	router.Methods("POST").Path("/admin/cars/merge").
+		Handler(PostMergeCarsHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("POST").Path("/admin/cars/move").
+		Handler(PostMoveCarsHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("POST").Path("/admin/cars/rename").
+		Handler(PostRenameCarsHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("GET").Path("/admin/cars/{id}/history").
+		Handler(GetCarHistoryHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("POST").Path("/admin/mapblocks/delete-empty").
+		Handler(PostDeleteEmptyMapBlocksHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("GET").Path("/admin/bans").
+		Handler(GetBansHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("POST").Path("/admin/bans").
+		Handler(PostBanHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("DELETE").Path("/admin/bans/{id}").
+		Handler(DeleteBanHandler(accounts, persistence, metrics, discardLogger))
+	router.Methods("GET").Path("/admin/actions").
+		Handler(GetActionsHandler(accounts, persistence, metrics, discardLogger))
+	return router
+}
+
+func serve(t *testing.T, method, target, role, body string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if role != "" {
+		r.AddCookie(&http.Cookie{Name: sessions.CookieName, Value: role})
+	}
+	recorder := httptest.NewRecorder()
+	newTestRouter().ServeHTTP(recorder, r)
+	var p apiv1.Problem
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+	return recorder.Code, p.Code
+}
+
+func TestAdminHandlersRequireRole(t *testing.T) {
+	requests := []struct {
+		method string
+		target string
+		body   string
+		role   services.Role
+	}{
+		{http.MethodPost, "/admin/cars/merge", `{"keepId": 1, "duplicateIds": [2]}`, services.RoleModerator},
+		{http.MethodPost, "/admin/cars/move", `{"carIds": [1], "mapBlockId": 2}`, services.RoleModerator},
+		{
+			http.MethodPost,
+			"/admin/cars/rename",
+			`{"from": {"make": "mazda"}, "to": {"make": "Mazda"}}`,
+			services.RoleModerator,
+		},
+		{http.MethodGet, "/admin/cars/1/history", "", services.RoleModerator},
+		{http.MethodPost, "/admin/mapblocks/delete-empty", "", services.RoleModerator},
+		{http.MethodGet, "/admin/bans", "", services.RoleAdmin},
+		{http.MethodPost, "/admin/bans", `{"ip": "192.0.2.1", "reason": "spam"}`, services.RoleAdmin},
+		{http.MethodDelete, "/admin/bans/1", "", services.RoleAdmin},
+		{http.MethodGet, "/admin/actions", "", services.RoleAdmin},
+	}
+
+	for _, req := range requests {
+		req := req // Capture range variable.
+		t.Run(req.method+" "+req.target, func(t *testing.T) {
+			t.Parallel()
+
+			status, code := serve(t, req.method, req.target, "", req.body)
+			assert.Equal(t, http.StatusUnauthorized, status, "Expected HTTP 401 without a session")
+			assert.Equal(t, "login_required", code, "Expected error codes to match")
+
+			status, code = serve(t, req.method, req.target, string(services.RoleUser), req.body)
+			assert.Equal(t, http.StatusForbidden, status, "Expected HTTP 403 for users")
+			assert.Equal(t, "forbidden", code, "Expected error codes to match")
+
+			if req.role == services.RoleAdmin {
+				status, code = serve(t, req.method, req.target, string(services.RoleModerator), req.body)
+				assert.Equal(t, http.StatusForbidden, status, "Expected HTTP 403 for moderators")
+				assert.Equal(t, "forbidden", code, "Expected error codes to match")
+			}
+		})
+	}
+}
+
+func TestAdminHandlersBadRequest(t *testing.T) {
+	tests := []struct {
+		description  string
+		method       string
+		target       string
+		body         string
+		expectedCode string
+	}{
+		{
+			description:  "Merges without duplicates should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/merge",
+			body:         `{"keepId": 1, "duplicateIds": []}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Merges of the car to keep should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/merge",
+			body:         `{"keepId": 1, "duplicateIds": [2, 1]}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Malformed JSON should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/merge",
+			body:         `{"keepId": `,
+			expectedCode: "invalid_json",
+		},
+		{
+			description:  "Moves without a map block should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/move",
+			body:         `{"carIds": [1]}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Moves of invalid car IDs should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/move",
+			body:         `{"carIds": [0], "mapBlockId": 1}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Renames without a make should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/rename",
+			body:         `{"from": {"make": " "}, "to": {"make": "Mazda"}}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Renames of only one model should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/rename",
+			body:         `{"from": {"make": "Mazda"}, "to": {"make": "Mazda", "model": "MX-5"}}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Unknown fields should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/cars/rename",
+			body:         `{"from": {"make": "mazda", "year": 1994}, "to": {"make": "Mazda"}}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Invalid car IDs should return HTTP 400",
+			method:       http.MethodGet,
+			target:       "/admin/cars/abc/history",
+			expectedCode: "invalid_car_id",
+		},
+		{
+			description:  "Bans without an IP address or user should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/bans",
+			body:         `{"reason": "spam"}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Bans of both an IP address and a user should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/bans",
+			body:         `{"ip": "192.0.2.1", "userId": 1, "reason": "spam"}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Bans of invalid IP addresses should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/bans",
+			body:         `{"ip": "192.0.2", "reason": "spam"}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Bans without a reason should return HTTP 400",
+			method:       http.MethodPost,
+			target:       "/admin/bans",
+			body:         `{"userId": 1, "reason": ""}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Invalid ban IDs should return HTTP 400",
+			method:       http.MethodDelete,
+			target:       "/admin/bans/abc",
+			expectedCode: "invalid_ban_id",
+		},
+		{
+			description:  "Invalid limits should return HTTP 400",
+			method:       http.MethodGet,
+			target:       "/admin/actions?limit=1000",
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Unknown query parameters should return HTTP 400",
+			method:       http.MethodGet,
+			target:       "/admin/actions?after=1",
+			expectedCode: "validation_failed",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			status, code := serve(t, test.method, test.target, string(services.RoleAdmin), test.body)
+			assert.Equal(t, http.StatusBadRequest, status, "Expected HTTP 400")
+			assert.Equal(t, test.expectedCode, code, "Expected error codes to match")
+		})
+	}
+}
+
+func TestPostRenameCarsNameLength(t *testing.T) {
+	tests := []struct {
+		description string
+		body        string
+		expected    []apiv1.FieldError
+	}{
+		{
+			description: "1 character makes should return HTTP 400",
+			body:        `{"from": {"make": "Mazda"}, "to": {"make": " M "}}`,
+			expected: []apiv1.FieldError{{
+				Pointer: "/to/make",
+				Keyword: "minLength",
+				Message: "make must have at least 2 characters",
+			}},
+		},
+		{
+			description: "1 character models should return HTTP 400",
+			body:        `{"from": {"make": "Mazda", "model": "M"}, "to": {"make": "Mazda", "model": "MX-5"}}`,
+			expected: []apiv1.FieldError{{
+				Pointer: "/from/model",
+				Keyword: "minLength",
+				Message: "model must have at least 2 characters",
+			}},
+		},
+		{
+			description: "Long makes should be counted in characters, not bytes",
+			body:        `{"from": {"make": "Mazda"}, "to": {"make": "` + strings.Repeat("ö", 101) + `"}}`,
+			expected: []apiv1.FieldError{{
+				Pointer: "/to/make",
+				Keyword: "maxLength",
+				Message: "make must be at most 100 characters",
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/cars/rename", strings.NewReader(test.body))
+			r.AddCookie(&http.Cookie{Name: sessions.CookieName, Value: string(services.RoleModerator)})
+			recorder := httptest.NewRecorder()
+			newTestRouter().ServeHTTP(recorder, r)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+			var p apiv1.Problem
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+			assert.Equal(t, "validation_failed", p.Code, "Expected error codes to match")
+			assert.Equal(t, test.expected, p.Errors, "Expected field errors to match")
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/decoders"
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/middlewares"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+// maxReasonLength is the longest ban reason, see the bans table.
+const maxReasonLength = 1000
+
+// Audit log pages have defaultActionsLimit entries unless the request asks
+// for up to maxActionsLimit.
+const (
+	defaultActionsLimit = 50
+	maxActionsLimit     = 200
+)
+
+func newBanResponse(ban services.Ban) apiv1.Ban {
+	return apiv1.Ban{
+		ID:      ban.ID,
+		IP:      ban.IP,
+		UserID:  ban.UserID,
+		Reason:  ban.Reason,
+		Created: ban.Created,
+	}
+}
+
+func getBansEndpoint(persistence services.Persistence) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		bans, err := persistence.GetBans(ctx)
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error getting bans"),
+				"bans_failed",
+				"error getting bans")
+		}
+		responses := make([]apiv1.Ban, 0, len(bans))
+		for _, ban := range bans {
+			responses = append(responses, newBanResponse(ban))
+		}
+		return apiv1.Bans{Bans: responses}, nil
+	}
+}
+
+// GetBansHandler lists the banned client IP addresses and users. It requires
+// the admin role.
+func GetBansHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"get_admin_bans",
+		services.RoleAdmin,
+		accounts,
+		getBansEndpoint(persistence),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return nil, nil
+		},
+		encoders.JSONResponseEncoder,
+		metrics,
+		logger)
+}
+
+func postBanEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(apiv1.BanRequest)
+		ban, err := persistence.InsertBan(ctx, adminFromContext(ctx), services.Ban{
+			IP:     req.IP,
+			UserID: req.UserID,
+			Reason: req.Reason,
+		})
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error inserting ban"),
+				"ban_failed",
+				"error banning")
+		}
+		metrics.AdminActions.With("action", services.ActionBan).Add(1)
+		return newBanResponse(ban), nil
+	}
+}
+
+func postBanDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.BanRequest
+	if err := decoders.DecodeJSONBody(r, maxBodyBytes, true, &req); err != nil {
+		return nil, err
+	}
+	req.IP = strings.TrimSpace(req.IP)
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	var fieldErrors []encoders.FieldError
+	switch {
+	case req.IP == "" && req.UserID == 0:
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("ip"),
+			Keyword: "oneOf",
+			Message: "one of ip and userId is required",
+		})
+	case req.IP != "" && req.UserID != 0:
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("userId"),
+			Keyword: "oneOf",
+			Message: "only one of ip and userId can be set",
+		})
+	case req.IP != "" && net.ParseIP(req.IP) == nil:
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("ip"),
+			Keyword: "format",
+			Message: "must be an IPv4 or IPv6 address",
+		})
+	case req.IP == "" && req.UserID < 1:
+		fieldErrors = append(fieldErrors, checkID(req.UserID, "userId")...)
+	}
+	if req.Reason == "" {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("reason"),
+			Keyword: "required",
+			Message: "reason is required",
+		})
+	}
+	if len(req.Reason) > maxReasonLength {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("reason"),
+			Keyword: "maxLength",
+			Message: "reason must be at most " + strconv.Itoa(maxReasonLength) + " characters",
+		})
+	}
+	if err := validationError(fieldErrors); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// banCreatedEncoder returns the new ban with HTTP 201.
+func banCreatedEncoder(_ context.Context, writer http.ResponseWriter, response interface{}) error {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(writer).Encode(response)
+}
+
+// PostBanHandler bans a client IP address or a user. Banned IP addresses
+// can't submit, edit or delete cars, sign image uploads or request login
+// links, and banned users are logged out and can't log in. It requires the
+// admin role.
+func PostBanHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"post_admin_bans",
+		services.RoleAdmin,
+		accounts,
+		postBanEndpoint(persistence, metrics),
+		postBanDecoder,
+		banCreatedEncoder,
+		metrics,
+		logger)
+}
+
+func deleteBanEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if err := persistence.DeleteBan(ctx, adminFromContext(ctx), request.(int)); err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error deleting ban"),
+				"unban_failed",
+				"error deleting ban")
+		}
+		metrics.AdminActions.With("action", services.ActionUnban).Add(1)
+		return nil, nil
+	}
+}
+
+func deleteBanDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, encoders.NewJSONError(
+			errors.WithMessage(err, "invalid {id} format, must be integer"),
+			http.StatusBadRequest,
+			"invalid_ban_id",
+			"invalid {id} format, must be integer")
+	}
+	return id, nil
+}
+
+// DeleteBanHandler lifts a ban. It requires the admin role.
+func DeleteBanHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"delete_admin_ban",
+		services.RoleAdmin,
+		accounts,
+		deleteBanEndpoint(persistence, metrics),
+		deleteBanDecoder,
+		encoders.NoContentResponseEncoder,
+		metrics,
+		logger)
+}
+
+func getActionsEndpoint(persistence services.Persistence) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		query := request.(apiv1.AdminActionsQuery)
+		actions, err := persistence.GetAdminActions(ctx, query.Before, query.Limit)
+		if err != nil {
+			return nil, adminError(
+				errors.WithMessage(err, "error getting admin actions"),
+				"actions_failed",
+				"error getting admin actions")
+		}
+		responses := make([]apiv1.AdminAction, 0, len(actions))
+		for _, action := range actions {
+			responses = append(responses, apiv1.AdminAction{
+				ID:        action.ID,
+				UserID:    action.UserID,
+				UserEmail: action.UserEmail,
+				Action:    action.Action,
+				Details:   action.Details,
+				Created:   action.Created,
+			})
+		}
+		return apiv1.AdminActions{Actions: responses}, nil
+	}
+}
+
+func getActionsDecoder(_ context.Context, r *http.Request) (interface{}, error) {
+	var query apiv1.AdminActionsQuery
+	if err := decoders.DecodeQuery(r.URL.Query(), &query); err != nil {
+		return nil, err
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultActionsLimit
+	}
+	var fieldErrors []encoders.FieldError
+	if query.Before < 0 {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("before"),
+			Keyword: "minimum",
+			Message: "before must not be negative",
+		})
+	}
+	if query.Limit < 1 || query.Limit > maxActionsLimit {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("limit"),
+			Keyword: "maximum",
+			Message: "limit must be between 1 and " + strconv.Itoa(maxActionsLimit),
+		})
+	}
+	if len(fieldErrors) > 0 {
+		return nil, encoders.NewValidationError("invalid query parameters", fieldErrors)
+	}
+	return query, nil
+}
+
+// GetActionsHandler returns a page of the audit log of admin and moderator
+// actions, newest first. It requires the admin role.
+func GetActionsHandler(
+	accounts middlewares.SessionUserGetter,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	return newServer(
+		"get_admin_actions",
+		services.RoleAdmin,
+		accounts,
+		getActionsEndpoint(persistence),
+		getActionsDecoder,
+		encoders.JSONResponseEncoder,
+		metrics,
+		logger)
+}
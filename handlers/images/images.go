@@ -2,28 +2,29 @@ package images
 
 import (
 	"context"
-	"encoding/json"
-	"io"
-	"io/ioutil"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/decoders"
 	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
 	"github.com/matthewdale/manualsmap.com/middlewares"
 	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
 	"github.com/pkg/errors"
 )
 
 type postSignatureRequest struct {
-	Parameters map[string]string `json:"parameters"`
-	Recaptcha  string            `json:"recaptcha"`
-	remoteIP   string
+	apiv1.SignatureRequest
+	remoteIP string
 }
 
-func (req postSignatureRequest) RecaptchaResponse() string {
+func (req postSignatureRequest) CaptchaResponse() string {
 	return req.Recaptcha
 }
 
@@ -31,10 +32,6 @@ func (req postSignatureRequest) RemoteIP() string {
 	return req.remoteIP
 }
 
-type postSignatureResponse struct {
-	Signature string `json:"signature"`
-}
-
 func postSignatureEndpoint(cloudinary services.Cloudinary) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		parameters := request.(postSignatureRequest).Parameters
@@ -46,36 +43,54 @@ func postSignatureEndpoint(cloudinary services.Cloudinary) endpoint.Endpoint {
 		}
 		signature := cloudinary.UploadSignature(parameters)
 
-		return postSignatureResponse{Signature: signature}, nil
+		return apiv1.SignatureResponse{Signature: signature}, nil
 	}
 }
 
-func postSignatureDecoder(_ context.Context, r *http.Request) (interface{}, error) {
-	defer r.Body.Close()
-
-	var req postSignatureRequest
-	// Limit the number of bytes of the HTTP POST body read into memory to 1MiB.
-	err := json.NewDecoder(io.LimitReader(r.Body, 1*1024*1024)).Decode(&req)
-	if err != nil {
-		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "error unmarshalling JSON body"),
-			http.StatusInternalServerError)
-	}
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "failed to get remote IP"),
-			http.StatusInternalServerError)
+func postSignatureDecoder(resolver clientip.Resolver) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		var req postSignatureRequest
+		// Limit the number of bytes of the HTTP POST body read into memory to 1MiB.
+		if err := decoders.DecodeJSONBody(r, 1*1024*1024, true, &req); err != nil {
+			return nil, err
+		}
+		ip, err := resolver.Resolve(r)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "failed to get remote IP"),
+				http.StatusInternalServerError,
+				"remote_ip_failed",
+				"failed to get remote IP")
+		}
+		req.remoteIP = ip
+		return req, nil
 	}
-	req.remoteIP = ip
-	return req, nil
 }
 
-func PostSignatureHandler(cloudinary services.Cloudinary) http.Handler {
+func PostSignatureHandler(
+	cloudinary services.Cloudinary,
+	bans middlewares.BanChecker,
+	verifier services.CaptchaVerifier,
+	limits services.RateLimitStore,
+	ipLimit services.RateLimit,
+	resolver clientip.Resolver,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		middlewares.RecaptchaValidator()(postSignatureEndpoint(cloudinary)),
-		postSignatureDecoder,
+		endpoint.Chain(
+			tracing.Endpoint("post_images_signature"),
+			instrumenting.Endpoint(metrics, "post_images_signature"),
+			middlewares.BanEnforcer(bans),
+			middlewares.IPRateLimiter(limits, "signature", ipLimit),
+			middlewares.CaptchaValidator(verifier),
+		)(postSignatureEndpoint(cloudinary)),
+		postSignatureDecoder(resolver),
 		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
 
@@ -88,29 +103,31 @@ type postNotificationRequest struct {
 
 type postNotificationResponse struct{}
 
-func postNotificationEndpoint(persistence services.Persistence) endpoint.Endpoint {
-	logErr := func(err error) {
-		log.Printf("[postNotificationEndpoint] ERROR: %s: ", err)
-	}
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+func postNotificationEndpoint(
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		r := request.(postNotificationRequest)
+		metrics.Notifications.With("type", r.NotificationType).Add(1)
 		var err error
 		switch r.NotificationType {
 		case "upload":
 			err = errors.WithMessage(
-				persistence.InsertImage(r.PublicID, r.Format),
+				persistence.InsertImage(ctx, r.PublicID, r.Format),
 				"error inserting image")
 		case "moderation":
 			err = errors.WithMessage(
-				persistence.UpdateImage(r.PublicID, r.ModerationStatus),
+				persistence.UpdateImage(ctx, r.PublicID, r.ModerationStatus),
 				"error updating image")
 		}
 
 		if err != nil {
-			logErr(err)
 			return nil, encoders.NewJSONError(
-				errors.New("error handling notification"),
-				http.StatusInternalServerError)
+				err,
+				http.StatusInternalServerError,
+				"notification_failed",
+				"error handling notification")
 		}
 
 		// If the notification type doesn't match anything in our switch, just return OK.
@@ -121,19 +138,11 @@ func postNotificationEndpoint(persistence services.Persistence) endpoint.Endpoin
 func postNotificationDecoder(
 	cloudinary services.Cloudinary,
 ) httptransport.DecodeRequestFunc {
-	logErr := func(err error) {
-		log.Printf("[postNotificationDecoder] ERROR: %s", err)
-	}
 	return func(_ context.Context, r *http.Request) (interface{}, error) {
-		defer r.Body.Close()
 		// Limit the number of bytes of the HTTP POST body read into memory to 5MiB.
-		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 5*1024*1024))
+		body, err := decoders.ReadBody(r, 5*1024*1024)
 		if err != nil {
-			msg := "failed to read HTTP body"
-			logErr(errors.WithMessage(err, msg))
-			return nil, encoders.NewJSONError(
-				errors.New(msg),
-				http.StatusInternalServerError)
+			return nil, err
 		}
 
 		// Validate the Cloudinary notification signature.
@@ -141,21 +150,18 @@ func postNotificationDecoder(
 		expectedSig := cloudinary.NotificationSignature(string(body), timestamp)
 		actualSig := r.Header.Get("x-cld-signature")
 		if expectedSig != actualSig {
-			msg := "signature does not match expected"
-			logErr(errors.New(msg))
 			return nil, encoders.NewJSONError(
-				errors.New(msg),
-				http.StatusUnauthorized)
+				nil,
+				http.StatusUnauthorized,
+				"invalid_signature",
+				"signature does not match expected")
 		}
 
+		// Cloudinary notifications contain many fields that aren't used, so
+		// don't reject unknown fields.
 		var req postNotificationRequest
-		err = json.Unmarshal(body, &req)
-		if err != nil {
-			msg := "failed to unmarshal JSON body"
-			logErr(errors.WithMessage(err, msg))
-			return nil, encoders.NewJSONError(
-				errors.New(msg),
-				http.StatusInternalServerError)
+		if err := decoders.UnmarshalJSON(body, false, &req); err != nil {
+			return nil, err
 		}
 
 		return req, nil
@@ -165,10 +171,19 @@ func postNotificationDecoder(
 func PostNotificationHandler(
 	persistence services.Persistence,
 	cloudinary services.Cloudinary,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
 ) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		postNotificationEndpoint(persistence),
+		endpoint.Chain(
+			tracing.Endpoint("post_images_notification"),
+			instrumenting.Endpoint(metrics, "post_images_notification"),
+		)(postNotificationEndpoint(persistence, metrics)),
 		postNotificationDecoder(cloudinary),
 		encoders.EmptyResponseEncoder,
+		options...,
 	)
 }
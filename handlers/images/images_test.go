@@ -0,0 +1,135 @@
+package images
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/openapi"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func problemCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	var p struct {
+		Code string `json:"code"`
+	}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+	return p.Code
+}
+
+func TestPostSignatureHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description  string
+		body         string
+		expectedCode string
+	}{
+		{
+			description:  "Malformed JSON should return HTTP 400",
+			body:         `{"parameters": `,
+			expectedCode: "invalid_json",
+		},
+		{
+			description:  "Invalid types should return HTTP 400",
+			body:         `{"parameters": {"timestamp": 1315060510}, "recaptcha": "token"}`,
+			expectedCode: "validation_failed",
+		},
+		{
+			description:  "Unknown fields should return HTTP 400",
+			body:         `{"parameters": {}, "recaptcha": "token", "secret": "abcd"}`,
+			expectedCode: "validation_failed",
+		},
+	}
+
+	handler := PostSignatureHandler(
+		services.NewCloudinary("1234", "abcd"),
+		services.Persistence{},
+		services.FixedVerifier(true),
+		nil,
+		services.RateLimit{},
+		clientip.Resolver{},
+		instrumenting.NewDiscard(),
+		discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(
+				http.MethodPost,
+				"/images/signature",
+				strings.NewReader(test.body)))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+			assert.Equal(t, test.expectedCode, problemCode(t, recorder), "Expected error codes to match")
+		})
+	}
+}
+
+func TestPostNotificationHandlerErrors(t *testing.T) {
+	cloudinary := services.NewCloudinary("1234", "abcd")
+
+	tests := []struct {
+		description    string
+		body           string
+		signature      string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			description:    "Invalid signature should return HTTP 401",
+			body:           `{"notification_type": "upload"}`,
+			signature:      "invalid",
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "invalid_signature",
+		},
+		{
+			description:    "Malformed JSON with a valid signature should return HTTP 400",
+			body:           `{"notification_type": `,
+			signature:      cloudinary.NotificationSignature(`{"notification_type": `, "1368881627"),
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_json",
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Persistence service.
+	handler := PostNotificationHandler(services.Persistence{}, cloudinary, instrumenting.NewDiscard(), discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/images/notification",
+				strings.NewReader(test.body))
+			r.Header.Set("X-Cld-Timestamp", "1368881627")
+			r.Header.Set("X-Cld-Signature", test.signature)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+			assert.Equal(t, test.expectedCode, problemCode(t, recorder), "Expected error codes to match")
+		})
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	assert.NoError(t, openapi.CheckBodies(
+		openapi.Body{OperationID: "postImagesSignature", Value: postSignatureRequest{}},
+		openapi.Body{OperationID: "postImagesNotification", Value: postNotificationRequest{}},
+		openapi.Body{OperationID: "postImagesNotification", Status: "200", Value: postNotificationResponse{}},
+	), "Expected the documented schemas to match")
+}
@@ -0,0 +1,268 @@
+package mapblocks
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/decoders"
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
+	"github.com/matthewdale/manualsmap.com/middlewares"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+var patchCarRequestValidator *gojsonschema.Schema
+
+// patchCarRequestSchema allows the same fields as postCarsRequestSchema,
+// except the captcha response, but doesn't require any of them. OpenAPI 3.0
+// doesn't support the "dependencies" keyword, so patchCarDecoder checks that
+// the coordinates are set together.
+var patchCarRequestSchema = map[string]interface{}{
+	"$schema":              "http://json-schema.org/draft-07/schema#",
+	"type":                 "object",
+	"properties":           patchCarProperties(),
+	"minProperties":        1,
+	"additionalProperties": false,
+}
+
+func patchCarProperties() map[string]interface{} {
+	properties := make(map[string]interface{})
+	for name, property := range postCarsRequestSchema["properties"].(map[string]interface{}) {
+		if name != "recaptcha" {
+			properties[name] = property
+		}
+	}
+	return properties
+}
+
+func init() {
+	var err error
+	patchCarRequestValidator, err = gojsonschema.NewSchema(
+		gojsonschema.NewGoLoader(patchCarRequestSchema))
+	if err != nil {
+		log.Fatal("Error loading PATCH Car request schema:", err)
+	}
+}
+
+// carEditRequest identifies the car to edit and the token that authorizes
+// editing it.
+type carEditRequest struct {
+	id            int
+	editTokenHash string
+	remoteIP      string
+}
+
+func (req carEditRequest) RemoteIP() string {
+	return req.remoteIP
+}
+
+func decodeCarEditRequest(r *http.Request, resolver clientip.Resolver) (carEditRequest, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return carEditRequest{}, encoders.NewJSONError(
+			errors.WithMessage(err, "invalid {id} format, must be integer"),
+			http.StatusBadRequest,
+			"invalid_car_id",
+			"invalid {id} format, must be integer")
+	}
+	token := r.Header.Get(apiv1.EditTokenHeader)
+	if token == "" {
+		return carEditRequest{}, encoders.NewJSONError(
+			nil,
+			http.StatusUnauthorized,
+			"edit_token_required",
+			"missing "+apiv1.EditTokenHeader+" header")
+	}
+	ip, err := resolver.Resolve(r)
+	if err != nil {
+		return carEditRequest{}, encoders.NewJSONError(
+			errors.WithMessage(err, "failed to get remote IP"),
+			http.StatusInternalServerError,
+			"remote_ip_failed",
+			"failed to get remote IP")
+	}
+	return carEditRequest{id: id, editTokenHash: services.HashToken(token), remoteIP: ip}, nil
+}
+
+// carEditError converts errors from editing a car to JSON errors.
+func carEditError(err error, code, message string) error {
+	switch errors.Cause(err) {
+	case services.ErrCarNotFound:
+		return encoders.NewJSONError(err, http.StatusNotFound, "car_not_found", "car not found")
+	case services.ErrInvalidEditToken:
+		return encoders.NewJSONError(err, http.StatusForbidden, "invalid_edit_token", "invalid edit token")
+	}
+	return encoders.NewJSONError(err, http.StatusInternalServerError, code, message)
+}
+
+type patchCarRequest struct {
+	carEditRequest
+	apiv1.CarUpdate
+}
+
+func patchCarEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		r := request.(patchCarRequest)
+
+		// The decoder requires the coordinates to be set together.
+		update := services.CarUpdate{
+			Latitude:      r.Latitude,
+			Longitude:     r.Longitude,
+			Year:          r.Year,
+			Make:          r.Make,
+			Model:         r.Model,
+			Trim:          r.Trim,
+			Color:         r.Color,
+			ImagePublicID: r.CloudinaryPublicID,
+		}
+		mapBlockID, mapBlockCreated, err := persistence.UpdateCar(ctx, r.id, r.editTokenHash, update)
+		if err != nil {
+			return nil, carEditError(
+				errors.WithMessage(err, "error updating car"),
+				"car_update_failed",
+				"error updating car")
+		}
+		if mapBlockCreated {
+			metrics.MapBlockCreations.Add(1)
+		}
+
+		metrics.CarEdits.With("action", "update").Add(1)
+		return apiv1.CarUpdated{ID: r.id, MapBlockID: mapBlockID}, nil
+	}
+}
+
+func patchCarDecoder(resolver clientip.Resolver) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		editReq, err := decodeCarEditRequest(r, resolver)
+		if err != nil {
+			return nil, err
+		}
+		body, err := decoders.ReadBody(r, maxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := patchCarRequestValidator.Validate(
+			gojsonschema.NewBytesLoader(body))
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error validating JSON body"),
+				http.StatusBadRequest,
+				"invalid_json",
+				"request body is not valid JSON")
+		}
+		if !result.Valid() {
+			return nil, encoders.NewValidationError(
+				"request body does not match schema",
+				encoders.SchemaFieldErrors(result.Errors()))
+		}
+
+		req := patchCarRequest{carEditRequest: editReq}
+		if err := decoders.UnmarshalJSON(body, true, &req.CarUpdate); err != nil {
+			return nil, err
+		}
+		fieldErrors := trimCarFields(req.Make, req.Model, req.Trim, req.Color)
+		if len(fieldErrors) > 0 {
+			return nil, encoders.NewValidationError("request body does not match schema", fieldErrors)
+		}
+		if (req.Latitude == nil) != (req.Longitude == nil) {
+			missing := "latitude"
+			if req.Longitude == nil {
+				missing = "longitude"
+			}
+			return nil, encoders.NewValidationError(
+				"request body does not match schema",
+				[]encoders.FieldError{{
+					Pointer: encoders.JSONPointer(missing),
+					Keyword: "required",
+					Message: "latitude and longitude must be set together",
+				}})
+		}
+		return req, nil
+	}
+}
+
+// PatchCarHandler updates a car. The request must have the edit token that
+// was returned when the car was submitted. Edits and deletions share a rate
+// limit per client IP, see DeleteCarHandler. Banned client IP addresses can't
+// edit cars.
+func PatchCarHandler(
+	persistence services.Persistence,
+	limits services.RateLimitStore,
+	ipLimit services.RateLimit,
+	resolver clientip.Resolver,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("patch_car"),
+			instrumenting.Endpoint(metrics, "patch_car"),
+			middlewares.IPRateLimiter(limits, "car_edits", ipLimit),
+			middlewares.BanEnforcer(persistence),
+		)(patchCarEndpoint(persistence, metrics)),
+		patchCarDecoder(resolver),
+		encoders.JSONResponseEncoder,
+		options...,
+	)
+}
+
+func deleteCarEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		r := request.(carEditRequest)
+		if err := persistence.DeleteCar(ctx, r.id, r.editTokenHash); err != nil {
+			return nil, carEditError(
+				errors.WithMessage(err, "error deleting car"),
+				"car_delete_failed",
+				"error deleting car")
+		}
+		metrics.CarEdits.With("action", "delete").Add(1)
+		return nil, nil
+	}
+}
+
+// DeleteCarHandler removes a car from the map. The request must have the edit
+// token that was returned when the car was submitted. Edits and deletions
+// share a rate limit per client IP, see PatchCarHandler. Banned client IP
+// addresses can't delete cars.
+func DeleteCarHandler(
+	persistence services.Persistence,
+	limits services.RateLimitStore,
+	ipLimit services.RateLimit,
+	resolver clientip.Resolver,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("delete_car"),
+			instrumenting.Endpoint(metrics, "delete_car"),
+			middlewares.IPRateLimiter(limits, "car_edits", ipLimit),
+			middlewares.BanEnforcer(persistence),
+		)(deleteCarEndpoint(persistence, metrics)),
+		func(_ context.Context, r *http.Request) (interface{}, error) {
+			return decodeCarEditRequest(r, resolver)
+		},
+		encoders.NoContentResponseEncoder,
+		options...,
+	)
+}
@@ -0,0 +1,157 @@
+package mapblocks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+func TestCarEditHandlersBadRequest(t *testing.T) {
+	tests := []struct {
+		description      string
+		method           string
+		id               string
+		editToken        string
+		body             string
+		expectedStatus   int
+		expectedCode     string
+		expectedPointers map[string]string
+	}{
+		{
+			description:    "Updates without an edit token should return HTTP 401",
+			method:         http.MethodPatch,
+			id:             "1",
+			body:           `{"year": 1999}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "edit_token_required",
+		},
+		{
+			description:    "Deletes without an edit token should return HTTP 401",
+			method:         http.MethodDelete,
+			id:             "1",
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   "edit_token_required",
+		},
+		{
+			description:    "Non-integer car IDs should return HTTP 400",
+			method:         http.MethodDelete,
+			id:             "abc",
+			editToken:      "token",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_car_id",
+		},
+		{
+			description:    "Empty updates should be reported",
+			method:         http.MethodPatch,
+			id:             "1",
+			editToken:      "token",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"": "minProperties",
+			},
+		},
+		{
+			description:    "Every schema violation should be reported",
+			method:         http.MethodPatch,
+			id:             "1",
+			editToken:      "token",
+			body:           `{"year": 1800, "make": "M", "recaptcha": "token"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/year":      "minimum",
+				"/make":      "minLength",
+				"/recaptcha": "additionalProperties",
+			},
+		},
+		{
+			description:    "Whitespace-only makes and models should be reported",
+			method:         http.MethodPatch,
+			id:             "1",
+			editToken:      "token",
+			body:           `{"make": "  ", "model": "\t"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/make":  "minLength",
+				"/model": "minLength",
+			},
+		},
+		{
+			description:    "Latitude without longitude should be reported",
+			method:         http.MethodPatch,
+			id:             "1",
+			editToken:      "token",
+			body:           `{"latitude": 45.5}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/longitude": "required",
+			},
+		},
+		{
+			description:    "Longitude without latitude should be reported",
+			method:         http.MethodPatch,
+			id:             "1",
+			editToken:      "token",
+			body:           `{"longitude": -122.6}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/latitude": "required",
+			},
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Persistence service.
+	handlers := map[string]http.Handler{
+		http.MethodPatch: PatchCarHandler(
+			services.Persistence{},
+			nil,
+			services.RateLimit{},
+			clientip.Resolver{},
+			instrumenting.NewDiscard(),
+			discardLogger),
+		http.MethodDelete: DeleteCarHandler(
+			services.Persistence{},
+			nil,
+			services.RateLimit{},
+			clientip.Resolver{},
+			instrumenting.NewDiscard(),
+			discardLogger),
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(test.method, "/cars/"+test.id, strings.NewReader(test.body))
+			req = mux.SetURLVars(req, map[string]string{"id": test.id})
+			if test.editToken != "" {
+				req.Header.Set(apiv1.EditTokenHeader, test.editToken)
+			}
+			recorder := httptest.NewRecorder()
+			handlers[test.method].ServeHTTP(recorder, req)
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+
+			p, pointers := problemPointers(t, recorder)
+			assert.Equal(t, test.expectedCode, p.Code, "Expected error codes to match")
+			if test.expectedPointers != nil {
+				assert.Equal(t, test.expectedPointers, pointers, "Expected field errors to match")
+			}
+		})
+	}
+}
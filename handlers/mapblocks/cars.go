@@ -2,13 +2,12 @@ package mapblocks
 
 import (
 	"context"
-	"encoding/json"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
@@ -17,41 +16,38 @@ import (
 	"github.com/shopspring/decimal"
 	"github.com/xeipuuv/gojsonschema"
 
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/decoders"
 	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
 	"github.com/matthewdale/manualsmap.com/middlewares"
 	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+	"github.com/matthewdale/manualsmap.com/tracing"
 )
 
 type getCarsRequest struct {
 	mapBlockID int
 }
 
-type carResponse struct {
-	Year         int    `json:"year"`
-	Make         string `json:"make"`
-	Model        string `json:"model"`
-	Trim         string `json:"trim"`
-	Color        string `json:"color"`
-	ImageURL     string `json:"imageUrl"`
-	ThumbnailURL string `json:"thumbnailUrl"`
-}
-
-type getCarsResponse struct {
-	Cars []carResponse `json:"cars"`
-}
-
 func getCarsEndpoint(persistence services.Persistence, cloudinary services.Cloudinary) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
-		cars, err := persistence.GetCars(request.(getCarsRequest).mapBlockID)
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		cars, err := persistence.GetCars(ctx, request.(getCarsRequest).mapBlockID)
 		if err != nil {
 			return nil, encoders.NewJSONError(
 				errors.WithMessage(err, "error getting car"),
-				http.StatusInternalServerError)
+				http.StatusInternalServerError,
+				"cars_failed",
+				"error getting cars")
 		}
 
-		carResponses := make([]carResponse, 0, len(cars))
+		carResponses := make([]apiv1.Car, 0, len(cars))
 		for _, car := range cars {
-			carResponses = append(carResponses, carResponse{
+			carResponses = append(carResponses, apiv1.Car{
+				ID:           car.ID,
+				MapBlockID:   car.MapBlockID,
 				Year:         car.Year,
 				Make:         car.Make,
 				Model:        car.Model,
@@ -61,42 +57,65 @@ func getCarsEndpoint(persistence services.Persistence, cloudinary services.Cloud
 				ThumbnailURL: cloudinary.URL(car.Image, "c_limit,w_300").String(),
 			})
 		}
-		return getCarsResponse{Cars: carResponses}, nil
+		return apiv1.Cars{Cars: carResponses}, nil
 	}
 }
 
-func GetCarsHandler(persistence services.Persistence, cloudinary services.Cloudinary) http.Handler {
+func GetCarsHandler(
+	persistence services.Persistence,
+	cloudinary services.Cloudinary,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		getCarsEndpoint(persistence, cloudinary),
+		endpoint.Chain(
+			tracing.Endpoint("get_mapblock_cars"),
+			instrumenting.Endpoint(metrics, "get_mapblock_cars"),
+		)(getCarsEndpoint(persistence, cloudinary)),
 		func(_ context.Context, r *http.Request) (interface{}, error) {
 			vars := mux.Vars(r)
 			id, ok := vars["id"]
 			if !ok {
 				return nil, encoders.NewJSONError(
-					errors.New("invalid request, missing {id} in path"),
-					http.StatusBadRequest)
+					nil,
+					http.StatusBadRequest,
+					"missing_map_block_id",
+					"invalid request, missing {id} in path")
 			}
 			mapBlockID, err := strconv.Atoi(id)
 			if err != nil {
 				return nil, encoders.NewJSONError(
 					errors.WithMessage(err, "invalid {id} format, must be integer"),
-					http.StatusBadRequest)
+					http.StatusBadRequest,
+					"invalid_map_block_id",
+					"invalid {id} format, must be integer")
 			}
 			return getCarsRequest{mapBlockID: mapBlockID}, nil
 		},
 		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
 
-func GetCarsSchemaHandler() http.Handler {
+func GetCarsSchemaHandler(metrics instrumenting.Metrics, logger *slog.Logger) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		func(_ context.Context, request interface{}) (interface{}, error) {
+		endpoint.Chain(
+			tracing.Endpoint("get_cars_schema"),
+			instrumenting.Endpoint(metrics, "get_cars_schema"),
+		)(func(_ context.Context, request interface{}) (interface{}, error) {
 			return postCarsRequestSchema, nil
-		},
+		}),
 		func(_ context.Context, r *http.Request) (interface{}, error) {
 			return nil, nil
 		},
 		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
 
@@ -106,7 +125,7 @@ var postCarsRequestSchema = map[string]interface{}{
 	"type":    "object",
 	"properties": map[string]interface{}{
 		"year": map[string]interface{}{
-			"type":    "number",
+			"type":    "integer",
 			"minimum": 1900,
 			"maximum": 2100,
 		},
@@ -146,6 +165,7 @@ var postCarsRequestSchema = map[string]interface{}{
 			"type": "string",
 		},
 	},
+	"additionalProperties": false,
 	"required": []string{
 		"year",
 		"make",
@@ -166,20 +186,47 @@ func init() {
 	}
 }
 
+// trimCarFields trims the whitespace around the car's text fields, like the
+// database does when storing them, and returns errors for the fields that are
+// shorter than the schema's minLength once trimmed. The schema only checks the
+// untrimmed lengths, so a whitespace-only make or model would pass it and then
+// fail the database constraints. Nil fields are skipped.
+func trimCarFields(carMake, model, trim, color *string) []encoders.FieldError {
+	properties := postCarsRequestSchema["properties"].(map[string]interface{})
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"make", carMake},
+		{"model", model},
+		{"trim", trim},
+		{"color", color},
+	}
+	var fieldErrors []encoders.FieldError
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+		*field.value = strings.TrimSpace(*field.value)
+		minLength, _ := properties[field.name].(map[string]interface{})["minLength"].(int)
+		if utf8.RuneCountInString(*field.value) < minLength {
+			fieldErrors = append(fieldErrors, encoders.FieldError{
+				Pointer: encoders.JSONPointer(field.name),
+				Keyword: "minLength",
+				Message: field.name + " must have at least " + strconv.Itoa(minLength) +
+					" characters other than whitespace",
+			})
+		}
+	}
+	return fieldErrors
+}
+
 type postCarsRequest struct {
-	Year               int             `json:"year"`
-	Make               string          `json:"make"`
-	Model              string          `json:"model"`
-	Trim               string          `json:"trim"`
-	Color              string          `json:"color"`
-	Latitude           decimal.Decimal `json:"latitude"`
-	Longitude          decimal.Decimal `json:"longitude"`
-	Recaptcha          string          `json:"recaptcha"`
-	CloudinaryPublicID string          `json:"cloudinaryPublicId"`
-	remoteIP           string
+	apiv1.CarSubmission
+	remoteIP string
 }
 
-func (req postCarsRequest) RecaptchaResponse() string {
+func (req postCarsRequest) CaptchaResponse() string {
 	return req.Recaptcha
 }
 
@@ -187,103 +234,182 @@ func (req postCarsRequest) RemoteIP() string {
 	return req.remoteIP
 }
 
-type postCarsResponse struct {
-	MapBlockID int `json:"mapBlockId"`
+func (req postCarsRequest) MapBlockKey() string {
+	return services.MapBlockKey(req.Latitude, req.Longitude)
 }
 
-func postCarsEndpoint(persistence services.Persistence) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+func postCarsEndpoint(persistence services.Persistence, metrics instrumenting.Metrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		r := request.(postCarsRequest)
 
-		block, err := persistence.GetMapBlock(r.Latitude, r.Longitude)
+		block, err := getOrInsertMapBlock(ctx, persistence, metrics, r.Latitude, r.Longitude)
+		if err != nil {
+			return nil, err
+		}
+		token, tokenHash, err := services.NewToken()
 		if err != nil {
 			return nil, encoders.NewJSONError(
-				errors.WithMessage(err, "error getting map block"),
-				http.StatusInternalServerError)
+				err,
+				http.StatusInternalServerError,
+				"edit_token_failed",
+				"error creating edit token")
 		}
-		// TODO: Do these in a transaction so it can be rolled back in case there's a
-		// duplicate key constraint inserting the car.
-		if block == nil {
-			if err := persistence.InsertMapBlock(r.Latitude, r.Longitude); err != nil {
-				return nil, encoders.NewJSONError(
-					errors.WithMessage(err, "error inserting map block"),
-					http.StatusInternalServerError)
-			}
-			block, err = persistence.GetMapBlock(r.Latitude, r.Longitude)
-			if err != nil {
-				return nil, encoders.NewJSONError(
-					errors.WithMessage(err, "error getting map block"),
-					http.StatusInternalServerError)
-			}
+		// Cars submitted while logged in are linked to the user so they're
+		// listed by GET /me. Anonymous cars have no user.
+		var userID int
+		if user, ok := sessions.UserFromContext(ctx); ok {
+			userID = user.ID
 		}
-		err = persistence.InsertCar(
+		// TODO: Do these in a transaction so the map block can be rolled back in
+		// case there's a duplicate key constraint inserting the car.
+		id, err := persistence.InsertCar(
+			ctx,
 			block.ID,
 			r.Year,
 			r.Make,
 			r.Model,
 			r.Trim,
 			r.Color,
-			r.CloudinaryPublicID)
+			r.CloudinaryPublicID,
+			tokenHash,
+			userID)
 		if err != nil {
 			// TODO: Handle duplicate key.
 			return nil, encoders.NewJSONError(
 				errors.WithMessage(err, "error inserting car"),
-				http.StatusInternalServerError)
+				http.StatusInternalServerError,
+				"car_insert_failed",
+				"error saving car")
 		}
 
-		return postCarsResponse{MapBlockID: block.ID}, nil
+		metrics.CarSubmissions.Add(1)
+		return apiv1.CarSubmitted{ID: id, MapBlockID: block.ID, EditToken: token}, nil
 	}
 }
 
-// maxBodyBytes is the maximum number of bytes that are read
-// from the HTTP POST body into memory.
-const maxBodyBytes = 5 * 1024 * 1024
-
-func postCarsDecoder(_ context.Context, r *http.Request) (interface{}, error) {
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+// getOrInsertMapBlock returns the map block containing the coordinates,
+// inserting it if there's no car in the block yet.
+func getOrInsertMapBlock(
+	ctx context.Context,
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	latitude,
+	longitude decimal.Decimal,
+) (*services.MapBlock, error) {
+	block, err := persistence.GetMapBlock(ctx, latitude, longitude)
 	if err != nil {
 		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "error reading body"),
-			http.StatusInternalServerError)
+			errors.WithMessage(err, "error getting map block"),
+			http.StatusInternalServerError,
+			"map_block_failed",
+			"error getting map block")
 	}
-
-	result, err := postCarsRequestValidator.Validate(
-		gojsonschema.NewBytesLoader(body))
+	if block != nil {
+		return block, nil
+	}
+	inserted, err := persistence.InsertMapBlock(ctx, latitude, longitude)
 	if err != nil {
 		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "error validating JSON body"),
-			http.StatusInternalServerError)
+			errors.WithMessage(err, "error inserting map block"),
+			http.StatusInternalServerError,
+			"map_block_insert_failed",
+			"error saving map block")
 	}
-	if !result.Valid() {
-		return nil, encoders.NewJSONError(
-			// TODO: Is there a good way to display multiple errors?
-			errors.New(result.Errors()[0].String()),
-			http.StatusBadRequest)
+	// A concurrent submission may have inserted the map block first.
+	if inserted {
+		metrics.MapBlockCreations.Add(1)
 	}
-
-	var req postCarsRequest
-	err = json.Unmarshal(body, &req)
+	block, err = persistence.GetMapBlock(ctx, latitude, longitude)
 	if err != nil {
 		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "error unmarshalling JSON body"),
-			http.StatusInternalServerError)
+			errors.WithMessage(err, "error getting map block"),
+			http.StatusInternalServerError,
+			"map_block_failed",
+			"error getting map block")
 	}
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return nil, encoders.NewJSONError(
-			errors.WithMessage(err, "failed to get remote IP"),
-			http.StatusInternalServerError)
+	return block, nil
+}
+
+// maxBodyBytes is the maximum number of bytes that are read
+// from the HTTP POST body into memory.
+const maxBodyBytes = 5 * 1024 * 1024
+
+func postCarsDecoder(resolver clientip.Resolver) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		body, err := decoders.ReadBody(r, maxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		// The schema is loaded when the package is initialized, so validation
+		// only fails if the body isn't valid JSON.
+		result, err := postCarsRequestValidator.Validate(
+			gojsonschema.NewBytesLoader(body))
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error validating JSON body"),
+				http.StatusBadRequest,
+				"invalid_json",
+				"request body is not valid JSON")
+		}
+		if !result.Valid() {
+			return nil, encoders.NewValidationError(
+				"request body does not match schema",
+				encoders.SchemaFieldErrors(result.Errors()))
+		}
+
+		var req postCarsRequest
+		if err := decoders.UnmarshalJSON(body, true, &req); err != nil {
+			return nil, err
+		}
+		fieldErrors := trimCarFields(&req.Make, &req.Model, &req.Trim, &req.Color)
+		if len(fieldErrors) > 0 {
+			return nil, encoders.NewValidationError("request body does not match schema", fieldErrors)
+		}
+		ip, err := resolver.Resolve(r)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "failed to get remote IP"),
+				http.StatusInternalServerError,
+				"remote_ip_failed",
+				"failed to get remote IP")
+		}
+		req.remoteIP = ip
+		return req, nil
 	}
-	req.remoteIP = ip
-	return req, nil
 }
 
-func PostCarsHandler(persistence services.Persistence) http.Handler {
+// PostCarsHandler handles car submissions. Submitting a car doesn't require
+// logging in, but cars submitted with a session cookie are linked to the
+// logged in user. Banned client IP addresses and users can't submit cars, and
+// are rejected before their captcha is verified or rate limits are used.
+func PostCarsHandler(
+	persistence services.Persistence,
+	accounts middlewares.SessionUserGetter,
+	verifier services.CaptchaVerifier,
+	limits services.RateLimitStore,
+	ipLimit services.RateLimit,
+	blockLimit services.RateLimit,
+	resolver clientip.Resolver,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerBefore(sessions.ContextFromCookie),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		middlewares.RecaptchaValidator()(postCarsEndpoint(persistence)),
-		postCarsDecoder,
+		endpoint.Chain(
+			tracing.Endpoint("post_cars"),
+			instrumenting.Endpoint(metrics, "post_cars"),
+			middlewares.Authenticator(accounts, false),
+			middlewares.BanEnforcer(persistence),
+			middlewares.IPRateLimiter(limits, "cars", ipLimit),
+			middlewares.CaptchaValidator(verifier),
+			middlewares.BlockRateLimiter(limits, "cars", blockLimit),
+		)(postCarsEndpoint(persistence, metrics)),
+		postCarsDecoder(resolver),
 		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
@@ -0,0 +1,129 @@
+package mapblocks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/clientip"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/openapi"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+func TestPostCarsHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description      string
+		body             string
+		expectedStatus   int
+		expectedCode     string
+		expectedPointers map[string]string
+	}{
+		{
+			description:    "Malformed JSON should return HTTP 400",
+			body:           `{"year": 1999,`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "invalid_json",
+		},
+		{
+			description:    "Every schema violation should be reported",
+			body:           `{"year": 1800, "make": "M", "model": "Miata", "latitude": 45.5, "longitude": -122.6, "recaptcha": "token"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/year":  "minimum",
+				"/make":  "minLength",
+				"/color": "required",
+			},
+		},
+		{
+			description:    "Unknown fields should be reported",
+			body:           `{"year": 1999, "make": "Mazda", "model": "Miata", "color": "red", "latitude": 45.5, "longitude": -122.6, "recaptcha": "token", "vin": "123"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/vin": "additionalProperties",
+			},
+		},
+		{
+			description:    "Whitespace-only make and model should be reported",
+			body:           `{"year": 1999, "make": " M  ", "model": "   ", "color": "red", "latitude": 45.5, "longitude": -122.6, "recaptcha": "token"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "validation_failed",
+			expectedPointers: map[string]string{
+				"/make":  "minLength",
+				"/model": "minLength",
+			},
+		},
+		{
+			description:    "Oversized bodies should return HTTP 413",
+			body:           `{"make": "` + strings.Repeat("a", maxBodyBytes) + `"}`,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+			expectedCode:   "body_too_large",
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Persistence service.
+	handler := PostCarsHandler(
+		services.Persistence{},
+		services.Accounts{},
+		services.FixedVerifier(true),
+		nil,
+		services.RateLimit{},
+		services.RateLimit{},
+		clientip.Resolver{},
+		instrumenting.NewDiscard(),
+		discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/cars", strings.NewReader(test.body)))
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+
+			p, pointers := problemPointers(t, recorder)
+			assert.Equal(t, test.expectedCode, p.Code, "Expected error codes to match")
+			if test.expectedPointers != nil {
+				assert.Equal(t, test.expectedPointers, pointers, "Expected field errors to match")
+			}
+		})
+	}
+}
+
+func TestGetCarsHandlerBadRequest(t *testing.T) {
+	handler := GetCarsHandler(services.Persistence{}, services.Cloudinary{}, instrumenting.NewDiscard(), discardLogger)
+
+	recorder := httptest.NewRecorder()
+	// The handler is called without the router, so the {id} path variable
+	// is missing.
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/mapblocks/abc/cars", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+
+	p, _ := problemPointers(t, recorder)
+	assert.Equal(t, "missing_map_block_id", p.Code, "Expected error codes to match")
+}
+
+// TestOpenAPI checks that the request types match the documented schemas, and
+// that the documented schemas have the same validation rules as the schemas
+// requests are validated against.
+func TestOpenAPI(t *testing.T) {
+	assert.NoError(t, openapi.CheckBodies(
+		openapi.Body{OperationID: "postCars", Value: postCarsRequest{}},
+		openapi.Body{OperationID: "patchCar", Value: patchCarRequest{}},
+	), "Expected the documented schemas to match")
+	assert.NoError(
+		t,
+		openapi.CheckComponentSchema("CarSubmission", postCarsRequestSchema),
+		"Expected the documented POST /cars schema to match")
+	assert.NoError(
+		t,
+		openapi.CheckComponentSchema("CarUpdate", patchCarRequestSchema),
+		"Expected the documented PATCH /cars/{id} schema to match")
+}
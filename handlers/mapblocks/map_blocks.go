@@ -2,39 +2,29 @@ package mapblocks
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
+	"strconv"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
-	"github.com/gorilla/schema"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/decoders"
 	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
 	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
 )
 
-type getMapBlocksRequest struct {
-	MinLatitude  decimal.Decimal `schema:"min_latitude"`
-	MinLongitude decimal.Decimal `schema:"min_longitude"`
-	MaxLatitude  decimal.Decimal `schema:"max_latitude"`
-	MaxLongitude decimal.Decimal `schema:"max_longitude"`
-}
-
-type mapBlock struct {
-	ID        int             `json:"id"`
-	Latitude  decimal.Decimal `json:"latitude"`
-	Longitude decimal.Decimal `json:"longitude"`
-}
-
-type getMapBlocksResponse struct {
-	MapBlocks []mapBlock `json:"mapBlocks"`
-}
-
 func getEndpoint(persistence services.Persistence) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
-		r := request.(getMapBlocksRequest)
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		r := request.(apiv1.MapBlocksQuery)
 		mapBlocks, err := persistence.GetMapBlocks(
+			ctx,
 			r.MinLatitude,
 			r.MinLongitude,
 			r.MaxLatitude,
@@ -42,31 +32,130 @@ func getEndpoint(persistence services.Persistence) endpoint.Endpoint {
 		if err != nil {
 			return nil, encoders.NewJSONError(
 				errors.WithMessage(err, "error getting map block"),
-				http.StatusInternalServerError)
+				http.StatusInternalServerError,
+				"map_block_failed",
+				"error getting map block")
 		}
-		responseBlocks := make([]mapBlock, 0, len(mapBlocks))
+		responseBlocks := make([]apiv1.MapBlock, 0, len(mapBlocks))
 		for _, block := range mapBlocks {
-			responseBlocks = append(responseBlocks, mapBlock{
+			responseBlocks = append(responseBlocks, apiv1.MapBlock{
 				ID:        block.ID,
 				Latitude:  block.Latitude,
 				Longitude: block.Longitude,
 			})
 		}
-		return getMapBlocksResponse{MapBlocks: responseBlocks}, nil
+		return apiv1.MapBlocks{MapBlocks: responseBlocks}, nil
 	}
 }
 
 func getDecode(_ context.Context, r *http.Request) (interface{}, error) {
-	var req getMapBlocksRequest
-	decoder := schema.NewDecoder()
-	decoder.Decode(&req, r.URL.Query())
+	var req apiv1.MapBlocksQuery
+	if err := decoders.DecodeQuery(r.URL.Query(), &req); err != nil {
+		return nil, err
+	}
 	return req, nil
 }
 
-func GetHandler(persistence services.Persistence) http.Handler {
+func GetHandler(
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		getEndpoint(persistence),
+		endpoint.Chain(
+			tracing.Endpoint("get_mapblocks"),
+			instrumenting.Endpoint(metrics, "get_mapblocks"),
+		)(getEndpoint(persistence)),
 		getDecode,
 		encoders.JSONResponseEncoder,
+		options...,
+	)
+}
+
+// maxNearbyRadius is the largest radius in meters of GET /mapblocks/nearby.
+const maxNearbyRadius = 100000
+
+func getNearbyEndpoint(persistence services.Persistence) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		r := request.(apiv1.NearbyMapBlocksQuery)
+		mapBlocks, err := persistence.GetMapBlocksNear(ctx, r.Latitude, r.Longitude, r.Radius)
+		if err != nil {
+			return nil, encoders.NewJSONError(
+				errors.WithMessage(err, "error getting map blocks"),
+				http.StatusInternalServerError,
+				"map_block_failed",
+				"error getting map block")
+		}
+		responseBlocks := make([]apiv1.MapBlock, 0, len(mapBlocks))
+		for _, block := range mapBlocks {
+			responseBlocks = append(responseBlocks, apiv1.MapBlock{
+				ID:        block.ID,
+				Latitude:  block.Latitude,
+				Longitude: block.Longitude,
+			})
+		}
+		return apiv1.MapBlocks{MapBlocks: responseBlocks}, nil
+	}
+}
+
+var (
+	maxLatitude  = decimal.NewFromInt(90)
+	maxLongitude = decimal.NewFromInt(180)
+)
+
+func getNearbyDecode(_ context.Context, r *http.Request) (interface{}, error) {
+	var req apiv1.NearbyMapBlocksQuery
+	if err := decoders.DecodeQuery(r.URL.Query(), &req); err != nil {
+		return nil, err
+	}
+	var fieldErrors []encoders.FieldError
+	if req.Latitude.Abs().GreaterThan(maxLatitude) {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("latitude"),
+			Keyword: "maximum",
+			Message: "latitude must be between -90 and 90",
+		})
+	}
+	if req.Longitude.Abs().GreaterThan(maxLongitude) {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("longitude"),
+			Keyword: "maximum",
+			Message: "longitude must be between -180 and 180",
+		})
+	}
+	if req.Radius <= 0 || req.Radius > maxNearbyRadius {
+		fieldErrors = append(fieldErrors, encoders.FieldError{
+			Pointer: encoders.JSONPointer("radius"),
+			Keyword: "maximum",
+			Message: "radius must be greater than 0 and at most " + strconv.Itoa(maxNearbyRadius) + " meters",
+		})
+	}
+	if len(fieldErrors) > 0 {
+		return nil, encoders.NewValidationError("invalid query parameters", fieldErrors)
+	}
+	return req, nil
+}
+
+// GetNearbyHandler returns up to 100 map blocks with cars within a radius of
+// a location, nearest first.
+func GetNearbyHandler(
+	persistence services.Persistence,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+	return httptransport.NewServer(
+		endpoint.Chain(
+			tracing.Endpoint("get_mapblocks_nearby"),
+			instrumenting.Endpoint(metrics, "get_mapblocks_nearby"),
+		)(getNearbyEndpoint(persistence)),
+		getNearbyDecode,
+		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
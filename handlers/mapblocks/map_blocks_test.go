@@ -0,0 +1,147 @@
+package mapblocks
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type problem struct {
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Errors []struct {
+		Pointer string `json:"pointer"`
+		Keyword string `json:"keyword"`
+	} `json:"errors"`
+}
+
+// problemPointers returns the field error pointers and keywords from a problem
+// details response.
+func problemPointers(t *testing.T, recorder *httptest.ResponseRecorder) (problem, map[string]string) {
+	var p problem
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &p), "Expected a JSON body")
+	pointers := make(map[string]string)
+	for _, fieldErr := range p.Errors {
+		pointers[fieldErr.Pointer] = fieldErr.Keyword
+	}
+	return p, pointers
+}
+
+func TestGetHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description      string
+		query            string
+		expectedPointers map[string]string
+	}{
+		{
+			description: "Missing parameters should be reported",
+			query:       "min_latitude=45.5",
+			expectedPointers: map[string]string{
+				"/min_longitude": "required",
+				"/max_latitude":  "required",
+				"/max_longitude": "required",
+			},
+		},
+		{
+			description: "Invalid parameters should be reported",
+			query:       "min_latitude=north&min_longitude=-122.7&max_latitude=45.6&max_longitude=-122.6",
+			expectedPointers: map[string]string{
+				"/min_latitude": "type",
+			},
+		},
+		{
+			description: "Unknown parameters should be reported",
+			query:       "min_latitude=45.5&min_longitude=-122.7&max_latitude=45.6&max_longitude=-122.6&zoom=3",
+			expectedPointers: map[string]string{
+				"/zoom": "additionalProperties",
+			},
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Persistence service.
+	handler := GetHandler(services.Persistence{}, instrumenting.NewDiscard(), discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/mapblocks?"+test.query, nil))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+
+			p, pointers := problemPointers(t, recorder)
+			assert.Equal(t, "validation_failed", p.Code, "Expected error codes to match")
+			assert.Equal(t, test.expectedPointers, pointers, "Expected field errors to match")
+		})
+	}
+}
+
+func TestGetNearbyHandlerBadRequest(t *testing.T) {
+	tests := []struct {
+		description      string
+		query            string
+		expectedPointers map[string]string
+	}{
+		{
+			description: "Missing parameters should be reported",
+			query:       "latitude=45.5",
+			expectedPointers: map[string]string{
+				"/longitude": "required",
+				"/radius":    "required",
+			},
+		},
+		{
+			description: "Coordinates out of range should be reported",
+			query:       "latitude=91&longitude=-181&radius=1000",
+			expectedPointers: map[string]string{
+				"/latitude":  "maximum",
+				"/longitude": "maximum",
+			},
+		},
+		{
+			description: "Radiuses that are too large should be reported",
+			query:       "latitude=45.5&longitude=-122.7&radius=100001",
+			expectedPointers: map[string]string{
+				"/radius": "maximum",
+			},
+		},
+		{
+			description: "Radiuses that aren't positive should be reported",
+			query:       "latitude=45.5&longitude=-122.7&radius=0",
+			expectedPointers: map[string]string{
+				"/radius": "maximum",
+			},
+		},
+	}
+
+	// Requests that fail decoding never reach the database, so use an empty
+	// Persistence service.
+	handler := GetNearbyHandler(services.Persistence{}, instrumenting.NewDiscard(), discardLogger)
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/mapblocks/nearby?"+test.query, nil))
+			assert.Equal(t, http.StatusBadRequest, recorder.Code, "Expected HTTP 400")
+
+			p, pointers := problemPointers(t, recorder)
+			assert.Equal(t, "validation_failed", p.Code, "Expected error codes to match")
+			assert.Equal(t, test.expectedPointers, pointers, "Expected field errors to match")
+		})
+	}
+}
@@ -4,36 +4,50 @@ package mapkit
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
 
 	"github.com/go-kit/kit/endpoint"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/pkg/errors"
 
+	"github.com/matthewdale/manualsmap.com/apiv1"
 	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/instrumenting"
+	"github.com/matthewdale/manualsmap.com/logging"
 	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/tracing"
 )
 
-type getTokenResponse struct {
-	Token string `json:"token"`
-}
-
 func getTokenEndpoint(mapkit services.AppleMapkit) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		token, err := mapkit.GetToken()
 		if err != nil {
 			return nil, encoders.NewJSONError(
 				errors.WithMessage(err, "error getting token"),
-				http.StatusInternalServerError)
+				http.StatusInternalServerError,
+				"token_failed",
+				"error getting token")
 		}
-		return getTokenResponse{Token: token}, nil
+		return apiv1.MapkitToken{Token: token}, nil
 	}
 }
 
-func GetTokenHandler(mapkit services.AppleMapkit) http.Handler {
+func GetTokenHandler(
+	mapkit services.AppleMapkit,
+	metrics instrumenting.Metrics,
+	logger *slog.Logger,
+) http.Handler {
+	options := append(
+		logging.ServerOptions(logger),
+		httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
 	return httptransport.NewServer(
-		getTokenEndpoint(mapkit),
+		endpoint.Chain(
+			tracing.Endpoint("get_mapkit_token"),
+			instrumenting.Endpoint(metrics, "get_mapkit_token"),
+		)(getTokenEndpoint(mapkit)),
 		func(_ context.Context, r *http.Request) (interface{}, error) { return nil, nil },
 		encoders.JSONResponseEncoder,
+		options...,
 	)
 }
@@ -0,0 +1,134 @@
+// Package health provides HTTP handlers that report whether the API is alive
+// and ready to serve requests, and which build is running.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Build information set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/matthewdale/manualsmap.com/health.commit=$(git rev-parse HEAD)"
+//
+// If they aren't set, the VCS information embedded by the Go toolchain is
+// used, if there is any.
+var (
+	commit    string
+	buildTime string
+)
+
+// Check reports an error if a dependency of the API is not ready.
+type Check func(ctx context.Context) error
+
+// Checks is a set of named readiness checks.
+type Checks map[string]Check
+
+// Run runs all checks in name order and returns the first error, annotated
+// with the name of the check that failed.
+func (checks Checks) Run(ctx context.Context) error {
+	for _, name := range checks.names() {
+		if err := checks[name](ctx); err != nil {
+			return errors.WithMessagef(err, "%s check failed", name)
+		}
+	}
+	return nil
+}
+
+func (checks Checks) names() []string {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HealthzHandler responds with HTTP 200 as long as the process is able to
+// handle requests.
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+type readyzResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ReadyzHandler runs all checks and responds with HTTP 200 if they all pass or
+// HTTP 503 if any fail. Each check must finish within the timeout. Errors are
+// logged rather than returned to the client because they may contain
+// connection details.
+func ReadyzHandler(checks Checks, timeout time.Duration, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		res := readyzResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+		status := http.StatusOK
+		for _, name := range checks.names() {
+			if err := checks[name](ctx); err != nil {
+				logger.WarnContext(ctx, "readiness check failed", "check", name, "error", err)
+				res.Checks[name] = "failed"
+				res.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			res.Checks[name] = "ok"
+		}
+		writeJSON(w, status, res)
+	})
+}
+
+// Version describes the running build.
+type Version struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// BuildVersion returns the Version of the running binary.
+func BuildVersion() Version {
+	v := Version{
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = setting.Value
+			case setting.Key == "vcs.time" && v.BuildTime == "":
+				v.BuildTime = setting.Value
+			}
+		}
+	}
+	return v
+}
+
+// VersionHandler responds with the Version of the running binary.
+func VersionHandler() http.Handler {
+	v := BuildVersion()
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, v)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// Probes must always see the current state.
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
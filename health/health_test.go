@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/openapi"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func passing(context.Context) error { return nil }
+
+func failing(context.Context) error { return errors.New("connection refused") }
+
+func TestReadyzHandler(t *testing.T) {
+	tests := []struct {
+		description    string
+		checks         Checks
+		expectedStatus int
+		expected       readyzResponse
+	}{
+		{
+			description:    "Passing checks should return HTTP 200",
+			checks:         Checks{"database": passing, "schema": passing},
+			expectedStatus: http.StatusOK,
+			expected: readyzResponse{
+				Status: "ok",
+				Checks: map[string]string{"database": "ok", "schema": "ok"},
+			},
+		},
+		{
+			description:    "Any failing check should return HTTP 503",
+			checks:         Checks{"database": failing, "schema": passing},
+			expectedStatus: http.StatusServiceUnavailable,
+			expected: readyzResponse{
+				Status: "unavailable",
+				Checks: map[string]string{"database": "failed", "schema": "ok"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			recorder := httptest.NewRecorder()
+			ReadyzHandler(test.checks, time.Second, discardLogger).ServeHTTP(
+				recorder,
+				httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, test.expectedStatus, recorder.Code, "Expected status codes to match")
+
+			var actual readyzResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &actual)
+			assert.NoError(t, err, "Expected no error decoding response")
+			assert.Equal(t, test.expected, actual, "Expected responses to match")
+		})
+	}
+}
+
+func TestChecksRun(t *testing.T) {
+	err := Checks{"database": passing, "schema": failing}.Run(context.Background())
+	assert.EqualError(
+		t,
+		err,
+		"schema check failed: connection refused",
+		"Expected the failed check to be named in the error")
+
+	err = Checks{"database": passing}.Run(context.Background())
+	assert.NoError(t, err, "Expected no error if all checks pass")
+}
+
+func TestVersionHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	VersionHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "Expected HTTP 200")
+
+	var actual Version
+	err := json.Unmarshal(recorder.Body.Bytes(), &actual)
+	assert.NoError(t, err, "Expected no error decoding response")
+	assert.Equal(t, BuildVersion(), actual, "Expected versions to match")
+	assert.NotEmpty(t, actual.GoVersion, "Expected the Go version to be set")
+}
+
+func TestOpenAPI(t *testing.T) {
+	assert.NoError(t, openapi.CheckBodies(
+		openapi.Body{OperationID: "getReadyz", Status: "200", Value: readyzResponse{}},
+		openapi.Body{OperationID: "getReadyz", Status: "503", Value: readyzResponse{}},
+		openapi.Body{OperationID: "getVersion", Status: "200", Value: Version{}},
+	), "Expected the documented schemas to match")
+}
@@ -0,0 +1,173 @@
+// Package instrumenting provides go-kit instrumenting middleware that records
+// Prometheus metrics for the API endpoints and services.
+package instrumenting
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+// Metrics holds all metrics recorded by the API.
+type Metrics struct {
+	// Requests counts endpoint calls by route and success.
+	Requests metrics.Counter
+	// RequestLatency records endpoint latency in seconds by route and success.
+	RequestLatency metrics.Histogram
+	// QueryDuration records Persistence query durations in seconds by method
+	// and success.
+	QueryDuration metrics.Histogram
+	// CaptchaVerifications counts captcha verifications by outcome, one of
+	// "valid", "invalid" or "error".
+	CaptchaVerifications metrics.Counter
+	// Notifications counts Cloudinary notifications received by type.
+	Notifications metrics.Counter
+	// CarSubmissions counts cars successfully submitted.
+	CarSubmissions metrics.Counter
+	// MapBlockCreations counts map blocks created by car submissions.
+	MapBlockCreations metrics.Counter
+	// CarEdits counts cars successfully edited by their submitters, by
+	// action, one of "update" or "delete".
+	CarEdits metrics.Counter
+	// Logins counts login steps by step, one of "link_sent", "login",
+	// "oidc_login" or "logout".
+	Logins metrics.Counter
+	// AdminActions counts successful admin and moderator actions by action,
+	// like "merge_cars" or "ban".
+	AdminActions metrics.Counter
+}
+
+const namespace = "manualsmap"
+
+// NewPrometheus creates Metrics that are registered with the default
+// Prometheus registry.
+func NewPrometheus() Metrics {
+	return Metrics{
+		Requests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "requests_total",
+			Help:      "Number of requests handled by each route.",
+		}, []string{"route", "success"}),
+		RequestLatency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Time spent handling requests for each route, in seconds.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"route", "success"}),
+		QueryDuration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "persistence",
+			Name:      "query_duration_seconds",
+			Help:      "Time spent in each Persistence method, in seconds.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"method", "success"}),
+		CaptchaVerifications: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "captcha",
+			Name:      "verifications_total",
+			Help:      "Number of captcha verifications by outcome.",
+		}, []string{"outcome"}),
+		Notifications: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "images",
+			Name:      "notifications_total",
+			Help:      "Number of Cloudinary notifications received by type.",
+		}, []string{"type"}),
+		CarSubmissions: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cars",
+			Name:      "submissions_total",
+			Help:      "Number of cars submitted.",
+		}, nil),
+		MapBlockCreations: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "mapblocks",
+			Name:      "created_total",
+			Help:      "Number of map blocks created.",
+		}, nil),
+		CarEdits: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cars",
+			Name:      "edits_total",
+			Help:      "Number of cars edited by their submitters, by action.",
+		}, []string{"action"}),
+		Logins: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "accounts",
+			Name:      "logins_total",
+			Help:      "Number of login links sent, logins and logouts, by step.",
+		}, []string{"step"}),
+		AdminActions: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "admin",
+			Name:      "actions_total",
+			Help:      "Number of admin and moderator actions, by action.",
+		}, []string{"action"}),
+	}
+}
+
+// NewDiscard creates Metrics that aren't recorded anywhere, for tests and
+// commands that don't expose metrics.
+func NewDiscard() Metrics {
+	return Metrics{
+		Requests:             discard.NewCounter(),
+		RequestLatency:       discard.NewHistogram(),
+		QueryDuration:        discard.NewHistogram(),
+		CaptchaVerifications: discard.NewCounter(),
+		Notifications:        discard.NewCounter(),
+		CarSubmissions:       discard.NewCounter(),
+		MapBlockCreations:    discard.NewCounter(),
+		CarEdits:             discard.NewCounter(),
+		Logins:               discard.NewCounter(),
+		AdminActions:         discard.NewCounter(),
+	}
+}
+
+// Endpoint records the number of calls and latency of the endpoint for the
+// given route.
+func Endpoint(m Metrics, route string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				labels := []string{"route", route, "success", strconv.FormatBool(err == nil)}
+				m.Requests.With(labels...).Add(1)
+				m.RequestLatency.With(labels...).Observe(time.Since(begin).Seconds())
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+type captchaVerifier struct {
+	next          services.CaptchaVerifier
+	verifications metrics.Counter
+}
+
+// CaptchaVerifier records the outcome of every verification made by the
+// given verifier.
+func CaptchaVerifier(m Metrics, next services.CaptchaVerifier) services.CaptchaVerifier {
+	return captchaVerifier{next: next, verifications: m.CaptchaVerifications}
+}
+
+func (v captchaVerifier) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	valid, err := v.next.Verify(ctx, response, remoteIP)
+	outcome := "invalid"
+	switch {
+	case err != nil:
+		outcome = "error"
+	case valid:
+		outcome = "valid"
+	}
+	v.verifications.With("outcome", outcome).Add(1)
+	return valid, err
+}
@@ -0,0 +1,114 @@
+package instrumenting
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		description    string
+		err            error
+		expectedLabels []string
+	}{
+		{
+			description:    "Successful requests should be labeled successful",
+			expectedLabels: []string{"route", "post_cars", "success", "true"},
+		},
+		{
+			description:    "Failed requests should be labeled unsuccessful",
+			err:            errors.New("failed"),
+			expectedLabels: []string{"route", "post_cars", "success", "false"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			m := NewDiscard()
+			requests := &recordingCounter{}
+			m.Requests = requests
+
+			e := Endpoint(m, "post_cars")(func(context.Context, interface{}) (interface{}, error) {
+				return nil, test.err
+			})
+			_, err := e(context.Background(), nil)
+			assert.Equal(t, test.err, err, "Expected errors to match")
+			assert.Equal(t, test.expectedLabels, requests.labels, "Expected request labels to match")
+			assert.Equal(t, 1.0, requests.value, "Expected one request to be counted")
+		})
+	}
+}
+
+func TestCaptchaVerifier(t *testing.T) {
+	tests := []struct {
+		description     string
+		verifier        services.CaptchaVerifier
+		expectedOutcome string
+	}{
+		{
+			description:     "Valid responses should be counted as valid",
+			verifier:        services.FixedVerifier(true),
+			expectedOutcome: "valid",
+		},
+		{
+			description:     "Invalid responses should be counted as invalid",
+			verifier:        services.FixedVerifier(false),
+			expectedOutcome: "invalid",
+		},
+		{
+			description:     "Verification errors should be counted as errors",
+			verifier:        failingVerifier{},
+			expectedOutcome: "error",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			m := NewDiscard()
+			verifications := &recordingCounter{}
+			m.CaptchaVerifications = verifications
+
+			CaptchaVerifier(m, test.verifier).Verify(context.Background(), "token", "127.0.0.1")
+			assert.Equal(
+				t,
+				[]string{"outcome", test.expectedOutcome},
+				verifications.labels,
+				"Expected verification labels to match")
+			assert.Equal(t, 1.0, verifications.value, "Expected one verification to be counted")
+		})
+	}
+}
+
+// recordingCounter is a metrics.Counter that records the labels of the most
+// recent call to With and the total of all values added.
+type recordingCounter struct {
+	labels []string
+	value  float64
+}
+
+func (c *recordingCounter) With(labelValues ...string) metrics.Counter {
+	c.labels = labelValues
+	return c
+}
+
+func (c *recordingCounter) Add(delta float64) {
+	c.value += delta
+}
+
+type failingVerifier struct{}
+
+func (failingVerifier) Verify(_ context.Context, _, _ string) (bool, error) {
+	return false, errors.New("provider unavailable")
+}
@@ -0,0 +1,88 @@
+// Package jobs provides maintenance jobs that run outside of the HTTP request
+// lifecycle.
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+// ImageStore is the subset of the Persistence service used to find and mark
+// orphaned images.
+type ImageStore interface {
+	GetOrphanedImages(ctx context.Context, createdBefore time.Time) ([]services.CloudinaryImage, error)
+	UpdateImage(ctx context.Context, publicID, status string) error
+}
+
+// ImageDeleter deletes images from the image hosting backend.
+type ImageDeleter interface {
+	DeleteImages(ctx context.Context, publicIDs []string) error
+}
+
+// ImageCollector deletes images that were uploaded but never attached to a
+// car, e.g. because the user abandoned the "add car" form or removed the image
+// before submitting.
+type ImageCollector struct {
+	store       ImageStore
+	deleter     ImageDeleter
+	gracePeriod time.Duration
+	logger      *slog.Logger
+	now         func() time.Time
+}
+
+// NewImageCollector creates a new ImageCollector. Images are only collected
+// once they are older than the grace period, which must be long enough for a
+// user to finish submitting a car after uploading an image.
+func NewImageCollector(
+	store ImageStore,
+	deleter ImageDeleter,
+	gracePeriod time.Duration,
+	logger *slog.Logger,
+) ImageCollector {
+	return ImageCollector{
+		store:       store,
+		deleter:     deleter,
+		gracePeriod: gracePeriod,
+		logger:      logger,
+		now:         time.Now,
+	}
+}
+
+// Collect deletes all orphaned images from the image backend and marks them
+// as deleted, returning the collected images. If dryRun is true, Collect
+// returns the images that would be collected without deleting anything.
+func (c ImageCollector) Collect(ctx context.Context, dryRun bool) ([]services.CloudinaryImage, error) {
+	images, err := c.store.GetOrphanedImages(ctx, c.now().Add(-c.gracePeriod))
+	if err != nil {
+		return nil, errors.WithMessage(err, "error getting orphaned images")
+	}
+	for _, img := range images {
+		c.logger.Info(
+			"found orphaned image",
+			"public_id", img.PublicID,
+			"format", img.Format,
+			"dry_run", dryRun)
+	}
+	if dryRun || len(images) == 0 {
+		return images, nil
+	}
+
+	publicIDs := make([]string, 0, len(images))
+	for _, img := range images {
+		publicIDs = append(publicIDs, img.PublicID)
+	}
+	if err := c.deleter.DeleteImages(ctx, publicIDs); err != nil {
+		return nil, errors.WithMessage(err, "error deleting images")
+	}
+	for _, publicID := range publicIDs {
+		if err := c.store.UpdateImage(ctx, publicID, "deleted"); err != nil {
+			return nil, errors.WithMessagef(err, "error marking image %q as deleted", publicID)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,107 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+type fakeImageStore struct {
+	images        []services.CloudinaryImage
+	createdBefore time.Time
+	statuses      map[string]string
+}
+
+func (store *fakeImageStore) GetOrphanedImages(_ context.Context, createdBefore time.Time) ([]services.CloudinaryImage, error) {
+	store.createdBefore = createdBefore
+	return store.images, nil
+}
+
+func (store *fakeImageStore) UpdateImage(_ context.Context, publicID, status string) error {
+	store.statuses[publicID] = status
+	return nil
+}
+
+type fakeImageDeleter struct {
+	deleted []string
+	err     error
+}
+
+func (deleter *fakeImageDeleter) DeleteImages(_ context.Context, publicIDs []string) error {
+	if deleter.err != nil {
+		return deleter.err
+	}
+	deleter.deleted = append(deleter.deleted, publicIDs...)
+	return nil
+}
+
+func TestCollect(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	images := []services.CloudinaryImage{
+		{PublicID: "abandoned", Format: "jpg"},
+		{PublicID: "removed", Format: "png"},
+	}
+
+	tests := []struct {
+		description      string
+		dryRun           bool
+		deleteErr        error
+		expectedDeleted  []string
+		expectedStatuses map[string]string
+		expectErr        bool
+	}{
+		{
+			description:     "Should delete and mark orphaned images",
+			expectedDeleted: []string{"abandoned", "removed"},
+			expectedStatuses: map[string]string{
+				"abandoned": "deleted",
+				"removed":   "deleted",
+			},
+		},
+		{
+			description:      "Dry run should not delete or mark images",
+			dryRun:           true,
+			expectedStatuses: map[string]string{},
+		},
+		{
+			description:      "Should not mark images if the backend fails to delete them",
+			deleteErr:        errors.New("backend unavailable"),
+			expectedStatuses: map[string]string{},
+			expectErr:        true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			store := &fakeImageStore{
+				images:   images,
+				statuses: make(map[string]string),
+			}
+			deleter := &fakeImageDeleter{err: test.deleteErr}
+			collector := NewImageCollector(store, deleter, 24*time.Hour, slog.Default())
+			collector.now = func() time.Time { return now }
+
+			collected, err := collector.Collect(context.Background(), test.dryRun)
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+			} else {
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, images, collected, "Expected collected images to match")
+			}
+			assert.Equal(
+				t,
+				now.Add(-24*time.Hour),
+				store.createdBefore,
+				"Expected only images older than the grace period to be collected")
+			assert.Equal(t, test.expectedDeleted, deleter.deleted, "Expected deleted images to match")
+			assert.Equal(t, test.expectedStatuses, store.statuses, "Expected image statuses to match")
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Package logging provides structured request logging for the go-kit HTTP
+// handlers.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+
+	"github.com/matthewdale/manualsmap.com/requestid"
+)
+
+type contextKey struct{}
+
+// requestInfo records the state of a request while it's being handled so that
+// it can be logged once the response is written.
+type requestInfo struct {
+	start time.Time
+	err   error
+}
+
+// ServerOptions returns go-kit server options that log every request handled
+// by the server exactly once, including the error if the request failed.
+func ServerOptions(logger *slog.Logger) []httptransport.ServerOption {
+	return []httptransport.ServerOption{
+		httptransport.ServerBefore(func(ctx context.Context, _ *http.Request) context.Context {
+			return context.WithValue(ctx, contextKey{}, &requestInfo{start: time.Now()})
+		}),
+		httptransport.ServerErrorHandler(errorHandler{}),
+		httptransport.ServerFinalizer(func(ctx context.Context, code int, r *http.Request) {
+			info, ok := ctx.Value(contextKey{}).(*requestInfo)
+			if !ok {
+				return
+			}
+			attrs := []slog.Attr{
+				slog.String("request_id", requestid.FromContext(ctx)),
+				slog.String("method", r.Method),
+				slog.String("route", Route(r)),
+				slog.Int("status", code),
+				slog.Duration("latency", time.Since(info.start)),
+			}
+			level := slog.LevelInfo
+			if info.err != nil {
+				attrs = append(attrs, slog.String("error", info.err.Error()))
+				level = slog.LevelWarn
+				if code >= http.StatusInternalServerError {
+					level = slog.LevelError
+				}
+			}
+			logger.LogAttrs(ctx, level, "handled request", attrs...)
+		}),
+	}
+}
+
+// Route returns the path template of the mux route that matched the request,
+// or the request path if it wasn't routed by mux.
+func Route(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// errorHandler records the request error so it can be logged with the
+// response status once the request is finished.
+type errorHandler struct{}
+
+func (errorHandler) Handle(ctx context.Context, err error) {
+	if info, ok := ctx.Value(contextKey{}).(*requestInfo); ok {
+		info.err = err
+	}
+}
+
+// New creates a logger that writes to w in the given format, either "json" or
+// "text".
+func New(w io.Writer, format string, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/requestid"
+)
+
+func TestServerOptions(t *testing.T) {
+	tests := []struct {
+		description   string
+		err           error
+		expectedLevel string
+		expectedCode  float64
+	}{
+		{
+			description:   "Successful requests should be logged at INFO",
+			expectedLevel: "INFO",
+			expectedCode:  200,
+		},
+		{
+			description:   "Client errors should be logged at WARN with the error",
+			err:           encoders.NewJSONError(nil, http.StatusBadRequest, "invalid", "invalid request"),
+			expectedLevel: "WARN",
+			expectedCode:  400,
+		},
+		{
+			description:   "Server errors should be logged at ERROR with the error",
+			err:           errors.New("database unavailable"),
+			expectedLevel: "ERROR",
+			expectedCode:  500,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			logger := New(&buf, "json", slog.LevelInfo)
+			options := append(
+				ServerOptions(logger),
+				httptransport.ServerErrorEncoder(encoders.JSONErrorEncoder))
+			server := httptransport.NewServer(
+				func(context.Context, interface{}) (interface{}, error) { return struct{}{}, test.err },
+				func(context.Context, *http.Request) (interface{}, error) { return nil, nil },
+				encoders.JSONResponseEncoder,
+				options...)
+			router := mux.NewRouter()
+			router.Path("/mapblocks/{id}/cars").Handler(server)
+
+			r := httptest.NewRequest(http.MethodGet, "/mapblocks/1/cars", nil)
+			r.Header.Set(requestid.Header, "abcd")
+			requestid.Middleware(router).ServeHTTP(httptest.NewRecorder(), r)
+
+			lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+			assert.Len(t, lines, 1, "Expected every request to be logged exactly once")
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal(lines[0], &entry), "Expected a JSON log line")
+
+			assert.Equal(t, test.expectedLevel, entry["level"], "Expected log levels to match")
+			assert.Equal(t, "abcd", entry["request_id"], "Expected request IDs to match")
+			assert.Equal(t, "GET", entry["method"], "Expected methods to match")
+			assert.Equal(t, "/mapblocks/{id}/cars", entry["route"], "Expected routes to match")
+			assert.Equal(t, test.expectedCode, entry["status"], "Expected status codes to match")
+			assert.Contains(t, entry, "latency", "Expected request latency to be logged")
+			if test.err != nil {
+				assert.Equal(t, test.err.Error(), entry["error"], "Expected the internal error to be logged")
+			} else {
+				assert.NotContains(t, entry, "error", "Expected no error to be logged")
+			}
+		})
+	}
+}
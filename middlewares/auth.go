@@ -0,0 +1,76 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+// SessionUserGetter gets the user logged in with a session token, like
+// services.Accounts.
+type SessionUserGetter interface {
+	SessionUser(ctx context.Context, sessionToken string) (*services.User, error)
+}
+
+// Authenticator stores the user logged in with the request's session cookie
+// in the context, see sessions.UserFromContext. If required is true, requests
+// without a valid session fail with HTTP 401. The handler must read the
+// session cookie with the sessions.ContextFromCookie ServerBefore option.
+func Authenticator(accounts SessionUserGetter, required bool) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			user, err := accounts.SessionUser(ctx, sessions.TokenFromContext(ctx))
+			if err != nil {
+				return nil, encoders.NewJSONError(
+					errors.WithMessage(err, "session error"),
+					http.StatusInternalServerError,
+					"session_unavailable",
+					"sessions are unavailable")
+			}
+			if user == nil {
+				if required {
+					return nil, encoders.NewJSONError(
+						nil,
+						http.StatusUnauthorized,
+						"login_required",
+						"login required")
+				}
+				return next(ctx, request)
+			}
+			return next(sessions.NewUserContext(ctx, *user), request)
+		}
+	}
+}
+
+// RoleChecker fails requests with HTTP 403 unless the logged in user's role
+// includes the role, see services.Role.Includes. It must be chained after
+// Authenticator, and requests without a logged in user fail with HTTP 401.
+func RoleChecker(role services.Role) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			user, ok := sessions.UserFromContext(ctx)
+			if !ok {
+				return nil, encoders.NewJSONError(
+					nil,
+					http.StatusUnauthorized,
+					"login_required",
+					"login required")
+			}
+			if !user.Role.Includes(role) {
+				return nil, encoders.NewJSONError(
+					nil,
+					http.StatusForbidden,
+					"forbidden",
+					fmt.Sprintf("the %s role is required", role))
+			}
+			return next(ctx, request)
+		}
+	}
+}
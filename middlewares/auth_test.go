@@ -0,0 +1,177 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+// fakeSessions is a SessionUserGetter with a single valid session token.
+type fakeSessions struct {
+	err error
+}
+
+func (fake fakeSessions) SessionUser(_ context.Context, sessionToken string) (*services.User, error) {
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	if sessionToken != "valid" {
+		return nil, nil
+	}
+	return &services.User{ID: 1, Email: "driver@example.com"}, nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	tests := []struct {
+		description  string
+		sessions     fakeSessions
+		cookie       string
+		required     bool
+		expectCalled bool
+		expectUser   bool
+		expectedCode int
+	}{
+		{
+			description:  "Valid sessions should store the user in the context",
+			cookie:       "valid",
+			required:     true,
+			expectCalled: true,
+			expectUser:   true,
+		},
+		{
+			description:  "Missing sessions should call the next endpoint if not required",
+			expectCalled: true,
+		},
+		{
+			description:  "Unknown sessions should call the next endpoint if not required",
+			cookie:       "unknown",
+			expectCalled: true,
+		},
+		{
+			description:  "Missing sessions should return HTTP 401 if required",
+			required:     true,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			description:  "Unknown sessions should return HTTP 401 if required",
+			cookie:       "unknown",
+			required:     true,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			description:  "Session errors should return HTTP 500",
+			sessions:     fakeSessions{err: errors.New("database unavailable")},
+			cookie:       "valid",
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessions.CookieName, Value: test.cookie})
+			}
+			ctx := sessions.ContextFromCookie(context.Background(), r)
+
+			called := false
+			var user services.User
+			var hasUser bool
+			next := func(ctx context.Context, _ interface{}) (interface{}, error) {
+				called = true
+				user, hasUser = sessions.UserFromContext(ctx)
+				return nil, nil
+			}
+			_, err := Authenticator(test.sessions, test.required)(next)(ctx, nil)
+			assert.Equal(t, test.expectCalled, called, "Expected next endpoint call to match")
+			assert.Equal(t, test.expectUser, hasUser, "Expected the user in the context to match")
+			if test.expectUser {
+				assert.Equal(t, services.User{ID: 1, Email: "driver@example.com"}, user, "Expected users to match")
+			}
+			if test.expectedCode == 0 {
+				assert.NoError(t, err, "Expected no error")
+				return
+			}
+			var jsonErr *encoders.JSONError
+			if assert.True(t, errors.As(err, &jsonErr), "Expected a JSONError") {
+				assert.Equal(t, test.expectedCode, jsonErr.StatusCode(), "Expected status codes to match")
+			}
+		})
+	}
+}
+
+func TestRoleChecker(t *testing.T) {
+	tests := []struct {
+		description  string
+		user         *services.User
+		role         services.Role
+		expectedCode int
+	}{
+		{
+			description: "Users with the role should call the next endpoint",
+			user:        &services.User{ID: 1, Role: services.RoleModerator},
+			role:        services.RoleModerator,
+		},
+		{
+			description: "Users with a more privileged role should call the next endpoint",
+			user:        &services.User{ID: 1, Role: services.RoleAdmin},
+			role:        services.RoleModerator,
+		},
+		{
+			description:  "Users with a less privileged role should return HTTP 403",
+			user:         &services.User{ID: 1, Role: services.RoleUser},
+			role:         services.RoleModerator,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Users without a role should return HTTP 403",
+			user:         &services.User{ID: 1},
+			role:         services.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Missing users should return HTTP 401",
+			role:         services.RoleUser,
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if test.user != nil {
+				ctx = sessions.NewUserContext(ctx, *test.user)
+			}
+			called := false
+			next := func(context.Context, interface{}) (interface{}, error) {
+				called = true
+				return nil, nil
+			}
+			_, err := RoleChecker(test.role)(next)(ctx, nil)
+			if test.expectedCode == 0 {
+				assert.NoError(t, err, "Expected no error")
+				assert.True(t, called, "Expected the next endpoint to be called")
+				return
+			}
+			assert.False(t, called, "Expected the next endpoint not to be called")
+			var jsonErr *encoders.JSONError
+			if assert.True(t, errors.As(err, &jsonErr), "Expected a JSONError") {
+				assert.Equal(t, test.expectedCode, jsonErr.StatusCode(), "Expected status codes to match")
+			}
+		})
+	}
+}
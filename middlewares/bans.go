@@ -0,0 +1,48 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+// BanChecker checks if a client IP address or user is banned, like
+// services.Persistence.
+type BanChecker interface {
+	IsBanned(ctx context.Context, ip string, userID int) (bool, error)
+}
+
+// BanEnforcer fails requests from banned client IP addresses or banned logged
+// in users with HTTP 403. Requests must implement IPRateLimitedRequest. To
+// check the logged in user, it must be chained after Authenticator.
+func BanEnforcer(bans BanChecker) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var userID int
+			if user, ok := sessions.UserFromContext(ctx); ok {
+				userID = user.ID
+			}
+			banned, err := bans.IsBanned(ctx, request.(IPRateLimitedRequest).RemoteIP(), userID)
+			if err != nil {
+				return nil, encoders.NewJSONError(
+					errors.WithMessage(err, "ban check error"),
+					http.StatusInternalServerError,
+					"bans_unavailable",
+					"bans are unavailable")
+			}
+			if banned {
+				return nil, encoders.NewJSONError(
+					nil,
+					http.StatusForbidden,
+					"banned",
+					"you are banned")
+			}
+			return next(ctx, request)
+		}
+	}
+}
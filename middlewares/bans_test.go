@@ -0,0 +1,93 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+	"github.com/matthewdale/manualsmap.com/sessions"
+)
+
+// fakeBans is a BanChecker that bans a single IP address and user.
+type fakeBans struct {
+	err error
+}
+
+func (fake fakeBans) IsBanned(_ context.Context, ip string, userID int) (bool, error) {
+	if fake.err != nil {
+		return false, fake.err
+	}
+	return ip == "192.0.2.1" || userID == 2, nil
+}
+
+type ipRequest string
+
+func (req ipRequest) RemoteIP() string {
+	return string(req)
+}
+
+func TestBanEnforcer(t *testing.T) {
+	tests := []struct {
+		description  string
+		bans         fakeBans
+		ip           string
+		user         *services.User
+		expectedCode int
+	}{
+		{
+			description: "Requests without bans should call the next endpoint",
+			ip:          "192.0.2.2",
+			user:        &services.User{ID: 1},
+		},
+		{
+			description:  "Banned IP addresses should return HTTP 403",
+			ip:           "192.0.2.1",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Banned users should return HTTP 403",
+			ip:           "192.0.2.2",
+			user:         &services.User{ID: 2},
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Ban errors should return HTTP 500",
+			bans:         fakeBans{err: errors.New("database unavailable")},
+			ip:           "192.0.2.2",
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if test.user != nil {
+				ctx = sessions.NewUserContext(ctx, *test.user)
+			}
+			called := false
+			next := func(context.Context, interface{}) (interface{}, error) {
+				called = true
+				return nil, nil
+			}
+			_, err := BanEnforcer(test.bans)(next)(ctx, ipRequest(test.ip))
+			if test.expectedCode == 0 {
+				assert.NoError(t, err, "Expected no error")
+				assert.True(t, called, "Expected the next endpoint to be called")
+				return
+			}
+			assert.False(t, called, "Expected the next endpoint not to be called")
+			var jsonErr *encoders.JSONError
+			if assert.True(t, errors.As(err, &jsonErr), "Expected a JSONError") {
+				assert.Equal(t, test.expectedCode, jsonErr.StatusCode(), "Expected status codes to match")
+			}
+		})
+	}
+}
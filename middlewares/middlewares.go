@@ -4,34 +4,38 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/dpapathanasiou/go-recaptcha"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
 	"github.com/pkg/errors"
 )
 
-type RecaptchaValidatedRequest interface {
-	RecaptchaResponse() string
+type CaptchaValidatedRequest interface {
+	CaptchaResponse() string
 	RemoteIP() string
 }
 
-func RecaptchaValidator() endpoint.Middleware {
+func CaptchaValidator(verifier services.CaptchaVerifier) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (interface{}, error) {
 			// Do an unchecked type assertion here. If the type assertion fails,
 			// the call will panic, which is OK because it's better than completely
 			// skipping request validation.
-			r := request.(RecaptchaValidatedRequest)
-			valid, err := recaptcha.Confirm(r.RemoteIP(), r.RecaptchaResponse())
+			r := request.(CaptchaValidatedRequest)
+			valid, err := verifier.Verify(ctx, r.CaptchaResponse(), r.RemoteIP())
 			if err != nil {
 				return nil, encoders.NewJSONError(
-					errors.WithMessage(err, "reCAPTCHA server error"),
-					http.StatusInternalServerError)
+					errors.WithMessage(err, "captcha server error"),
+					http.StatusInternalServerError,
+					"captcha_unavailable",
+					"captcha verification is unavailable")
 			}
 			if !valid {
 				return nil, encoders.NewJSONError(
-					errors.New("reCAPTCHA validation failed"),
-					http.StatusForbidden)
+					nil,
+					http.StatusForbidden,
+					"captcha_failed",
+					"captcha validation failed")
 			}
 			return next(ctx, request)
 		}
@@ -0,0 +1,72 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+type captchaRequest struct{}
+
+func (captchaRequest) CaptchaResponse() string { return "token" }
+func (captchaRequest) RemoteIP() string        { return "127.0.0.1" }
+
+type errVerifier struct{}
+
+func (errVerifier) Verify(_ context.Context, _, _ string) (bool, error) {
+	return false, errors.New("provider unavailable")
+}
+
+func TestCaptchaValidator(t *testing.T) {
+	tests := []struct {
+		description  string
+		verifier     services.CaptchaVerifier
+		expectCalled bool
+		expectedCode int
+	}{
+		{
+			description:  "Valid captcha should call the next endpoint",
+			verifier:     services.FixedVerifier(true),
+			expectCalled: true,
+		},
+		{
+			description:  "Invalid captcha should return HTTP 403",
+			verifier:     services.FixedVerifier(false),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Verifier error should return HTTP 500",
+			verifier:     errVerifier{},
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			called := false
+			next := func(_ context.Context, _ interface{}) (interface{}, error) {
+				called = true
+				return nil, nil
+			}
+			_, err := CaptchaValidator(test.verifier)(next)(context.Background(), captchaRequest{})
+			assert.Equal(t, test.expectCalled, called, "Expected next endpoint call to match")
+			if test.expectedCode == 0 {
+				assert.NoError(t, err, "Expected no error")
+				return
+			}
+			var jsonErr *encoders.JSONError
+			if assert.True(t, errors.As(err, &jsonErr), "Expected a JSONError") {
+				assert.Equal(t, test.expectedCode, jsonErr.StatusCode(), "Expected status codes to match")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package middlewares
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+type IPRateLimitedRequest interface {
+	RemoteIP() string
+}
+
+type BlockRateLimitedRequest interface {
+	// MapBlockKey returns a key that identifies the map block the request
+	// modifies.
+	MapBlockKey() string
+}
+
+type EmailRateLimitedRequest interface {
+	// EmailKey returns a key that identifies the email address the request
+	// sends email to.
+	EmailKey() string
+}
+
+// IPRateLimiter limits the rate of requests to the given route from each
+// client IP address.
+func IPRateLimiter(
+	store services.RateLimitStore,
+	route string,
+	limit services.RateLimit,
+) endpoint.Middleware {
+	return rateLimiter(store, limit, func(request interface{}) string {
+		return route + ":ip:" + request.(IPRateLimitedRequest).RemoteIP()
+	})
+}
+
+// BlockRateLimiter limits the rate of requests to the given route that modify
+// each map block.
+func BlockRateLimiter(
+	store services.RateLimitStore,
+	route string,
+	limit services.RateLimit,
+) endpoint.Middleware {
+	return rateLimiter(store, limit, func(request interface{}) string {
+		return route + ":block:" + request.(BlockRateLimitedRequest).MapBlockKey()
+	})
+}
+
+// EmailRateLimiter limits the rate of requests to the given route that send
+// email to each address.
+func EmailRateLimiter(
+	store services.RateLimitStore,
+	route string,
+	limit services.RateLimit,
+) endpoint.Middleware {
+	return rateLimiter(store, limit, func(request interface{}) string {
+		return route + ":email:" + request.(EmailRateLimitedRequest).EmailKey()
+	})
+}
+
+func rateLimiter(
+	store services.RateLimitStore,
+	limit services.RateLimit,
+	key func(request interface{}) string,
+) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if !limit.Enabled() {
+			return next
+		}
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			// Do an unchecked type assertion in the key func. If the type
+			// assertion fails, the call will panic, which is OK because it's
+			// better than completely skipping rate limiting.
+			wait, err := store.Take(ctx, key(request), limit, time.Now())
+			if err != nil {
+				return nil, encoders.NewJSONError(
+					errors.WithMessage(err, "rate limit error"),
+					http.StatusInternalServerError,
+					"rate_limit_unavailable",
+					"rate limiting is unavailable")
+			}
+			if wait > 0 {
+				retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+				return nil, encoders.NewJSONErrorWithHeaders(
+					nil,
+					http.StatusTooManyRequests,
+					"rate_limited",
+					"too many requests, try again later",
+					http.Header{"Retry-After": []string{retryAfter}})
+			}
+			return next(ctx, request)
+		}
+	}
+}
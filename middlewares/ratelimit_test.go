@@ -0,0 +1,89 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+type rateLimitedRequest struct {
+	ip string
+}
+
+func (req rateLimitedRequest) RemoteIP() string    { return req.ip }
+func (req rateLimitedRequest) MapBlockKey() string { return "45.5,-122.65" }
+func (req rateLimitedRequest) EmailKey() string    { return "driver@example.com" }
+
+func TestIPRateLimiter(t *testing.T) {
+	store := services.NewMemoryRateLimitStore(time.Hour)
+	limit := services.RateLimit{Limit: 1, Per: time.Hour}
+	next := func(_ context.Context, _ interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	e := IPRateLimiter(store, "cars", limit)(next)
+
+	res, err := e(context.Background(), rateLimitedRequest{ip: "10.0.0.1"})
+	assert.NoError(t, err, "Expected the first request to be allowed")
+	assert.Equal(t, "ok", res, "Expected the next endpoint to be called")
+
+	_, err = e(context.Background(), rateLimitedRequest{ip: "10.0.0.1"})
+	var jsonErr *encoders.JSONError
+	if assert.True(t, errors.As(err, &jsonErr), "Expected a JSONError") {
+		assert.Equal(t, http.StatusTooManyRequests, jsonErr.StatusCode(), "Expected HTTP 429")
+		assert.Equal(t, "3600", jsonErr.Headers().Get("Retry-After"), "Expected Retry-After to match")
+	}
+
+	_, err = e(context.Background(), rateLimitedRequest{ip: "10.0.0.2"})
+	assert.NoError(t, err, "Expected requests from other IPs to be allowed")
+}
+
+func TestBlockRateLimiter(t *testing.T) {
+	store := services.NewMemoryRateLimitStore(time.Hour)
+	limit := services.RateLimit{Limit: 1, Per: time.Hour}
+	next := func(_ context.Context, _ interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	e := BlockRateLimiter(store, "cars", limit)(next)
+
+	_, err := e(context.Background(), rateLimitedRequest{ip: "10.0.0.1"})
+	assert.NoError(t, err, "Expected the first request to be allowed")
+
+	_, err = e(context.Background(), rateLimitedRequest{ip: "10.0.0.2"})
+	assert.Error(t, err, "Expected requests from other IPs to the same block to be limited")
+}
+
+func TestEmailRateLimiter(t *testing.T) {
+	store := services.NewMemoryRateLimitStore(time.Hour)
+	limit := services.RateLimit{Limit: 1, Per: time.Hour}
+	next := func(_ context.Context, _ interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	e := EmailRateLimiter(store, "login", limit)(next)
+
+	_, err := e(context.Background(), rateLimitedRequest{ip: "10.0.0.1"})
+	assert.NoError(t, err, "Expected the first request to be allowed")
+
+	_, err = e(context.Background(), rateLimitedRequest{ip: "10.0.0.2"})
+	assert.Error(t, err, "Expected requests from other IPs to the same address to be limited")
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	called := 0
+	next := func(_ context.Context, _ interface{}) (interface{}, error) {
+		called++
+		return nil, nil
+	}
+	e := IPRateLimiter(nil, "cars", services.RateLimit{})(next)
+	for i := 0; i < 3; i++ {
+		_, err := e(context.Background(), rateLimitedRequest{ip: "10.0.0.1"})
+		assert.NoError(t, err, "Expected no error")
+	}
+	assert.Equal(t, 3, called, "Expected all requests to be allowed")
+}
@@ -0,0 +1,373 @@
+// Package migrations applies the versioned database schema migrations that
+// are embedded in the binary.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+// Each driver has its own migrations in the directory named after it, because
+// the schemas can't be expressed in the same SQL. Their versions are
+// independent.
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// postGISScript adds the columns used by the PostGIS spatial mode. It isn't a
+// versioned migration because it depends on the PostGIS extension being
+// installed, which may happen long after the schema was migrated.
+//
+//go:embed postgis.sql
+var postGISScript string
+
+// Migration is a single versioned schema change. Every migration has an "up"
+// script that applies the change and a "down" script that reverts it.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// Status describes whether a Migration has been applied to the database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database and records the applied versions
+// in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	driver     database.Driver
+	migrations []Migration
+	logger     *slog.Logger
+}
+
+// New creates a Migrator for the driver's migrations embedded in the binary.
+func New(db *sql.DB, driver database.Driver, logger *slog.Logger) (Migrator, error) {
+	dir, err := fs.Sub(files, string(driver))
+	if err != nil {
+		return Migrator{}, errors.WithMessage(err, "error reading embedded migrations")
+	}
+	migrations, err := load(dir)
+	if err != nil {
+		return Migrator{}, err
+	}
+	return Migrator{db: db, driver: driver, migrations: migrations, logger: logger}, nil
+}
+
+// migrationFile matches migration file names like "0001_initial.up.sql".
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// load reads all migrations in the root of fsys, sorted by version.
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, errors.WithMessage(err, "error listing migrations")
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, errors.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid migration version in %q", entry.Name())
+		}
+		script, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "error reading migration %q", entry.Name())
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, errors.Errorf(
+				"migration %d has conflicting names %q and %q",
+				version,
+				m.Name,
+				match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, errors.Errorf(
+				"migration %d_%s must have both up and down scripts",
+				m.Version,
+				m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the version of the newest migration, or 0 if there are none.
+func (m Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+const createMigrationsTableQuery = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+)
+`
+
+// lockMigrationsQuery serializes migrations run concurrently, e.g. by several
+// API instances started with --auto-migrate. SQLite doesn't need it because
+// its transactions take the database write lock when they begin.
+const lockMigrationsQuery = `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`
+
+const getVersionQuery = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+
+const insertMigrationQuery = `
+INSERT INTO schema_migrations (version, name)
+VALUES ($1, $2)
+`
+
+const deleteMigrationQuery = `
+DELETE FROM schema_migrations
+WHERE version = $1
+`
+
+const getMigrationsQuery = `
+SELECT version, applied
+FROM schema_migrations
+`
+
+// Up applies all migrations newer than the current version, each in its own
+// transaction, and returns the applied migrations.
+func (m Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if _, err := m.db.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return nil, errors.WithMessage(err, "error creating schema_migrations table")
+	}
+	var applied []Migration
+	for _, migration := range m.migrations {
+		ok, err := m.step(ctx, func(tx *sql.Tx, version int) (bool, error) {
+			if migration.Version <= version {
+				return false, nil
+			}
+			if _, err := tx.ExecContext(ctx, migration.up); err != nil {
+				return false, errors.WithMessagef(
+					err,
+					"error applying migration %d_%s",
+					migration.Version,
+					migration.Name)
+			}
+			_, err := tx.ExecContext(ctx, m.driver.Rebind(insertMigrationQuery), migration.Version, migration.Name)
+			return true, errors.WithMessage(err, "error recording migration")
+		})
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			m.logger.Info(
+				"applied migration",
+				"version", migration.Version,
+				"name", migration.Name)
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// Down reverts the given number of most recently applied migrations, each in
+// its own transaction, and returns the reverted migrations.
+func (m Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if _, err := m.db.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return nil, errors.WithMessage(err, "error creating schema_migrations table")
+	}
+	var reverted []Migration
+	for i := 0; i < steps; i++ {
+		var migration Migration
+		ok, err := m.step(ctx, func(tx *sql.Tx, version int) (bool, error) {
+			if version == 0 {
+				return false, nil
+			}
+			var found bool
+			migration, found = m.find(version)
+			if !found {
+				return false, errors.Errorf(
+					"database is at version %d, which has no known migration",
+					version)
+			}
+			if _, err := tx.ExecContext(ctx, migration.down); err != nil {
+				return false, errors.WithMessagef(
+					err,
+					"error reverting migration %d_%s",
+					migration.Version,
+					migration.Name)
+			}
+			_, err := tx.ExecContext(ctx, m.driver.Rebind(deleteMigrationQuery), migration.Version)
+			return true, errors.WithMessage(err, "error recording migration")
+		})
+		if err != nil {
+			return reverted, err
+		}
+		if !ok {
+			break
+		}
+		m.logger.Info(
+			"reverted migration",
+			"version", migration.Version,
+			"name", migration.Name)
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+// step runs fn in a transaction that holds the schema_migrations lock, passing
+// it the current version. The transaction is only committed if fn returns
+// true.
+func (m Migrator) step(ctx context.Context, fn func(tx *sql.Tx, version int) (bool, error)) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.WithMessage(err, "error beginning migration transaction")
+	}
+	defer tx.Rollback()
+
+	if m.driver == database.Postgres {
+		if _, err := tx.ExecContext(ctx, lockMigrationsQuery); err != nil {
+			return false, errors.WithMessage(err, "error locking schema_migrations table")
+		}
+	}
+	var version int
+	if err := tx.QueryRowContext(ctx, getVersionQuery).Scan(&version); err != nil {
+		return false, errors.WithMessage(err, "error reading schema version")
+	}
+	ok, err := fn(tx, version)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.WithMessage(err, "error committing migration transaction")
+	}
+	return true, nil
+}
+
+func (m Migrator) find(version int) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// Status returns the status of every known migration, sorted by version.
+func (m Migrator) Status(ctx context.Context) ([]Status, error) {
+	if _, err := m.db.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return nil, errors.WithMessage(err, "error creating schema_migrations table")
+	}
+	rows, err := m.db.QueryContext(ctx, getMigrationsQuery)
+	if err != nil {
+		return nil, errors.WithMessage(err, "error reading applied migrations")
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, errors.WithMessage(err, "error scanning applied migration")
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "error reading applied migrations")
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		at, ok := applied[migration.Version]
+		statuses = append(statuses, Status{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return statuses, nil
+}
+
+// CheckVersion returns an error if the database schema is not at the latest
+// migration version, e.g. because "migrate up" hasn't been run since
+// deploying a new binary.
+func (m Migrator) CheckVersion(ctx context.Context) error {
+	var version int
+	err := m.db.QueryRowContext(ctx, getVersionQuery).Scan(&version)
+	if err != nil {
+		return errors.WithMessage(err, "error reading schema version, has \"migrate up\" been run?")
+	}
+	switch latest := m.Latest(); {
+	case version < latest:
+		return errors.Errorf(
+			"database schema is at version %d but %d is required, run \"migrate up\"",
+			version,
+			latest)
+	case version > latest:
+		return errors.Errorf(
+			"database schema is at version %d, which is newer than the latest known migration %d",
+			version,
+			latest)
+	}
+	return nil
+}
+
+// SetupPostGIS adds the geometry columns and indexes used by the PostGIS
+// spatial mode. It requires Postgres with the PostGIS extension available and
+// a migrated schema. It can be run any number of times, e.g. to set up the
+// columns after installing PostGIS on an existing database.
+func (m Migrator) SetupPostGIS(ctx context.Context) error {
+	if m.driver != database.Postgres {
+		return errors.Errorf("PostGIS requires Postgres, not %s", m.driver)
+	}
+	if _, err := m.db.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return errors.WithMessage(err, "error creating schema_migrations table")
+	}
+	_, err := m.step(ctx, func(tx *sql.Tx, version int) (bool, error) {
+		if version == 0 {
+			return false, errors.New("database schema has no migrations applied, run \"migrate up\" first")
+		}
+		if _, err := tx.ExecContext(ctx, postGISScript); err != nil {
+			return false, errors.WithMessage(err, "error setting up PostGIS columns")
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Info("set up PostGIS columns")
+	return nil
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		description string
+		files       fstest.MapFS
+		expected    []Migration
+		expectErr   bool
+	}{
+		{
+			description: "Migrations should be sorted by version",
+			files: fstest.MapFS{
+				"0002_indexes.up.sql":   {Data: []byte("CREATE INDEX")},
+				"0002_indexes.down.sql": {Data: []byte("DROP INDEX")},
+				"0001_initial.up.sql":   {Data: []byte("CREATE TABLE")},
+				"0001_initial.down.sql": {Data: []byte("DROP TABLE")},
+			},
+			expected: []Migration{
+				{Version: 1, Name: "initial", up: "CREATE TABLE", down: "DROP TABLE"},
+				{Version: 2, Name: "indexes", up: "CREATE INDEX", down: "DROP INDEX"},
+			},
+		},
+		{
+			description: "Migrations without a down script should be rejected",
+			files: fstest.MapFS{
+				"0001_initial.up.sql": {Data: []byte("CREATE TABLE")},
+			},
+			expectErr: true,
+		},
+		{
+			description: "Migrations with conflicting names should be rejected",
+			files: fstest.MapFS{
+				"0001_initial.up.sql": {Data: []byte("CREATE TABLE")},
+				"0001_other.down.sql": {Data: []byte("DROP TABLE")},
+			},
+			expectErr: true,
+		},
+		{
+			description: "Files that aren't migrations should be rejected",
+			files: fstest.MapFS{
+				"schema.sql": {Data: []byte("CREATE TABLE")},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			migrations, err := load(test.files)
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+				return
+			}
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, test.expected, migrations, "Expected migrations to match")
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	for _, driver := range []database.Driver{database.Postgres, database.SQLite} {
+		driver := driver // Capture range variable.
+		t.Run(string(driver), func(t *testing.T) {
+			t.Parallel()
+
+			m, err := New(nil, driver, nil)
+			assert.NoError(t, err, "Expected embedded migrations to be valid")
+			assert.Equal(t, 1, m.migrations[0].Version, "Expected the first migration to be version 1")
+			assert.Equal(t, len(m.migrations), m.Latest(), "Expected migration versions to be contiguous")
+		})
+	}
+}
+
+func TestSetupPostGISRequiresPostgres(t *testing.T) {
+	m, err := New(nil, database.SQLite, nil)
+	assert.NoError(t, err, "Expected embedded migrations to be valid")
+	assert.Error(t, m.SetupPostGIS(context.Background()), "Expected PostGIS to require Postgres")
+}
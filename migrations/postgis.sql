@@ -0,0 +1,32 @@
+-- Adds the geometry columns used by the PostGIS spatial mode
+-- (--spatial=postgis), see Migrator.SetupPostGIS. Every statement is
+-- idempotent, so the script can be run again, e.g. after installing PostGIS on
+-- a database that was set up without it.
+--
+-- The geometry columns are derived from the existing coordinates, so the
+-- queries that insert map blocks and cars don't depend on the mode.
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+ALTER TABLE map_blocks ADD COLUMN IF NOT EXISTS geom geometry(Point, 4326)
+    GENERATED ALWAYS AS (
+        ST_SetSRID(ST_MakePoint(longitude::double precision, latitude::double precision), 4326)
+    ) STORED;
+CREATE INDEX IF NOT EXISTS map_blocks_geom_idx ON map_blocks USING GIST (geom);
+CREATE INDEX IF NOT EXISTS map_blocks_geog_idx ON map_blocks USING GIST ((geom::geography));
+
+-- Cars are located at the map block they were submitted to.
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS geom geometry(Point, 4326);
+CREATE OR REPLACE FUNCTION cars_set_geom() RETURNS trigger AS $fn$
+BEGIN
+    NEW.geom := (SELECT geom FROM map_blocks WHERE id = NEW.map_block_id);
+    RETURN NEW;
+END
+$fn$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS cars_set_geom ON cars;
+CREATE TRIGGER cars_set_geom
+    BEFORE INSERT OR UPDATE OF map_block_id ON cars
+    FOR EACH ROW EXECUTE FUNCTION cars_set_geom();
+UPDATE cars c SET geom = mb.geom
+FROM map_blocks mb
+WHERE mb.id = c.map_block_id AND c.geom IS DISTINCT FROM mb.geom;
+CREATE INDEX IF NOT EXISTS cars_geom_idx ON cars USING GIST (geom);
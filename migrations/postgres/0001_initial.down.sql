@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS cars;
+DROP TABLE IF EXISTS images;
+DROP TYPE IF EXISTS status_t;
+DROP TABLE IF EXISTS map_blocks;
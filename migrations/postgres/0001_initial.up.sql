@@ -0,0 +1,44 @@
+-- The initial schema, formerly schema.sql. Every statement is idempotent so
+-- that databases created from schema.sql before migrations existed can be
+-- brought under version control by running "migrate up".
+CREATE TABLE IF NOT EXISTS map_blocks (
+    id SERIAL PRIMARY KEY,
+    latitude NUMERIC NOT NULL,
+    longitude NUMERIC NOT NULL,
+    UNIQUE (longitude, latitude)
+);
+
+DO $$
+BEGIN
+    CREATE TYPE status_t AS ENUM('pending', 'approved', 'rejected', 'deleted');
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END
+$$;
+ALTER TYPE status_t ADD VALUE IF NOT EXISTS 'deleted';
+
+CREATE TABLE IF NOT EXISTS images (
+    public_id TEXT PRIMARY KEY,
+    format TEXT NOT NULL,
+    status status_t NOT NULL DEFAULT 'pending',
+    created timestamp NOT NULL DEFAULT NOW(),
+    updated timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS cars (
+    id SERIAL PRIMARY KEY,
+    map_block_id INTEGER NOT NULL,
+    year INTEGER NOT NULL,
+    make TEXT NOT NULL,
+    model TEXT NOT NULL,
+    trim TEXT NOT NULL,
+    color TEXT NOT NULL,
+    images_public_id TEXT,
+    created timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated timestamp NOT NULL
+);
@@ -0,0 +1,19 @@
+DROP INDEX IF EXISTS images_created_idx;
+DROP INDEX IF EXISTS cars_images_public_id_idx;
+DROP INDEX IF EXISTS cars_map_block_id_created_idx;
+
+ALTER TABLE map_blocks DROP CONSTRAINT map_blocks_latitude_longitude_key;
+ALTER TABLE map_blocks ADD CONSTRAINT map_blocks_longitude_latitude_key UNIQUE (longitude, latitude);
+
+ALTER TABLE map_blocks
+    DROP CONSTRAINT map_blocks_longitude_check,
+    DROP CONSTRAINT map_blocks_latitude_check;
+
+ALTER TABLE cars
+    DROP CONSTRAINT cars_color_check,
+    DROP CONSTRAINT cars_trim_check,
+    DROP CONSTRAINT cars_model_check,
+    DROP CONSTRAINT cars_make_check,
+    DROP CONSTRAINT cars_year_check,
+    DROP CONSTRAINT cars_images_public_id_fkey,
+    DROP CONSTRAINT cars_map_block_id_fkey;
@@ -0,0 +1,41 @@
+-- Cars without an image used to store an empty string instead of NULL, which
+-- would violate the images foreign key.
+UPDATE cars SET images_public_id = NULL WHERE images_public_id = '';
+
+-- Cars can be submitted before Cloudinary sends the upload notification for
+-- their image, so make sure every referenced image exists. The format is
+-- filled in when the notification arrives.
+INSERT INTO images (public_id, format)
+SELECT DISTINCT images_public_id, ''
+FROM cars
+WHERE images_public_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE cars
+    ADD CONSTRAINT cars_map_block_id_fkey
+        FOREIGN KEY (map_block_id) REFERENCES map_blocks (id) ON DELETE CASCADE,
+    ADD CONSTRAINT cars_images_public_id_fkey
+        FOREIGN KEY (images_public_id) REFERENCES images (public_id) ON DELETE SET NULL,
+    -- Mirror the limits in the POST /cars request schema.
+    ADD CONSTRAINT cars_year_check CHECK (year BETWEEN 1900 AND 2100),
+    ADD CONSTRAINT cars_make_check CHECK (char_length(make) BETWEEN 2 AND 100),
+    ADD CONSTRAINT cars_model_check CHECK (char_length(model) BETWEEN 1 AND 100),
+    ADD CONSTRAINT cars_trim_check CHECK (char_length(trim) <= 100),
+    ADD CONSTRAINT cars_color_check CHECK (char_length(color) <= 100);
+
+ALTER TABLE map_blocks
+    ADD CONSTRAINT map_blocks_latitude_check CHECK (latitude BETWEEN -360 AND 360),
+    ADD CONSTRAINT map_blocks_longitude_check CHECK (longitude BETWEEN -360 AND 360);
+
+-- GetMapBlocks range scans latitude first, so the unique index must lead with
+-- latitude to support bounding box queries.
+ALTER TABLE map_blocks DROP CONSTRAINT map_blocks_longitude_latitude_key;
+ALTER TABLE map_blocks ADD CONSTRAINT map_blocks_latitude_longitude_key UNIQUE (latitude, longitude);
+
+-- Supports GetCars, which lists a map block's cars newest first, and cascading
+-- map block deletes.
+CREATE INDEX cars_map_block_id_created_idx ON cars (map_block_id, created DESC);
+
+-- Supports GetOrphanedImages and setting references to deleted images to NULL.
+CREATE INDEX cars_images_public_id_idx ON cars (images_public_id);
+CREATE INDEX images_created_idx ON images (created) WHERE status <> 'deleted';
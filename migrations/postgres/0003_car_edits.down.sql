@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS car_history;
+
+ALTER TABLE cars
+    DROP COLUMN IF EXISTS deleted,
+    DROP COLUMN IF EXISTS updated,
+    DROP COLUMN IF EXISTS edit_token_hash;
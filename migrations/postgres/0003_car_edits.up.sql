@@ -0,0 +1,30 @@
+-- Submitters can edit and delete their cars with the secret edit token that's
+-- returned when the car is submitted. Only a SHA-256 hash of the token is
+-- stored. Cars submitted before edit tokens existed can't be edited. Deleted
+-- cars are kept, but hidden, so that moderators can review them.
+ALTER TABLE cars
+    ADD COLUMN edit_token_hash TEXT,
+    ADD COLUMN updated timestamp,
+    ADD COLUMN deleted timestamp;
+
+-- Every edit or deletion stores the previous version of the car for
+-- moderators. The map block isn't a foreign key because the car may have been
+-- moved out of it, and empty map blocks may be deleted.
+CREATE TABLE car_history (
+    id SERIAL PRIMARY KEY,
+    car_id INTEGER NOT NULL REFERENCES cars (id) ON DELETE CASCADE,
+    action TEXT NOT NULL CHECK (action IN ('update', 'delete')),
+    map_block_id INTEGER NOT NULL,
+    year INTEGER NOT NULL,
+    make TEXT NOT NULL,
+    model TEXT NOT NULL,
+    trim TEXT NOT NULL,
+    color TEXT NOT NULL,
+    images_public_id TEXT,
+    created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Supports GetCarHistory and cascading car deletes.
+CREATE INDEX car_history_car_id_idx ON car_history (car_id, id);
+-- Supports GetOrphanedImages, which keeps images of previous versions.
+CREATE INDEX car_history_images_public_id_idx ON car_history (images_public_id);
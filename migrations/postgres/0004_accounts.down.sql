@@ -0,0 +1,5 @@
+ALTER TABLE cars DROP COLUMN IF EXISTS user_id;
+
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS login_tokens;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,35 @@
+-- Optional user accounts with passwordless email login. Logging in sends a
+-- single-use login token to the user's email address, which is exchanged for a
+-- session token stored in a cookie. Only SHA-256 hashes of the tokens are
+-- stored. Accounts are created the first time an email address logs in.
+CREATE TABLE users (
+    id SERIAL PRIMARY KEY,
+    -- Email addresses are stored lowercased.
+    email TEXT NOT NULL UNIQUE CHECK (length(email) <= 254),
+    created timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE login_tokens (
+    token_hash TEXT PRIMARY KEY,
+    email TEXT NOT NULL,
+    expires timestamp NOT NULL
+);
+
+CREATE TABLE sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created timestamp NOT NULL DEFAULT NOW(),
+    expires timestamp NOT NULL
+);
+
+-- Cars submitted while logged in belong to the user. Cars are kept if the
+-- user is deleted.
+ALTER TABLE cars ADD COLUMN user_id INTEGER REFERENCES users (id) ON DELETE SET NULL;
+
+-- Support deleting expired tokens and sessions.
+CREATE INDEX login_tokens_expires_idx ON login_tokens (expires);
+CREATE INDEX sessions_expires_idx ON sessions (expires);
+-- Supports cascading user deletes.
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- Supports GetUserCars and setting references to deleted users to NULL.
+CREATE INDEX cars_user_id_idx ON cars (user_id);
@@ -0,0 +1,3 @@
+-- Sessions created by OpenID Connect logins store the provider's subject
+-- identifier, which is mapped to the user's role on every request.
+ALTER TABLE sessions ADD COLUMN oidc_subject TEXT;
@@ -0,0 +1,28 @@
+-- Admins can ban client IP addresses and user accounts. Banned IP addresses
+-- can't submit cars, sign image uploads or request login links, and banned
+-- users can't log in. Exactly one of ip and user_id is set. IP addresses are
+-- stored in canonical form, like Go's net.IP.String.
+CREATE TABLE bans (
+    id SERIAL PRIMARY KEY,
+    ip TEXT UNIQUE,
+    user_id INTEGER UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    reason TEXT NOT NULL CHECK (char_length(reason) <= 1000),
+    created timestamp NOT NULL DEFAULT NOW(),
+    CHECK ((ip IS NULL) <> (user_id IS NULL))
+);
+
+-- The audit log of admin actions, which are recorded in the same transaction
+-- as the change. The admin's email address is copied so that the log is kept
+-- if their account is deleted. Details are a JSON object that depends on the
+-- action.
+CREATE TABLE admin_actions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    user_email TEXT NOT NULL,
+    action TEXT NOT NULL,
+    details TEXT NOT NULL,
+    created timestamp NOT NULL DEFAULT NOW()
+);
+
+-- Supports setting references to deleted users to NULL.
+CREATE INDEX admin_actions_user_id_idx ON admin_actions (user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS cars;
+DROP TABLE IF EXISTS images;
+DROP TABLE IF EXISTS map_blocks;
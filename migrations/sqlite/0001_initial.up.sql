@@ -0,0 +1,48 @@
+-- The SQLite equivalent of the Postgres schema. SQLite can't add constraints to
+-- existing tables, so this creates the tables with the constraints added by
+-- the Postgres constraints migration. Timestamps are stored as UTC text, which
+-- the driver reads as time.Time because the columns are declared "timestamp".
+CREATE TABLE map_blocks (
+    id INTEGER PRIMARY KEY,
+    latitude NUMERIC NOT NULL CHECK (latitude BETWEEN -360 AND 360),
+    longitude NUMERIC NOT NULL CHECK (longitude BETWEEN -360 AND 360),
+    UNIQUE (latitude, longitude)
+);
+
+CREATE TABLE images (
+    public_id TEXT PRIMARY KEY,
+    format TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'approved', 'rejected', 'deleted')),
+    created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE cars (
+    id INTEGER PRIMARY KEY,
+    map_block_id INTEGER NOT NULL
+        REFERENCES map_blocks (id) ON DELETE CASCADE,
+    -- Mirror the limits in the POST /cars request schema.
+    year INTEGER NOT NULL CHECK (year BETWEEN 1900 AND 2100),
+    make TEXT NOT NULL CHECK (length(make) BETWEEN 2 AND 100),
+    model TEXT NOT NULL CHECK (length(model) BETWEEN 1 AND 100),
+    trim TEXT NOT NULL CHECK (length(trim) <= 100),
+    color TEXT NOT NULL CHECK (length(color) <= 100),
+    images_public_id TEXT
+        REFERENCES images (public_id) ON DELETE SET NULL,
+    created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE rate_limits (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated timestamp NOT NULL
+);
+
+-- Supports GetCars, which lists a map block's cars newest first, and cascading
+-- map block deletes.
+CREATE INDEX cars_map_block_id_created_idx ON cars (map_block_id, created DESC);
+
+-- Supports GetOrphanedImages and setting references to deleted images to NULL.
+CREATE INDEX cars_images_public_id_idx ON cars (images_public_id);
+CREATE INDEX images_created_idx ON images (created) WHERE status <> 'deleted';
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS car_history;
+
+ALTER TABLE cars DROP COLUMN deleted;
+ALTER TABLE cars DROP COLUMN updated;
+ALTER TABLE cars DROP COLUMN edit_token_hash;
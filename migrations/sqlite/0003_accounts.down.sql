@@ -0,0 +1,7 @@
+-- SQLite can't drop a column that's indexed.
+DROP INDEX IF EXISTS cars_user_id_idx;
+ALTER TABLE cars DROP COLUMN user_id;
+
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS login_tokens;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1 @@
+ALTER TABLE sessions DROP COLUMN oidc_subject;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS admin_actions;
+DROP TABLE IF EXISTS bans;
@@ -0,0 +1,234 @@
+// Package oidctest provides a mock OpenID Connect provider for tests.
+//
+// The provider logs in whichever user was last set with Provider.SetUser
+// without asking for credentials: its authorization endpoint immediately
+// redirects back to the client with an authorization code, which the token
+// endpoint exchanges for a signed ID token.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// ClientID is the only client ID the provider accepts.
+	ClientID = "manualsmap"
+	// ClientSecret is the client secret for ClientID.
+	ClientSecret = "secret"
+	// KeyID is the ID of the provider's signing key.
+	KeyID = "test-key"
+)
+
+var (
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+)
+
+// signingKey returns an RSA key shared by all providers, because generating
+// keys is slow.
+func signingKey() *rsa.PrivateKey {
+	keyOnce.Do(func() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return key
+}
+
+// Provider is a mock OpenID Connect provider.
+type Provider struct {
+	// Issuer is the provider's issuer URL.
+	Issuer string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	user  jwt.MapClaims
+	codes map[string]authorization
+}
+
+// authorization is an issued authorization code.
+type authorization struct {
+	claims      jwt.MapClaims
+	redirectURI string
+}
+
+// NewProvider starts a mock OpenID Connect provider that's stopped when the
+// test finishes. It logs in the user with subject "subject" and email address
+// "user@example.com" until SetUser is called.
+func NewProvider(t *testing.T) *Provider {
+	t.Helper()
+	p := &Provider{
+		key:   signingKey(),
+		codes: make(map[string]authorization),
+	}
+	p.SetUser("subject", "user@example.com")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/keys", p.keys)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	p.Issuer = server.URL
+	return p
+}
+
+// SetUser sets the subject and email address of the user that's logged in
+// by later authorization requests.
+func (p *Provider) SetUser(subject, email string) {
+	p.SetClaims(jwt.MapClaims{
+		"sub":            subject,
+		"email":          email,
+		"email_verified": true,
+	})
+}
+
+// SetClaims sets the claims included in the ID tokens issued by later
+// authorization requests, in addition to "iss", "aud", "exp", "iat" and
+// "nonce".
+func (p *Provider) SetClaims(claims jwt.MapClaims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = claims
+}
+
+// IDToken returns an ID token with the claims signed by the provider's key.
+// No claims are added.
+func (p *Provider) IDToken(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = KeyID
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// Claims returns valid claims for an ID token with the subject, email address
+// and nonce, issued now.
+func (p *Provider) Claims(subject, email, nonce string) jwt.MapClaims {
+	claims := p.tokenClaims(nonce)
+	claims["sub"] = subject
+	claims["email"] = email
+	claims["email_verified"] = true
+	return claims
+}
+
+// tokenClaims returns the "iss", "aud", "exp", "iat" and "nonce" claims for
+// an ID token issued now.
+func (p *Provider) tokenClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   p.Issuer,
+		"aud":   ClientID,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 p.Issuer,
+		"authorization_endpoint": p.Issuer + "/authorize",
+		"token_endpoint":         p.Issuer + "/token",
+		"jwks_uri":               p.Issuer + "/keys",
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if query.Get("client_id") != ClientID ||
+		query.Get("response_type") != "code" ||
+		err != nil ||
+		!redirectURI.IsAbs() {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	claims := p.tokenClaims(query.Get("nonce"))
+	for k, v := range p.user {
+		claims[k] = v
+	}
+	code := randomString()
+	p.codes[code] = authorization{claims: claims, redirectURI: redirectURI.String()}
+	p.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || clientSecret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	// Authorization codes can only be used once.
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || auth.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     p.IDToken(auth.claims),
+	})
+}
+
+func (p *Provider) keys(w http.ResponseWriter, _ *http.Request) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(p.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
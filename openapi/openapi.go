@@ -0,0 +1,528 @@
+// Package openapi serves the OpenAPI 3 document that describes the
+// manualsmap.com API and checks it against the Go types that the handlers
+// decode and encode.
+//
+// The document is maintained by hand in openapi.json. Each handler package
+// tests that its request and response types match the documented schemas, so
+// the document can't drift from the code without failing the tests.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the OpenAPI document.
+func Spec() []byte {
+	return append([]byte(nil), spec...)
+}
+
+// Handler serves the OpenAPI document.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(spec)
+	})
+}
+
+// Document is the subset of an OpenAPI 3 document used to check it against
+// the API.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Servers    []Server            `json:"servers"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+// PathItem holds the operations for a path. If Servers is set, it overrides
+// the document's servers for the path.
+type PathItem struct {
+	Servers []Server   `json:"servers"`
+	Get     *Operation `json:"get"`
+	Put     *Operation `json:"put"`
+	Post    *Operation `json:"post"`
+	Patch   *Operation `json:"patch"`
+	Delete  *Operation `json:"delete"`
+}
+
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary"`
+	Parameters  []Parameter         `json:"parameters"`
+	RequestBody *RequestBody        `json:"requestBody"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is a response or, if Ref is set, a reference to a response in the
+// document's components.
+type Response struct {
+	Ref         string               `json:"$ref"`
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas   map[string]*Schema  `json:"schemas"`
+	Responses map[string]Response `json:"responses"`
+}
+
+// Schema is the subset of a JSON schema needed to compare it to a Go type. If
+// Ref is set, it's a reference to a schema in the document's components.
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Properties map[string]*Schema `json:"properties"`
+	Items      *Schema            `json:"items"`
+	Required   []string           `json:"required"`
+	// AdditionalProperties is either a boolean or a schema.
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+}
+
+// Endpoint is a documented operation and the full URL path it's served at.
+type Endpoint struct {
+	Method    string
+	Path      string
+	Operation *Operation
+}
+
+// Load parses the OpenAPI document.
+func Load() (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, errors.WithMessage(err, "error parsing OpenAPI document")
+	}
+	return &doc, nil
+}
+
+// Endpoints returns every documented operation, sorted by path and method.
+func (doc *Document) Endpoints() []Endpoint {
+	var endpoints []Endpoint
+	for path, item := range doc.Paths {
+		servers := doc.Servers
+		if len(item.Servers) > 0 {
+			servers = item.Servers
+		}
+		base := ""
+		if len(servers) > 0 {
+			base = strings.TrimSuffix(servers[0].URL, "/")
+		}
+		for method, op := range item.operations() {
+			endpoints = append(endpoints, Endpoint{
+				Method:    method,
+				Path:      base + path,
+				Operation: op,
+			})
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Path != endpoints[j].Path {
+			return endpoints[i].Path < endpoints[j].Path
+		}
+		return endpoints[i].Method < endpoints[j].Method
+	})
+	return endpoints
+}
+
+func (item PathItem) operations() map[string]*Operation {
+	operations := make(map[string]*Operation)
+	for method, op := range map[string]*Operation{
+		http.MethodGet:    item.Get,
+		http.MethodPut:    item.Put,
+		http.MethodPost:   item.Post,
+		http.MethodPatch:  item.Patch,
+		http.MethodDelete: item.Delete,
+	} {
+		if op != nil {
+			operations[method] = op
+		}
+	}
+	return operations
+}
+
+func (doc *Document) operation(operationID string) (*Operation, error) {
+	for _, endpoint := range doc.Endpoints() {
+		if endpoint.Operation.OperationID == operationID {
+			return endpoint.Operation, nil
+		}
+	}
+	return nil, fmt.Errorf("operation %q is not documented", operationID)
+}
+
+// RequestSchema returns the resolved JSON request body schema of the
+// operation.
+func (doc *Document) RequestSchema(operationID string) (*Schema, error) {
+	op, err := doc.operation(operationID)
+	if err != nil {
+		return nil, err
+	}
+	if op.RequestBody == nil {
+		return nil, fmt.Errorf("operation %q has no request body", operationID)
+	}
+	media, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil, fmt.Errorf("operation %q has no JSON request body", operationID)
+	}
+	return doc.resolve(media.Schema)
+}
+
+// ResponseSchema returns the resolved JSON schema of the operation's response
+// with the given status code.
+func (doc *Document) ResponseSchema(operationID, status string) (*Schema, error) {
+	op, err := doc.operation(operationID)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := op.Responses[status]
+	if !ok {
+		return nil, fmt.Errorf("operation %q has no %s response", operationID, status)
+	}
+	if ref := res.Ref; ref != "" {
+		name := strings.TrimPrefix(ref, "#/components/responses/")
+		if res, ok = doc.Components.Responses[name]; !ok {
+			return nil, fmt.Errorf("unknown response reference %q", ref)
+		}
+	}
+	for _, contentType := range []string{"application/json", "application/problem+json"} {
+		if media, ok := res.Content[contentType]; ok {
+			return doc.resolve(media.Schema)
+		}
+	}
+	return nil, fmt.Errorf("operation %q has no JSON %s response", operationID, status)
+}
+
+// resolve follows schema references.
+func (doc *Document) resolve(schema *Schema) (*Schema, error) {
+	for schema != nil && schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		resolved, ok := doc.Components.Schemas[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown schema reference %q", schema.Ref)
+		}
+		schema = resolved
+	}
+	if schema == nil {
+		return nil, errors.New("missing schema")
+	}
+	return schema, nil
+}
+
+// CheckParameters checks that the operation documents exactly the parameters
+// decoded into v's fields from the given location, e.g. "query". Parameter
+// names are read from the "schema" struct tags used by gorilla/schema.
+func (doc *Document) CheckParameters(operationID, in string, v interface{}) error {
+	op, err := doc.operation(operationID)
+	if err != nil {
+		return err
+	}
+	documented := make(map[string]bool)
+	for _, param := range op.Parameters {
+		if param.In == in {
+			documented[param.Name] = param.Required
+		}
+	}
+
+	t := reflect.TypeOf(v)
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("schema")
+		if !ok || tag == "-" || !field.IsExported() {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		required := false
+		for _, option := range options[1:] {
+			required = required || option == "required"
+		}
+		fields[options[0]] = required
+	}
+
+	for name, required := range fields {
+		documentedRequired, ok := documented[name]
+		if !ok {
+			return fmt.Errorf("%s parameter %q is not documented", in, name)
+		}
+		if documentedRequired != required {
+			return fmt.Errorf("%s parameter %q is documented with required=%t", in, name, documentedRequired)
+		}
+	}
+	for name := range documented {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("documented %s parameter %q is not decoded", in, name)
+		}
+	}
+	return nil
+}
+
+// Body is a Go value that's encoded as, or decoded from, the JSON body of a
+// documented operation.
+type Body struct {
+	OperationID string
+	// Status is the response status code, or empty for the request body.
+	Status string
+	Value  interface{}
+}
+
+func (body Body) String() string {
+	if body.Status == "" {
+		return body.OperationID + " request"
+	}
+	return body.OperationID + " " + body.Status + " response"
+}
+
+// CheckBodies loads the document and checks each body's value against the
+// documented schema with Check. It returns every mismatch, so that a handler
+// package can check all of its types in a single assertion.
+func CheckBodies(bodies ...Body) error {
+	doc, err := Load()
+	if err != nil {
+		return err
+	}
+	var mismatches []string
+	for _, body := range bodies {
+		var schema *Schema
+		if body.Status == "" {
+			schema, err = doc.RequestSchema(body.OperationID)
+		} else {
+			schema, err = doc.ResponseSchema(body.OperationID, body.Status)
+		}
+		if err == nil {
+			err = doc.Check(schema, body.Value)
+		}
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %v", body, err))
+		}
+	}
+	if len(mismatches) > 0 {
+		return errors.New(strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// CheckComponentSchema checks that the named schema in the document's
+// components is the same as the JSON schema that requests are validated
+// against, apart from the "$schema" keyword. Unlike Check, it compares every
+// keyword, including validation rules like minLength.
+func CheckComponentSchema(name string, schema map[string]interface{}) error {
+	var doc struct {
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return errors.WithMessage(err, "error parsing OpenAPI document")
+	}
+	documented, ok := doc.Components.Schemas[name]
+	if !ok {
+		return fmt.Errorf("schema %q is not documented", name)
+	}
+
+	// Round-trip the schema through JSON so that both use the same types.
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return errors.WithMessage(err, "error encoding schema")
+	}
+	var expected map[string]interface{}
+	if err := json.Unmarshal(b, &expected); err != nil {
+		return errors.WithMessage(err, "error decoding schema")
+	}
+	delete(expected, "$schema")
+
+	if !reflect.DeepEqual(expected, documented) {
+		documentedJSON, _ := json.Marshal(documented)
+		expectedJSON, _ := json.Marshal(expected)
+		return fmt.Errorf(
+			"documented schema %q doesn't match the validated schema: documented %s, validated %s",
+			name,
+			documentedJSON,
+			expectedJSON)
+	}
+	return nil
+}
+
+var (
+	decimalType = reflect.TypeOf(decimal.Decimal{})
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// Check checks that the JSON encoding of v's type matches the schema: every
+// struct field must be a documented property of the right type, every
+// documented property must be a struct field, and optional fields must not be
+// required.
+func (doc *Document) Check(schema *Schema, v interface{}) error {
+	return doc.check("", schema, reflect.TypeOf(v))
+}
+
+func (doc *Document) check(pointer string, schema *Schema, t reflect.Type) error {
+	schema, err := doc.resolve(schema)
+	if err != nil {
+		return errors.WithMessage(err, at(pointer))
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var expected string
+	switch {
+	case t == decimalType:
+		expected = "number"
+	case t == timeType:
+		expected = "string"
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			expected = "string"
+		case reflect.Bool:
+			expected = "boolean"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			expected = "integer"
+		case reflect.Float32, reflect.Float64:
+			expected = "number"
+		case reflect.Slice, reflect.Array:
+			expected = "array"
+		case reflect.Map, reflect.Struct:
+			expected = "object"
+		case reflect.Interface:
+			// Any JSON value.
+			return nil
+		default:
+			return fmt.Errorf("%s: unsupported Go type %s", at(pointer), t)
+		}
+	}
+	if schema.Type != expected {
+		return fmt.Errorf("%s: documented type %q, but Go type %s encodes as %q", at(pointer), schema.Type, t, expected)
+	}
+
+	switch {
+	case expected == "array":
+		return doc.check(pointer+"/items", schema.Items, t.Elem())
+	case expected == "object" && t.Kind() == reflect.Map:
+		additional, err := schema.additionalProperties()
+		if err != nil {
+			return errors.WithMessage(err, at(pointer))
+		}
+		if additional == nil {
+			return fmt.Errorf("%s: map %s must be documented with an additionalProperties schema", at(pointer), t)
+		}
+		return doc.check(pointer+"/additionalProperties", additional, t.Elem())
+	case expected == "object" && t.Kind() == reflect.Struct:
+		return doc.checkStruct(pointer, schema, t)
+	}
+	return nil
+}
+
+func (doc *Document) checkStruct(pointer string, schema *Schema, t reflect.Type) error {
+	fields := make(map[string]bool)
+	for _, field := range jsonFields(t) {
+		fields[field.name] = field.omitempty
+		property, ok := schema.Properties[field.name]
+		if !ok {
+			return fmt.Errorf("%s: field %s.%s is not documented", at(pointer), t, field.goName)
+		}
+		if err := doc.check(pointer+"/"+field.name, property, field.t); err != nil {
+			return err
+		}
+	}
+	for name := range schema.Properties {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("%s: documented property %q is not a field of %s", at(pointer), name, t)
+		}
+	}
+	for _, name := range schema.Required {
+		omitempty, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("%s: required property %q is not a field of %s", at(pointer), name, t)
+		}
+		if omitempty {
+			return fmt.Errorf("%s: property %q is required but may be omitted by %s", at(pointer), name, t)
+		}
+	}
+	return nil
+}
+
+type jsonField struct {
+	name      string
+	goName    string
+	omitempty bool
+	t         reflect.Type
+}
+
+// jsonFields returns the fields of the struct type that are encoded as JSON,
+// including the fields of embedded structs without a JSON name.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{
+			name:      name,
+			goName:    field.Name,
+			omitempty: strings.Contains(options, "omitempty"),
+			t:         field.Type,
+		})
+	}
+	return fields
+}
+
+// additionalProperties returns the schema of additional properties, or nil if
+// additionalProperties isn't a schema.
+func (schema *Schema) additionalProperties() (*Schema, error) {
+	if len(schema.AdditionalProperties) == 0 || schema.AdditionalProperties[0] != '{' {
+		return nil, nil
+	}
+	var additional Schema
+	if err := json.Unmarshal(schema.AdditionalProperties, &additional); err != nil {
+		return nil, errors.WithMessage(err, "error parsing additionalProperties")
+	}
+	return &additional, nil
+}
+
+func at(pointer string) string {
+	if pointer == "" {
+		return "schema"
+	}
+	return "schema at " + pointer
+}
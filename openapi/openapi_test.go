@@ -0,0 +1,380 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/encoders"
+)
+
+func TestDocument(t *testing.T) {
+	doc, err := Load()
+	require.NoError(t, err, "Expected no error loading the document")
+	assert.True(t, strings.HasPrefix(doc.OpenAPI, "3."), "Expected an OpenAPI 3 document")
+
+	operationIDs := make(map[string]bool)
+	for _, endpoint := range doc.Endpoints() {
+		id := endpoint.Operation.OperationID
+		assert.NotEmpty(t, id, "Expected %s %s to have an operation ID", endpoint.Method, endpoint.Path)
+		assert.False(t, operationIDs[id], "Expected operation ID %q to be unique", id)
+		operationIDs[id] = true
+
+		for status := range endpoint.Operation.Responses {
+			res := endpoint.Operation.Responses[status]
+			if res.Ref != "" {
+				_, ok := doc.Components.Responses[strings.TrimPrefix(res.Ref, "#/components/responses/")]
+				assert.True(t, ok, "Expected response reference %q to resolve", res.Ref)
+			}
+		}
+	}
+
+	// Every schema reference in the document must resolve.
+	var walk func(schema *Schema)
+	walk = func(schema *Schema) {
+		if schema == nil {
+			return
+		}
+		_, err := doc.resolve(schema)
+		assert.NoError(t, err, "Expected schema reference to resolve")
+		for _, property := range schema.Properties {
+			walk(property)
+		}
+		walk(schema.Items)
+	}
+	for _, schema := range doc.Components.Schemas {
+		walk(schema)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code, "Expected status codes to match")
+	assert.Equal(
+		t,
+		"application/json; charset=utf-8",
+		recorder.Header().Get("Content-Type"),
+		"Expected Content-Type to match")
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body), "Expected a JSON body")
+	assert.Contains(t, body, "paths", "Expected the document to have paths")
+}
+
+// TestProblemSchema checks the documented error schema against the JSON
+// encoding of a JSONError, which can't be compared by type because it has a
+// custom MarshalJSON method.
+func TestProblemSchema(t *testing.T) {
+	doc, err := Load()
+	require.NoError(t, err, "Expected no error loading the document")
+	schema, err := doc.resolve(&Schema{Ref: "#/components/schemas/Problem"})
+	require.NoError(t, err, "Expected no error resolving the Problem schema")
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/cars", nil)
+	encoders.JSONErrorEncoder(
+		req.Context(),
+		encoders.NewValidationError(
+			"request body does not match schema",
+			[]encoders.FieldError{{Pointer: "/year", Keyword: "minimum", Message: "too old"}}),
+		recorder)
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body), "Expected a JSON body")
+	for name := range body {
+		assert.Contains(t, schema.Properties, name, "Expected property %q to be documented", name)
+	}
+	for _, name := range schema.Required {
+		assert.Contains(t, body, name, "Expected required property %q to be set", name)
+	}
+	assert.NoError(
+		t,
+		doc.Check(schema.Properties["errors"], []encoders.FieldError{}),
+		"Expected FieldError to match its schema")
+}
+
+func TestCheck(t *testing.T) {
+	type car struct {
+		Year   int             `json:"year"`
+		Make   string          `json:"make"`
+		Price  decimal.Decimal `json:"price"`
+		Tags   []string        `json:"tags"`
+		Note   string          `json:"note,omitempty"`
+		hidden string
+	}
+	carSchema := func(mutate func(schema *Schema)) *Schema {
+		schema := &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"year":  {Type: "integer"},
+				"make":  {Type: "string"},
+				"price": {Type: "number"},
+				"tags":  {Type: "array", Items: &Schema{Type: "string"}},
+				"note":  {Type: "string"},
+			},
+			Required: []string{"year", "make"},
+		}
+		if mutate != nil {
+			mutate(schema)
+		}
+		return schema
+	}
+
+	tests := []struct {
+		description string
+		schema      *Schema
+		v           interface{}
+		expectErr   bool
+	}{
+		{
+			description: "Matching schemas should pass",
+			schema:      carSchema(nil),
+			v:           car{},
+		},
+		{
+			description: "Slices of matching structs should pass",
+			schema:      &Schema{Type: "array", Items: carSchema(nil)},
+			v:           []*car{},
+		},
+		{
+			description: "Fields of embedded structs should be checked",
+			schema:      carSchema(nil),
+			v: struct {
+				car
+				remoteIP string
+			}{},
+		},
+		{
+			description: "Maps should be checked against additionalProperties",
+			schema: &Schema{
+				Type:                 "object",
+				AdditionalProperties: json.RawMessage(`{"type": "string"}`),
+			},
+			v: map[string]string{},
+		},
+		{
+			description: "Maps with mismatched values should fail",
+			schema: &Schema{
+				Type:                 "object",
+				AdditionalProperties: json.RawMessage(`{"type": "integer"}`),
+			},
+			v:         map[string]string{},
+			expectErr: true,
+		},
+		{
+			description: "Undocumented fields should fail",
+			schema:      carSchema(func(schema *Schema) { delete(schema.Properties, "tags") }),
+			v:           car{},
+			expectErr:   true,
+		},
+		{
+			description: "Documented properties without fields should fail",
+			schema: carSchema(func(schema *Schema) {
+				schema.Properties["color"] = &Schema{Type: "string"}
+			}),
+			v:         car{},
+			expectErr: true,
+		},
+		{
+			description: "Mismatched types should fail",
+			schema:      carSchema(func(schema *Schema) { schema.Properties["year"].Type = "string" }),
+			v:           car{},
+			expectErr:   true,
+		},
+		{
+			description: "Mismatched item types should fail",
+			schema:      carSchema(func(schema *Schema) { schema.Properties["tags"].Items.Type = "number" }),
+			v:           car{},
+			expectErr:   true,
+		},
+		{
+			description: "Required properties that may be omitted should fail",
+			schema:      carSchema(func(schema *Schema) { schema.Required = append(schema.Required, "note") }),
+			v:           car{},
+			expectErr:   true,
+		},
+		{
+			description: "Unknown references should fail",
+			schema:      &Schema{Ref: "#/components/schemas/Unknown"},
+			v:           car{},
+			expectErr:   true,
+		},
+	}
+
+	doc := &Document{}
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			err := doc.Check(test.schema, test.v)
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+			} else {
+				assert.NoError(t, err, "Expected no error")
+			}
+		})
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	doc := &Document{
+		Paths: map[string]PathItem{
+			"/mapblocks": {
+				Get: &Operation{
+					OperationID: "getMapBlocks",
+					Parameters: []Parameter{
+						{Name: "min_latitude", In: "query", Required: true},
+						{Name: "limit", In: "query"},
+						{Name: "x-request-id", In: "header"},
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		description string
+		v           interface{}
+		expectErr   bool
+	}{
+		{
+			description: "Matching parameters should pass",
+			v: struct {
+				MinLatitude decimal.Decimal `schema:"min_latitude,required"`
+				Limit       int             `schema:"limit"`
+			}{},
+		},
+		{
+			description: "Undocumented parameters should fail",
+			v: struct {
+				MinLatitude decimal.Decimal `schema:"min_latitude,required"`
+				Limit       int             `schema:"limit"`
+				Offset      int             `schema:"offset"`
+			}{},
+			expectErr: true,
+		},
+		{
+			description: "Documented parameters that aren't decoded should fail",
+			v: struct {
+				MinLatitude decimal.Decimal `schema:"min_latitude,required"`
+			}{},
+			expectErr: true,
+		},
+		{
+			description: "Mismatched required flags should fail",
+			v: struct {
+				MinLatitude decimal.Decimal `schema:"min_latitude"`
+				Limit       int             `schema:"limit"`
+			}{},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			err := doc.CheckParameters("getMapBlocks", "query", test.v)
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+			} else {
+				assert.NoError(t, err, "Expected no error")
+			}
+		})
+	}
+}
+
+func TestCheckBodies(t *testing.T) {
+	type version struct {
+		Commit    string `json:"commit"`
+		BuildTime string `json:"buildTime"`
+		GoVersion string `json:"goVersion"`
+	}
+
+	tests := []struct {
+		description string
+		bodies      []Body
+		expectErr   bool
+	}{
+		{
+			description: "Matching bodies should pass",
+			bodies: []Body{
+				{OperationID: "getVersion", Status: "200", Value: version{}},
+			},
+		},
+		{
+			description: "Mismatched bodies should fail",
+			bodies: []Body{
+				{OperationID: "getVersion", Status: "200", Value: struct {
+					Commit string `json:"commit"`
+				}{}},
+			},
+			expectErr: true,
+		},
+		{
+			description: "Undocumented responses should fail",
+			bodies: []Body{
+				{OperationID: "getVersion", Status: "201", Value: version{}},
+			},
+			expectErr: true,
+		},
+		{
+			description: "Undocumented request bodies should fail",
+			bodies: []Body{
+				{OperationID: "getVersion", Value: version{}},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			err := CheckBodies(test.bodies...)
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+			} else {
+				assert.NoError(t, err, "Expected no error")
+			}
+		})
+	}
+}
+
+func TestCheckComponentSchema(t *testing.T) {
+	version := func(commit map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"$schema": "http://json-schema.org/draft-07/schema#",
+			"type":    "object",
+			"properties": map[string]interface{}{
+				"commit":    commit,
+				"buildTime": map[string]interface{}{"type": "string"},
+				"goVersion": map[string]interface{}{"type": "string"},
+			},
+			"required": []string{"commit", "buildTime", "goVersion"},
+		}
+	}
+
+	assert.NoError(
+		t,
+		CheckComponentSchema("Version", version(map[string]interface{}{"type": "string"})),
+		"Expected matching schemas to pass")
+	assert.Error(
+		t,
+		CheckComponentSchema("Version", version(map[string]interface{}{"type": "string", "minLength": 1})),
+		"Expected different validation rules to fail")
+	assert.Error(
+		t,
+		CheckComponentSchema("Missing", version(map[string]interface{}{"type": "string"})),
+		"Expected undocumented schemas to fail")
+}
@@ -9,7 +9,7 @@ var canvi = new Canvi({
 
 mapkit.init({
     authorizationCallback: function (done) {
-        fetch("/mapkit/token")
+        fetch("/api/v1/mapkit/token")
             .then(response => response.json())
             .then(result => {
                 done(result.token)
@@ -51,6 +51,10 @@ function privacyModal(options) {
     $("#privacyModal").modal(options);
 }
 
+function loginModal(options) {
+    $("#loginModal").modal(options);
+}
+
 //////// Search ////////
 function submitSearch() {
     let searchInput = $("#searchInput");
@@ -149,7 +153,7 @@ function addImage(token) {
             "Content-Type": "application/json",
         },
     };
-    fetch("/images/signature", options)
+    fetch("/api/v1/images/signature", options)
         .then(res => {
             handleErrors(res);
             return res.json();
@@ -249,7 +253,7 @@ function resetAddCar() {
 }
 
 var postCarsValidator;
-fetch("/cars/schema")
+fetch("/api/v1/cars/schema")
     .then(res => {
         handleErrors(res);
         return res.json();
@@ -326,7 +330,7 @@ function submitCar(token) {
             "Content-Type": "application/json",
         },
     };
-    fetch("/cars", options)
+    fetch("/api/v1/cars", options)
         .then(res => {
             handleErrors(res);
             return res.json();
@@ -334,6 +338,9 @@ function submitCar(token) {
             addCarModal("hide");
             resetAddCar();
 
+            // The edit token is only returned once, so keep it in this browser
+            // to allow editing or deleting the car later.
+            localStorage.setItem(`editToken:${result.id}`, result.editToken);
             displayCars(result.mapBlockId);
             fetchVisibleOverlays();
         }).catch(error => {
@@ -359,7 +366,7 @@ function displayCars(mapBlockId) {
     container.html("");
     canvi.open();
 
-    fetch(`/mapblocks/${mapBlockId}/cars`)
+    fetch(`/api/v1/mapblocks/${mapBlockId}/cars`)
         .then(res => {
             handleErrors(res);
             return res.json();
@@ -470,7 +477,7 @@ function fetchVisibleOverlays() {
     let maxLatitude = region.northLatitude;
     let maxLongitude = region.eastLongitude;
     let query = `min_latitude=${minLatitude}&min_longitude=${minLongitude}&max_latitude=${maxLatitude}&max_longitude=${maxLongitude}`
-    fetch("/mapblocks?" + query)
+    fetch("/api/v1/mapblocks?" + query)
         .then(res => {
             handleErrors(res);
             return res.json();
@@ -492,3 +499,66 @@ map.addEventListener("region-change-end", function (event) {
         drawAddCarOverlay(addCarAnnotation.coordinate);
     }
 });
+
+//////// Login ////////
+function requestLogin(token) {
+    let email = $("#loginEmail");
+    if (!email.get(0).checkValidity()) {
+        email.addClass("is-invalid");
+        grecaptcha.reset();
+        return;
+    }
+    email.removeClass("is-invalid");
+
+    let options = {
+        method: "POST",
+        body: JSON.stringify({ email: email.val(), recaptcha: token }),
+        headers: {
+            "Content-Type": "application/json",
+        },
+    };
+    fetch("/api/v1/login", options)
+        .then(res => {
+            handleErrors(res);
+            loginModal("hide");
+            email.val("");
+            alert("Check your email for a link to log in.");
+        }).catch(error => {
+            alert("Failed to send a login link: " + error);
+        }).finally(() => {
+            grecaptcha.reset();
+        });
+}
+
+// Login links emailed by POST /api/v1/login open the site with a single-use
+// login token, which is exchanged for a session cookie.
+function verifyLogin() {
+    let url = new URL(window.location.href);
+    let token = url.searchParams.get("login");
+    if (!token) {
+        return;
+    }
+    // Remove the token from the address bar and history, it can't be used
+    // again.
+    url.searchParams.delete("login");
+    window.history.replaceState(null, "", url.toString());
+
+    let options = {
+        method: "POST",
+        body: JSON.stringify({ token: token }),
+        headers: {
+            "Content-Type": "application/json",
+        },
+    };
+    fetch("/api/v1/login/verify", options)
+        .then(res => {
+            handleErrors(res);
+            return res.json();
+        }).then(user => {
+            alert(`Logged in as ${user.email}. Cars you add are saved to your account.`);
+        }).catch(error => {
+            alert("Failed to log in, the login link may have expired: " + error);
+        });
+}
+
+verifyLogin();
@@ -0,0 +1,72 @@
+// Package requestid assigns unique IDs to HTTP requests so that error
+// responses can be correlated with log lines.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type contextKey struct{}
+
+// New returns a new random request ID.
+func New() string {
+	var b [16]byte
+	// crypto/rand.Read only fails if the OS random number generator is
+	// unavailable, in which case the zero ID is still usable.
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// NewContext returns a copy of the context that carries the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID stored in the context, or an empty string
+// if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Header is the HTTP header used to propagate request IDs.
+const Header = "X-Request-ID"
+
+// maxLength is the maximum length of request IDs accepted from clients or
+// proxies.
+const maxLength = 128
+
+// valid returns true if the request ID is short and only contains characters
+// that are safe to log and return in a header.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware is an HTTP middleware that assigns a request ID to every request,
+// reusing the X-Request-ID header set by a client or proxy if it's valid. The
+// request ID is stored in the request context and returned in the X-Request-ID
+// response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
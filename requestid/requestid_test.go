@@ -0,0 +1,61 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		description string
+		header      string
+		expectReuse bool
+	}{
+		{
+			description: "Should generate a request ID if none is set",
+		},
+		{
+			description: "Should reuse a valid request ID",
+			header:      "f6b1c3a0-proxy.1",
+			expectReuse: true,
+		},
+		{
+			description: "Should replace request IDs with unsafe characters",
+			header:      "abc\ninjected log line",
+		},
+		{
+			description: "Should replace request IDs that are too long",
+			header:      strings.Repeat("a", maxLength+1),
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			var ctxID string
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxID = FromContext(r.Context())
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set(Header, test.header)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+
+			assert.NotEmpty(t, ctxID, "Expected a request ID in the context")
+			assert.Equal(t, ctxID, recorder.Header().Get(Header), "Expected the request ID in the response header")
+			if test.expectReuse {
+				assert.Equal(t, test.header, ctxID, "Expected the request ID to be reused")
+			} else {
+				assert.NotEqual(t, test.header, ctxID, "Expected a new request ID")
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidEmail is returned when logging in with an invalid email
+	// address.
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrBanned is returned when a banned user logs in.
+	ErrBanned = errors.New("user is banned")
+)
+
+// maxEmailLength is the longest valid email address, see RFC 5321.
+const maxEmailLength = 254
+
+// NormalizeEmail returns the lowercased email address, or ErrInvalidEmail if
+// it isn't a single bare address like "user@example.com".
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	// Reject display names and comments, like "User <user@example.com>", so
+	// that only the address is stored.
+	if err != nil || addr.Address != email || len(email) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(email), nil
+}
+
+// Session is a logged in session. The token is stored in the session cookie.
+type Session struct {
+	Token   string
+	Expires time.Time
+}
+
+// Accounts implements passwordless email login. Users log in by opening a
+// link with a single-use login token that's emailed to them, which is
+// exchanged for a session.
+type Accounts struct {
+	persistence Persistence
+	mailer      Mailer
+	loginURL    url.URL
+	loginTTL    time.Duration
+	sessionTTL  time.Duration
+	roles       RoleRules
+}
+
+// NewAccounts creates Accounts that email login links to the site at baseURL,
+// like "https://manualsmap.com". Login links expire after loginTTL and
+// sessions expire after sessionTTL. If mailer is nil, email login is disabled,
+// but users can still log in with OIDC.
+func NewAccounts(
+	persistence Persistence,
+	mailer Mailer,
+	baseURL string,
+	loginTTL,
+	sessionTTL time.Duration,
+) (Accounts, error) {
+	loginURL, err := url.Parse(baseURL)
+	if err != nil {
+		return Accounts{}, errors.WithMessagef(err, "invalid base URL %q", baseURL)
+	}
+	if loginURL.Scheme != "http" && loginURL.Scheme != "https" {
+		return Accounts{}, errors.Errorf("base URL %q must be an http or https URL", baseURL)
+	}
+	loginURL.Path = "/"
+	return Accounts{
+		persistence: persistence,
+		mailer:      mailer,
+		loginURL:    *loginURL,
+		loginTTL:    loginTTL,
+		sessionTTL:  sessionTTL,
+	}, nil
+}
+
+// WithRoleRules returns a copy of the Accounts that grants roles to users that
+// log in with OIDC using the rules.
+func (accounts Accounts) WithRoleRules(roles RoleRules) Accounts {
+	accounts.roles = roles
+	return accounts
+}
+
+const loginEmailSubject = "Log in to Manuals Map"
+
+// loginEmailBody is the body of the login email, formatted with the login
+// link and the number of minutes it's valid for.
+const loginEmailBody = `Open this link to log in to Manuals Map:
+
+%s
+
+The link can only be used once and expires in %d minutes. If you didn't try
+to log in, you can ignore this email.
+`
+
+// EmailKey returns a string that identifies the email address for rate
+// limiting, without storing the address itself. Addresses are normalized
+// first, so that different spellings of an address share a key.
+func EmailKey(email string) string {
+	if normalized, err := NormalizeEmail(email); err == nil {
+		email = normalized
+	}
+	return HashToken(email)
+}
+
+// EmailLoginEnabled returns whether login links can be emailed.
+func (accounts Accounts) EmailLoginEnabled() bool {
+	return accounts.mailer != nil
+}
+
+// SendLoginLink emails a login link to the address. It returns ErrInvalidEmail
+// if the address is invalid.
+func (accounts Accounts) SendLoginLink(ctx context.Context, email string) error {
+	if !accounts.EmailLoginEnabled() {
+		return errors.New("email login is disabled")
+	}
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	token, hash, err := NewToken()
+	if err != nil {
+		return err
+	}
+	if err := accounts.persistence.InsertLoginToken(ctx, email, hash, time.Now().Add(accounts.loginTTL)); err != nil {
+		return err
+	}
+
+	// The link opens the site, which exchanges the token for a session.
+	// Linking to the API directly would let email scanners that open links
+	// use up the token.
+	link := accounts.loginURL
+	link.RawQuery = url.Values{"login": {token}}.Encode()
+	body := fmt.Sprintf(loginEmailBody, link.String(), int(accounts.loginTTL.Minutes()))
+	return errors.WithMessage(
+		accounts.mailer.Send(ctx, email, loginEmailSubject, body),
+		"error sending login email")
+}
+
+// Login exchanges a login token for a new session, creating the user if they
+// haven't logged in before. It returns ErrInvalidLoginToken if the token
+// doesn't exist, has expired or was already used, or ErrBanned if the user is
+// banned.
+func (accounts Accounts) Login(ctx context.Context, loginToken string) (User, Session, error) {
+	user, err := accounts.persistence.UseLoginToken(ctx, HashToken(loginToken))
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	user.Role = RoleUser
+	session, err := accounts.newSession(ctx, user.ID, "")
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	return user, session, nil
+}
+
+// LoginOIDC creates a new session for the identity verified by the OIDC
+// provider, creating the user if they haven't logged in before. Users are
+// identified by email address, so logging in with OIDC and with an emailed
+// link use the same account. It returns ErrBanned if the user is banned.
+func (accounts Accounts) LoginOIDC(ctx context.Context, identity Identity) (User, Session, error) {
+	user, err := accounts.persistence.GetOrInsertUser(ctx, identity.Email)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	user.Role = accounts.roles.Role(identity.Subject, user.Email)
+	session, err := accounts.newSession(ctx, user.ID, identity.Subject)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	return user, session, nil
+}
+
+func (accounts Accounts) newSession(ctx context.Context, userID int, oidcSubject string) (Session, error) {
+	banned, err := accounts.persistence.IsBanned(ctx, "", userID)
+	if err != nil {
+		return Session{}, err
+	}
+	if banned {
+		return Session{}, ErrBanned
+	}
+	token, hash, err := NewToken()
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{Token: token, Expires: time.Now().Add(accounts.sessionTTL)}
+	if err := accounts.persistence.InsertSession(ctx, userID, hash, oidcSubject, session.Expires); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// Logout ends the session.
+func (accounts Accounts) Logout(ctx context.Context, sessionToken string) error {
+	return accounts.persistence.DeleteSession(ctx, HashToken(sessionToken))
+}
+
+// SessionUser returns the user logged in with the session token, or nil if
+// the token is empty or the session doesn't exist or has expired.
+//
+// Roles are only granted to users that logged in with OIDC, and are looked up
+// on every request so that changes to the role rules apply to existing
+// sessions.
+func (accounts Accounts) SessionUser(ctx context.Context, sessionToken string) (*User, error) {
+	if sessionToken == "" {
+		return nil, nil
+	}
+	user, oidcSubject, err := accounts.persistence.GetSessionUser(ctx, HashToken(sessionToken))
+	if err != nil || user == nil {
+		return nil, err
+	}
+	user.Role = RoleUser
+	if oidcSubject != "" {
+		user.Role = accounts.roles.Role(oidcSubject, user.Email)
+	}
+	return user, nil
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+// email is an email recorded by recordingMailer.
+type email struct {
+	to      string
+	subject string
+	body    string
+}
+
+// recordingMailer is a Mailer that records sent emails.
+type recordingMailer struct {
+	mu     sync.Mutex
+	emails []email
+}
+
+func (mailer *recordingMailer) Send(_ context.Context, to, subject, body string) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	mailer.emails = append(mailer.emails, email{to: to, subject: subject, body: body})
+	return nil
+}
+
+// loginLink returns the link in the last email.
+func (mailer *recordingMailer) loginLink(t *testing.T) *url.URL {
+	t.Helper()
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	require.NotEmpty(t, mailer.emails, "Expected an email")
+	for _, line := range strings.Split(mailer.emails[len(mailer.emails)-1].body, "\n") {
+		if strings.HasPrefix(line, "https://") {
+			link, err := url.Parse(line)
+			require.NoError(t, err, "Expected a valid login link")
+			return link
+		}
+	}
+	t.Fatal("Expected a login link in the email")
+	return nil
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		description string
+		email       string
+		expected    string
+		expectedErr error
+	}{
+		{
+			description: "Addresses should be lowercased and trimmed",
+			email:       " Driver@Example.com ",
+			expected:    "driver@example.com",
+		},
+		{
+			description: "Addresses with display names should be rejected",
+			email:       "Driver <driver@example.com>",
+			expectedErr: ErrInvalidEmail,
+		},
+		{
+			description: "Multiple addresses should be rejected",
+			email:       "driver@example.com, other@example.com",
+			expectedErr: ErrInvalidEmail,
+		},
+		{
+			description: "Addresses without a domain should be rejected",
+			email:       "driver",
+			expectedErr: ErrInvalidEmail,
+		},
+		{
+			description: "Addresses longer than 254 characters should be rejected",
+			email:       strings.Repeat("a", 64) + "@" + strings.Repeat("b", 186) + ".com",
+			expectedErr: ErrInvalidEmail,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			email, err := NormalizeEmail(test.email)
+			assert.Equal(t, test.expectedErr, err, "Expected errors to match")
+			assert.Equal(t, test.expected, email, "Expected email addresses to match")
+		})
+	}
+}
+
+func TestEmailKey(t *testing.T) {
+	assert.Equal(
+		t,
+		EmailKey("driver@example.com"),
+		EmailKey(" Driver@Example.com "),
+		"Expected spellings of the same address to share a key")
+	assert.NotEqual(
+		t,
+		EmailKey("driver@example.com"),
+		EmailKey("other@example.com"),
+		"Expected different addresses to have different keys")
+	assert.NotContains(t, EmailKey("driver@example.com"), "driver", "Expected the key not to contain the address")
+}
+
+func TestNewAccounts(t *testing.T) {
+	_, err := NewAccounts(Persistence{}, &recordingMailer{}, "manualsmap.com", time.Minute, time.Hour)
+	assert.Error(t, err, "Expected base URLs without a scheme to be rejected")
+	_, err = NewAccounts(Persistence{}, &recordingMailer{}, "https://manualsmap.com", time.Minute, time.Hour)
+	assert.NoError(t, err, "Expected no error")
+}
+
+func TestAccounts(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		mailer := &recordingMailer{}
+		accounts, err := NewAccounts(svc, mailer, "https://manualsmap.com/ignored", 15*time.Minute, time.Hour)
+		require.NoError(t, err, "Expected no error creating Accounts")
+
+		assert.Equal(
+			t,
+			ErrInvalidEmail,
+			accounts.SendLoginLink(ctx, "not an address"),
+			"Expected invalid addresses to be rejected")
+		assert.Empty(t, mailer.emails, "Expected no email to invalid addresses")
+
+		require.NoError(t, accounts.SendLoginLink(ctx, "Driver@Example.com"), "Expected no error sending a login link")
+		require.Len(t, mailer.emails, 1, "Expected one email")
+		assert.Equal(t, "driver@example.com", mailer.emails[0].to, "Expected the normalized address")
+		assert.Contains(t, mailer.emails[0].body, "expires in 15 minutes", "Expected the link lifetime")
+		link := mailer.loginLink(t)
+		assert.Equal(t, "manualsmap.com", link.Host, "Expected the link to open the site")
+		assert.Equal(t, "/", link.Path, "Expected the link to open the home page")
+
+		user, session, err := accounts.Login(ctx, link.Query().Get("login"))
+		require.NoError(t, err, "Expected no error logging in")
+		assert.Equal(t, "driver@example.com", user.Email, "Expected email addresses to match")
+		assert.NotEmpty(t, session.Token, "Expected a session token")
+		assert.WithinDuration(t, time.Now().Add(time.Hour), session.Expires, time.Minute, "Expected the session lifetime")
+
+		_, _, err = accounts.Login(ctx, link.Query().Get("login"))
+		assert.Equal(t, ErrInvalidLoginToken, err, "Expected login tokens to be single-use")
+
+		sessionUser, err := accounts.SessionUser(ctx, session.Token)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, &user, sessionUser, "Expected the session user")
+		sessionUser, err = accounts.SessionUser(ctx, "")
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected no user without a session token")
+
+		require.NoError(t, accounts.Logout(ctx, session.Token), "Expected no error logging out")
+		sessionUser, err = accounts.SessionUser(ctx, session.Token)
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected no user after logging out")
+	})
+}
+
+func TestAccountsLoginOIDC(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		mailer := &recordingMailer{}
+		accounts, err := NewAccounts(svc, mailer, "https://manualsmap.com", 15*time.Minute, time.Hour)
+		require.NoError(t, err, "Expected no error creating Accounts")
+		accounts = accounts.WithRoleRules(RoleRules{
+			{Claim: "email", Value: "driver@example.com", Role: RoleAdmin},
+		})
+		existing := insertUser(t, svc, "driver@example.com")
+
+		user, session, err := accounts.LoginOIDC(ctx, Identity{Subject: "subject", Email: "driver@example.com"})
+		require.NoError(t, err, "Expected no error logging in")
+		assert.Equal(
+			t,
+			User{ID: existing.ID, Email: "driver@example.com", Role: RoleAdmin},
+			user,
+			"Expected the existing user with the role granted by the rules")
+		sessionUser, err := accounts.SessionUser(ctx, session.Token)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, &user, sessionUser, "Expected the session user")
+
+		// Role rules apply to existing sessions.
+		sessionUser, err = accounts.WithRoleRules(nil).SessionUser(ctx, session.Token)
+		assert.NoError(t, err, "Expected no error")
+		require.NotNil(t, sessionUser, "Expected a session user")
+		assert.Equal(t, RoleUser, sessionUser.Role, "Expected the role to be removed")
+
+		// Sessions from emailed links never have roles.
+		require.NoError(t, accounts.SendLoginLink(ctx, "driver@example.com"), "Expected no error sending a login link")
+		emailUser, emailSession, err := accounts.Login(ctx, mailer.loginLink(t).Query().Get("login"))
+		require.NoError(t, err, "Expected no error logging in")
+		assert.Equal(t, RoleUser, emailUser.Role, "Expected no role for emailed link logins")
+		sessionUser, err = accounts.SessionUser(ctx, emailSession.Token)
+		assert.NoError(t, err, "Expected no error")
+		require.NotNil(t, sessionUser, "Expected a session user")
+		assert.Equal(t, RoleUser, sessionUser.Role, "Expected no role for emailed link sessions")
+	})
+}
@@ -0,0 +1,684 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+var (
+	// ErrMapBlockNotFound is returned when moving cars to a map block that
+	// doesn't exist.
+	ErrMapBlockNotFound = errors.New("map block not found")
+	// ErrUserNotFound is returned when banning a user that doesn't exist.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidIP is returned when banning an invalid IP address.
+	ErrInvalidIP = errors.New("invalid IP address")
+	// ErrAlreadyBanned is returned when banning an IP address or user that's
+	// already banned.
+	ErrAlreadyBanned = errors.New("already banned")
+	// ErrBanNotFound is returned when deleting a ban that doesn't exist.
+	ErrBanNotFound = errors.New("ban not found")
+)
+
+// Admin actions recorded in the audit log.
+const (
+	ActionMergeCars            = "merge_cars"
+	ActionMoveCars             = "move_cars"
+	ActionRenameCars           = "rename_cars"
+	ActionDeleteEmptyMapBlocks = "delete_empty_map_blocks"
+	ActionBan                  = "ban"
+	ActionUnban                = "unban"
+)
+
+// AdminAction is an entry in the audit log of admin actions.
+type AdminAction struct {
+	ID int
+	// UserID is the ID of the admin, or 0 if their account was deleted.
+	UserID    int
+	UserEmail string
+	// Action is one of the Action constants.
+	Action string
+	// Details describe the action, like the IDs of the changed cars.
+	Details map[string]interface{}
+	Created time.Time
+}
+
+// Ban bans a client IP address or a user. Exactly one of IP and UserID is
+// set.
+type Ban struct {
+	ID     int
+	IP     string
+	UserID int
+	Reason string
+	// Created is set when the ban is inserted.
+	Created time.Time
+}
+
+// CarName is a car's make and model.
+type CarName struct {
+	Make  string
+	Model string
+}
+
+const insertAdminActionQuery = `
+INSERT INTO admin_actions (user_id, user_email, action, details, created)
+VALUES ($1, $2, $3, $4, $5)
+`
+
+// insertAdminAction records the action by the admin in the audit log in the
+// transaction, so that the log only contains committed changes.
+func (svc Persistence) insertAdminAction(
+	ctx context.Context,
+	tx *sql.Tx,
+	admin User,
+	action string,
+	details map[string]interface{},
+) error {
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode admin action details")
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		svc.driver.Rebind(insertAdminActionQuery),
+		admin.ID,
+		admin.Email,
+		action,
+		string(encoded),
+		time.Now().UTC())
+	return errors.WithMessage(err, "failed to insert admin action")
+}
+
+const updateCarImageQuery = `
+UPDATE cars
+SET
+	images_public_id = $2,
+	updated = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+// mergeCarQuery hides a duplicate car that was merged into another car. Like
+// DeleteCar, the car and its history are kept.
+const mergeCarQuery = `
+UPDATE cars
+SET deleted = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+// uniqueIDs returns the sorted IDs without duplicates and without the
+// excluded ID. Cars are locked in ID order so that concurrent admin actions
+// can't deadlock.
+func uniqueIDs(ids []int, exclude int) []int {
+	unique := make([]int, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if id == exclude || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	sort.Ints(unique)
+	return unique
+}
+
+// MergeCars merges duplicate submissions of a car into the car to keep. The
+// duplicates are deleted, and if the car to keep has no image, it gets the
+// image of the duplicate with the lowest ID that has one. It returns
+// ErrCarNotFound if any of the cars doesn't exist or has been deleted.
+func (svc Persistence) MergeCars(
+	ctx context.Context,
+	admin User,
+	keepID int,
+	duplicateIDs []int,
+) (err error) {
+	ctx, done := svc.instrument(ctx, "MergeCars", "mergeCarQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to begin merge transaction")
+	}
+	defer tx.Rollback()
+
+	keep, _, err := svc.lockCar(ctx, tx, keepID)
+	if err != nil {
+		return err
+	}
+	image := keep.imageID
+	duplicateIDs = uniqueIDs(duplicateIDs, keepID)
+	for _, id := range duplicateIDs {
+		duplicate, _, err := svc.lockCar(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := svc.insertCarHistory(ctx, tx, id, "delete", duplicate); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, svc.driver.Rebind(mergeCarQuery), id); err != nil {
+			return errors.WithMessage(err, "failed to delete car")
+		}
+		if !image.Valid {
+			image = duplicate.imageID
+		}
+	}
+	if image != keep.imageID {
+		if err := svc.insertCarHistory(ctx, tx, keepID, "update", keep); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, svc.driver.Rebind(updateCarImageQuery), keepID, image); err != nil {
+			return errors.WithMessage(err, "failed to update car image")
+		}
+	}
+
+	err = svc.insertAdminAction(ctx, tx, admin, ActionMergeCars, map[string]interface{}{
+		"keepId":       keepID,
+		"duplicateIds": duplicateIDs,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(tx.Commit(), "failed to commit merge transaction")
+}
+
+const lockMapBlockQuery = `
+SELECT id
+FROM map_blocks
+WHERE id = $1
+FOR SHARE
+`
+
+// SQLite doesn't support row locks, but the transaction already holds the
+// database write lock once it has written.
+const lockMapBlockSQLiteQuery = `
+SELECT id
+FROM map_blocks
+WHERE id = $1
+`
+
+const moveCarQuery = `
+UPDATE cars
+SET
+	map_block_id = $2,
+	updated = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+// MoveCars moves the cars to the map block, keeping their previous versions
+// in their history. It returns ErrMapBlockNotFound if the map block doesn't
+// exist, or ErrCarNotFound if any of the cars doesn't exist or has been
+// deleted.
+func (svc Persistence) MoveCars(
+	ctx context.Context,
+	admin User,
+	carIDs []int,
+	mapBlockID int,
+) (err error) {
+	ctx, done := svc.instrument(ctx, "MoveCars", "moveCarQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to begin move transaction")
+	}
+	defer tx.Rollback()
+
+	// Lock the map block so that it can't be deleted as empty before the
+	// cars are moved into it.
+	query := lockMapBlockQuery
+	if svc.driver == database.SQLite {
+		query = lockMapBlockSQLiteQuery
+	}
+	var id int
+	err = tx.QueryRowContext(ctx, svc.driver.Rebind(query), mapBlockID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrMapBlockNotFound
+	}
+	if err != nil {
+		return errors.WithMessage(err, "failed to read map block")
+	}
+
+	carIDs = uniqueIDs(carIDs, 0)
+	for _, carID := range carIDs {
+		car, _, err := svc.lockCar(ctx, tx, carID)
+		if err != nil {
+			return err
+		}
+		if car.mapBlockID == mapBlockID {
+			continue
+		}
+		if err := svc.insertCarHistory(ctx, tx, carID, "update", car); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, svc.driver.Rebind(moveCarQuery), carID, mapBlockID); err != nil {
+			return errors.WithMessage(err, "failed to move car")
+		}
+	}
+
+	err = svc.insertAdminAction(ctx, tx, admin, ActionMoveCars, map[string]interface{}{
+		"carIds":     carIDs,
+		"mapBlockId": mapBlockID,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(tx.Commit(), "failed to commit move transaction")
+}
+
+// The rename queries match makes and models case-insensitively so that
+// variants like "mazda" and "MAZDA" can be fixed at once. Cars that already
+// have the new name are skipped so that they don't get history entries.
+const insertRenamedCarsHistoryQuery = `
+INSERT INTO car_history (
+	car_id,
+	action,
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id
+)
+SELECT
+	id,
+	'update',
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id
+FROM cars
+WHERE
+	lower(make) = lower($1)
+	AND ($2 = '' OR lower(model) = lower($2))
+	AND NOT (make = $3 AND ($4 = '' OR model = $4))
+	AND deleted IS NULL
+`
+
+const renameCarsQuery = `
+UPDATE cars
+SET
+	make = $3,
+	model = CASE WHEN $4 = '' THEN model ELSE $4 END,
+	updated = CURRENT_TIMESTAMP
+WHERE
+	lower(make) = lower($1)
+	AND ($2 = '' OR lower(model) = lower($2))
+	AND NOT (make = $3 AND ($4 = '' OR model = $4))
+	AND deleted IS NULL
+`
+
+// RenameCars renames the make and model of every car named from to the new
+// name, keeping their previous versions in their history, and returns the
+// number of renamed cars. Names are matched case-insensitively. If from.Model
+// is empty, cars of every model of the make are renamed and to.Model must be
+// empty too, which keeps their models.
+func (svc Persistence) RenameCars(
+	ctx context.Context,
+	admin User,
+	from,
+	to CarName,
+) (_ int, err error) {
+	ctx, done := svc.instrument(ctx, "RenameCars", "renameCarsQuery")
+	defer func() { done(err) }()
+
+	if (from.Model == "") != (to.Model == "") {
+		return 0, errors.New("the old and new model must both be set or both be empty")
+	}
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to begin rename transaction")
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{from.Make, from.Model, to.Make, to.Model}
+	if _, err := tx.ExecContext(ctx, svc.driver.Rebind(insertRenamedCarsHistoryQuery), args...); err != nil {
+		return 0, errors.WithMessage(err, "failed to insert car history")
+	}
+	result, err := tx.ExecContext(ctx, svc.driver.Rebind(renameCarsQuery), args...)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to rename cars")
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to count renamed cars")
+	}
+
+	err = svc.insertAdminAction(ctx, tx, admin, ActionRenameCars, map[string]interface{}{
+		"from":  map[string]string{"make": from.Make, "model": from.Model},
+		"to":    map[string]string{"make": to.Make, "model": to.Model},
+		"count": count,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.WithMessage(err, "failed to commit rename transaction")
+	}
+	return int(count), nil
+}
+
+// Map blocks whose cars were all deleted aren't empty, because deleting the
+// map block would delete the cars' history.
+const deleteEmptyMapBlocksQuery = `
+DELETE FROM map_blocks
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM cars c
+	WHERE c.map_block_id = map_blocks.id
+)
+RETURNING id
+`
+
+// DeleteEmptyMapBlocks deletes every map block without cars and returns the
+// IDs of the deleted map blocks.
+func (svc Persistence) DeleteEmptyMapBlocks(ctx context.Context, admin User) (_ []int, err error) {
+	ctx, done := svc.instrument(ctx, "DeleteEmptyMapBlocks", "deleteEmptyMapBlocksQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to begin map block transaction")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, svc.driver.Rebind(deleteEmptyMapBlocksQuery))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to delete map blocks")
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(ids)
+
+	err = svc.insertAdminAction(ctx, tx, admin, ActionDeleteEmptyMapBlocks, map[string]interface{}{
+		"mapBlockIds": ids,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.WithMessage(err, "failed to commit map block transaction")
+	}
+	return ids, nil
+}
+
+// scanIDs reads all IDs from rows and closes them.
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	ids := make([]int, 0, 10)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.WithMessage(err, "failed to scan ID")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read IDs")
+	}
+	return ids, nil
+}
+
+// canonicalIP returns the IP address in canonical form, or an empty string if
+// it isn't an IP address.
+func canonicalIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	return parsed.String()
+}
+
+const getUserByIDQuery = `
+SELECT id, email
+FROM users
+WHERE id = $1
+`
+
+const getBanQuery = `
+SELECT id
+FROM bans
+WHERE ip = $1 OR user_id = $2
+`
+
+const insertBanQuery = `
+INSERT INTO bans (ip, user_id, reason, created)
+VALUES ($1, $2, $3, $4)
+RETURNING id
+`
+
+const deleteUserSessionsQuery = `
+DELETE FROM sessions
+WHERE user_id = $1
+`
+
+// InsertBan bans the IP address or user in the ban, and returns the ban with
+// its ID and creation time set. Banning a user logs them out. It returns
+// ErrInvalidIP, ErrUserNotFound or ErrAlreadyBanned if the ban can't be
+// inserted.
+func (svc Persistence) InsertBan(ctx context.Context, admin User, ban Ban) (_ Ban, err error) {
+	ctx, done := svc.instrument(ctx, "InsertBan", "insertBanQuery")
+	defer func() { done(err) }()
+
+	if (ban.IP == "") == (ban.UserID == 0) {
+		return Ban{}, errors.New("exactly one of the IP address and user must be set")
+	}
+	if ban.IP != "" {
+		ban.IP = canonicalIP(ban.IP)
+		if ban.IP == "" {
+			return Ban{}, ErrInvalidIP
+		}
+	}
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Ban{}, errors.WithMessage(err, "failed to begin ban transaction")
+	}
+	defer tx.Rollback()
+
+	var banned User
+	if ban.UserID != 0 {
+		err := tx.QueryRowContext(ctx, svc.driver.Rebind(getUserByIDQuery), ban.UserID).
+			Scan(&banned.ID, &banned.Email)
+		if err == sql.ErrNoRows {
+			return Ban{}, ErrUserNotFound
+		}
+		if err != nil {
+			return Ban{}, errors.WithMessage(err, "failed to read user")
+		}
+	}
+	var existing int
+	err = tx.QueryRowContext(ctx, svc.driver.Rebind(getBanQuery), ban.IP, ban.UserID).Scan(&existing)
+	if err == nil {
+		return Ban{}, ErrAlreadyBanned
+	}
+	if err != sql.ErrNoRows {
+		return Ban{}, errors.WithMessage(err, "failed to read ban")
+	}
+
+	ban.Created = time.Now().UTC()
+	err = tx.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(insertBanQuery),
+		sql.NullString{String: ban.IP, Valid: ban.IP != ""},
+		sql.NullInt64{Int64: int64(ban.UserID), Valid: ban.UserID != 0},
+		ban.Reason,
+		ban.Created,
+	).Scan(&ban.ID)
+	if err != nil {
+		return Ban{}, errors.WithMessage(err, "failed to insert ban")
+	}
+	details := map[string]interface{}{"banId": ban.ID, "reason": ban.Reason}
+	if ban.IP != "" {
+		details["ip"] = ban.IP
+	} else {
+		details["userId"] = banned.ID
+		details["userEmail"] = banned.Email
+		if _, err := tx.ExecContext(ctx, svc.driver.Rebind(deleteUserSessionsQuery), ban.UserID); err != nil {
+			return Ban{}, errors.WithMessage(err, "failed to delete user sessions")
+		}
+	}
+	if err := svc.insertAdminAction(ctx, tx, admin, ActionBan, details); err != nil {
+		return Ban{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Ban{}, errors.WithMessage(err, "failed to commit ban transaction")
+	}
+	return ban, nil
+}
+
+const deleteBanQuery = `
+DELETE FROM bans
+WHERE id = $1
+RETURNING ip, user_id
+`
+
+// DeleteBan deletes the ban. It returns ErrBanNotFound if the ban doesn't
+// exist.
+func (svc Persistence) DeleteBan(ctx context.Context, admin User, id int) (err error) {
+	ctx, done := svc.instrument(ctx, "DeleteBan", "deleteBanQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to begin ban transaction")
+	}
+	defer tx.Rollback()
+
+	var ip sql.NullString
+	var userID sql.NullInt64
+	err = tx.QueryRowContext(ctx, svc.driver.Rebind(deleteBanQuery), id).Scan(&ip, &userID)
+	if err == sql.ErrNoRows {
+		return ErrBanNotFound
+	}
+	if err != nil {
+		return errors.WithMessage(err, "failed to delete ban")
+	}
+	details := map[string]interface{}{"banId": id}
+	if ip.Valid {
+		details["ip"] = ip.String
+	} else {
+		details["userId"] = userID.Int64
+	}
+	if err := svc.insertAdminAction(ctx, tx, admin, ActionUnban, details); err != nil {
+		return err
+	}
+	return errors.WithMessage(tx.Commit(), "failed to commit ban transaction")
+}
+
+const getBansQuery = `
+SELECT id, ip, user_id, reason, created
+FROM bans
+ORDER BY id DESC
+`
+
+// GetBans returns all bans, newest first.
+func (svc Persistence) GetBans(ctx context.Context) (_ []Ban, err error) {
+	ctx, done := svc.instrument(ctx, "GetBans", "getBansQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(getBansQuery))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read bans")
+	}
+	defer rows.Close()
+	bans := make([]Ban, 0, 10)
+	for rows.Next() {
+		var ban Ban
+		var ip sql.NullString
+		var userID sql.NullInt64
+		if err := rows.Scan(&ban.ID, &ip, &userID, &ban.Reason, &ban.Created); err != nil {
+			return nil, errors.WithMessage(err, "failed to scan ban row into struct")
+		}
+		ban.IP = ip.String
+		ban.UserID = int(userID.Int64)
+		bans = append(bans, ban)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read bans")
+	}
+	return bans, nil
+}
+
+const isBannedQuery = `
+SELECT COUNT(*)
+FROM bans
+WHERE ip = $1 OR user_id = $2
+`
+
+// IsBanned returns true if the IP address or the user with the ID is banned.
+// Either may be empty or 0 to only check the other.
+func (svc Persistence) IsBanned(ctx context.Context, ip string, userID int) (_ bool, err error) {
+	ctx, done := svc.instrument(ctx, "IsBanned", "isBannedQuery")
+	defer func() { done(err) }()
+	var count int
+	err = svc.db.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(isBannedQuery),
+		canonicalIP(ip),
+		userID,
+	).Scan(&count)
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to read bans")
+	}
+	return count > 0, nil
+}
+
+const getAdminActionsQuery = `
+SELECT id, user_id, user_email, action, details, created
+FROM admin_actions
+WHERE $1 = 0 OR id < $1
+ORDER BY id DESC
+LIMIT $2
+`
+
+// GetAdminActions returns up to limit entries of the audit log, newest first,
+// starting before the entry with the ID before, or with the newest entry if
+// before is 0.
+func (svc Persistence) GetAdminActions(ctx context.Context, before, limit int) (_ []AdminAction, err error) {
+	ctx, done := svc.instrument(ctx, "GetAdminActions", "getAdminActionsQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(getAdminActionsQuery), before, limit)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read admin actions")
+	}
+	defer rows.Close()
+	actions := make([]AdminAction, 0, limit)
+	for rows.Next() {
+		var action AdminAction
+		var userID sql.NullInt64
+		var details string
+		err := rows.Scan(
+			&action.ID,
+			&userID,
+			&action.UserEmail,
+			&action.Action,
+			&details,
+			&action.Created)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to scan admin action row into struct")
+		}
+		action.UserID = int(userID.Int64)
+		if err := json.Unmarshal([]byte(details), &action.Details); err != nil {
+			return nil, errors.WithMessage(err, "failed to decode admin action details")
+		}
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read admin actions")
+	}
+	return actions, nil
+}
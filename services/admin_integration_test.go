@@ -0,0 +1,379 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+// insertNamedCar inserts a car with the make, model and image in the block.
+func insertNamedCar(t *testing.T, svc Persistence, mapBlockID int, make, model, imageID string) int {
+	t.Helper()
+	id, err := svc.InsertCar(context.Background(), mapBlockID, 1994, make, model, "", "red", imageID, "", 0)
+	require.NoError(t, err, "Expected no error inserting car")
+	return id
+}
+
+// carImageID returns the image ID of the car, including deleted cars.
+func carImageID(t *testing.T, db *sql.DB, driver database.Driver, id int) sql.NullString {
+	t.Helper()
+	var imageID sql.NullString
+	err := db.QueryRow(driver.Rebind(`SELECT images_public_id FROM cars WHERE id = $1`), id).Scan(&imageID)
+	require.NoError(t, err, "Expected no error reading car")
+	return imageID
+}
+
+// historyActions returns the actions in the car's history, oldest first.
+func historyActions(t *testing.T, svc Persistence, id int) []string {
+	t.Helper()
+	history, err := svc.GetCarHistory(context.Background(), id)
+	require.NoError(t, err, "Expected no error getting car history")
+	var actions []string
+	for _, version := range history {
+		actions = append(actions, version.Action)
+	}
+	return actions
+}
+
+// adminActions returns the names of all admin actions, newest first.
+func adminActions(t *testing.T, svc Persistence) []string {
+	t.Helper()
+	actions, err := svc.GetAdminActions(context.Background(), 0, 100)
+	require.NoError(t, err, "Expected no error getting admin actions")
+	var names []string
+	for _, action := range actions {
+		names = append(names, action.Action)
+	}
+	return names
+}
+
+func TestPersistenceMergeCars(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		admin := insertUser(t, svc, "admin@example.com")
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		keep := insertNamedCar(t, svc, blocks[0].ID, "Mazda", "Miata", "")
+		noImage := insertNamedCar(t, svc, blocks[0].ID, "mazda", "miata", "")
+		withImage := insertNamedCar(t, svc, blocks[0].ID, "MAZDA", "MIATA", "miata")
+
+		assert.Equal(
+			t,
+			ErrCarNotFound,
+			svc.MergeCars(ctx, admin, keep, []int{noImage, withImage + 1}),
+			"Expected missing duplicates to not be found")
+		assert.Empty(t, historyActions(t, svc, noImage), "Expected failed merges to be rolled back")
+		assert.Empty(t, adminActions(t, svc), "Expected failed merges to not be logged")
+
+		require.NoError(
+			t,
+			svc.MergeCars(ctx, admin, keep, []int{withImage, noImage, noImage, keep}),
+			"Expected no error merging cars")
+
+		cars, err := svc.GetCars(ctx, blocks[0].ID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		if assert.Len(t, cars, 1, "Expected duplicates to be deleted") {
+			assert.Equal(t, keep, cars[0].ID, "Expected the car to keep")
+		}
+		assert.Equal(
+			t,
+			sql.NullString{String: "miata", Valid: true},
+			carImageID(t, db, driver, keep),
+			"Expected the car to keep to get the duplicate's image")
+		assert.Equal(t, []string{"update"}, historyActions(t, svc, keep), "Expected the previous version to be kept")
+		assert.Equal(t, []string{"delete"}, historyActions(t, svc, noImage), "Expected the duplicate to be deleted")
+		assert.Equal(t, []string{"delete"}, historyActions(t, svc, withImage), "Expected the duplicate to be deleted")
+
+		actions, err := svc.GetAdminActions(ctx, 0, 10)
+		require.NoError(t, err, "Expected no error getting admin actions")
+		if assert.Len(t, actions, 1, "Expected the merge to be logged") {
+			assert.Equal(t, admin.ID, actions[0].UserID, "Expected user IDs to match")
+			assert.Equal(t, "admin@example.com", actions[0].UserEmail, "Expected email addresses to match")
+			assert.Equal(t, ActionMergeCars, actions[0].Action, "Expected actions to match")
+			assert.Equal(
+				t,
+				map[string]interface{}{
+					"keepId":       float64(keep),
+					"duplicateIds": []interface{}{float64(noImage), float64(withImage)},
+				},
+				actions[0].Details,
+				"Expected details to match")
+			assert.False(t, actions[0].Created.IsZero(), "Expected a creation time")
+		}
+
+		assert.Equal(
+			t,
+			ErrCarNotFound,
+			svc.MergeCars(ctx, admin, keep, []int{noImage}),
+			"Expected deleted duplicates to not be found")
+	})
+}
+
+func TestPersistenceMoveCars(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		admin := insertUser(t, svc, "admin@example.com")
+		blocks := insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "45.5152", longitude: "-122.6784"})
+		moved := insertNamedCar(t, svc, blocks[0].ID, "Mazda", "Miata", "")
+		already := insertNamedCar(t, svc, blocks[1].ID, "Mazda", "Miata", "")
+
+		assert.Equal(
+			t,
+			ErrMapBlockNotFound,
+			svc.MoveCars(ctx, admin, []int{moved}, blocks[1].ID+1),
+			"Expected missing map blocks to not be found")
+		assert.Equal(
+			t,
+			ErrCarNotFound,
+			svc.MoveCars(ctx, admin, []int{moved, already + 1}, blocks[1].ID),
+			"Expected missing cars to not be found")
+		assert.Empty(t, historyActions(t, svc, moved), "Expected failed moves to be rolled back")
+
+		require.NoError(
+			t,
+			svc.MoveCars(ctx, admin, []int{moved, already}, blocks[1].ID),
+			"Expected no error moving cars")
+		cars, err := svc.GetCars(ctx, blocks[0].ID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Empty(t, cars, "Expected the car to be moved out of the map block")
+		cars, err = svc.GetCars(ctx, blocks[1].ID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Len(t, cars, 2, "Expected the car to be moved into the map block")
+
+		history, err := svc.GetCarHistory(ctx, moved)
+		assert.NoError(t, err, "Expected no error getting car history")
+		if assert.Len(t, history, 1, "Expected the previous version to be kept") {
+			assert.Equal(t, blocks[0].ID, history[0].MapBlockID, "Expected the previous map block")
+		}
+		assert.Empty(t, historyActions(t, svc, already), "Expected cars already in the map block to not change")
+		assert.Equal(t, []string{ActionMoveCars}, adminActions(t, svc), "Expected the move to be logged")
+	})
+}
+
+func TestPersistenceRenameCars(t *testing.T) {
+	tests := []struct {
+		description    string
+		from           CarName
+		to             CarName
+		expectedCount  int
+		expectedNames  []CarName
+		expectedEdited []bool
+		expectErr      bool
+	}{
+		{
+			description:   "Makes should be renamed case-insensitively",
+			from:          CarName{Make: "MAZDA"},
+			to:            CarName{Make: "Mazda"},
+			expectedCount: 2,
+			expectedNames: []CarName{
+				{Make: "Mazda", Model: "Miata"},
+				{Make: "Mazda", Model: "MX-5"},
+				{Make: "Mazda", Model: "miata"},
+				{Make: "Honda", Model: "Civic"},
+			},
+			expectedEdited: []bool{false, true, true, false},
+		},
+		{
+			description:   "Models should be renamed case-insensitively",
+			from:          CarName{Make: "mazda", Model: "MIATA"},
+			to:            CarName{Make: "Mazda", Model: "MX-5"},
+			expectedCount: 2,
+			expectedNames: []CarName{
+				{Make: "Mazda", Model: "MX-5"},
+				{Make: "mazda", Model: "MX-5"},
+				{Make: "Mazda", Model: "MX-5"},
+				{Make: "Honda", Model: "Civic"},
+			},
+			expectedEdited: []bool{true, false, true, false},
+		},
+		{
+			description: "Renaming models of every make should be rejected",
+			from:        CarName{Make: "Mazda"},
+			to:          CarName{Make: "Mazda", Model: "MX-5"},
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+				ctx := context.Background()
+				svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+				admin := insertUser(t, svc, "admin@example.com")
+				blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+				ids := []int{
+					insertNamedCar(t, svc, blocks[0].ID, "Mazda", "Miata", ""),
+					insertNamedCar(t, svc, blocks[0].ID, "mazda", "MX-5", ""),
+					insertNamedCar(t, svc, blocks[0].ID, "MAZDA", "miata", ""),
+					insertNamedCar(t, svc, blocks[0].ID, "Honda", "Civic", ""),
+				}
+
+				count, err := svc.RenameCars(ctx, admin, test.from, test.to)
+				if test.expectErr {
+					assert.Error(t, err, "Expected an error")
+					assert.Empty(t, adminActions(t, svc), "Expected failed renames to not be logged")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, test.expectedCount, count, "Expected counts to match")
+
+				cars, err := svc.GetCars(ctx, blocks[0].ID)
+				require.NoError(t, err, "Expected no error getting cars")
+				names := make(map[int]CarName, len(cars))
+				for _, car := range cars {
+					names[car.ID] = CarName{Make: car.Make, Model: car.Model}
+				}
+				for i, id := range ids {
+					assert.Equal(t, test.expectedNames[i], names[id], "Expected names to match")
+					assert.Equal(
+						t,
+						test.expectedEdited[i],
+						len(historyActions(t, svc, id)) == 1,
+						"Expected only renamed cars to have history")
+				}
+				assert.Equal(t, []string{ActionRenameCars}, adminActions(t, svc), "Expected the rename to be logged")
+			})
+		})
+	}
+}
+
+func TestPersistenceDeleteEmptyMapBlocks(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		admin := insertUser(t, svc, "admin@example.com")
+		blocks := insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "45.5152", longitude: "-122.6784"},
+			coordinates{latitude: "47.6062", longitude: "-122.3321"})
+		insertEditableCar(t, svc, blocks[0].ID, "")
+		id, hash := insertEditableCar(t, svc, blocks[1].ID, "")
+		require.NoError(t, svc.DeleteCar(ctx, id, hash), "Expected no error deleting car")
+
+		deleted, err := svc.DeleteEmptyMapBlocks(ctx, admin)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, []int{blocks[2].ID}, deleted, "Expected only map blocks without cars to be deleted")
+		deleted, err = svc.DeleteEmptyMapBlocks(ctx, admin)
+		assert.NoError(t, err, "Expected no error")
+		assert.Empty(t, deleted, "Expected no more empty map blocks")
+
+		var count int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM map_blocks`).Scan(&count), "Expected no error counting map blocks")
+		assert.Equal(t, 2, count, "Expected map blocks with deleted cars to be kept")
+		assert.Equal(
+			t,
+			[]string{ActionDeleteEmptyMapBlocks, ActionDeleteEmptyMapBlocks},
+			adminActions(t, svc),
+			"Expected every deletion to be logged")
+	})
+}
+
+func TestPersistenceBans(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		admin := insertUser(t, svc, "admin@example.com")
+		user := insertUser(t, svc, "spammer@example.com")
+		require.NoError(
+			t,
+			svc.InsertSession(ctx, user.ID, "session", "", time.Now().Add(time.Hour)),
+			"Expected no error inserting session")
+
+		banned, err := svc.IsBanned(ctx, "192.0.2.1", user.ID)
+		assert.NoError(t, err, "Expected no error")
+		assert.False(t, banned, "Expected no bans")
+
+		userBan, err := svc.InsertBan(ctx, admin, Ban{UserID: user.ID, Reason: "spam"})
+		require.NoError(t, err, "Expected no error banning user")
+		assert.NotZero(t, userBan.ID, "Expected an ID")
+		assert.False(t, userBan.Created.IsZero(), "Expected a creation time")
+		sessionUser, _, err := svc.GetSessionUser(ctx, "session")
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected banned users to be logged out")
+		banned, err = svc.IsBanned(ctx, "", user.ID)
+		assert.NoError(t, err, "Expected no error")
+		assert.True(t, banned, "Expected the user to be banned")
+
+		// IPv4-mapped IPv6 addresses are stored as IPv4 addresses.
+		ipBan, err := svc.InsertBan(ctx, admin, Ban{IP: "::ffff:192.0.2.1", Reason: "spam"})
+		require.NoError(t, err, "Expected no error banning IP address")
+		assert.Equal(t, "192.0.2.1", ipBan.IP, "Expected the canonical IP address")
+		banned, err = svc.IsBanned(ctx, "192.0.2.1", 0)
+		assert.NoError(t, err, "Expected no error")
+		assert.True(t, banned, "Expected the IP address to be banned")
+		banned, err = svc.IsBanned(ctx, "192.0.2.2", admin.ID)
+		assert.NoError(t, err, "Expected no error")
+		assert.False(t, banned, "Expected other IP addresses and users to not be banned")
+
+		_, err = svc.InsertBan(ctx, admin, Ban{IP: "192.0.2.1", Reason: "spam"})
+		assert.Equal(t, ErrAlreadyBanned, err, "Expected duplicate IP bans to be rejected")
+		_, err = svc.InsertBan(ctx, admin, Ban{UserID: user.ID, Reason: "spam"})
+		assert.Equal(t, ErrAlreadyBanned, err, "Expected duplicate user bans to be rejected")
+		_, err = svc.InsertBan(ctx, admin, Ban{UserID: user.ID + 100, Reason: "spam"})
+		assert.Equal(t, ErrUserNotFound, err, "Expected missing users to not be found")
+		_, err = svc.InsertBan(ctx, admin, Ban{IP: "192.0.2", Reason: "spam"})
+		assert.Equal(t, ErrInvalidIP, err, "Expected invalid IP addresses to be rejected")
+		_, err = svc.InsertBan(ctx, admin, Ban{IP: "192.0.2.3", UserID: user.ID, Reason: "spam"})
+		assert.Error(t, err, "Expected bans of both an IP address and a user to be rejected")
+
+		bans, err := svc.GetBans(ctx)
+		assert.NoError(t, err, "Expected no error getting bans")
+		assert.Equal(t, []int{ipBan.ID, userBan.ID}, []int{bans[0].ID, bans[1].ID}, "Expected bans newest first")
+		assert.Equal(t, user.ID, bans[1].UserID, "Expected user IDs to match")
+		assert.Equal(t, "spam", bans[1].Reason, "Expected reasons to match")
+
+		require.NoError(t, svc.DeleteBan(ctx, admin, userBan.ID), "Expected no error deleting ban")
+		assert.Equal(t, ErrBanNotFound, svc.DeleteBan(ctx, admin, userBan.ID), "Expected deleted bans to not be found")
+		banned, err = svc.IsBanned(ctx, "", user.ID)
+		assert.NoError(t, err, "Expected no error")
+		assert.False(t, banned, "Expected the user to not be banned")
+
+		assert.Equal(
+			t,
+			[]string{ActionUnban, ActionBan, ActionBan},
+			adminActions(t, svc),
+			"Expected successful bans to be logged")
+	})
+}
+
+func TestPersistenceGetAdminActions(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		admin := insertUser(t, svc, "admin@example.com")
+		for i := 0; i < 5; i++ {
+			_, err := svc.DeleteEmptyMapBlocks(ctx, admin)
+			require.NoError(t, err, "Expected no error deleting map blocks")
+		}
+
+		first, err := svc.GetAdminActions(ctx, 0, 2)
+		require.NoError(t, err, "Expected no error")
+		require.Len(t, first, 2, "Expected a page of actions")
+		assert.Greater(t, first[0].ID, first[1].ID, "Expected actions newest first")
+		assert.Equal(
+			t,
+			map[string]interface{}{"mapBlockIds": []interface{}{}},
+			first[0].Details,
+			"Expected details to match")
+
+		second, err := svc.GetAdminActions(ctx, first[1].ID, 10)
+		require.NoError(t, err, "Expected no error")
+		assert.Len(t, second, 3, "Expected the remaining actions")
+		assert.Less(t, second[0].ID, first[1].ID, "Expected the next page to start after the previous page")
+	})
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// CaptchaVerifier verifies anti-abuse challenge responses (e.g. reCAPTCHA
+// tokens) submitted by clients.
+type CaptchaVerifier interface {
+	// Verify returns true if the challenge response is valid for the client
+	// with the given IP address. An error is only returned if the response
+	// could not be verified.
+	Verify(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+// SiteVerifier is a CaptchaVerifier for challenge providers that implement the
+// reCAPTCHA "siteverify" API, which includes reCAPTCHA, hCaptcha and
+// Cloudflare Turnstile.
+type SiteVerifier struct {
+	verifyURL string
+	secret    string
+	minScore  float64
+	action    string
+	client    *http.Client
+	logger    *slog.Logger
+}
+
+// NewRecaptcha creates a SiteVerifier for Google reCAPTCHA. For reCAPTCHA v2,
+// minScore should be 0 and action should be empty. For reCAPTCHA v3, responses
+// are rejected if they have no score or a score lower than minScore or, if
+// action is not empty, if their action doesn't match.
+func NewRecaptcha(
+	secret string,
+	minScore float64,
+	action string,
+	logger *slog.Logger,
+) SiteVerifier {
+	return newSiteVerifier(
+		"https://www.google.com/recaptcha/api/siteverify",
+		secret,
+		minScore,
+		action,
+		logger)
+}
+
+// NewHCaptcha creates a SiteVerifier for hCaptcha.
+func NewHCaptcha(secret string, logger *slog.Logger) SiteVerifier {
+	return newSiteVerifier("https://api.hcaptcha.com/siteverify", secret, 0, "", logger)
+}
+
+// NewTurnstile creates a SiteVerifier for Cloudflare Turnstile.
+func NewTurnstile(secret string, logger *slog.Logger) SiteVerifier {
+	return newSiteVerifier(
+		"https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		secret,
+		0,
+		"",
+		logger)
+}
+
+func newSiteVerifier(
+	verifyURL,
+	secret string,
+	minScore float64,
+	action string,
+	logger *slog.Logger,
+) SiteVerifier {
+	return SiteVerifier{
+		verifyURL: verifyURL,
+		secret:    secret,
+		minScore:  minScore,
+		action:    action,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: tracing.Transport(http.DefaultTransport),
+		},
+		logger: logger,
+	}
+}
+
+// WithVerifyURL returns a copy of the SiteVerifier that sends verification
+// requests to verifyURL, e.g. a fake siteverify server in tests.
+func (svc SiteVerifier) WithVerifyURL(verifyURL string) SiteVerifier {
+	svc.verifyURL = verifyURL
+	return svc
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	Action     string   `json:"action"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (svc SiteVerifier) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	form := url.Values{
+		"secret":   {svc.secret},
+		"response": {response},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		svc.verifyURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, errors.WithMessage(err, "error creating siteverify request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := svc.client.Do(req)
+	if err != nil {
+		return false, errors.WithMessage(err, "error sending siteverify request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, errors.Errorf("siteverify request failed with status %d", res.StatusCode)
+	}
+
+	var body siteVerifyResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return false, errors.WithMessage(err, "error decoding siteverify response")
+	}
+	if !body.Success {
+		svc.logger.Info(
+			"captcha response rejected",
+			"remote_ip", remoteIP,
+			"error_codes", body.ErrorCodes)
+		return false, nil
+	}
+	// Responses only have a score for reCAPTCHA v3, so if a minimum score is
+	// set, responses without one (e.g. from a reCAPTCHA v2 site key) are
+	// rejected rather than skipping the check.
+	if svc.minScore > 0 && body.Score == nil {
+		svc.logger.Info(
+			"captcha score missing",
+			"remote_ip", remoteIP,
+			"min_score", svc.minScore)
+		return false, nil
+	}
+	if body.Score != nil && *body.Score < svc.minScore {
+		svc.logger.Info(
+			"captcha score below threshold",
+			"remote_ip", remoteIP,
+			"score", *body.Score,
+			"min_score", svc.minScore)
+		return false, nil
+	}
+	if svc.action != "" && body.Action != svc.action {
+		svc.logger.Info(
+			"captcha action mismatch",
+			"remote_ip", remoteIP,
+			"action", body.Action,
+			"expected_action", svc.action)
+		return false, nil
+	}
+	return true, nil
+}
+
+// FixedVerifier is a CaptchaVerifier that always returns the same answer
+// without contacting any provider. It is intended for local development and
+// tests only.
+type FixedVerifier bool
+
+func (valid FixedVerifier) Verify(_ context.Context, _, _ string) (bool, error) {
+	return bool(valid), nil
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSiteVerifierVerify(t *testing.T) {
+	tests := []struct {
+		description string
+		minScore    float64
+		action      string
+		response    string
+		expected    bool
+	}{
+		{
+			description: "reCAPTCHA v2 success should be valid",
+			response:    `{"success": true}`,
+			expected:    true,
+		},
+		{
+			description: "Failed response should be invalid",
+			response:    `{"success": false, "error-codes": ["invalid-input-response"]}`,
+			expected:    false,
+		},
+		{
+			description: "reCAPTCHA v3 score above the threshold should be valid",
+			minScore:    0.5,
+			action:      "submit",
+			response:    `{"success": true, "score": 0.9, "action": "submit"}`,
+			expected:    true,
+		},
+		{
+			description: "reCAPTCHA v3 score below the threshold should be invalid",
+			minScore:    0.5,
+			response:    `{"success": true, "score": 0.1, "action": "submit"}`,
+			expected:    false,
+		},
+		{
+			description: "Responses without a score should be invalid if there is a minimum score",
+			minScore:    0.5,
+			response:    `{"success": true, "action": "submit"}`,
+			expected:    false,
+		},
+		{
+			description: "reCAPTCHA v3 mismatched action should be invalid",
+			action:      "submit",
+			response:    `{"success": true, "score": 0.9, "action": "login"}`,
+			expected:    false,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "abcd", r.PostFormValue("secret"), "Expected secrets to match")
+				assert.Equal(t, "token", r.PostFormValue("response"), "Expected responses to match")
+				assert.Equal(t, "127.0.0.1", r.PostFormValue("remoteip"), "Expected remote IPs to match")
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			svc := newSiteVerifier(server.URL, "abcd", test.minScore, test.action, slog.Default())
+			valid, err := svc.Verify(context.Background(), "token", "127.0.0.1")
+			assert.NoError(t, err, "Expected no error verifying response")
+			assert.Equal(t, test.expected, valid, "Expected validity to match")
+		})
+	}
+}
+
+func TestSiteVerifierVerifyServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	svc := newSiteVerifier(server.URL, "abcd", 0, "", slog.Default())
+	_, err := svc.Verify(context.Background(), "token", "127.0.0.1")
+	assert.Error(t, err, "Expected an error if the provider is unavailable")
+}
@@ -0,0 +1,356 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+var (
+	// ErrCarNotFound is returned when editing a car that doesn't exist or
+	// has been deleted.
+	ErrCarNotFound = errors.New("car not found")
+	// ErrInvalidEditToken is returned when editing a car with the wrong edit
+	// token, or a car that has no edit token.
+	ErrInvalidEditToken = errors.New("invalid edit token")
+)
+
+// CarUpdate holds the fields of a car changed by UpdateCar. Nil fields aren't
+// changed. Latitude and Longitude must be set together to move the car to the
+// map block containing the coordinates. Setting ImagePublicID to an empty
+// string removes the car's image.
+type CarUpdate struct {
+	Latitude      *decimal.Decimal
+	Longitude     *decimal.Decimal
+	Year          *int
+	Make          *string
+	Model         *string
+	Trim          *string
+	Color         *string
+	ImagePublicID *string
+}
+
+// CarVersion is a previous version of a car, stored when the car was updated
+// or deleted.
+type CarVersion struct {
+	// Action is "update" or "delete".
+	Action        string
+	MapBlockID    int
+	Year          int
+	Make          string
+	Model         string
+	Trim          string
+	Color         string
+	ImagePublicID string
+	// Created is when the version was replaced.
+	Created time.Time
+}
+
+const getCarForEditQuery = `
+SELECT
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id,
+	edit_token_hash
+FROM cars
+WHERE
+	id = $1
+	AND deleted IS NULL
+FOR UPDATE
+`
+
+// SQLite doesn't support row locks, but the transaction already holds the
+// database write lock.
+const getCarForEditSQLiteQuery = `
+SELECT
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id,
+	edit_token_hash
+FROM cars
+WHERE
+	id = $1
+	AND deleted IS NULL
+`
+
+const insertCarHistoryQuery = `
+INSERT INTO car_history (
+	car_id,
+	action,
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+// carRow is a car as stored in the cars table.
+type carRow struct {
+	mapBlockID int
+	year       int
+	make       string
+	model      string
+	trim       string
+	color      string
+	imageID    sql.NullString
+}
+
+// editCar locks the car for editing in the transaction, checks the edit
+// token, and stores the current version of the car in its history.
+func (svc Persistence) editCar(
+	ctx context.Context,
+	tx *sql.Tx,
+	id int,
+	editTokenHash,
+	action string,
+) (carRow, error) {
+	car, storedHash, err := svc.lockCar(ctx, tx, id)
+	if err != nil {
+		return carRow{}, err
+	}
+	if !storedHash.Valid ||
+		subtle.ConstantTimeCompare([]byte(storedHash.String), []byte(editTokenHash)) != 1 {
+		return carRow{}, ErrInvalidEditToken
+	}
+	if err := svc.insertCarHistory(ctx, tx, id, action, car); err != nil {
+		return carRow{}, err
+	}
+	return car, nil
+}
+
+// lockCar locks the car for editing in the transaction and returns it with
+// its edit token hash. It returns ErrCarNotFound if the car doesn't exist or
+// has been deleted.
+func (svc Persistence) lockCar(ctx context.Context, tx *sql.Tx, id int) (carRow, sql.NullString, error) {
+	query := getCarForEditQuery
+	if svc.driver == database.SQLite {
+		query = getCarForEditSQLiteQuery
+	}
+	var car carRow
+	var storedHash sql.NullString
+	err := tx.QueryRowContext(ctx, svc.driver.Rebind(query), id).Scan(
+		&car.mapBlockID,
+		&car.year,
+		&car.make,
+		&car.model,
+		&car.trim,
+		&car.color,
+		&car.imageID,
+		&storedHash)
+	if err == sql.ErrNoRows {
+		return carRow{}, sql.NullString{}, ErrCarNotFound
+	}
+	if err != nil {
+		return carRow{}, sql.NullString{}, errors.WithMessage(err, "failed to read car")
+	}
+	return car, storedHash, nil
+}
+
+// insertCarHistory stores the version of the car that's replaced by the
+// action, "update" or "delete", in its history.
+func (svc Persistence) insertCarHistory(ctx context.Context, tx *sql.Tx, id int, action string, car carRow) error {
+	_, err := tx.ExecContext(
+		ctx,
+		svc.driver.Rebind(insertCarHistoryQuery),
+		id,
+		action,
+		car.mapBlockID,
+		car.year,
+		car.make,
+		car.model,
+		car.trim,
+		car.color,
+		car.imageID)
+	return errors.WithMessage(err, "failed to insert car history")
+}
+
+const updateCarQuery = `
+UPDATE cars
+SET
+	map_block_id = $2,
+	year = $3,
+	make = $4,
+	model = $5,
+	trim = $6,
+	color = $7,
+	images_public_id = $8,
+	updated = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+// UpdateCar changes the fields of a car set in the update if the edit token
+// hash matches, keeping the previous version in the car's history. If the
+// car is moved, the map block containing the new coordinates is created if it
+// doesn't exist, but only after the edit token is checked. It returns the ID
+// of the map block the car is in after the update and whether that map block
+// was created, or ErrCarNotFound or ErrInvalidEditToken.
+func (svc Persistence) UpdateCar(
+	ctx context.Context,
+	id int,
+	editTokenHash string,
+	update CarUpdate,
+) (_ int, mapBlockCreated bool, err error) {
+	ctx, done := svc.instrument(ctx, "UpdateCar", "updateCarQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, errors.WithMessage(err, "failed to begin car transaction")
+	}
+	defer tx.Rollback()
+
+	car, err := svc.editCar(ctx, tx, id, editTokenHash, "update")
+	if err != nil {
+		return 0, false, err
+	}
+	if update.Latitude != nil && update.Longitude != nil {
+		car.mapBlockID, mapBlockCreated, err = svc.getOrInsertMapBlock(
+			ctx,
+			tx,
+			*update.Latitude,
+			*update.Longitude)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if update.Year != nil {
+		car.year = *update.Year
+	}
+	if update.Make != nil {
+		car.make = strings.TrimSpace(*update.Make)
+	}
+	if update.Model != nil {
+		car.model = strings.TrimSpace(*update.Model)
+	}
+	if update.Trim != nil {
+		car.trim = strings.TrimSpace(*update.Trim)
+	}
+	if update.Color != nil {
+		car.color = strings.ToLower(strings.TrimSpace(*update.Color))
+	}
+	if update.ImagePublicID != nil {
+		car.imageID.String = strings.TrimSpace(*update.ImagePublicID)
+		car.imageID.Valid = car.imageID.String != ""
+		if car.imageID.Valid {
+			if _, err := tx.ExecContext(ctx, svc.driver.Rebind(insertCarImageQuery), car.imageID); err != nil {
+				return 0, false, errors.WithMessage(err, "failed to insert car image")
+			}
+		}
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		svc.driver.Rebind(updateCarQuery),
+		id,
+		car.mapBlockID,
+		car.year,
+		car.make,
+		car.model,
+		car.trim,
+		car.color,
+		car.imageID)
+	if err != nil {
+		return 0, false, errors.WithMessage(err, "failed to update car")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, errors.WithMessage(err, "failed to commit car transaction")
+	}
+	return car.mapBlockID, mapBlockCreated, nil
+}
+
+const deleteCarQuery = `
+UPDATE cars
+SET deleted = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+// DeleteCar hides a car if the edit token hash matches. The car and its
+// history are kept for moderators. It returns ErrCarNotFound or
+// ErrInvalidEditToken if the car can't be deleted.
+func (svc Persistence) DeleteCar(ctx context.Context, id int, editTokenHash string) (err error) {
+	ctx, done := svc.instrument(ctx, "DeleteCar", "deleteCarQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to begin car transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := svc.editCar(ctx, tx, id, editTokenHash, "delete"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, svc.driver.Rebind(deleteCarQuery), id); err != nil {
+		return errors.WithMessage(err, "failed to delete car")
+	}
+	return errors.WithMessage(tx.Commit(), "failed to commit car transaction")
+}
+
+const getCarHistoryQuery = `
+SELECT
+	action,
+	map_block_id,
+	year,
+	make,
+	model,
+	trim,
+	color,
+	images_public_id,
+	created
+FROM car_history
+WHERE car_id = $1
+ORDER BY id
+`
+
+// GetCarHistory returns the previous versions of a car, oldest first.
+func (svc Persistence) GetCarHistory(ctx context.Context, id int) (_ []CarVersion, err error) {
+	ctx, done := svc.instrument(ctx, "GetCarHistory", "getCarHistoryQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(getCarHistoryQuery), id)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read car history")
+	}
+	defer rows.Close()
+	versions := make([]CarVersion, 0, 10)
+	for rows.Next() {
+		var version CarVersion
+		var imageID sql.NullString
+		err := rows.Scan(
+			&version.Action,
+			&version.MapBlockID,
+			&version.Year,
+			&version.Make,
+			&version.Model,
+			&version.Trim,
+			&version.Color,
+			&imageID,
+			&version.Created)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to scan car history row into struct")
+		}
+		version.ImagePublicID = imageID.String
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read car history")
+	}
+	return versions, nil
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+// insertEditableCar inserts a car in the block that can be edited with the
+// returned edit token hash.
+func insertEditableCar(t *testing.T, svc Persistence, mapBlockID int, imageID string) (int, string) {
+	t.Helper()
+	_, hash, err := NewToken()
+	require.NoError(t, err, "Expected no error creating edit token")
+	id, err := svc.InsertCar(context.Background(), mapBlockID, 1994, "Mazda", "Miata", "", "red", imageID, hash, 0)
+	require.NoError(t, err, "Expected no error inserting car")
+	return id, hash
+}
+
+func stringPtr(s string) *string { return &s }
+
+func intPtr(i int) *int { return &i }
+
+func TestPersistenceUpdateCar(t *testing.T) {
+	tests := []struct {
+		description     string
+		update          CarUpdate
+		move            bool
+		wrongToken      bool
+		legacy          bool
+		deleted         bool
+		missing         bool
+		expected        Car
+		expectedImageID sql.NullString
+		expectErr       bool
+		expectedErr     error
+	}{
+		{
+			description: "Updated fields should be trimmed and the color lowercased",
+			update: CarUpdate{
+				Year:  intPtr(1995),
+				Trim:  stringPtr(" R "),
+				Color: stringPtr(" Blue "),
+			},
+			expected:        Car{Year: 1995, Make: "Mazda", Model: "Miata", Trim: "R", Color: "blue"},
+			expectedImageID: sql.NullString{String: "miata", Valid: true},
+		},
+		{
+			description:     "Cars should be moved to another map block",
+			move:            true,
+			expected:        Car{Year: 1994, Make: "Mazda", Model: "Miata", Color: "red"},
+			expectedImageID: sql.NullString{String: "miata", Valid: true},
+		},
+		{
+			description:     "Images should be swapped before they're uploaded",
+			update:          CarUpdate{ImagePublicID: stringPtr("miata2")},
+			expected:        Car{Year: 1994, Make: "Mazda", Model: "Miata", Color: "red"},
+			expectedImageID: sql.NullString{String: "miata2", Valid: true},
+		},
+		{
+			description: "Empty image IDs should remove the image",
+			update:      CarUpdate{ImagePublicID: stringPtr("")},
+			expected:    Car{Year: 1994, Make: "Mazda", Model: "Miata", Color: "red"},
+		},
+		{
+			description: "Invalid fields should be rejected",
+			update:      CarUpdate{Year: intPtr(1800)},
+			expectErr:   true,
+		},
+		{
+			description: "Wrong edit tokens should be rejected",
+			update:      CarUpdate{Year: intPtr(1995)},
+			wrongToken:  true,
+			expectedErr: ErrInvalidEditToken,
+		},
+		{
+			description: "Cars without an edit token should be rejected",
+			update:      CarUpdate{Year: intPtr(1995)},
+			legacy:      true,
+			expectedErr: ErrInvalidEditToken,
+		},
+		{
+			description: "Deleted cars should not be found",
+			update:      CarUpdate{Year: intPtr(1995)},
+			deleted:     true,
+			expectedErr: ErrCarNotFound,
+		},
+		{
+			description: "Missing cars should not be found",
+			update:      CarUpdate{Year: intPtr(1995)},
+			missing:     true,
+			expectedErr: ErrCarNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+				ctx := context.Background()
+				svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+				blocks := insertMapBlocks(
+					t,
+					svc,
+					coordinates{latitude: "37.7749", longitude: "-122.4194"},
+					coordinates{latitude: "45.5152", longitude: "-122.6784"})
+				id, hash := insertEditableCar(t, svc, blocks[0].ID, "miata")
+				if test.legacy {
+					_, err := db.Exec(`UPDATE cars SET edit_token_hash = NULL`)
+					require.NoError(t, err, "Expected no error removing edit token")
+				}
+				if test.deleted {
+					require.NoError(t, svc.DeleteCar(ctx, id, hash), "Expected no error deleting car")
+				}
+				if test.wrongToken {
+					hash = HashToken("wrong")
+				}
+				if test.missing {
+					id++
+				}
+				update := test.update
+				expectedBlockID := blocks[0].ID
+				if test.move {
+					update.Latitude = &blocks[1].Latitude
+					update.Longitude = &blocks[1].Longitude
+					expectedBlockID = blocks[1].ID
+				}
+
+				mapBlockID, created, err := svc.UpdateCar(ctx, id, hash, update)
+				if test.expectedErr != nil {
+					assert.Equal(t, test.expectedErr, err, "Expected errors to match")
+					return
+				}
+				if test.expectErr {
+					assert.Error(t, err, "Expected an error")
+					history, err := svc.GetCarHistory(ctx, id)
+					assert.NoError(t, err, "Expected no error getting car history")
+					assert.Empty(t, history, "Expected failed updates to be rolled back")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, expectedBlockID, mapBlockID, "Expected map block IDs to match")
+				assert.False(t, created, "Expected no map block to be created")
+
+				cars, err := svc.GetCars(ctx, expectedBlockID)
+				assert.NoError(t, err, "Expected no error getting cars")
+				expected := test.expected
+				expected.ID = id
+				expected.MapBlockID = expectedBlockID
+				assert.Equal(t, []Car{expected}, cars, "Expected cars to match")
+
+				var imageID sql.NullString
+				err = db.QueryRow(`SELECT images_public_id FROM cars`).Scan(&imageID)
+				assert.NoError(t, err, "Expected no error reading car")
+				assert.Equal(t, test.expectedImageID, imageID, "Expected image IDs to match")
+
+				history, err := svc.GetCarHistory(ctx, id)
+				assert.NoError(t, err, "Expected no error getting car history")
+				if assert.Len(t, history, 1, "Expected the previous version to be kept") {
+					version := history[0]
+					version.Created = time.Time{}
+					assert.Equal(
+						t,
+						CarVersion{
+							Action:        "update",
+							MapBlockID:    blocks[0].ID,
+							Year:          1994,
+							Make:          "Mazda",
+							Model:         "Miata",
+							Color:         "red",
+							ImagePublicID: "miata",
+						},
+						version,
+						"Expected the previous version to match")
+				}
+			})
+		})
+	}
+}
+
+func TestPersistenceUpdateCarMapBlocks(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		id, hash := insertEditableCar(t, svc, blocks[0].ID, "")
+		latitude, longitude := decimal.RequireFromString("51.5072"), decimal.RequireFromString("-0.1276")
+		update := CarUpdate{Latitude: &latitude, Longitude: &longitude}
+
+		_, _, err := svc.UpdateCar(ctx, id, HashToken("wrong"), update)
+		assert.Equal(t, ErrInvalidEditToken, err, "Expected wrong edit tokens to be rejected")
+		block, err := svc.GetMapBlock(ctx, latitude, longitude)
+		assert.NoError(t, err, "Expected no error getting map block")
+		assert.Nil(t, block, "Expected no map block to be created with a wrong edit token")
+
+		mapBlockID, created, err := svc.UpdateCar(ctx, id, hash, update)
+		require.NoError(t, err, "Expected no error")
+		assert.True(t, created, "Expected the map block to be created")
+		block, err = svc.GetMapBlock(ctx, latitude, longitude)
+		assert.NoError(t, err, "Expected no error getting map block")
+		if assert.NotNil(t, block, "Expected the map block to exist") {
+			assert.Equal(t, block.ID, mapBlockID, "Expected map block IDs to match")
+		}
+
+		_, created, err = svc.UpdateCar(ctx, id, hash, update)
+		require.NoError(t, err, "Expected no error")
+		assert.False(t, created, "Expected the existing map block to be used")
+	})
+}
+
+func TestPersistenceDeleteCar(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		id, hash := insertEditableCar(t, svc, blocks[0].ID, "")
+
+		assert.Equal(
+			t,
+			ErrInvalidEditToken,
+			svc.DeleteCar(ctx, id, HashToken("wrong")),
+			"Expected wrong edit tokens to be rejected")
+		require.NoError(t, svc.DeleteCar(ctx, id, hash), "Expected no error")
+		assert.Equal(t, ErrCarNotFound, svc.DeleteCar(ctx, id, hash), "Expected deleted cars to not be found")
+
+		cars, err := svc.GetCars(ctx, blocks[0].ID)
+		assert.NoError(t, err, "Expected no error getting cars")
+		assert.Empty(t, cars, "Expected deleted cars to be hidden")
+
+		history, err := svc.GetCarHistory(ctx, id)
+		assert.NoError(t, err, "Expected no error getting car history")
+		if assert.Len(t, history, 1, "Expected the deleted version to be kept") {
+			assert.Equal(t, "delete", history[0].Action, "Expected actions to match")
+			assert.Equal(t, "Miata", history[0].Model, "Expected models to match")
+			assert.False(t, history[0].Created.IsZero(), "Expected a creation time")
+		}
+	})
+}
+
+func TestPersistenceGetCarHistory(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		id, hash := insertEditableCar(t, svc, blocks[0].ID, "miata")
+
+		for _, color := range []string{"blue", "green"} {
+			_, _, err := svc.UpdateCar(ctx, id, hash, CarUpdate{
+				Color:         stringPtr(color),
+				ImagePublicID: stringPtr(color),
+			})
+			require.NoError(t, err, "Expected no error updating car")
+		}
+		require.NoError(t, svc.DeleteCar(ctx, id, hash), "Expected no error deleting car")
+
+		history, err := svc.GetCarHistory(ctx, id)
+		assert.NoError(t, err, "Expected no error")
+		var actions, colors, images []string
+		for _, version := range history {
+			actions = append(actions, version.Action)
+			colors = append(colors, version.Color)
+			images = append(images, version.ImagePublicID)
+		}
+		assert.Equal(t, []string{"update", "update", "delete"}, actions, "Expected versions oldest first")
+		assert.Equal(t, []string{"red", "blue", "green"}, colors, "Expected colors to match")
+		assert.Equal(t, []string{"miata", "blue", "green"}, images, "Expected image IDs to match")
+
+		// Images of previous versions are kept for moderators.
+		orphans, err := svc.GetOrphanedImages(ctx, time.Now().Add(time.Minute))
+		assert.NoError(t, err, "Expected no error getting orphaned images")
+		assert.Empty(t, orphans, "Expected images of previous versions to not be orphaned")
+
+		history, err = svc.GetCarHistory(ctx, id+1)
+		assert.NoError(t, err, "Expected no error")
+		assert.Empty(t, history, "Expected no history for missing cars")
+	})
+}
@@ -1,22 +1,47 @@
 package services
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/tracing"
 )
 
+const cloudinaryCloudName = "dawfgqsur"
+
 type Cloudinary struct {
+	cloudinaryAPIKey string
 	cloudinarySecret string
+	adminURL         string
+	client           *http.Client
 }
 
-func NewCloudinary(cloudinarySecret string) Cloudinary {
-	return Cloudinary{cloudinarySecret: cloudinarySecret}
+func NewCloudinary(cloudinaryAPIKey, cloudinarySecret string) Cloudinary {
+	return Cloudinary{
+		cloudinaryAPIKey: cloudinaryAPIKey,
+		cloudinarySecret: cloudinarySecret,
+		adminURL:         "https://api.cloudinary.com/v1_1/" + cloudinaryCloudName,
+		client:           &http.Client{Transport: tracing.Transport(http.DefaultTransport)},
+	}
+}
+
+// WithAdminURL returns a copy of the Cloudinary service that sends Admin API
+// requests to adminURL, e.g. a fake Cloudinary server in tests.
+func (svc Cloudinary) WithAdminURL(adminURL string) Cloudinary {
+	svc.adminURL = adminURL
+	return svc
 }
 
 // encode encodes parameters in the Cloudinary signature
@@ -67,6 +92,19 @@ func (svc Cloudinary) deliverySignature(img CloudinaryImage, transform string) s
 	return fmt.Sprintf("s--%s--", base64.URLEncoding.EncodeToString(hash[:])[:8])
 }
 
+// CheckConfig verifies that the Cloudinary API credentials are set and well
+// formed. It doesn't contact Cloudinary, so it can't detect revoked
+// credentials.
+func (svc Cloudinary) CheckConfig(_ context.Context) error {
+	if svc.cloudinaryAPIKey == "" || svc.cloudinarySecret == "" {
+		return errors.New("Cloudinary API key and secret must be set")
+	}
+	if _, err := strconv.ParseUint(svc.cloudinaryAPIKey, 10, 64); err != nil {
+		return errors.Errorf("Cloudinary API key %q must be numeric", svc.cloudinaryAPIKey)
+	}
+	return nil
+}
+
 func (svc Cloudinary) URL(img CloudinaryImage, transform string) *url.URL {
 	if img.Empty() {
 		return new(url.URL)
@@ -76,7 +114,7 @@ func (svc Cloudinary) URL(img CloudinaryImage, transform string) *url.URL {
 		Scheme: "https",
 		Host:   "res.cloudinary.com",
 		Path: path.Join(
-			"dawfgqsur",
+			cloudinaryCloudName,
 			"image",
 			"authenticated",
 			svc.deliverySignature(img, transform),
@@ -84,6 +122,63 @@ func (svc Cloudinary) URL(img CloudinaryImage, transform string) *url.URL {
 	}
 }
 
+// maxDeleteImages is the maximum number of public IDs the Cloudinary Admin
+// API accepts in a single delete resources request.
+const maxDeleteImages = 100
+
+// DeleteImages deletes the images with the given public IDs using the
+// Cloudinary Admin API. Images that Cloudinary reports as not found are
+// considered deleted.
+func (svc Cloudinary) DeleteImages(ctx context.Context, publicIDs []string) error {
+	for start := 0; start < len(publicIDs); start += maxDeleteImages {
+		end := start + maxDeleteImages
+		if end > len(publicIDs) {
+			end = len(publicIDs)
+		}
+		if err := svc.deleteImages(ctx, publicIDs[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc Cloudinary) deleteImages(ctx context.Context, publicIDs []string) error {
+	query := url.Values{"public_ids[]": publicIDs}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodDelete,
+		svc.adminURL+"/resources/image/authenticated?"+query.Encode(),
+		nil)
+	if err != nil {
+		return errors.WithMessage(err, "error creating delete resources request")
+	}
+	req.SetBasicAuth(svc.cloudinaryAPIKey, svc.cloudinarySecret)
+
+	res, err := svc.client.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "error sending delete resources request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("delete resources request failed with status %d", res.StatusCode)
+	}
+
+	var body struct {
+		Deleted map[string]string `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return errors.WithMessage(err, "error decoding delete resources response")
+	}
+	for _, publicID := range publicIDs {
+		switch status := body.Deleted[publicID]; status {
+		case "deleted", "not_found":
+		default:
+			return errors.Errorf("failed to delete image %q (status %q)", publicID, status)
+		}
+	}
+	return nil
+}
+
 type CloudinaryImage struct {
 	PublicID string
 	Format   string
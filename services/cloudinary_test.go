@@ -1,6 +1,11 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -8,7 +13,7 @@ import (
 )
 
 func TestUploadSignature(t *testing.T) {
-	svc := NewCloudinary("abcd")
+	svc := NewCloudinary("1234", "abcd")
 	sig := svc.UploadSignature(map[string]string{
 		"timestamp": "1315060510",
 		"public_id": "sample_image",
@@ -21,7 +26,7 @@ func TestUploadSignature(t *testing.T) {
 		"Expected signatures to match")
 }
 func TestNotificationSignature(t *testing.T) {
-	svc := NewCloudinary("abcd")
+	svc := NewCloudinary("1234", "abcd")
 	body := `{"public_id":"djhoeaqcynvogt9xzbn9","version":1368881626,"width":864,"height":576,"format":"jpg","resource_type":"image","created_at":"2013-05-18T12:53:46Z","bytes":120253,"type":"upload","url":"https://res.cloudinary.com/1233456ab/image/upload/v1368881626/djhoeaqcynvogt9xzbn9.jpg","secure_url":"https://cloudinary-a.akamaihd.net/1233456ab/image/upload/v1368881626/djhoeaqcynvogt9xzbn9.jpg"}`
 	timestamp := "1368881627"
 	sig := svc.NotificationSignature(body, timestamp)
@@ -33,7 +38,7 @@ func TestNotificationSignature(t *testing.T) {
 }
 
 func TestDeliverySignature(t *testing.T) {
-	svc := NewCloudinary("abcd")
+	svc := NewCloudinary("1234", "abcd")
 	img := CloudinaryImage{
 		PublicID: "sample",
 		Format:   "png",
@@ -81,7 +86,7 @@ func TestURL(t *testing.T) {
 			},
 		},
 	}
-	svc := NewCloudinary("abcd")
+	svc := NewCloudinary("1234", "abcd")
 
 	for _, test := range tests {
 		test := test // Capture range variable.
@@ -97,3 +102,54 @@ func TestURL(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteImages(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		deleted := make(map[string]string)
+		for _, publicID := range r.URL.Query()["public_ids[]"] {
+			deleted[publicID] = "deleted"
+		}
+		deleted["missing"] = "not_found"
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted": deleted})
+	}))
+	defer server.Close()
+
+	svc := NewCloudinary("1234", "abcd")
+	svc.adminURL = server.URL
+
+	publicIDs := make([]string, 0, 150)
+	for i := 0; i < 150; i++ {
+		publicIDs = append(publicIDs, fmt.Sprintf("image%d", i))
+	}
+	err := svc.DeleteImages(context.Background(), publicIDs)
+	assert.NoError(t, err, "Expected no error deleting images")
+
+	assert.Len(t, requests, 2, "Expected public IDs to be deleted in batches of 100")
+	for _, r := range requests {
+		assert.Equal(t, http.MethodDelete, r.Method, "Expected DELETE requests")
+		assert.Equal(t, "/resources/image/authenticated", r.URL.Path, "Expected paths to match")
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok, "Expected basic auth credentials")
+		assert.Equal(t, "1234", user, "Expected API key to match")
+		assert.Equal(t, "abcd", pass, "Expected API secret to match")
+	}
+	assert.Len(t, requests[0].URL.Query()["public_ids[]"], 100)
+	assert.Len(t, requests[1].URL.Query()["public_ids[]"], 50)
+}
+
+func TestDeleteImagesFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"deleted": map[string]string{"sample": "error"},
+		})
+	}))
+	defer server.Close()
+
+	svc := NewCloudinary("1234", "abcd")
+	svc.adminURL = server.URL
+
+	err := svc.DeleteImages(context.Background(), []string{"sample"})
+	assert.Error(t, err, "Expected an error if an image isn't deleted")
+}
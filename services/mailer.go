@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// SMTPMailer is a Mailer that sends emails with an SMTP server. It upgrades
+// the connection with STARTTLS if the server supports it.
+type SMTPMailer struct {
+	addr string
+	host string
+	from mail.Address
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates an SMTPMailer that sends emails from the from address
+// with the SMTP server at addr, like "smtp.example.com:587". If username is
+// empty, the mailer doesn't authenticate.
+func NewSMTPMailer(addr, username, password, from string) (SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return SMTPMailer{}, errors.WithMessagef(err, "invalid SMTP address %q", addr)
+	}
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return SMTPMailer{}, errors.WithMessagef(err, "invalid from address %q", from)
+	}
+	mailer := SMTPMailer{addr: addr, host: host, from: *fromAddr}
+	if username != "" {
+		// PlainAuth refuses to send credentials without TLS, except to
+		// localhost.
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+func (mailer SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return errors.WithMessagef(err, "invalid recipient address %q", to)
+	}
+	msg := mailer.message(*toAddr, subject, body, time.Now())
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", mailer.addr)
+	if err != nil {
+		return errors.WithMessage(err, "error connecting to SMTP server")
+	}
+	// The SMTP client doesn't support contexts, so use the context deadline
+	// for the whole conversation.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, mailer.host)
+	if err != nil {
+		conn.Close()
+		return errors.WithMessage(err, "error starting SMTP session")
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: mailer.host}); err != nil {
+			return errors.WithMessage(err, "error starting TLS")
+		}
+	}
+	if mailer.auth != nil {
+		if err := client.Auth(mailer.auth); err != nil {
+			return errors.WithMessage(err, "error authenticating with SMTP server")
+		}
+	}
+	if err := client.Mail(mailer.from.Address); err != nil {
+		return errors.WithMessage(err, "error setting sender")
+	}
+	if err := client.Rcpt(toAddr.Address); err != nil {
+		return errors.WithMessage(err, "error setting recipient")
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.WithMessage(err, "error starting message")
+	}
+	if _, err := w.Write(msg); err != nil {
+		return errors.WithMessage(err, "error writing message")
+	}
+	if err := w.Close(); err != nil {
+		return errors.WithMessage(err, "error sending message")
+	}
+	return errors.WithMessage(client.Quit(), "error ending SMTP session")
+}
+
+// message formats a plain text email with CRLF line endings.
+func (mailer SMTPMailer) message(to mail.Address, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", mailer.from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// LogMailer is a Mailer that logs emails instead of sending them, for local
+// development.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+// NewLogMailer creates a LogMailer that logs emails with the logger.
+func NewLogMailer(logger *slog.Logger) LogMailer {
+	return LogMailer{logger: logger}
+}
+
+func (mailer LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	mailer.logger.InfoContext(
+		ctx,
+		"logged email instead of sending it",
+		"to", to,
+		"subject", subject,
+		"body", body)
+	return nil
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSMTPMailer(t *testing.T) {
+	_, err := NewSMTPMailer("smtp.example.com", "", "", "noreply@manualsmap.com")
+	assert.Error(t, err, "Expected addresses without a port to be rejected")
+	_, err = NewSMTPMailer("smtp.example.com:587", "", "", "not an address")
+	assert.Error(t, err, "Expected invalid from addresses to be rejected")
+	_, err = NewSMTPMailer("smtp.example.com:587", "user", "password", "Manuals Map <noreply@manualsmap.com>")
+	assert.NoError(t, err, "Expected no error")
+}
+
+func TestSMTPMailerMessage(t *testing.T) {
+	mailer, err := NewSMTPMailer("smtp.example.com:587", "", "", "Manuals Map <noreply@manualsmap.com>")
+	require.NoError(t, err, "Expected no error creating mailer")
+
+	msg := mailer.message(
+		mail.Address{Address: "driver@example.com"},
+		"Log in to Manuals Map",
+		"Open this link:\n\nhttps://manualsmap.com/?login=token\n",
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	assert.Equal(
+		t,
+		"From: \"Manuals Map\" <noreply@manualsmap.com>\r\n"+
+			"To: <driver@example.com>\r\n"+
+			"Subject: Log in to Manuals Map\r\n"+
+			"Date: Wed, 01 May 2024 12:00:00 +0000\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Transfer-Encoding: 8bit\r\n"+
+			"\r\n"+
+			"Open this link:\r\n\r\nhttps://manualsmap.com/?login=token\r\n",
+		string(msg),
+		"Expected the message to match")
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	require.NoError(t, err, "Expected a valid message")
+	assert.Equal(t, "Log in to Manuals Map", parsed.Header.Get("Subject"), "Expected subjects to match")
+}
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	mailer := NewLogMailer(slog.New(slog.NewTextHandler(&buf, nil)))
+	err := mailer.Send(context.Background(), "driver@example.com", "Log in", "https://manualsmap.com/?login=token")
+	assert.NoError(t, err, "Expected no error")
+	assert.Contains(t, buf.String(), "to=driver@example.com", "Expected the recipient to be logged")
+	assert.Contains(t, buf.String(), "login=token", "Expected the body to be logged")
+}
@@ -0,0 +1,373 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// ErrInvalidIDToken is returned when the OIDC provider's ID token can't be
+// verified.
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Identity is the identity of a user logged in with OIDC.
+type Identity struct {
+	Subject string
+	// Email is the email address from the "email" claim, lowercased.
+	Email string
+}
+
+// idTokenLeeway is the allowed clock skew when checking ID token times.
+const idTokenLeeway = time.Minute
+
+// OIDC logs users in with an OpenID Connect provider using the authorization
+// code flow. The provider's endpoints and signing keys are discovered from
+// the issuer URL, so any compliant provider works, including a local mock
+// provider for development.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+	// provider is shared by copies so that discovery and keys are only
+	// fetched once.
+	provider *oidcProvider
+}
+
+// oidcProvider caches the provider's discovery document and signing keys.
+type oidcProvider struct {
+	mu   sync.Mutex
+	doc  *oidcDiscovery
+	keys map[string]interface{}
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDC creates an OIDC client for the provider at the issuer URL, e.g.
+// "https://accounts.google.com". The provider redirects users back to
+// redirectURL after they log in, which must be registered with the provider.
+func NewOIDC(issuer, clientID, clientSecret, redirectURL string) (OIDC, error) {
+	if !isHTTPURL(issuer) {
+		return OIDC{}, errors.Errorf("OIDC issuer %q must be an http or https URL", issuer)
+	}
+	if clientID == "" {
+		return OIDC{}, errors.New("OIDC client ID must be set")
+	}
+	if !isHTTPURL(redirectURL) {
+		return OIDC{}, errors.Errorf("OIDC redirect URL %q must be an http or https URL", redirectURL)
+	}
+	return OIDC{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: tracing.Transport(http.DefaultTransport),
+		},
+		provider: &oidcProvider{},
+	}, nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CheckConfig fetches the provider's discovery document, which fails if the
+// issuer is unreachable or misconfigured.
+func (svc OIDC) CheckConfig(ctx context.Context) error {
+	_, err := svc.discover(ctx)
+	return err
+}
+
+func (svc OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	svc.provider.mu.Lock()
+	defer svc.provider.mu.Unlock()
+	if svc.provider.doc != nil {
+		return svc.provider.doc, nil
+	}
+
+	var doc oidcDiscovery
+	if err := svc.getJSON(ctx, svc.issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, errors.WithMessage(err, "error fetching OIDC discovery document")
+	}
+	// The discovery document must be for the configured issuer, see OpenID
+	// Connect Discovery 1.0 section 4.3.
+	if strings.TrimSuffix(doc.Issuer, "/") != svc.issuer {
+		return nil, errors.Errorf("OIDC discovery document issuer %q doesn't match %q", doc.Issuer, svc.issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+	svc.provider.doc = &doc
+	return &doc, nil
+}
+
+// AuthURL returns the provider URL that users are redirected to to log in.
+// The state is returned unchanged to the redirect URL and the nonce is
+// included in the ID token. Both must be unguessable and tied to the user's
+// browser.
+func (svc OIDC) AuthURL(ctx context.Context, state, nonce string) (string, error) {
+	doc, err := svc.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	authURL, err := url.Parse(doc.AuthorizationEndpoint)
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid OIDC authorization endpoint")
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", svc.clientID)
+	query.Set("redirect_uri", svc.redirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+// Exchange exchanges the authorization code that the provider sent to the
+// redirect URL for the user's verified identity. It returns
+// ErrInvalidIDToken if the ID token is invalid, wasn't issued for this
+// client, doesn't have the nonce, or doesn't have a verified email address.
+func (svc OIDC) Exchange(ctx context.Context, code, nonce string) (Identity, error) {
+	doc, err := svc.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {svc.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		doc.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, errors.WithMessage(err, "error creating OIDC token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(svc.clientID), url.QueryEscape(svc.clientSecret))
+	res, err := svc.client.Do(req)
+	if err != nil {
+		return Identity{}, errors.WithMessage(err, "error sending OIDC token request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Identity{}, errors.Errorf("OIDC token request failed with status %d", res.StatusCode)
+	}
+	var body oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return Identity{}, errors.WithMessage(err, "error decoding OIDC token response")
+	}
+	return svc.verify(ctx, doc, body.IDToken, nonce, time.Now())
+}
+
+// idTokenMethods are the ID token signing algorithms that are accepted. HMAC
+// and "none" are never accepted.
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// verify checks the ID token's signature and claims, see OpenID Connect Core
+// 1.0 section 3.1.3.7.
+func (svc OIDC) verify(ctx context.Context, doc *oidcDiscovery, idToken, nonce string, now time.Time) (Identity, error) {
+	parser := jwt.Parser{
+		ValidMethods: idTokenMethods,
+		// The time claims are checked below with leeway for clock skew.
+		SkipClaimsValidation: true,
+	}
+	var claims jwt.MapClaims
+	_, err := parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return svc.key(ctx, doc, kid)
+	})
+	if err != nil {
+		return Identity{}, errors.WithMessage(ErrInvalidIDToken, err.Error())
+	}
+
+	invalid := func(reason string) (Identity, error) {
+		return Identity{}, errors.WithMessage(ErrInvalidIDToken, reason)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != svc.issuer {
+		return invalid("wrong issuer")
+	}
+	if !audienceContains(claims["aud"], svc.clientID) {
+		return invalid("wrong audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-idTokenLeeway).Unix() > int64(exp) {
+		return invalid("expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(idTokenLeeway).Unix() < int64(iat) {
+		return invalid("issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return invalid("wrong nonce")
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return invalid("missing subject")
+	}
+	// Accounts are linked and roles are granted by email address, so only
+	// accept addresses that the provider says it verified. Otherwise anyone
+	// who can set an unverified address at the provider could log in to the
+	// account with that address.
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return invalid("email address not verified")
+	}
+	claimed, _ := claims["email"].(string)
+	email, err := NormalizeEmail(claimed)
+	if err != nil {
+		return invalid("missing or invalid email address")
+	}
+	return Identity{Subject: subject, Email: email}, nil
+}
+
+// audienceContains returns true if the "aud" claim, a string or an array of
+// strings, contains the client ID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the provider's public key with the key ID. Keys are fetched
+// again if the key ID is unknown, because providers rotate their keys.
+func (svc OIDC) key(ctx context.Context, doc *oidcDiscovery, kid string) (interface{}, error) {
+	svc.provider.mu.Lock()
+	defer svc.provider.mu.Unlock()
+	if key, ok := svc.provider.keys[kid]; ok {
+		return key, nil
+	}
+	keys, err := svc.fetchKeys(ctx, doc.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	svc.provider.keys = keys
+	key, ok := keys[kid]
+	if !ok {
+		return nil, errors.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk is an RSA or EC public JSON Web Key, see RFC 7517 and RFC 7518.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// fetchKeys returns the signing keys in the JWK set by key ID. Keys that
+// aren't RSA or EC signing keys are skipped.
+func (svc OIDC) fetchKeys(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	var set jwks
+	if err := svc.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, errors.WithMessage(err, "error fetching OIDC signing keys")
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				return nil, errors.Errorf("invalid RSA signing key %q", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			curve, ok := jwkCurves[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || errX != nil || errY != nil {
+				return nil, errors.Errorf("invalid EC signing key %q", k.Kid)
+			}
+			key := &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				return nil, errors.Errorf("invalid EC signing key %q", k.Kid)
+			}
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (svc OIDC) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.WithMessage(err, "error creating request")
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := svc.client.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "error sending request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("request to %s failed with status %d", u, res.StatusCode)
+	}
+	return errors.WithMessage(json.NewDecoder(res.Body).Decode(v), "error decoding response")
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/oidctest"
+)
+
+const testRedirectURL = "https://manualsmap.test/api/v1/login/oidc/callback"
+
+func newTestOIDC(t *testing.T, provider *oidctest.Provider) OIDC {
+	t.Helper()
+	svc, err := NewOIDC(provider.Issuer, oidctest.ClientID, oidctest.ClientSecret, testRedirectURL)
+	require.NoError(t, err, "Expected no error creating OIDC client")
+	return svc
+}
+
+// authorize opens the provider's authorization URL and returns the
+// authorization code that it redirects back with.
+func authorize(t *testing.T, svc OIDC, state, nonce string) string {
+	t.Helper()
+	authURL, err := svc.AuthURL(context.Background(), state, nonce)
+	require.NoError(t, err, "Expected no error getting authorization URL")
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	res, err := client.Get(authURL)
+	require.NoError(t, err, "Expected no error opening authorization URL")
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode, "Expected a redirect")
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err, "Expected a valid redirect URL")
+	require.Equal(t, testRedirectURL, location.Scheme+"://"+location.Host+location.Path, "Expected a redirect to the redirect URL")
+	require.Equal(t, state, location.Query().Get("state"), "Expected states to match")
+	return location.Query().Get("code")
+}
+
+func TestNewOIDC(t *testing.T) {
+	tests := []struct {
+		description string
+		issuer      string
+		clientID    string
+		redirectURL string
+	}{
+		{
+			description: "Invalid issuers should be an error",
+			issuer:      "accounts.example.com",
+			clientID:    "manualsmap",
+			redirectURL: testRedirectURL,
+		},
+		{
+			description: "Missing client IDs should be an error",
+			issuer:      "https://accounts.example.com",
+			redirectURL: testRedirectURL,
+		},
+		{
+			description: "Invalid redirect URLs should be an error",
+			issuer:      "https://accounts.example.com",
+			clientID:    "manualsmap",
+			redirectURL: "/callback",
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewOIDC(test.issuer, test.clientID, "secret", test.redirectURL)
+			assert.Error(t, err, "Expected an error")
+		})
+	}
+}
+
+func TestOIDCCheckConfig(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	assert.NoError(t, newTestOIDC(t, provider).CheckConfig(context.Background()), "Expected no error")
+
+	svc, err := NewOIDC(provider.Issuer+"/other", oidctest.ClientID, oidctest.ClientSecret, testRedirectURL)
+	require.NoError(t, err, "Expected no error creating OIDC client")
+	assert.Error(t, svc.CheckConfig(context.Background()), "Expected an error for unknown issuers")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	tests := []struct {
+		description      string
+		claims           jwt.MapClaims
+		nonce            string
+		clientSecret     string
+		expected         Identity
+		expectErr        bool
+		expectInvalidErr bool
+	}{
+		{
+			description: "Valid logins should return the identity",
+			claims:      jwt.MapClaims{"sub": "248289761001", "email": "Driver@Example.com", "email_verified": true},
+			expected:    Identity{Subject: "248289761001", Email: "driver@example.com"},
+		},
+		{
+			description:      "Missing email_verified claims should be rejected",
+			claims:           jwt.MapClaims{"sub": "248289761001", "email": "driver@example.com"},
+			expectInvalidErr: true,
+		},
+		{
+			description:      "Unverified email addresses should be rejected",
+			claims:           jwt.MapClaims{"sub": "248289761001", "email": "driver@example.com", "email_verified": false},
+			expectInvalidErr: true,
+		},
+		{
+			description:      "Missing email addresses should be rejected",
+			claims:           jwt.MapClaims{"sub": "248289761001", "email_verified": true},
+			expectInvalidErr: true,
+		},
+		{
+			description:      "Missing subjects should be rejected",
+			claims:           jwt.MapClaims{"email": "driver@example.com", "email_verified": true},
+			expectInvalidErr: true,
+		},
+		{
+			description:      "Wrong nonces should be rejected",
+			claims:           jwt.MapClaims{"sub": "248289761001", "email": "driver@example.com", "email_verified": true},
+			nonce:            "other",
+			expectInvalidErr: true,
+		},
+		{
+			description:  "Wrong client secrets should be an error",
+			claims:       jwt.MapClaims{"sub": "248289761001", "email": "driver@example.com", "email_verified": true},
+			clientSecret: "wrong",
+			expectErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			provider := oidctest.NewProvider(t)
+			provider.SetClaims(test.claims)
+			clientSecret := oidctest.ClientSecret
+			if test.clientSecret != "" {
+				clientSecret = test.clientSecret
+			}
+			svc, err := NewOIDC(provider.Issuer, oidctest.ClientID, clientSecret, testRedirectURL)
+			require.NoError(t, err, "Expected no error creating OIDC client")
+
+			code := authorize(t, svc, "state", "nonce")
+			nonce := "nonce"
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+			identity, err := svc.Exchange(context.Background(), code, nonce)
+			switch {
+			case test.expectInvalidErr:
+				assert.Equal(t, ErrInvalidIDToken, errors.Cause(err), "Expected ErrInvalidIDToken")
+			case test.expectErr:
+				assert.Error(t, err, "Expected an error")
+				assert.NotEqual(t, ErrInvalidIDToken, errors.Cause(err), "Expected an error other than ErrInvalidIDToken")
+			default:
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, test.expected, identity, "Expected identities to match")
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeUsedCode(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	svc := newTestOIDC(t, provider)
+	code := authorize(t, svc, "state", "nonce")
+	_, err := svc.Exchange(context.Background(), code, "nonce")
+	require.NoError(t, err, "Expected no error")
+	_, err = svc.Exchange(context.Background(), code, "nonce")
+	assert.Error(t, err, "Expected an error using an authorization code twice")
+}
+
+func TestOIDCVerify(t *testing.T) {
+	provider := oidctest.NewProvider(t)
+	svc := newTestOIDC(t, provider)
+	ctx := context.Background()
+	doc, err := svc.discover(ctx)
+	require.NoError(t, err, "Expected no error fetching discovery document")
+
+	withClaims := func(claims jwt.MapClaims) string {
+		valid := provider.Claims("subject", "driver@example.com", "nonce")
+		for k, v := range claims {
+			valid[k] = v
+		}
+		return provider.IDToken(valid)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		description string
+		idToken     string
+		expectErr   bool
+	}{
+		{
+			description: "Valid ID tokens should be accepted",
+			idToken:     withClaims(nil),
+		},
+		{
+			description: "Audience arrays containing the client ID should be accepted",
+			idToken:     withClaims(jwt.MapClaims{"aud": []string{"other", oidctest.ClientID}}),
+		},
+		{
+			description: "ID tokens that just expired should be accepted",
+			idToken:     withClaims(jwt.MapClaims{"exp": now.Add(-idTokenLeeway / 2).Unix()}),
+		},
+		{
+			description: "Expired ID tokens should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"exp": now.Add(-2 * idTokenLeeway).Unix()}),
+			expectErr:   true,
+		},
+		{
+			description: "ID tokens without expiry should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"exp": nil}),
+			expectErr:   true,
+		},
+		{
+			description: "ID tokens issued in the future should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"iat": now.Add(2 * idTokenLeeway).Unix()}),
+			expectErr:   true,
+		},
+		{
+			description: "Wrong issuers should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"iss": "https://accounts.example.com"}),
+			expectErr:   true,
+		},
+		{
+			description: "Wrong audiences should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"aud": "other"}),
+			expectErr:   true,
+		},
+		{
+			description: "Audience arrays without the client ID should be rejected",
+			idToken:     withClaims(jwt.MapClaims{"aud": []string{"other"}}),
+			expectErr:   true,
+		},
+		{
+			description: "Invalid signatures should be rejected",
+			idToken:     withClaims(nil) + "x",
+			expectErr:   true,
+		},
+		{
+			description: "HMAC signed ID tokens should be rejected",
+			idToken: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.Claims("subject", "driver@example.com", "nonce"))
+				token.Header["kid"] = oidctest.KeyID
+				signed, err := token.SignedString([]byte(oidctest.ClientSecret))
+				require.NoError(t, err, "Expected no error signing ID token")
+				return signed
+			}(),
+			expectErr: true,
+		},
+		{
+			description: "Malformed ID tokens should be rejected",
+			idToken:     "not a token",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			identity, err := svc.verify(ctx, doc, test.idToken, "nonce", now)
+			if test.expectErr {
+				assert.Equal(t, ErrInvalidIDToken, errors.Cause(err), "Expected ErrInvalidIDToken")
+				return
+			}
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, Identity{Subject: "subject", Email: "driver@example.com"}, identity, "Expected identities to match")
+		})
+	}
+}
@@ -1,25 +1,106 @@
 package services
 
 import (
+	"context"
 	"database/sql"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-kit/kit/metrics"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/tracing"
 )
 
 // Persistence is a service that provides persistence for all service data in a
 // SQL database.
 type Persistence struct {
-	db   *sql.DB
-	salt []byte
+	db            *sql.DB
+	driver        database.Driver
+	salt          []byte
+	spatial       SpatialMode
+	queryTimeout  time.Duration
+	queryDuration metrics.Histogram
 }
 
-// NewPersistence creates a new Persistence service. The salt is used to
+// NewPersistence creates a new Persistence service for a database opened with
+// the given driver, see database.Open. The salt is used to
 // obfuscate the license plate information and must remain the same to detect
-// duplicate car entries.
-func NewPersistence(db *sql.DB, salt []byte) Persistence {
-	return Persistence{db: db, salt: salt}
+// duplicate car entries. The spatial mode selects how map block locations are
+// queried, see SpatialMode. Every method call is canceled if it takes longer than
+// queryTimeout, unless queryTimeout is 0. The duration of every method call is
+// recorded in the queryDuration histogram, labeled by method and success.
+func NewPersistence(
+	db *sql.DB,
+	driver database.Driver,
+	salt []byte,
+	spatial SpatialMode,
+	queryTimeout time.Duration,
+	queryDuration metrics.Histogram,
+) Persistence {
+	return Persistence{
+		db:            db,
+		driver:        driver,
+		salt:          salt,
+		spatial:       spatial,
+		queryTimeout:  queryTimeout,
+		queryDuration: queryDuration,
+	}
+}
+
+const tracerName = "github.com/matthewdale/manualsmap.com/services"
+
+// instrument starts a span for a call to the named method, which runs the
+// named SQL statement, and applies the query timeout to the returned context.
+// The returned function must be called with the method's error when it
+// returns to cancel the context, end the span and record the call duration in
+// the queryDuration histogram, if there is one.
+func (svc Persistence) instrument(
+	ctx context.Context,
+	method string,
+	statement string,
+) (context.Context, func(error)) {
+	begin := time.Now()
+	system := semconv.DBSystemPostgreSQL
+	if svc.driver == database.SQLite {
+		system = semconv.DBSystemSqlite
+	}
+	cancel := context.CancelFunc(func() {})
+	if svc.queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, svc.queryTimeout)
+	}
+	ctx, span := otel.Tracer(tracerName).Start(
+		ctx,
+		"Persistence."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			system,
+			attribute.String("db.statement.name", statement)))
+	return ctx, func(err error) {
+		cancel()
+		tracing.SpanError(span, err)
+		span.End()
+		if svc.queryDuration != nil {
+			svc.queryDuration.With(
+				"method", method,
+				"success", strconv.FormatBool(err == nil),
+			).Observe(time.Since(begin).Seconds())
+		}
+	}
+}
+
+// Ping verifies that the database is reachable.
+func (svc Persistence) Ping(ctx context.Context) (err error) {
+	ctx, done := svc.instrument(ctx, "Ping", "ping")
+	defer func() { done(err) }()
+	return errors.WithMessage(svc.db.PingContext(ctx), "failed to ping database")
 }
 
 type MapBlock struct {
@@ -34,6 +115,14 @@ func segmentCoordinate(coordinate decimal.Decimal) decimal.Decimal {
 	return coordinate.Div(mapBlockSize).Truncate(0).Mul(mapBlockSize)
 }
 
+// MapBlockKey returns a string that uniquely identifies the map block that
+// contains the given coordinates.
+func MapBlockKey(latitude, longitude decimal.Decimal) string {
+	return segmentCoordinate(latitude).String() + "," + segmentCoordinate(longitude).String()
+}
+
+// Map blocks without any cars, e.g. because every car was deleted or moved,
+// aren't shown on the map.
 // TODO: Adjust limit.
 const getMapBlocksQuery = `
 SELECT
@@ -42,26 +131,48 @@ FROM map_blocks
 WHERE
 	latitude BETWEEN $1 AND $2
 	AND longitude BETWEEN $3 AND $4
+	AND EXISTS (
+		SELECT 1
+		FROM cars
+		WHERE
+			cars.map_block_id = map_blocks.id
+			AND cars.deleted IS NULL
+	)
 LIMIT 100
 `
 
 var coordinateOvershoot = decimal.NewFromFloat(0.5)
 
 func (svc Persistence) GetMapBlocks(
+	ctx context.Context,
 	minLatitude,
 	minLongitude,
 	maxLatitude,
 	maxLongitude decimal.Decimal,
-) ([]MapBlock, error) {
-	rows, err := svc.db.Query(
-		getMapBlocksQuery,
+) (_ []MapBlock, err error) {
+	query, statement := getMapBlocksQuery, "getMapBlocksQuery"
+	args := []interface{}{
 		minLatitude.Sub(coordinateOvershoot),
 		maxLatitude.Add(coordinateOvershoot),
 		minLongitude.Sub(coordinateOvershoot),
-		maxLongitude.Add(coordinateOvershoot))
+		maxLongitude.Add(coordinateOvershoot),
+	}
+	if svc.spatial == SpatialPostGIS {
+		query, statement = getMapBlocksPostGISQuery, "getMapBlocksPostGISQuery"
+		args = postGISEnvelopes(minLatitude, minLongitude, maxLatitude, maxLongitude)
+	}
+	ctx, done := svc.instrument(ctx, "GetMapBlocks", statement)
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(query), args...)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to read map blocks")
 	}
+	return scanMapBlocks(rows)
+}
+
+// scanMapBlocks reads all map blocks from rows and closes them.
+func scanMapBlocks(rows *sql.Rows) ([]MapBlock, error) {
+	defer rows.Close()
 	blocks := make([]MapBlock, 0, 10)
 
 	for rows.Next() {
@@ -75,6 +186,9 @@ func (svc Persistence) GetMapBlocks(
 		}
 		blocks = append(blocks, block)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read map blocks")
+	}
 	return blocks, nil
 }
 
@@ -87,16 +201,19 @@ WHERE
 	AND longitude = $2
 `
 
-func (svc Persistence) GetMapBlock(latitude, longitude decimal.Decimal) (*MapBlock, error) {
+func (svc Persistence) GetMapBlock(ctx context.Context, latitude, longitude decimal.Decimal) (_ *MapBlock, err error) {
+	ctx, done := svc.instrument(ctx, "GetMapBlock", "getMapBlockQuery")
+	defer func() { done(err) }()
 	var block MapBlock
-	err := svc.db.QueryRow(
-		getMapBlockQuery,
+	err = svc.db.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(getMapBlockQuery),
 		segmentCoordinate(latitude),
 		segmentCoordinate(longitude),
 	).Scan(
 		&block.ID,
-		&block.Longitude,
 		&block.Latitude,
+		&block.Longitude,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -113,22 +230,69 @@ VALUES ($1, $2)
 ON CONFLICT DO NOTHING
 `
 
-func (svc Persistence) InsertMapBlock(latitude, longitude decimal.Decimal) error {
-	_, err := svc.db.Exec(
-		insertMapBlockQuery,
+// InsertMapBlock inserts the map block containing the coordinates if it
+// doesn't exist, and returns whether it was inserted.
+func (svc Persistence) InsertMapBlock(ctx context.Context, latitude, longitude decimal.Decimal) (_ bool, err error) {
+	ctx, done := svc.instrument(ctx, "InsertMapBlock", "insertMapBlockQuery")
+	defer func() { done(err) }()
+	result, err := svc.db.ExecContext(
+		ctx,
+		svc.driver.Rebind(insertMapBlockQuery),
 		segmentCoordinate(latitude),
 		segmentCoordinate(longitude))
-	return err
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to count inserted map blocks")
+	}
+	return inserted > 0, nil
 }
 
+// getOrInsertMapBlock returns the ID of the map block containing the
+// coordinates, inserting it in the transaction if it doesn't exist, and
+// whether it was inserted.
+func (svc Persistence) getOrInsertMapBlock(
+	ctx context.Context,
+	tx *sql.Tx,
+	latitude,
+	longitude decimal.Decimal,
+) (int, bool, error) {
+	latitude, longitude = segmentCoordinate(latitude), segmentCoordinate(longitude)
+	result, err := tx.ExecContext(ctx, svc.driver.Rebind(insertMapBlockQuery), latitude, longitude)
+	if err != nil {
+		return 0, false, errors.WithMessage(err, "failed to insert map block")
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, errors.WithMessage(err, "failed to insert map block")
+	}
+	var block MapBlock
+	err = tx.QueryRowContext(ctx, svc.driver.Rebind(getMapBlockQuery), latitude, longitude).Scan(
+		&block.ID,
+		&block.Latitude,
+		&block.Longitude)
+	if err != nil {
+		return 0, false, errors.WithMessage(err, "failed to read map block")
+	}
+	return block.ID, inserted > 0, nil
+}
+
+// The image may already exist if a car referencing it was submitted before
+// the upload notification arrived, in which case only the format is unknown.
 const insertImageQuery = `
 INSERT INTO images (public_id, format)
 VALUES ($1, $2)
-ON CONFLICT DO NOTHING
+ON CONFLICT (public_id) DO UPDATE SET
+	format = EXCLUDED.format,
+	updated = CURRENT_TIMESTAMP
 `
 
-func (svc Persistence) InsertImage(publicID, format string) error {
-	_, err := svc.db.Exec(insertImageQuery, publicID, format)
+func (svc Persistence) InsertImage(ctx context.Context, publicID, format string) (err error) {
+	ctx, done := svc.instrument(ctx, "InsertImage", "insertImageQuery")
+	defer func() { done(err) }()
+	_, err = svc.db.ExecContext(ctx, svc.driver.Rebind(insertImageQuery), publicID, format)
 	return err
 }
 
@@ -136,28 +300,79 @@ const updateImageQuery = `
 UPDATE images
 SET
 	status = $2,
-	updated = NOW()
+	updated = CURRENT_TIMESTAMP
 WHERE public_id = $1
 `
 
-func (svc Persistence) UpdateImage(publicID, status string) error {
-	_, err := svc.db.Exec(updateImageQuery, publicID, status)
+func (svc Persistence) UpdateImage(ctx context.Context, publicID, status string) (err error) {
+	ctx, done := svc.instrument(ctx, "UpdateImage", "updateImageQuery")
+	defer func() { done(err) }()
+	_, err = svc.db.ExecContext(ctx, svc.driver.Rebind(updateImageQuery), publicID, status)
 	return err
 }
 
+const getOrphanedImagesQuery = `
+SELECT
+	i.public_id,
+	i.format
+FROM images i
+WHERE
+	i.status <> 'deleted'
+	AND i.created < $1
+	AND NOT EXISTS (
+		SELECT 1 FROM cars c WHERE c.images_public_id = i.public_id
+	)
+	AND NOT EXISTS (
+		SELECT 1 FROM car_history h WHERE h.images_public_id = i.public_id
+	)
+ORDER BY i.created
+`
+
+// GetOrphanedImages returns all images created before the given time that
+// are not referenced by any car or previous version of a car and have not
+// already been deleted.
+func (svc Persistence) GetOrphanedImages(ctx context.Context, createdBefore time.Time) (_ []CloudinaryImage, err error) {
+	ctx, done := svc.instrument(ctx, "GetOrphanedImages", "getOrphanedImagesQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(
+		ctx,
+		svc.driver.Rebind(getOrphanedImagesQuery),
+		createdBefore.UTC())
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read orphaned images")
+	}
+	defer rows.Close()
+	images := make([]CloudinaryImage, 0, 10)
+	for rows.Next() {
+		var img CloudinaryImage
+		if err := rows.Scan(&img.PublicID, &img.Format); err != nil {
+			return nil, errors.WithMessage(err, "failed to scan image row into struct")
+		}
+		images = append(images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read orphaned images")
+	}
+	return images, nil
+}
+
 type Car struct {
-	Year  int
-	Make  string
-	Model string
-	Trim  string
-	Color string
-	Image CloudinaryImage
+	ID         int
+	MapBlockID int
+	Year       int
+	Make       string
+	Model      string
+	Trim       string
+	Color      string
+	Image      CloudinaryImage
 }
 
 // TODO: Fetch additional columns, order by created descending,
 // and paginate.
 const getCarsQuery = `
 SELECT
+	c.id,
+	c.map_block_id,
 	c.year,
 	c.make,
 	c.model,
@@ -169,21 +384,33 @@ FROM cars c
 LEFT JOIN images i ON
 	i.public_id = c.images_public_id
 	AND i.status = 'approved'
-WHERE c.map_block_id = $1
+WHERE
+	c.map_block_id = $1
+	AND c.deleted IS NULL
 ORDER BY c.created DESC
 `
 
-func (svc Persistence) GetCars(mapBlockID int) ([]Car, error) {
-	rows, err := svc.db.Query(getCarsQuery, mapBlockID)
+func (svc Persistence) GetCars(ctx context.Context, mapBlockID int) (_ []Car, err error) {
+	ctx, done := svc.instrument(ctx, "GetCars", "getCarsQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(getCarsQuery), mapBlockID)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to read cars")
 	}
+	return scanCars(rows)
+}
+
+// scanCars reads and closes rows of cars selected like in getCarsQuery.
+func scanCars(rows *sql.Rows) ([]Car, error) {
+	defer rows.Close()
 	cars := make([]Car, 0, 10)
 	for rows.Next() {
 		var car Car
 		var publicID sql.NullString
 		var format sql.NullString
 		err := rows.Scan(
+			&car.ID,
+			&car.MapBlockID,
 			&car.Year,
 			&car.Make,
 			&car.Model,
@@ -202,6 +429,9 @@ func (svc Persistence) GetCars(mapBlockID int) ([]Car, error) {
 		}
 		cars = append(cars, car)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithMessage(err, "failed to read cars")
+	}
 	return cars, nil
 }
 
@@ -213,30 +443,75 @@ INSERT INTO cars(
 	model,
 	trim,
 	color,
-	images_public_id
-) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	images_public_id,
+	edit_token_hash,
+	user_id
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING id
 `
 
+// insertCarImageQuery makes sure the image referenced by a new car exists,
+// because the car may be submitted before Cloudinary sends the upload
+// notification. The format is set when the notification arrives.
+const insertCarImageQuery = `
+INSERT INTO images (public_id, format)
+VALUES ($1, '')
+ON CONFLICT DO NOTHING
+`
+
+// InsertCar inserts a car and returns its ID. The editTokenHash is the hash
+// of the token that authorizes editing the car, see NewToken. Cars with
+// an empty editTokenHash can't be edited. The userID is the ID of the user who
+// submitted the car, or 0 if they weren't logged in.
 func (svc Persistence) InsertCar(
+	ctx context.Context,
 	mapBlockID,
 	year int,
 	make,
 	model,
 	trim,
 	color,
-	imagePublicID string,
-) error {
-	_, err := svc.db.Exec(
-		insertCarQuery,
+	imagePublicID,
+	editTokenHash string,
+	userID int,
+) (_ int, err error) {
+	ctx, done := svc.instrument(ctx, "InsertCar", "insertCarQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to begin car transaction")
+	}
+	defer tx.Rollback()
+
+	// Cars without an image store NULL so that they don't violate the images
+	// foreign key.
+	imageID := sql.NullString{String: strings.TrimSpace(imagePublicID)}
+	imageID.Valid = imageID.String != ""
+	if imageID.Valid {
+		if _, err := tx.ExecContext(ctx, svc.driver.Rebind(insertCarImageQuery), imageID); err != nil {
+			return 0, errors.WithMessage(err, "failed to insert car image")
+		}
+	}
+	var id int
+	err = tx.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(insertCarQuery),
 		mapBlockID,
 		year,
 		strings.TrimSpace(make),
 		strings.TrimSpace(model),
 		strings.TrimSpace(trim),
 		strings.ToLower(strings.TrimSpace(color)),
-		strings.TrimSpace(imagePublicID))
+		imageID,
+		sql.NullString{String: editTokenHash, Valid: editTokenHash != ""},
+		sql.NullInt64{Int64: int64(userID), Valid: userID != 0},
+	).Scan(&id)
 	if err != nil {
-		return errors.WithMessage(err, "failed to insert car")
+		return 0, errors.WithMessage(err, "failed to insert car")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.WithMessage(err, "failed to commit car transaction")
 	}
-	return nil
+	return id, nil
 }
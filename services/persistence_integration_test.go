@@ -0,0 +1,738 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+// The tests in this file run every Persistence method against each supported
+// database, see the dbtest package for how to enable Postgres.
+
+func TestMain(m *testing.M) {
+	dbtest.Main(m)
+}
+
+// d parses a decimal test fixture.
+var d = decimal.RequireFromString
+
+// coordinates is a map block location used by the test fixtures.
+type coordinates struct {
+	latitude  string
+	longitude string
+}
+
+// insertMapBlocks inserts map blocks at the given locations and returns the
+// inserted blocks.
+func insertMapBlocks(t *testing.T, svc Persistence, locations ...coordinates) []MapBlock {
+	t.Helper()
+	ctx := context.Background()
+	blocks := make([]MapBlock, 0, len(locations))
+	for _, location := range locations {
+		latitude, longitude := d(location.latitude), d(location.longitude)
+		_, err := svc.InsertMapBlock(ctx, latitude, longitude)
+		require.NoError(t, err, "Expected no error inserting map block")
+		block, err := svc.GetMapBlock(ctx, latitude, longitude)
+		require.NoError(t, err, "Expected no error getting map block")
+		require.NotNil(t, block, "Expected the inserted map block to exist")
+		blocks = append(blocks, *block)
+	}
+	return blocks
+}
+
+// insertCarsIn inserts a car in each block so that the blocks are shown on the
+// map, see GetMapBlocks.
+func insertCarsIn(t *testing.T, svc Persistence, blocks []MapBlock) {
+	t.Helper()
+	for _, block := range blocks {
+		_, err := svc.InsertCar(context.Background(), block.ID, 1994, "Mazda", "Miata", "", "red", "", "", 0)
+		require.NoError(t, err, "Expected no error inserting car")
+	}
+}
+
+// blockLocations returns the locations of the blocks for comparison, because
+// the databases return coordinates with different decimal exponents.
+func blockLocations(blocks []MapBlock) []coordinates {
+	locations := make([]coordinates, 0, len(blocks))
+	for _, block := range blocks {
+		locations = append(locations, coordinates{
+			latitude:  block.Latitude.String(),
+			longitude: block.Longitude.String(),
+		})
+	}
+	return locations
+}
+
+// imageRow reads the stored format and status of an image.
+func imageRow(t *testing.T, db *sql.DB, driver database.Driver, publicID string) (string, string) {
+	t.Helper()
+	var format, status string
+	err := db.QueryRow(
+		driver.Rebind(`SELECT format, status FROM images WHERE public_id = $1`),
+		publicID,
+	).Scan(&format, &status)
+	require.NoError(t, err, "Expected no error reading image")
+	return format, status
+}
+
+func TestPersistencePing(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		assert.NoError(t, svc.Ping(context.Background()), "Expected no error")
+	})
+}
+
+func TestPersistenceGetMapBlock(t *testing.T) {
+	tests := []struct {
+		description string
+		latitude    string
+		longitude   string
+		expected    *coordinates
+	}{
+		{
+			description: "Coordinates in a map block should return the block",
+			latitude:    "37.7749",
+			longitude:   "-122.4194",
+			expected:    &coordinates{latitude: "37.75", longitude: "-122.4"},
+		},
+		{
+			description: "Coordinates on the corner of a map block should return the block",
+			latitude:    "37.75",
+			longitude:   "-122.4",
+			expected:    &coordinates{latitude: "37.75", longitude: "-122.4"},
+		},
+		{
+			description: "Coordinates in the southern and eastern hemispheres should return the block",
+			latitude:    "-33.8688",
+			longitude:   "151.2093",
+			expected:    &coordinates{latitude: "-33.85", longitude: "151.2"},
+		},
+		{
+			description: "Coordinates outside every map block should return nil",
+			latitude:    "10",
+			longitude:   "10",
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "-33.8688", longitude: "151.2093"})
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				block, err := svc.GetMapBlock(context.Background(), d(test.latitude), d(test.longitude))
+				assert.NoError(t, err, "Expected no error")
+				if test.expected == nil {
+					assert.Nil(t, block, "Expected no map block")
+					return
+				}
+				require.NotNil(t, block, "Expected a map block")
+				assert.Equal(
+					t,
+					[]coordinates{*test.expected},
+					blockLocations([]MapBlock{*block}),
+					"Expected map block coordinates to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceGetMapBlocks(t *testing.T) {
+	tests := []struct {
+		description  string
+		minLatitude  string
+		minLongitude string
+		maxLatitude  string
+		maxLongitude string
+		expected     []coordinates
+	}{
+		{
+			description:  "Map blocks in the bounding box should be returned",
+			minLatitude:  "37.7",
+			minLongitude: "-122.5",
+			maxLatitude:  "37.8",
+			maxLongitude: "-122.3",
+			expected: []coordinates{
+				{latitude: "37.75", longitude: "-122.4"},
+				{latitude: "37.8", longitude: "-122.3"},
+			},
+		},
+		{
+			description:  "Map blocks just outside the bounding box should be returned",
+			minLatitude:  "38.28",
+			minLongitude: "-122.35",
+			maxLatitude:  "38.5",
+			maxLongitude: "-122.2",
+			expected: []coordinates{
+				{latitude: "37.8", longitude: "-122.3"},
+			},
+		},
+		{
+			description:  "Map blocks far outside the bounding box should not be returned",
+			minLatitude:  "0",
+			minLongitude: "0",
+			maxLatitude:  "1",
+			maxLongitude: "1",
+			expected:     []coordinates{},
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		insertCarsIn(t, svc, insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "37.8", longitude: "-122.3"},
+			coordinates{latitude: "40.7128", longitude: "-74.006"}))
+		// Map blocks without cars, or with only deleted cars, are hidden.
+		insertMapBlocks(t, svc, coordinates{latitude: "37.72", longitude: "-122.46"})
+		deleted := insertMapBlocks(t, svc, coordinates{latitude: "37.76", longitude: "-122.36"})
+		id, hash := insertEditableCar(t, svc, deleted[0].ID, "")
+		require.NoError(t, svc.DeleteCar(context.Background(), id, hash), "Expected no error deleting car")
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				blocks, err := svc.GetMapBlocks(
+					context.Background(),
+					d(test.minLatitude),
+					d(test.minLongitude),
+					d(test.maxLatitude),
+					d(test.maxLongitude))
+				assert.NoError(t, err, "Expected no error")
+				assert.ElementsMatch(
+					t,
+					test.expected,
+					blockLocations(blocks),
+					"Expected map blocks to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceGetMapBlocksNear(t *testing.T) {
+	tests := []struct {
+		description string
+		radius      float64
+		expected    []coordinates
+	}{
+		{
+			description: "Map blocks within the radius should be returned nearest first",
+			radius:      20000,
+			expected: []coordinates{
+				{latitude: "37.75", longitude: "-122.4"},
+				{latitude: "37.8", longitude: "-122.3"},
+			},
+		},
+		{
+			description: "Map blocks outside the radius should not be returned",
+			radius:      5000,
+			expected: []coordinates{
+				{latitude: "37.75", longitude: "-122.4"},
+			},
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		insertCarsIn(t, svc, insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "37.8", longitude: "-122.3"},
+			coordinates{latitude: "40.7128", longitude: "-74.006"}))
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				blocks, err := svc.GetMapBlocksNear(
+					context.Background(),
+					d("37.76"),
+					d("-122.39"),
+					test.radius)
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, test.expected, blockLocations(blocks), "Expected map blocks to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceGetMapBlocksNearLimit(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		latitude, longitude, radius := d("37.76"), d("-122.39"), 100000.0
+
+		// Fill the bounding box around the radius with more blocks than the
+		// query returns, so that the block within the radius, inserted last,
+		// is only returned if the blocks are ordered by distance before the
+		// limit is applied.
+		minLatitude, minLongitude, maxLatitude, maxLongitude := radiusBounds(latitude, longitude, radius)
+		var far []coordinates
+		for lat := minLatitude; lat.LessThan(maxLatitude); lat = lat.Add(mapBlockSize) {
+			for long := minLongitude; long.LessThan(maxLongitude); long = long.Add(mapBlockSize) {
+				blockLat, blockLong := segmentCoordinate(lat), segmentCoordinate(long)
+				if blockLat.LessThan(minLatitude) || blockLong.LessThan(minLongitude) ||
+					distance(latitude, longitude, blockLat, blockLong) <= radius {
+					continue
+				}
+				far = append(far, coordinates{latitude: blockLat.String(), longitude: blockLong.String()})
+			}
+		}
+		require.Greater(t, len(far), maxRadiusBlocks, "Expected more blocks outside the radius than the limit")
+		insertCarsIn(t, svc, insertMapBlocks(t, svc, far...))
+		insertCarsIn(t, svc, insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"}))
+
+		blocks, err := svc.GetMapBlocksNear(context.Background(), latitude, longitude, radius)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(
+			t,
+			[]coordinates{{latitude: "37.75", longitude: "-122.4"}},
+			blockLocations(blocks),
+			"Expected only the block within the radius")
+	})
+}
+
+func TestPersistenceInsertMapBlock(t *testing.T) {
+	tests := []struct {
+		description string
+		latitude    string
+		longitude   string
+		expected    *coordinates
+		inserted    bool
+		expectErr   bool
+	}{
+		{
+			description: "Map blocks should be stored at the segmented coordinates",
+			latitude:    "51.5074",
+			longitude:   "-0.1278",
+			expected:    &coordinates{latitude: "51.5", longitude: "-0.1"},
+			inserted:    true,
+		},
+		{
+			description: "Inserting an existing map block should succeed without inserting it",
+			latitude:    "37.7749",
+			longitude:   "-122.4194",
+			expected:    &coordinates{latitude: "37.75", longitude: "-122.4"},
+		},
+		{
+			description: "Map blocks with an invalid latitude should be rejected",
+			latitude:    "400",
+			longitude:   "0",
+			expectErr:   true,
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				ctx := context.Background()
+				inserted, err := svc.InsertMapBlock(ctx, d(test.latitude), d(test.longitude))
+				if test.expectErr {
+					assert.Error(t, err, "Expected an error")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, test.inserted, inserted, "Expected whether the map block was inserted to match")
+				block, err := svc.GetMapBlock(ctx, d(test.latitude), d(test.longitude))
+				require.NoError(t, err, "Expected no error getting map block")
+				require.NotNil(t, block, "Expected the map block to exist")
+				assert.Equal(
+					t,
+					[]coordinates{*test.expected},
+					blockLocations([]MapBlock{*block}),
+					"Expected map block coordinates to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceInsertMapBlockConcurrently(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+
+		// Every car submitted in a new map block inserts the block, so
+		// concurrent submissions race to insert the same block.
+		const inserts = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, inserts)
+		var insertedCount atomic.Int32
+		for i := 0; i < inserts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inserted, err := svc.InsertMapBlock(context.Background(), d("37.7749"), d("-122.4194"))
+				if inserted {
+					insertedCount.Add(1)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			assert.NoError(t, err, "Expected concurrent inserts to succeed")
+		}
+		assert.Equal(t, int32(1), insertedCount.Load(), "Expected exactly one insert to report inserting the map block")
+
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM map_blocks`).Scan(&count)
+		assert.NoError(t, err, "Expected no error counting map blocks")
+		assert.Equal(t, 1, count, "Expected exactly one map block")
+	})
+}
+
+func TestPersistenceInsertImage(t *testing.T) {
+	tests := []struct {
+		description    string
+		publicID       string
+		format         string
+		expectedStatus string
+	}{
+		{
+			description:    "New images should be pending",
+			publicID:       "new",
+			format:         "jpg",
+			expectedStatus: "pending",
+		},
+		{
+			description:    "Images referenced by a car should get their format",
+			publicID:       "referenced",
+			format:         "png",
+			expectedStatus: "pending",
+		},
+		{
+			description:    "Existing images should keep their status",
+			publicID:       "approved",
+			format:         "webp",
+			expectedStatus: "approved",
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		// The car is submitted before the upload notification for its image.
+		_, err := svc.InsertCar(ctx, blocks[0].ID, 1994, "Mazda", "Miata", "", "red", "referenced", "", 0)
+		require.NoError(t, err, "Expected no error inserting car")
+		require.NoError(t, svc.InsertImage(ctx, "approved", "jpg"), "Expected no error inserting image")
+		require.NoError(t, svc.UpdateImage(ctx, "approved", "approved"), "Expected no error approving image")
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				err := svc.InsertImage(ctx, test.publicID, test.format)
+				assert.NoError(t, err, "Expected no error")
+				format, status := imageRow(t, db, driver, test.publicID)
+				assert.Equal(t, test.format, format, "Expected image format to match")
+				assert.Equal(t, test.expectedStatus, status, "Expected image status to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceUpdateImage(t *testing.T) {
+	tests := []struct {
+		description string
+		status      string
+		expectErr   bool
+	}{
+		{
+			description: "Images should be approved",
+			status:      "approved",
+		},
+		{
+			description: "Images should be rejected",
+			status:      "rejected",
+		},
+		{
+			description: "Images should be deleted",
+			status:      "deleted",
+		},
+		{
+			description: "Unknown statuses should be rejected",
+			status:      "lost",
+			expectErr:   true,
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				publicID := "image-" + test.status
+				require.NoError(t, svc.InsertImage(ctx, publicID, "jpg"), "Expected no error inserting image")
+				err := svc.UpdateImage(ctx, publicID, test.status)
+				if test.expectErr {
+					assert.Error(t, err, "Expected an error")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+				_, status := imageRow(t, db, driver, publicID)
+				assert.Equal(t, test.status, status, "Expected image status to match")
+			})
+		}
+
+		t.Run("Updating a missing image should do nothing", func(t *testing.T) {
+			assert.NoError(t, svc.UpdateImage(ctx, "missing", "approved"), "Expected no error")
+		})
+	})
+}
+
+func TestPersistenceGetOrphanedImages(t *testing.T) {
+	tests := []struct {
+		description   string
+		createdBefore time.Duration
+		expected      []CloudinaryImage
+	}{
+		{
+			description:   "Unreferenced images that aren't deleted should be returned",
+			createdBefore: time.Minute,
+			expected:      []CloudinaryImage{{PublicID: "orphan", Format: "jpg"}},
+		},
+		{
+			description:   "Images created after the given time should not be returned",
+			createdBefore: -time.Hour,
+			expected:      []CloudinaryImage{},
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+		for _, publicID := range []string{"orphan", "deleted", "referenced"} {
+			require.NoError(t, svc.InsertImage(ctx, publicID, "jpg"), "Expected no error inserting image")
+		}
+		require.NoError(t, svc.UpdateImage(ctx, "deleted", "deleted"), "Expected no error deleting image")
+		_, err := svc.InsertCar(ctx, blocks[0].ID, 1994, "Mazda", "Miata", "", "red", "referenced", "", 0)
+		require.NoError(t, err, "Expected no error inserting car")
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				images, err := svc.GetOrphanedImages(ctx, time.Now().Add(test.createdBefore))
+				assert.NoError(t, err, "Expected no error")
+				assert.Equal(t, test.expected, images, "Expected orphaned images to match")
+			})
+		}
+	})
+}
+
+func TestPersistenceGetCars(t *testing.T) {
+	// Each car has an image with the status in its model name.
+	tests := []struct {
+		description string
+		status      string
+		expected    CloudinaryImage
+	}{
+		{
+			description: "Cars with an approved image should include the image",
+			status:      "approved",
+			expected:    CloudinaryImage{PublicID: "approved", Format: "jpg"},
+		},
+		{
+			description: "Cars with a pending image should not include the image",
+			status:      "pending",
+		},
+		{
+			description: "Cars with a rejected image should not include the image",
+			status:      "rejected",
+		},
+		{
+			description: "Cars with a deleted image should not include the image",
+			status:      "deleted",
+		},
+		{
+			description: "Cars without an image should not include an image",
+		},
+	}
+
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		blocks := insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "40.7128", longitude: "-74.006"})
+		for _, test := range tests {
+			if test.status != "" {
+				require.NoError(t, svc.InsertImage(ctx, test.status, "jpg"), "Expected no error inserting image")
+				require.NoError(t, svc.UpdateImage(ctx, test.status, test.status), "Expected no error updating image")
+			}
+			_, err := svc.InsertCar(ctx, blocks[0].ID, 1994, "Mazda", "model-"+test.status, "", "red", test.status, "", 0)
+			require.NoError(t, err, "Expected no error inserting car")
+		}
+		_, err := svc.InsertCar(ctx, blocks[1].ID, 2002, "BMW", "M3", "", "silver", "", "", 0)
+		require.NoError(t, err, "Expected no error inserting car in another map block")
+
+		cars, err := svc.GetCars(ctx, blocks[0].ID)
+		require.NoError(t, err, "Expected no error getting cars")
+		require.Len(t, cars, len(tests), "Expected only the cars in the map block")
+		byModel := make(map[string]Car, len(cars))
+		for _, car := range cars {
+			byModel[car.Model] = car
+		}
+
+		for _, test := range tests {
+			test := test // Capture range variable.
+			t.Run(test.description, func(t *testing.T) {
+				car, ok := byModel["model-"+test.status]
+				require.True(t, ok, "Expected the car to be returned")
+				assert.Equal(t, test.expected, car.Image, "Expected car image to match")
+			})
+		}
+
+		t.Run("Map blocks without cars should have no cars", func(t *testing.T) {
+			cars, err := svc.GetCars(ctx, blocks[1].ID+1)
+			assert.NoError(t, err, "Expected no error")
+			assert.Empty(t, cars, "Expected no cars")
+		})
+	})
+}
+
+func TestPersistenceInsertCar(t *testing.T) {
+	tests := []struct {
+		description string
+		year        int
+		make        string
+		model       string
+		trim        string
+		color       string
+		imageID     string
+		missing     bool
+		expected    Car
+		expectErr   bool
+	}{
+		{
+			description: "Car fields should be trimmed and the color lowercased",
+			year:        1994,
+			make:        " Mazda ",
+			model:       " Miata ",
+			trim:        " R ",
+			color:       " Red ",
+			expected:    Car{Year: 1994, Make: "Mazda", Model: "Miata", Trim: "R", Color: "red"},
+		},
+		{
+			description: "Cars with an image should reference it before it's uploaded",
+			year:        2002,
+			make:        "BMW",
+			model:       "M3",
+			color:       "silver",
+			imageID:     "m3",
+			expected:    Car{Year: 2002, Make: "BMW", Model: "M3", Color: "silver"},
+		},
+		{
+			description: "Cars with an invalid year should be rejected",
+			year:        1800,
+			make:        "Ford",
+			model:       "Model T",
+			color:       "black",
+			expectErr:   true,
+		},
+		{
+			description: "Cars with a short make should be rejected",
+			year:        2000,
+			make:        "X",
+			model:       "Y",
+			color:       "black",
+			expectErr:   true,
+		},
+		{
+			description: "Cars in a missing map block should be rejected",
+			year:        2000,
+			make:        "Honda",
+			model:       "S2000",
+			color:       "yellow",
+			missing:     true,
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+				ctx := context.Background()
+				svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+				blocks := insertMapBlocks(t, svc, coordinates{latitude: "37.7749", longitude: "-122.4194"})
+				blockID := blocks[0].ID
+				if test.missing {
+					blockID++
+				}
+
+				id, err := svc.InsertCar(
+					ctx,
+					blockID,
+					test.year,
+					test.make,
+					test.model,
+					test.trim,
+					test.color,
+					test.imageID,
+					"",
+					0)
+				if test.expectErr {
+					assert.Error(t, err, "Expected an error")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+
+				cars, err := svc.GetCars(ctx, blockID)
+				assert.NoError(t, err, "Expected no error getting cars")
+				expected := test.expected
+				expected.ID = id
+				expected.MapBlockID = blockID
+				assert.Equal(t, []Car{expected}, cars, "Expected cars to match")
+
+				var imageID sql.NullString
+				err = db.QueryRow(`SELECT images_public_id FROM cars`).Scan(&imageID)
+				assert.NoError(t, err, "Expected no error reading car")
+				assert.Equal(
+					t,
+					sql.NullString{String: test.imageID, Valid: test.imageID != ""},
+					imageID,
+					"Expected cars without an image to store NULL")
+			})
+		})
+	}
+}
+
+func TestPersistenceCheckSpatial(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+
+		numeric := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		assert.NoError(t, numeric.CheckSpatial(ctx), "Expected numeric mode to be supported")
+
+		// PostGIS may be installed on the Postgres test server.
+		if driver == database.SQLite {
+			postGIS := NewPersistence(db, driver, nil, SpatialPostGIS, 0, nil)
+			assert.Error(t, postGIS.CheckSpatial(ctx), "Expected PostGIS mode to require Postgres")
+		}
+	})
+}
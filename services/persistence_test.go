@@ -1,11 +1,15 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/database"
 )
 
 func TestSegmentCoordinate(t *testing.T) {
@@ -50,3 +54,40 @@ func TestSegmentCoordinate(t *testing.T) {
 		})
 	}
 }
+
+func TestPersistenceQueryTimeout(t *testing.T) {
+	tests := []struct {
+		description    string
+		queryTimeout   time.Duration
+		expectDeadline bool
+	}{
+		{
+			description:    "Queries should have a deadline if there is a query timeout",
+			queryTimeout:   time.Second,
+			expectDeadline: true,
+		},
+		{
+			description:    "Queries should not have a deadline if the query timeout is 0",
+			expectDeadline: false,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			svc := NewPersistence(nil, database.Postgres, nil, SpatialNumeric, test.queryTimeout, nil)
+			ctx, done := svc.instrument(context.Background(), "GetCars", "getCarsQuery")
+			_, ok := ctx.Deadline()
+			assert.Equal(t, test.expectDeadline, ok, "Expected query deadline to match")
+
+			done(nil)
+			assert.Equal(
+				t,
+				test.expectDeadline,
+				ctx.Err() == context.Canceled,
+				"Expected the query context to be canceled when the query is done")
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+// RateLimit configures a token bucket that holds up to Limit tokens and
+// refills at a rate of Limit tokens every Per. The zero value disables rate
+// limiting.
+type RateLimit struct {
+	Limit int
+	Per   time.Duration
+}
+
+// Enabled returns true if the rate limit allows a finite number of requests.
+func (limit RateLimit) Enabled() bool {
+	return limit.Limit > 0 && limit.Per > 0
+}
+
+// UnmarshalText parses a rate limit in the format "<limit>/<duration>", e.g.
+// "10/1h" for 10 requests per hour. An empty string disables rate limiting.
+func (limit *RateLimit) UnmarshalText(text []byte) error {
+	s := string(text)
+	if s == "" {
+		*limit = RateLimit{}
+		return nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid rate limit %q, must be formatted like 10/1h", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return errors.Errorf("invalid rate limit %q, limit must be a non-negative integer", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return errors.Errorf("invalid rate limit %q, period must be a positive duration", s)
+	}
+	*limit = RateLimit{Limit: n, Per: per}
+	return nil
+}
+
+// RateLimitStore stores token buckets for rate-limited keys.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for the given key. If the bucket is
+	// empty, no token is removed and Take returns how long to wait until a token
+	// is available.
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+}
+
+// bucket is a token bucket that is refilled lazily whenever a token is taken.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) bucket {
+	return bucket{tokens: float64(limit.Limit), updated: now}
+}
+
+func (b *bucket) take(limit RateLimit, now time.Time) time.Duration {
+	rate := float64(limit.Limit) / float64(limit.Per)
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Limit), b.tokens+float64(elapsed)*rate)
+		b.updated = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / rate))
+}
+
+// sweepInterval is how often rate limit stores delete buckets that haven't
+// been used recently.
+const sweepInterval = 10 * time.Minute
+
+// MemoryRateLimitStore is a RateLimitStore that keeps token buckets in memory.
+// It is only suitable for single-instance deployments.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]bucket
+	lastSweep time.Time
+	maxAge    time.Duration
+}
+
+// NewMemoryRateLimitStore creates a new MemoryRateLimitStore. Buckets that
+// haven't been used for longer than maxAge are deleted, so maxAge should be
+// at least as long as the longest rate limit period.
+func NewMemoryRateLimitStore(maxAge time.Duration) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]bucket),
+		maxAge:  maxAge,
+	}
+}
+
+func (store *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if now.Sub(store.lastSweep) > sweepInterval {
+		for k, b := range store.buckets {
+			if now.Sub(b.updated) > store.maxAge {
+				delete(store.buckets, k)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	b, ok := store.buckets[key]
+	if !ok {
+		b = newBucket(limit, now)
+	}
+	wait := b.take(limit, now)
+	store.buckets[key] = b
+	return wait, nil
+}
+
+// SQLRateLimitStore is a RateLimitStore that keeps token buckets in the
+// rate_limits table so that rate limits are shared by all API instances.
+type SQLRateLimitStore struct {
+	db        *sql.DB
+	driver    database.Driver
+	mu        sync.Mutex
+	lastSweep time.Time
+	maxAge    time.Duration
+}
+
+// NewSQLRateLimitStore creates a new SQLRateLimitStore for a database opened
+// with the given driver. Buckets that haven't been used for longer than maxAge
+// are deleted, so maxAge should be at least as long as the longest rate limit
+// period.
+func NewSQLRateLimitStore(db *sql.DB, driver database.Driver, maxAge time.Duration) *SQLRateLimitStore {
+	return &SQLRateLimitStore{db: db, driver: driver, maxAge: maxAge}
+}
+
+const insertRateLimitQuery = `
+INSERT INTO rate_limits (key, tokens, updated)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING
+`
+
+const getRateLimitQuery = `
+SELECT tokens, updated
+FROM rate_limits
+WHERE key = $1
+FOR UPDATE
+`
+
+// SQLite doesn't support row locks, but the transaction already holds the
+// database write lock.
+const getRateLimitSQLiteQuery = `
+SELECT tokens, updated
+FROM rate_limits
+WHERE key = $1
+`
+
+const updateRateLimitQuery = `
+UPDATE rate_limits
+SET
+	tokens = $2,
+	updated = $3
+WHERE key = $1
+`
+
+const deleteRateLimitsQuery = `
+DELETE FROM rate_limits
+WHERE updated < $1
+`
+
+func (store *SQLRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	// Timestamps are stored without a time zone, so always store UTC.
+	now = now.UTC()
+	if err := store.sweep(ctx, now); err != nil {
+		return 0, err
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to begin rate limit transaction")
+	}
+	defer tx.Rollback()
+
+	initial := newBucket(limit, now)
+	if _, err := tx.ExecContext(ctx, store.driver.Rebind(insertRateLimitQuery), key, initial.tokens, initial.updated); err != nil {
+		return 0, errors.WithMessage(err, "failed to insert rate limit")
+	}
+	getQuery := getRateLimitQuery
+	if store.driver == database.SQLite {
+		getQuery = getRateLimitSQLiteQuery
+	}
+	var b bucket
+	if err := tx.QueryRowContext(ctx, store.driver.Rebind(getQuery), key).Scan(&b.tokens, &b.updated); err != nil {
+		return 0, errors.WithMessage(err, "failed to read rate limit")
+	}
+	wait := b.take(limit, now)
+	if _, err := tx.ExecContext(ctx, store.driver.Rebind(updateRateLimitQuery), key, b.tokens, b.updated); err != nil {
+		return 0, errors.WithMessage(err, "failed to update rate limit")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.WithMessage(err, "failed to commit rate limit transaction")
+	}
+	return wait, nil
+}
+
+func (store *SQLRateLimitStore) sweep(ctx context.Context, now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if now.Sub(store.lastSweep) <= sweepInterval {
+		return nil
+	}
+	if _, err := store.db.ExecContext(ctx, store.driver.Rebind(deleteRateLimitsQuery), now.Add(-store.maxAge)); err != nil {
+		return errors.WithMessage(err, "failed to delete stale rate limits")
+	}
+	store.lastSweep = now
+	return nil
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+func TestRateLimitUnmarshalText(t *testing.T) {
+	tests := []struct {
+		description string
+		text        string
+		expected    RateLimit
+		expectErr   bool
+	}{
+		{
+			description: "Should parse limit and period",
+			text:        "10/1h",
+			expected:    RateLimit{Limit: 10, Per: time.Hour},
+		},
+		{
+			description: "Empty string should disable rate limiting",
+			text:        "",
+			expected:    RateLimit{},
+		},
+		{
+			description: "Missing period should be an error",
+			text:        "10",
+			expectErr:   true,
+		},
+		{
+			description: "Invalid period should be an error",
+			text:        "10/hour",
+			expectErr:   true,
+		},
+		{
+			description: "Negative limit should be an error",
+			text:        "-1/1h",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			var actual RateLimit
+			err := actual.UnmarshalText([]byte(test.text))
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+				return
+			}
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, test.expected, actual, "Expected rate limits to match")
+		})
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore(time.Hour)
+	limit := RateLimit{Limit: 2, Per: time.Minute}
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		wait, err := store.Take(context.Background(), "a", limit, now)
+		assert.NoError(t, err, "Expected no error")
+		assert.Zero(t, wait, "Expected requests within the burst to be allowed")
+	}
+
+	wait, err := store.Take(context.Background(), "a", limit, now)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, 30*time.Second, wait, "Expected to wait for one token to refill")
+
+	wait, err = store.Take(context.Background(), "b", limit, now)
+	assert.NoError(t, err, "Expected no error")
+	assert.Zero(t, wait, "Expected different keys to have separate buckets")
+
+	wait, err = store.Take(context.Background(), "a", limit, now.Add(30*time.Second))
+	assert.NoError(t, err, "Expected no error")
+	assert.Zero(t, wait, "Expected a token to be available after refilling")
+
+	// Unused buckets should be deleted once they are older than the max age.
+	_, err = store.Take(context.Background(), "c", limit, now.Add(2*time.Hour))
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, store.buckets, 1, "Expected stale buckets to be deleted")
+}
+
+func TestSQLRateLimitStore(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		store := NewSQLRateLimitStore(db, driver, time.Hour)
+		limit := RateLimit{Limit: 2, Per: time.Minute}
+		// Use a non-UTC time to make sure timestamps round trip.
+		now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.FixedZone("PDT", -7*60*60))
+
+		for i := 0; i < 2; i++ {
+			wait, err := store.Take(context.Background(), "a", limit, now)
+			assert.NoError(t, err, "Expected no error")
+			assert.Zero(t, wait, "Expected requests within the burst to be allowed")
+		}
+
+		wait, err := store.Take(context.Background(), "a", limit, now)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, 30*time.Second, wait, "Expected to wait for one token to refill")
+
+		wait, err = store.Take(context.Background(), "b", limit, now)
+		assert.NoError(t, err, "Expected no error")
+		assert.Zero(t, wait, "Expected different keys to have separate buckets")
+
+		wait, err = store.Take(context.Background(), "a", limit, now.Add(30*time.Second))
+		assert.NoError(t, err, "Expected no error")
+		assert.Zero(t, wait, "Expected a token to be available after refilling")
+
+		// Unused buckets should be deleted once they are older than the max age.
+		_, err = store.Take(context.Background(), "c", limit, now.Add(2*time.Hour))
+		assert.NoError(t, err, "Expected no error")
+		var count int
+		err = db.QueryRow(`SELECT COUNT(*) FROM rate_limits`).Scan(&count)
+		assert.NoError(t, err, "Expected no error counting rate limits")
+		assert.Equal(t, 1, count, "Expected stale buckets to be deleted")
+	})
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Role is a user's role, which determines what they're allowed to do. Every
+// role is allowed to do everything the roles before it can.
+type Role string
+
+const (
+	// RoleUser is the role of every logged in user.
+	RoleUser Role = "user"
+	// RoleModerator can fix and remove other users' cars.
+	RoleModerator Role = "moderator"
+	// RoleAdmin can do everything.
+	RoleAdmin Role = "admin"
+)
+
+// roleRanks orders the roles from least to most privileged.
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func (role *Role) UnmarshalText(text []byte) error {
+	if _, ok := roleRanks[Role(text)]; !ok {
+		return errors.Errorf("unknown role %q, must be one of: user, moderator, admin", text)
+	}
+	*role = Role(text)
+	return nil
+}
+
+// Includes returns true if the role is allowed to do everything that other is
+// allowed to do. Unknown roles include no other roles.
+func (role Role) Includes(other Role) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[other]
+}
+
+// RoleRule grants a role to OIDC logins with a matching "sub" or "email"
+// claim.
+type RoleRule struct {
+	// Claim is "sub" or "email".
+	Claim string
+	Value string
+	Role  Role
+}
+
+// UnmarshalText parses a rule in the format "<claim>:<value>=<role>", e.g.
+// "email:alice@example.com=admin" or "sub:248289761001=moderator".
+func (rule *RoleRule) UnmarshalText(text []byte) error {
+	s := string(text)
+	match, role, ok := strings.Cut(s, "=")
+	if !ok {
+		return errors.Errorf("invalid role rule %q, must be formatted like email:alice@example.com=admin", s)
+	}
+	claim, value, ok := strings.Cut(match, ":")
+	if !ok || value == "" || (claim != "sub" && claim != "email") {
+		return errors.Errorf("invalid role rule %q, must match a sub or email claim", s)
+	}
+	var r Role
+	if err := r.UnmarshalText([]byte(role)); err != nil {
+		return errors.WithMessagef(err, "invalid role rule %q", s)
+	}
+	if claim == "email" {
+		// Email addresses are compared lowercased, like they're stored.
+		value = strings.ToLower(value)
+	}
+	*rule = RoleRule{Claim: claim, Value: value, Role: r}
+	return nil
+}
+
+// RoleRules maps OIDC claims to roles.
+type RoleRules []RoleRule
+
+// Role returns the most privileged role granted to the subject and email
+// address by the rules, or RoleUser if no rule matches. The email address
+// must be normalized, see NormalizeEmail.
+func (rules RoleRules) Role(subject, email string) Role {
+	role := RoleUser
+	for _, rule := range rules {
+		matches := (rule.Claim == "sub" && rule.Value == subject) ||
+			(rule.Claim == "email" && rule.Value == email)
+		if matches && rule.Role.Includes(role) {
+			role = rule.Role
+		}
+	}
+	return role
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleIncludes(t *testing.T) {
+	tests := []struct {
+		description string
+		role        Role
+		other       Role
+		expected    bool
+	}{
+		{
+			description: "Roles should include themselves",
+			role:        RoleModerator,
+			other:       RoleModerator,
+			expected:    true,
+		},
+		{
+			description: "Admins should include moderators",
+			role:        RoleAdmin,
+			other:       RoleModerator,
+			expected:    true,
+		},
+		{
+			description: "Moderators should include users",
+			role:        RoleModerator,
+			other:       RoleUser,
+			expected:    true,
+		},
+		{
+			description: "Users should not include moderators",
+			role:        RoleUser,
+			other:       RoleModerator,
+			expected:    false,
+		},
+		{
+			description: "Empty roles should not include users",
+			role:        "",
+			other:       RoleUser,
+			expected:    false,
+		},
+		{
+			description: "Unknown roles should not include users",
+			role:        "superuser",
+			other:       RoleUser,
+			expected:    false,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, test.role.Includes(test.other), "Expected Includes to match")
+		})
+	}
+}
+
+func TestRoleRuleUnmarshalText(t *testing.T) {
+	tests := []struct {
+		description string
+		text        string
+		expected    RoleRule
+		expectErr   bool
+	}{
+		{
+			description: "Should parse email rules and lowercase the address",
+			text:        "email:Alice@Example.com=admin",
+			expected:    RoleRule{Claim: "email", Value: "alice@example.com", Role: RoleAdmin},
+		},
+		{
+			description: "Should parse subject rules",
+			text:        "sub:248289761001=moderator",
+			expected:    RoleRule{Claim: "sub", Value: "248289761001", Role: RoleModerator},
+		},
+		{
+			description: "Subjects containing '=' should be an error",
+			text:        "sub:a=b=admin",
+			expectErr:   true,
+		},
+		{
+			description: "Missing roles should be an error",
+			text:        "email:alice@example.com",
+			expectErr:   true,
+		},
+		{
+			description: "Unknown roles should be an error",
+			text:        "email:alice@example.com=owner",
+			expectErr:   true,
+		},
+		{
+			description: "Unknown claims should be an error",
+			text:        "name:alice=admin",
+			expectErr:   true,
+		},
+		{
+			description: "Empty values should be an error",
+			text:        "sub:=admin",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			var actual RoleRule
+			err := actual.UnmarshalText([]byte(test.text))
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+				return
+			}
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, test.expected, actual, "Expected rules to match")
+		})
+	}
+}
+
+func TestRoleRulesRole(t *testing.T) {
+	rules := RoleRules{
+		{Claim: "email", Value: "alice@example.com", Role: RoleModerator},
+		{Claim: "sub", Value: "alice", Role: RoleAdmin},
+		{Claim: "email", Value: "bob@example.com", Role: RoleModerator},
+		{Claim: "email", Value: "bob@example.com", Role: RoleUser},
+	}
+
+	tests := []struct {
+		description string
+		subject     string
+		email       string
+		expected    Role
+	}{
+		{
+			description: "Should return the most privileged matching role",
+			subject:     "alice",
+			email:       "alice@example.com",
+			expected:    RoleAdmin,
+		},
+		{
+			description: "Should match email addresses",
+			subject:     "someone",
+			email:       "alice@example.com",
+			expected:    RoleModerator,
+		},
+		{
+			description: "Less privileged rules should not lower the role",
+			subject:     "bob",
+			email:       "bob@example.com",
+			expected:    RoleModerator,
+		},
+		{
+			description: "Users without rules should be users",
+			subject:     "carol",
+			email:       "carol@example.com",
+			expected:    RoleUser,
+		},
+		{
+			description: "Subjects should not match email rules",
+			subject:     "alice@example.com",
+			email:       "carol@example.com",
+			expected:    RoleUser,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, rules.Role(test.subject, test.email), "Expected roles to match")
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+
+	"github.com/matthewdale/manualsmap.com/database"
+)
+
+// SpatialMode selects how Persistence queries map blocks by location.
+type SpatialMode string
+
+const (
+	// SpatialNumeric queries the NUMERIC latitude and longitude columns with
+	// range scans. It works on any Postgres database and is the default.
+	SpatialNumeric SpatialMode = "numeric"
+	// SpatialPostGIS queries the geometry columns added by "migrate postgis",
+	// which requires the PostGIS extension. Bounding box queries
+	// work across the antimeridian.
+	SpatialPostGIS SpatialMode = "postgis"
+)
+
+func (mode *SpatialMode) UnmarshalText(text []byte) error {
+	switch m := SpatialMode(text); m {
+	case SpatialNumeric, SpatialPostGIS:
+		*mode = m
+		return nil
+	}
+	return errors.Errorf("unknown spatial mode %q, must be one of: numeric, postgis", text)
+}
+
+// The envelopes are expanded by $9 degrees so that blocks that overlap the
+// edges of the bounding box are included.
+const getMapBlocksPostGISQuery = `
+SELECT
+	id, latitude, longitude
+FROM map_blocks
+WHERE
+	(
+		ST_Intersects(geom, ST_Expand(ST_MakeEnvelope($1, $2, $3, $4, 4326), $9))
+		OR ST_Intersects(geom, ST_Expand(ST_MakeEnvelope($5, $6, $7, $8, 4326), $9))
+	)
+	AND EXISTS (
+		SELECT 1
+		FROM cars
+		WHERE
+			cars.map_block_id = map_blocks.id
+			AND cars.deleted IS NULL
+	)
+LIMIT 100
+`
+
+// postGISEnvelopes returns the getMapBlocksPostGISQuery arguments for a
+// bounding box. If the bounding box crosses the antimeridian (i.e. the minimum
+// longitude is greater than the maximum), it is split into an envelope on
+// either side, otherwise the same envelope is used twice.
+func postGISEnvelopes(
+	minLatitude,
+	minLongitude,
+	maxLatitude,
+	maxLongitude decimal.Decimal,
+) []interface{} {
+	east, west := maxLongitude, minLongitude
+	if minLongitude.GreaterThan(maxLongitude) {
+		east, west = decimal.NewFromInt(180), decimal.NewFromInt(-180)
+	}
+	return []interface{}{
+		minLongitude, minLatitude, east, maxLatitude,
+		west, minLatitude, maxLongitude, maxLatitude,
+		mapBlockSize,
+	}
+}
+
+// maxRadiusBlocks is the maximum number of map blocks returned by
+// GetMapBlocksNear.
+const maxRadiusBlocks = 100
+
+// The blocks are ordered by their approximate distance from ($5, $6), with
+// longitude differences scaled by $7, the cosine of the latitude, so that the
+// limit keeps the nearest blocks in the bounding box. nearest then filters
+// them by great-circle distance.
+const getMapBlocksNearQuery = `
+SELECT
+	id, latitude, longitude
+FROM map_blocks
+WHERE
+	latitude BETWEEN $1 AND $2
+	AND longitude BETWEEN $3 AND $4
+	AND EXISTS (
+		SELECT 1
+		FROM cars
+		WHERE
+			cars.map_block_id = map_blocks.id
+			AND cars.deleted IS NULL
+	)
+ORDER BY
+	(latitude - $5) * (latitude - $5)
+	+ (longitude - $6) * $7 * (longitude - $6) * $7
+LIMIT 100
+`
+
+// The geography cast measures distances in meters on the spheroid and uses the
+// map_blocks_geog_idx index.
+const getMapBlocksNearPostGISQuery = `
+SELECT
+	id, latitude, longitude
+FROM map_blocks
+WHERE
+	ST_DWithin(
+		geom::geography,
+		ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography,
+		$3)
+	AND EXISTS (
+		SELECT 1
+		FROM cars
+		WHERE
+			cars.map_block_id = map_blocks.id
+			AND cars.deleted IS NULL
+	)
+ORDER BY geom::geography <-> ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography
+LIMIT 100
+`
+
+// GetMapBlocksNear returns up to 100 map blocks with cars within radius
+// meters of the given coordinates, nearest first. In numeric mode, the blocks
+// are found with a bounding box range scan and filtered by great-circle
+// distance, and the search doesn't wrap around the antimeridian.
+func (svc Persistence) GetMapBlocksNear(
+	ctx context.Context,
+	latitude,
+	longitude decimal.Decimal,
+	radius float64,
+) (_ []MapBlock, err error) {
+	minLatitude, minLongitude, maxLatitude, maxLongitude := radiusBounds(latitude, longitude, radius)
+	lat, _ := latitude.Float64()
+	query, statement := getMapBlocksNearQuery, "getMapBlocksNearQuery"
+	args := []interface{}{
+		minLatitude,
+		maxLatitude,
+		minLongitude,
+		maxLongitude,
+		latitude,
+		longitude,
+		decimal.NewFromFloat(math.Cos(lat * math.Pi / 180)),
+	}
+	if svc.spatial == SpatialPostGIS {
+		query, statement = getMapBlocksNearPostGISQuery, "getMapBlocksNearPostGISQuery"
+		args = []interface{}{latitude, longitude, radius}
+	}
+	ctx, done := svc.instrument(ctx, "GetMapBlocksNear", statement)
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(query), args...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read map blocks")
+	}
+	blocks, err := scanMapBlocks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if svc.spatial == SpatialPostGIS {
+		return blocks, nil
+	}
+	return nearest(blocks, latitude, longitude, radius), nil
+}
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// metersPerDegree is the length of one degree of latitude in meters.
+const metersPerDegree = earthRadius * math.Pi / 180
+
+// radiusBounds returns a bounding box that contains every point within radius
+// meters of the given coordinates.
+func radiusBounds(
+	latitude,
+	longitude decimal.Decimal,
+	radius float64,
+) (minLatitude, minLongitude, maxLatitude, maxLongitude decimal.Decimal) {
+	lat, _ := latitude.Float64()
+	latDelta := radius / metersPerDegree
+	// Degrees of longitude get shorter towards the poles. Near the poles, any
+	// longitude may be within the radius.
+	longDelta := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > latDelta/180 {
+		longDelta = math.Min(latDelta/cos, 180)
+	}
+	return latitude.Sub(decimal.NewFromFloat(latDelta)),
+		longitude.Sub(decimal.NewFromFloat(longDelta)),
+		latitude.Add(decimal.NewFromFloat(latDelta)),
+		longitude.Add(decimal.NewFromFloat(longDelta))
+}
+
+// distance returns the great-circle distance in meters between two
+// coordinates using the haversine formula.
+func distance(lat1, long1, lat2, long2 decimal.Decimal) float64 {
+	toRadians := func(d decimal.Decimal) float64 {
+		f, _ := d.Float64()
+		return f * math.Pi / 180
+	}
+	phi1, phi2 := toRadians(lat1), toRadians(lat2)
+	dPhi := phi2 - phi1
+	dLambda := toRadians(long2) - toRadians(long1)
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// nearest returns the blocks within radius meters of the given coordinates,
+// nearest first.
+func nearest(blocks []MapBlock, latitude, longitude decimal.Decimal, radius float64) []MapBlock {
+	distances := make(map[int]float64, len(blocks))
+	within := make([]MapBlock, 0, len(blocks))
+	for _, block := range blocks {
+		d := distance(latitude, longitude, block.Latitude, block.Longitude)
+		if d <= radius {
+			distances[block.ID] = d
+			within = append(within, block)
+		}
+	}
+	sort.SliceStable(within, func(i, j int) bool {
+		return distances[within[i].ID] < distances[within[j].ID]
+	})
+	if len(within) > maxRadiusBlocks {
+		within = within[:maxRadiusBlocks]
+	}
+	return within
+}
+
+const geometryColumnExistsQuery = `
+SELECT EXISTS (
+	SELECT 1
+	FROM information_schema.columns
+	WHERE table_name = 'map_blocks' AND column_name = 'geom'
+)
+`
+
+// CheckSpatial verifies that the database supports the spatial mode. In
+// PostGIS mode, the database must be Postgres and "migrate postgis" must have
+// been run, see migrations.Migrator.SetupPostGIS.
+func (svc Persistence) CheckSpatial(ctx context.Context) (err error) {
+	if svc.spatial != SpatialPostGIS {
+		return nil
+	}
+	if svc.driver != database.Postgres {
+		return errors.Errorf("spatial mode %q requires Postgres", svc.spatial)
+	}
+	ctx, done := svc.instrument(ctx, "CheckSpatial", "geometryColumnExistsQuery")
+	defer func() { done(err) }()
+	var exists bool
+	if err := svc.db.QueryRowContext(ctx, geometryColumnExistsQuery).Scan(&exists); err != nil {
+		return errors.WithMessage(err, "failed to check for geometry columns")
+	}
+	if !exists {
+		return errors.New("map_blocks.geom does not exist, install PostGIS and run \"migrate postgis\"")
+	}
+	return nil
+}
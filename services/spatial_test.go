@@ -0,0 +1,218 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpatialModeUnmarshalText(t *testing.T) {
+	tests := []struct {
+		description string
+		text        string
+		expected    SpatialMode
+		expectErr   bool
+	}{
+		{
+			description: "numeric should be accepted",
+			text:        "numeric",
+			expected:    SpatialNumeric,
+		},
+		{
+			description: "postgis should be accepted",
+			text:        "postgis",
+			expected:    SpatialPostGIS,
+		},
+		{
+			description: "Unknown modes should be rejected",
+			text:        "mysql",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			var mode SpatialMode
+			err := mode.UnmarshalText([]byte(test.text))
+			if test.expectErr {
+				assert.Error(t, err, "Expected an error")
+				return
+			}
+			assert.NoError(t, err, "Expected no error")
+			assert.Equal(t, test.expected, mode, "Expected spatial mode to match")
+		})
+	}
+}
+
+func TestPostGISEnvelopes(t *testing.T) {
+	d := decimal.RequireFromString
+	tests := []struct {
+		description  string
+		minLatitude  decimal.Decimal
+		minLongitude decimal.Decimal
+		maxLatitude  decimal.Decimal
+		maxLongitude decimal.Decimal
+		expected     []interface{}
+	}{
+		{
+			description:  "Bounding boxes should use the same envelope twice",
+			minLatitude:  d("37.7"),
+			minLongitude: d("-122.5"),
+			maxLatitude:  d("37.8"),
+			maxLongitude: d("-122.3"),
+			expected: []interface{}{
+				d("-122.5"), d("37.7"), d("-122.3"), d("37.8"),
+				d("-122.5"), d("37.7"), d("-122.3"), d("37.8"),
+				mapBlockSize,
+			},
+		},
+		{
+			description:  "Bounding boxes across the antimeridian should be split",
+			minLatitude:  d("-18.2"),
+			minLongitude: d("177.5"),
+			maxLatitude:  d("-16.1"),
+			maxLongitude: d("-179.8"),
+			expected: []interface{}{
+				d("177.5"), d("-18.2"), decimal.NewFromInt(180), d("-16.1"),
+				decimal.NewFromInt(-180), d("-18.2"), d("-179.8"), d("-16.1"),
+				mapBlockSize,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			args := postGISEnvelopes(
+				test.minLatitude,
+				test.minLongitude,
+				test.maxLatitude,
+				test.maxLongitude)
+			assert.Equal(t, test.expected, args, "Expected envelope arguments to match")
+		})
+	}
+}
+
+func TestRadiusBounds(t *testing.T) {
+	tests := []struct {
+		description string
+		latitude    decimal.Decimal
+		longitude   decimal.Decimal
+		radius      float64
+		// allLongitudes is set if every longitude may be within the radius.
+		allLongitudes bool
+	}{
+		{
+			description: "Bounds at the equator should contain the radius",
+			latitude:    decimal.NewFromFloat(0),
+			longitude:   decimal.NewFromFloat(0),
+			radius:      10000,
+		},
+		{
+			description: "Bounds at high latitudes should contain the radius",
+			latitude:    decimal.NewFromFloat(64.1),
+			longitude:   decimal.NewFromFloat(-21.9),
+			radius:      50000,
+		},
+		{
+			description:   "Bounds near the poles should contain every longitude",
+			latitude:      decimal.NewFromFloat(89.99),
+			longitude:     decimal.NewFromFloat(10),
+			radius:        5000,
+			allLongitudes: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			minLatitude, minLongitude, maxLatitude, maxLongitude := radiusBounds(
+				test.latitude,
+				test.longitude,
+				test.radius)
+			// Every point due north, south, east and west at the radius should
+			// be within the bounds.
+			assert.InDelta(
+				t,
+				test.radius,
+				distance(test.latitude, test.longitude, maxLatitude, test.longitude),
+				1,
+				"Expected the maximum latitude to be at the radius")
+			assert.InDelta(
+				t,
+				test.radius,
+				distance(test.latitude, test.longitude, minLatitude, test.longitude),
+				1,
+				"Expected the minimum latitude to be at the radius")
+			if test.allLongitudes {
+				assert.True(
+					t,
+					maxLongitude.Sub(minLongitude).Equal(decimal.NewFromInt(360)),
+					"Expected the bounds to span every longitude")
+				return
+			}
+			assert.GreaterOrEqual(
+				t,
+				distance(test.latitude, test.longitude, test.latitude, maxLongitude),
+				test.radius-1,
+				"Expected the maximum longitude to be at least the radius away")
+			assert.GreaterOrEqual(
+				t,
+				distance(test.latitude, test.longitude, test.latitude, minLongitude),
+				test.radius-1,
+				"Expected the minimum longitude to be at least the radius away")
+		})
+	}
+}
+
+func TestNearest(t *testing.T) {
+	d := decimal.RequireFromString
+	blocks := []MapBlock{
+		{ID: 1, Latitude: d("37.8"), Longitude: d("-122.4")},
+		{ID: 2, Latitude: d("37.75"), Longitude: d("-122.45")},
+		{ID: 3, Latitude: d("38.5"), Longitude: d("-121.5")},
+		{ID: 4, Latitude: d("37.7"), Longitude: d("-122.5")},
+	}
+	tests := []struct {
+		description string
+		radius      float64
+		expected    []int
+	}{
+		{
+			description: "Blocks should be sorted nearest first",
+			radius:      200000,
+			expected:    []int{2, 1, 4, 3},
+		},
+		{
+			description: "Blocks outside the radius should be excluded",
+			radius:      10000,
+			expected:    []int{2, 1, 4},
+		},
+		{
+			description: "No blocks should be returned if none are within the radius",
+			radius:      10,
+			expected:    []int{},
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			t.Parallel()
+
+			ids := []int{}
+			for _, block := range nearest(blocks, d("37.76"), d("-122.44"), test.radius) {
+				ids = append(ids, block.ID)
+			}
+			assert.Equal(t, test.expected, ids, "Expected map block IDs to match")
+		})
+	}
+}
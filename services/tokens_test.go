@@ -0,0 +1,20 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewToken(t *testing.T) {
+	token, hash, err := NewToken()
+	require.NoError(t, err, "Expected no error")
+	assert.Len(t, token, 43, "Expected a 32 byte base64url token")
+	assert.Equal(t, HashToken(token), hash, "Expected the hash to match the token")
+	assert.NotEqual(t, token, hash, "Expected the hash to differ from the token")
+
+	other, _, err := NewToken()
+	require.NoError(t, err, "Expected no error")
+	assert.NotEqual(t, token, other, "Expected every token to be different")
+}
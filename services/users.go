@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidLoginToken is returned when logging in with a login token that
+// doesn't exist, has expired or was already used.
+var ErrInvalidLoginToken = errors.New("invalid login token")
+
+// User is a user account. Accounts are optional and are created the first
+// time an email address logs in.
+type User struct {
+	ID    int
+	Email string
+	// Role is the user's role. Users that log in with an emailed link are
+	// always RoleUser, see Accounts.SessionUser.
+	Role Role
+}
+
+const deleteExpiredLoginTokensQuery = `
+DELETE FROM login_tokens
+WHERE expires < $1
+`
+
+const insertLoginTokenQuery = `
+INSERT INTO login_tokens (token_hash, email, expires)
+VALUES ($1, $2, $3)
+`
+
+// InsertLoginToken stores the hash of a single-use login token for the email
+// address that expires at the given time. Expired login tokens are deleted.
+func (svc Persistence) InsertLoginToken(
+	ctx context.Context,
+	email,
+	tokenHash string,
+	expires time.Time,
+) (err error) {
+	ctx, done := svc.instrument(ctx, "InsertLoginToken", "insertLoginTokenQuery")
+	defer func() { done(err) }()
+
+	// Timestamps are stored without a time zone, so always store UTC.
+	now := time.Now().UTC()
+	if _, err := svc.db.ExecContext(ctx, svc.driver.Rebind(deleteExpiredLoginTokensQuery), now); err != nil {
+		return errors.WithMessage(err, "failed to delete expired login tokens")
+	}
+	_, err = svc.db.ExecContext(
+		ctx,
+		svc.driver.Rebind(insertLoginTokenQuery),
+		tokenHash,
+		email,
+		expires.UTC())
+	return errors.WithMessage(err, "failed to insert login token")
+}
+
+const deleteLoginTokenQuery = `
+DELETE FROM login_tokens
+WHERE
+	token_hash = $1
+	AND expires >= $2
+RETURNING email
+`
+
+const insertUserQuery = `
+INSERT INTO users (email)
+VALUES ($1)
+ON CONFLICT DO NOTHING
+`
+
+const getUserByEmailQuery = `
+SELECT id, email
+FROM users
+WHERE email = $1
+`
+
+// UseLoginToken deletes the login token so it can't be used again and returns
+// the user with the token's email address, creating the user if it doesn't
+// exist. It returns ErrInvalidLoginToken if the token doesn't exist or has
+// expired.
+func (svc Persistence) UseLoginToken(ctx context.Context, tokenHash string) (_ User, err error) {
+	ctx, done := svc.instrument(ctx, "UseLoginToken", "deleteLoginTokenQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, errors.WithMessage(err, "failed to begin login transaction")
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(deleteLoginTokenQuery),
+		tokenHash,
+		time.Now().UTC(),
+	).Scan(&email)
+	if err == sql.ErrNoRows {
+		return User{}, ErrInvalidLoginToken
+	}
+	if err != nil {
+		return User{}, errors.WithMessage(err, "failed to delete login token")
+	}
+	user, err := svc.getOrInsertUser(ctx, tx, email)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, errors.WithMessage(err, "failed to commit login transaction")
+	}
+	return user, nil
+}
+
+// GetOrInsertUser returns the user with the email address, creating the user
+// if it doesn't exist.
+func (svc Persistence) GetOrInsertUser(ctx context.Context, email string) (_ User, err error) {
+	ctx, done := svc.instrument(ctx, "GetOrInsertUser", "insertUserQuery")
+	defer func() { done(err) }()
+
+	tx, err := svc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, errors.WithMessage(err, "failed to begin user transaction")
+	}
+	defer tx.Rollback()
+
+	user, err := svc.getOrInsertUser(ctx, tx, email)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, errors.WithMessage(err, "failed to commit user transaction")
+	}
+	return user, nil
+}
+
+// getOrInsertUser returns the user with the email address in the
+// transaction, creating the user if it doesn't exist.
+func (svc Persistence) getOrInsertUser(ctx context.Context, tx *sql.Tx, email string) (User, error) {
+	if _, err := tx.ExecContext(ctx, svc.driver.Rebind(insertUserQuery), email); err != nil {
+		return User{}, errors.WithMessage(err, "failed to insert user")
+	}
+	var user User
+	err := tx.QueryRowContext(ctx, svc.driver.Rebind(getUserByEmailQuery), email).Scan(&user.ID, &user.Email)
+	if err != nil {
+		return User{}, errors.WithMessage(err, "failed to read user")
+	}
+	return user, nil
+}
+
+const deleteExpiredSessionsQuery = `
+DELETE FROM sessions
+WHERE expires < $1
+`
+
+const insertSessionQuery = `
+INSERT INTO sessions (token_hash, user_id, oidc_subject, expires)
+VALUES ($1, $2, $3, $4)
+`
+
+// InsertSession stores the hash of a session token for the user that expires
+// at the given time. The OIDC subject is empty unless the user logged in with
+// OIDC. Expired sessions are deleted.
+func (svc Persistence) InsertSession(
+	ctx context.Context,
+	userID int,
+	tokenHash,
+	oidcSubject string,
+	expires time.Time,
+) (err error) {
+	ctx, done := svc.instrument(ctx, "InsertSession", "insertSessionQuery")
+	defer func() { done(err) }()
+
+	now := time.Now().UTC()
+	if _, err := svc.db.ExecContext(ctx, svc.driver.Rebind(deleteExpiredSessionsQuery), now); err != nil {
+		return errors.WithMessage(err, "failed to delete expired sessions")
+	}
+	_, err = svc.db.ExecContext(
+		ctx,
+		svc.driver.Rebind(insertSessionQuery),
+		tokenHash,
+		userID,
+		sql.NullString{String: oidcSubject, Valid: oidcSubject != ""},
+		expires.UTC())
+	return errors.WithMessage(err, "failed to insert session")
+}
+
+const getSessionUserQuery = `
+SELECT
+	u.id,
+	u.email,
+	s.oidc_subject
+FROM sessions s
+JOIN users u ON u.id = s.user_id
+WHERE
+	s.token_hash = $1
+	AND s.expires >= $2
+	AND NOT EXISTS (
+		SELECT 1
+		FROM bans b
+		WHERE b.user_id = u.id
+	)
+`
+
+// GetSessionUser returns the user logged in with the session token hash and
+// the session's OIDC subject, or a nil user if the session doesn't exist, has
+// expired or the user is banned. The OIDC subject is empty unless the user
+// logged in with OIDC.
+func (svc Persistence) GetSessionUser(ctx context.Context, tokenHash string) (_ *User, oidcSubject string, err error) {
+	ctx, done := svc.instrument(ctx, "GetSessionUser", "getSessionUserQuery")
+	defer func() { done(err) }()
+
+	var user User
+	var subject sql.NullString
+	err = svc.db.QueryRowContext(
+		ctx,
+		svc.driver.Rebind(getSessionUserQuery),
+		tokenHash,
+		time.Now().UTC(),
+	).Scan(&user.ID, &user.Email, &subject)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.WithMessage(err, "failed to read session")
+	}
+	return &user, subject.String, nil
+}
+
+const deleteSessionQuery = `
+DELETE FROM sessions
+WHERE token_hash = $1
+`
+
+// DeleteSession deletes the session with the token hash, if it exists.
+func (svc Persistence) DeleteSession(ctx context.Context, tokenHash string) (err error) {
+	ctx, done := svc.instrument(ctx, "DeleteSession", "deleteSessionQuery")
+	defer func() { done(err) }()
+	_, err = svc.db.ExecContext(ctx, svc.driver.Rebind(deleteSessionQuery), tokenHash)
+	return errors.WithMessage(err, "failed to delete session")
+}
+
+const getUserCarsQuery = `
+SELECT
+	c.id,
+	c.map_block_id,
+	c.year,
+	c.make,
+	c.model,
+	c.trim,
+	c.color,
+	i.public_id,
+	i.format
+FROM cars c
+LEFT JOIN images i ON
+	i.public_id = c.images_public_id
+	AND i.status = 'approved'
+WHERE
+	c.user_id = $1
+	AND c.deleted IS NULL
+ORDER BY c.created DESC, c.id DESC
+`
+
+// GetUserCars returns the cars submitted by the user, newest first.
+func (svc Persistence) GetUserCars(ctx context.Context, userID int) (_ []Car, err error) {
+	ctx, done := svc.instrument(ctx, "GetUserCars", "getUserCarsQuery")
+	defer func() { done(err) }()
+	rows, err := svc.db.QueryContext(ctx, svc.driver.Rebind(getUserCarsQuery), userID)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read user cars")
+	}
+	return scanCars(rows)
+}
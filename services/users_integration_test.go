@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/matthewdale/manualsmap.com/database"
+	"github.com/matthewdale/manualsmap.com/dbtest"
+)
+
+// insertUser logs in the address with a new login token and returns the
+// user.
+func insertUser(t *testing.T, svc Persistence, email string) User {
+	t.Helper()
+	ctx := context.Background()
+	_, hash, err := NewToken()
+	require.NoError(t, err, "Expected no error creating login token")
+	require.NoError(
+		t,
+		svc.InsertLoginToken(ctx, email, hash, time.Now().Add(time.Minute)),
+		"Expected no error inserting login token")
+	user, err := svc.UseLoginToken(ctx, hash)
+	require.NoError(t, err, "Expected no error using login token")
+	return user
+}
+
+func TestPersistenceUseLoginToken(t *testing.T) {
+	tests := []struct {
+		description string
+		expires     time.Duration
+		used        bool
+		expectedErr error
+	}{
+		{
+			description: "Valid login tokens should log in",
+			expires:     time.Minute,
+		},
+		{
+			description: "Expired login tokens should be rejected",
+			expires:     -time.Minute,
+			expectedErr: ErrInvalidLoginToken,
+		},
+		{
+			description: "Used login tokens should be rejected",
+			expires:     time.Minute,
+			used:        true,
+			expectedErr: ErrInvalidLoginToken,
+		},
+	}
+
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+				ctx := context.Background()
+				svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+				_, hash, err := NewToken()
+				require.NoError(t, err, "Expected no error creating login token")
+				err = svc.InsertLoginToken(ctx, "driver@example.com", hash, time.Now().Add(test.expires))
+				require.NoError(t, err, "Expected no error inserting login token")
+				if test.used {
+					_, err := svc.UseLoginToken(ctx, hash)
+					require.NoError(t, err, "Expected no error using login token")
+				}
+
+				user, err := svc.UseLoginToken(ctx, hash)
+				if test.expectedErr != nil {
+					assert.Equal(t, test.expectedErr, err, "Expected errors to match")
+					return
+				}
+				assert.NoError(t, err, "Expected no error")
+				assert.NotZero(t, user.ID, "Expected a user ID")
+				assert.Equal(t, "driver@example.com", user.Email, "Expected email addresses to match")
+			})
+		})
+	}
+}
+
+func TestPersistenceUseLoginTokenExistingUser(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		first := insertUser(t, svc, "driver@example.com")
+		second := insertUser(t, svc, "driver@example.com")
+		assert.Equal(t, first, second, "Expected logging in again to return the same user")
+		other := insertUser(t, svc, "other@example.com")
+		assert.NotEqual(t, first.ID, other.ID, "Expected other addresses to create another user")
+	})
+}
+
+func TestPersistenceGetOrInsertUser(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		existing := insertUser(t, svc, "driver@example.com")
+
+		user, err := svc.GetOrInsertUser(ctx, "driver@example.com")
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, existing, user, "Expected the existing user")
+		user, err = svc.GetOrInsertUser(ctx, "new@example.com")
+		assert.NoError(t, err, "Expected no error")
+		assert.NotEqual(t, existing.ID, user.ID, "Expected a new user")
+		assert.Equal(t, "new@example.com", user.Email, "Expected email addresses to match")
+	})
+}
+
+func TestPersistenceSessions(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		user := insertUser(t, svc, "driver@example.com")
+
+		require.NoError(
+			t,
+			svc.InsertSession(ctx, user.ID, "valid", "", time.Now().Add(time.Hour)),
+			"Expected no error inserting session")
+		require.NoError(
+			t,
+			svc.InsertSession(ctx, user.ID, "expired", "", time.Now().Add(-time.Hour)),
+			"Expected no error inserting session")
+
+		require.NoError(
+			t,
+			svc.InsertSession(ctx, user.ID, "oidc", "248289761001", time.Now().Add(time.Hour)),
+			"Expected no error inserting session")
+
+		sessionUser, subject, err := svc.GetSessionUser(ctx, "valid")
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, &user, sessionUser, "Expected the session user")
+		assert.Empty(t, subject, "Expected no OIDC subject")
+		sessionUser, subject, err = svc.GetSessionUser(ctx, "oidc")
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, &user, sessionUser, "Expected the session user")
+		assert.Equal(t, "248289761001", subject, "Expected OIDC subjects to match")
+		sessionUser, _, err = svc.GetSessionUser(ctx, "expired")
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected no user for expired sessions")
+		sessionUser, _, err = svc.GetSessionUser(ctx, "missing")
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected no user for missing sessions")
+
+		require.NoError(t, svc.DeleteSession(ctx, "valid"), "Expected no error deleting session")
+		sessionUser, _, err = svc.GetSessionUser(ctx, "valid")
+		assert.NoError(t, err, "Expected no error")
+		assert.Nil(t, sessionUser, "Expected no user for deleted sessions")
+		assert.NoError(t, svc.DeleteSession(ctx, "valid"), "Expected deleting missing sessions to succeed")
+
+		// Inserting a session deletes expired sessions.
+		require.NoError(
+			t,
+			svc.InsertSession(ctx, user.ID, "new", "", time.Now().Add(time.Hour)),
+			"Expected no error inserting session")
+		var count int
+		require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&count), "Expected no error counting sessions")
+		assert.Equal(t, 2, count, "Expected expired sessions to be deleted")
+	})
+}
+
+func TestPersistenceGetUserCars(t *testing.T) {
+	dbtest.ForEach(t, func(t *testing.T, db *sql.DB, driver database.Driver) {
+		ctx := context.Background()
+		svc := NewPersistence(db, driver, nil, SpatialNumeric, 0, nil)
+		user := insertUser(t, svc, "driver@example.com")
+		other := insertUser(t, svc, "other@example.com")
+		blocks := insertMapBlocks(
+			t,
+			svc,
+			coordinates{latitude: "37.7749", longitude: "-122.4194"},
+			coordinates{latitude: "45.5152", longitude: "-122.6784"})
+
+		miata, err := svc.InsertCar(ctx, blocks[0].ID, 1994, "Mazda", "Miata", "", "red", "", "", user.ID)
+		require.NoError(t, err, "Expected no error inserting car")
+		m3, err := svc.InsertCar(ctx, blocks[1].ID, 2002, "BMW", "M3", "", "silver", "", "", user.ID)
+		require.NoError(t, err, "Expected no error inserting car")
+		_, hash, err := NewToken()
+		require.NoError(t, err, "Expected no error creating edit token")
+		deleted, err := svc.InsertCar(ctx, blocks[1].ID, 1999, "Honda", "S2000", "", "yellow", "", hash, user.ID)
+		require.NoError(t, err, "Expected no error inserting car")
+		require.NoError(t, svc.DeleteCar(ctx, deleted, hash), "Expected no error deleting car")
+		_, err = svc.InsertCar(ctx, blocks[0].ID, 1990, "Mazda", "Miata", "", "blue", "", "", other.ID)
+		require.NoError(t, err, "Expected no error inserting car")
+		_, err = svc.InsertCar(ctx, blocks[0].ID, 1991, "Mazda", "Miata", "", "green", "", "", 0)
+		require.NoError(t, err, "Expected no error inserting car")
+
+		cars, err := svc.GetUserCars(ctx, user.ID)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(
+			t,
+			[]Car{
+				{ID: m3, MapBlockID: blocks[1].ID, Year: 2002, Make: "BMW", Model: "M3", Color: "silver"},
+				{ID: miata, MapBlockID: blocks[0].ID, Year: 1994, Make: "Mazda", Model: "Miata", Color: "red"},
+			},
+			cars,
+			"Expected the user's cars that aren't deleted, newest first")
+	})
+}
@@ -0,0 +1,73 @@
+// Package sessions carries the session token from the session cookie and the
+// logged in user through request contexts.
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matthewdale/manualsmap.com/apiv1"
+	"github.com/matthewdale/manualsmap.com/services"
+)
+
+// CookieName is the name of the cookie that holds the session token.
+const CookieName = apiv1.SessionCookie
+
+type tokenContextKey struct{}
+
+type userContextKey struct{}
+
+// ContextFromCookie is a go-kit httptransport.RequestFunc that stores the
+// session token from the request's session cookie in the context.
+func ContextFromCookie(ctx context.Context, r *http.Request) context.Context {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenContextKey{}, cookie.Value)
+}
+
+// TokenFromContext returns the session token stored in the context, or an
+// empty string if there is none.
+func TokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tokenContextKey{}).(string)
+	return token
+}
+
+// NewUserContext returns a copy of the context that carries the logged in
+// user.
+func NewUserContext(ctx context.Context, user services.User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFromContext returns the logged in user stored in the context, and false
+// if there is none.
+func UserFromContext(ctx context.Context) (services.User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(services.User)
+	return user, ok
+}
+
+// NewCookie returns the session cookie for the session. The cookie is only
+// sent over HTTPS if secure is true, which should only be false for local
+// development. The cookie isn't sent with cross-site POST requests, which
+// protects the API from cross-site request forgery.
+func NewCookie(session services.Session, secure bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     CookieName,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.Expires,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ExpiredCookie returns a session cookie that deletes the session cookie from
+// the browser.
+func ExpiredCookie(secure bool) *http.Cookie {
+	cookie := NewCookie(services.Session{Expires: time.Unix(0, 0)}, secure)
+	cookie.MaxAge = -1
+	return cookie
+}
@@ -0,0 +1,117 @@
+// Package tracing provides OpenTelemetry tracing for the go-kit HTTP handlers
+// and configures where spans are exported.
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "manualsmap"
+	tracerName  = "github.com/matthewdale/manualsmap.com/tracing"
+)
+
+// NewProvider creates a TracerProvider that exports spans using the given
+// exporter, one of "otlp", "stdout" or "none", and registers it as the global
+// TracerProvider. The "otlp" exporter is configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables and the "stdout" exporter writes
+// spans to w. The returned provider must be shut down to flush any buffered
+// spans before the program exits.
+func NewProvider(ctx context.Context, exporter string, w io.Writer) (*sdktrace.TracerProvider, error) {
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, errors.WithMessage(err, "error creating trace resource")
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	switch exporter {
+	case "otlp":
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, errors.WithMessage(err, "error creating OTLP trace exporter")
+		}
+		options = append(options, sdktrace.WithBatcher(exp))
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(w), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, errors.WithMessage(err, "error creating stdout trace exporter")
+		}
+		options = append(options, sdktrace.WithBatcher(exp))
+	case "none":
+		// Spans are still created so that trace context is propagated, but
+		// they aren't exported anywhere.
+	default:
+		return nil, errors.Errorf("unknown trace exporter %q", exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{}))
+	return provider, nil
+}
+
+// Endpoint starts a span with the given name around every call to the
+// endpoint, marking the span as failed if the endpoint returns an error.
+func Endpoint(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			ctx, span := otel.Tracer(tracerName).Start(ctx, name)
+			defer func() {
+				SpanError(span, err)
+				span.End()
+			}()
+			return next(ctx, request)
+		}
+	}
+}
+
+// Handler starts a server span for every request handled by h, continuing
+// the trace from the incoming request headers if there is one.
+func Handler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(
+		h,
+		"http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method
+		}))
+}
+
+// Transport returns an http.RoundTripper that starts a client span for every
+// outbound request and propagates the trace context to the remote server.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(
+		base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method + " " + r.URL.Host
+		}))
+}
+
+// SpanError marks the span as failed if err is not nil.
+func SpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		description    string
+		err            error
+		expectedStatus codes.Code
+	}{
+		{
+			description:    "Successful requests should not set the span status",
+			expectedStatus: codes.Unset,
+		},
+		{
+			description:    "Failed requests should mark the span as failed",
+			err:            errors.New("failed"),
+			expectedStatus: codes.Error,
+		},
+	}
+
+	// The tracer provider is global, so the subtests can't run in parallel.
+	for _, test := range tests {
+		test := test // Capture range variable.
+		t.Run(test.description, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+			e := Endpoint("post_cars")(func(context.Context, interface{}) (interface{}, error) {
+				return nil, test.err
+			})
+			_, err := e(context.Background(), nil)
+			assert.Equal(t, test.err, err, "Expected errors to match")
+
+			spans := recorder.Ended()
+			if assert.Len(t, spans, 1, "Expected one span to be ended") {
+				assert.Equal(t, "post_cars", spans[0].Name(), "Expected span names to match")
+				assert.Equal(t, test.expectedStatus, spans[0].Status().Code, "Expected span statuses to match")
+			}
+		})
+	}
+}
+
+func TestNewProviderUnknownExporter(t *testing.T) {
+	_, err := NewProvider(context.Background(), "zipkin", io.Discard)
+	assert.Error(t, err, "Expected an error for an unknown exporter")
+}